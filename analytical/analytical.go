@@ -0,0 +1,266 @@
+package analytical
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// ErrBadK as is
+var ErrBadK = fmt.Errorf("Chunk exponent of analytical table out of range")
+
+// DefaultPrimaryKey is the name of the row id of tables
+// without a primary key definition
+const DefaultPrimaryKey = "id"
+
+// NewAnalytical initializes a new analytical table
+func NewAnalytical(conf *common.DatabaseConfigure, bucket storage.Storage, meta *metaparser.Metadata) (*Analytical, error) {
+	k := meta.K
+	if k == 0 {
+		k = DefaultK
+	}
+	if k < 0 || k > MaxK {
+		return nil, ErrBadK
+	}
+	if meta.PrimaryKey == nil {
+		m := *meta
+		m.PrimaryKey = &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: DefaultPrimaryKey}
+		meta = &m
+	}
+	return &Analytical{
+		conf:   conf,
+		bucket: bucket,
+		meta:   meta,
+		schema: document.NewDocument(conf, bucket, meta),
+		k:      uint(k),
+		// TODO: Determine sync option from user input configuration
+		sync: false,
+	}, nil
+}
+
+// Analytical is the analytical document table, rows get auto
+// increment ids and are stored in chunks of 2^k rows, it is
+// meant to be appended to and read chunk by chunk
+type Analytical struct {
+	conf     *common.DatabaseConfigure
+	bucket   storage.Storage
+	meta     *metaparser.Metadata
+	schema   *document.Document
+	k        uint
+	sync     bool
+	notifier common.Notifier
+	codec    *compression.Codec
+}
+
+// SetNotifier sets the function receiving the events of every
+// append
+func (a *Analytical) SetNotifier(n common.Notifier) {
+	a.notifier = n
+}
+
+// SetCodec sets the codec compressing the stored chunks
+func (a *Analytical) SetCodec(c *compression.Codec) {
+	a.codec = c
+}
+
+// Metadata returns the metadata of the table
+func (a *Analytical) Metadata() *metaparser.Metadata {
+	return a.meta
+}
+
+// FieldType returns the type of the field named name
+func (a *Analytical) FieldType(name string) (byte, bool) {
+	if name == a.PrimaryKey() {
+		return common.TypeInteger, true
+	}
+	return a.schema.FieldType(name)
+}
+
+// PrimaryKey returns the name of the row id
+func (a *Analytical) PrimaryKey() string {
+	return a.meta.PrimaryKey.Name
+}
+
+// ChunkSize returns the number of rows of a full chunk
+func (a *Analytical) ChunkSize() int {
+	return 1 << a.k
+}
+
+func chunkKey(chunk int64) []byte {
+	ret := make([]byte, 9)
+	ret[0] = keyInitialCharacter
+	binary.BigEndian.PutUint64(ret[1:], uint64(chunk))
+	return ret
+}
+
+// EncodeChunk encodes rows the way a chunk is stored, before the
+// table codec compresses it
+func EncodeChunk(rows []document.Row) ([]byte, error) {
+	plain := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		plain[i] = row
+	}
+	buf := bytes.NewBuffer([]byte{})
+	err := gob.NewEncoder(buf).Encode(&plain)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeChunk decodes a stored chunk once decompressed
+func DecodeChunk(rs []byte) ([]document.Row, error) {
+	var plain []map[string]interface{}
+	err := gob.NewDecoder(bytes.NewBuffer(rs)).Decode(&plain)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]document.Row, len(plain))
+	for i, m := range plain {
+		ret[i] = m
+	}
+	return ret, nil
+}
+
+type reader interface {
+	Get(key []byte) ([]byte, error)
+}
+
+func (a *Analytical) getChunk(r reader, chunk int64) ([]document.Row, error) {
+	rs, err := r.Get(chunkKey(chunk))
+	if err == storage.ErrNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.decodeChunk(rs)
+}
+
+// decodeChunk decompresses and decodes a stored chunk
+func (a *Analytical) decodeChunk(rs []byte) ([]document.Row, error) {
+	rs, err := a.codec.Decompress(rs)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeChunk(rs)
+}
+
+// Append appends rows in a single batch and returns their ids
+func (a *Analytical) Append(rows ...document.Row) ([]int64, error) {
+	batch := a.bucket.NewBatch(storage.BatchReadWrite)
+	ids, events, err := a.append(batch, rows)
+	if err != nil {
+		batch.Close()
+		return nil, err
+	}
+	err = batch.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if a.notifier != nil && len(events) != 0 {
+		a.notifier(events)
+	}
+	return ids, nil
+}
+
+func (a *Analytical) append(batch storage.Batch, rows []document.Row) ([]int64, []common.Event, error) {
+	counterKey := []byte{metaparser.MetaInitCharacter, metaparser.MetaTypeExtended, metaparser.MetaTypeExtendedAutoIncrement}
+	var last int64
+	rs, err := batch.Get(counterKey)
+	if err == nil {
+		last, err = strconv.ParseInt(string(rs), 10, 64)
+		if err != nil {
+			return nil, nil, metaparser.ErrMalformedMetadata
+		}
+	} else if err != storage.ErrNoSuchKey {
+		return nil, nil, err
+	}
+	pk := a.PrimaryKey()
+	ids := make([]int64, 0, len(rows))
+	var events []common.Event
+	chunks := make(map[int64][]document.Row)
+	var order []int64
+	for _, row := range rows {
+		row, err = a.schema.Normalize(row)
+		if err != nil {
+			return nil, nil, err
+		}
+		last++
+		row[pk] = last
+		chunk := (last - 1) >> a.k
+		if _, ok := chunks[chunk]; !ok {
+			chunks[chunk], err = a.getChunk(batch, chunk)
+			if err != nil {
+				return nil, nil, err
+			}
+			order = append(order, chunk)
+		}
+		chunks[chunk] = append(chunks[chunk], row)
+		ids = append(ids, last)
+		if a.notifier != nil {
+			events = append(events, common.Event{Type: common.EventPut, Key: strconv.FormatInt(last, 10), Value: row})
+		}
+	}
+	opts := &storage.SetOptions{Synchronized: a.sync}
+	for _, chunk := range order {
+		rs, err := EncodeChunk(chunks[chunk])
+		if err != nil {
+			return nil, nil, err
+		}
+		err = batch.Set(chunkKey(chunk), a.codec.Compress(rs), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = batch.Set(counterKey, []byte(strconv.FormatInt(last, 10)), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, events, nil
+}
+
+// Get gets a row by its id
+func (a *Analytical) Get(id int64) (document.Row, error) {
+	if id <= 0 {
+		return nil, storage.ErrNoSuchKey
+	}
+	rows, err := a.getChunk(a.bucket, (id-1)>>a.k)
+	if err != nil {
+		return nil, err
+	}
+	i := int((id - 1) & (1<<a.k - 1))
+	if i >= len(rows) {
+		return nil, storage.ErrNoSuchKey
+	}
+	return rows[i], nil
+}
+
+// Chunks calls fn on every chunk in id order, the iteration
+// ends early when fn returns false
+func (a *Analytical) Chunks(fn func(rows []document.Row) (bool, error)) error {
+	iter := a.bucket.NewIter([]byte{keyInitialCharacter}, []byte{keyInitialCharacter + 1})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if len(iter.Key()) != 9 {
+			continue
+		}
+		rows, err := a.decodeChunk(iter.Value())
+		if err != nil {
+			return err
+		}
+		more, err := fn(rows)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package analytical_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/analytical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newBucket(t *testing.T) storage.Storage {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	t.Cleanup(func() { drv.Close() })
+	bucket, err := drv.Bucket("metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func metadata(k int) *metaparser.Metadata {
+	return &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeAnalytical,
+		K:           k,
+		Fields: []metaparser.Field{
+			{Name: "host", Type: common.TypeString},
+			{Name: "load", Type: common.TypeFloat},
+		},
+	}
+}
+
+func TestAnalytical(t *testing.T) {
+	bucket := newBucket(t)
+	for _, k := range []int{-1, analytical.MaxK + 1} {
+		if _, err := analytical.NewAnalytical(nil, bucket, metadata(k)); !errors.Is(err, analytical.ErrBadK) {
+			t.Fatalf("k %d: expected ErrBadK, got %v", k, err)
+		}
+	}
+	if a, err := analytical.NewAnalytical(nil, bucket, metadata(0)); err != nil || a.ChunkSize() != 1<<analytical.DefaultK {
+		t.Fatalf("default chunk size: %v", err)
+	}
+
+	a, err := analytical.NewAnalytical(nil, bucket, metadata(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrimaryKey() != analytical.DefaultPrimaryKey {
+		t.Fatalf("got primary key %q", a.PrimaryKey())
+	}
+	if typ, ok := a.FieldType("id"); !ok || typ != common.TypeInteger {
+		t.Fatalf("id is a %c", typ)
+	}
+	var events []common.Event
+	a.SetNotifier(func(e []common.Event) {
+		events = append(events, e...)
+	})
+	var rows []document.Row
+	for i := 0; i < 10; i++ {
+		rows = append(rows, document.Row{"host": fmt.Sprintf("h%d", i), "load": float64(i) / 4})
+	}
+	ids, err := a.Append(rows[:7]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second append fills the chunk left partial by the first
+	more, err := a.Append(rows[7:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, more...)
+	if len(ids) != 10 || ids[0] != 1 || ids[9] != 10 || len(events) != 10 || events[4].Key != "5" {
+		t.Fatalf("got ids %v and %d events", ids, len(events))
+	}
+	row, err := a.Get(6)
+	if err != nil || row["host"] != "h5" || row["load"] != 1.25 || row["id"] != int64(6) {
+		t.Fatalf("got %v, %v", row, err)
+	}
+	for _, id := range []int64{0, 11, 100} {
+		if _, err = a.Get(id); err != storage.ErrNoSuchKey {
+			t.Fatalf("row %d: expected ErrNoSuchKey, got %v", id, err)
+		}
+	}
+	var sizes []int
+	err = a.Chunks(func(rows []document.Row) (bool, error) {
+		sizes = append(sizes, len(rows))
+		return true, nil
+	})
+	if err != nil || !reflect.DeepEqual(sizes, []int{4, 4, 2}) {
+		t.Fatalf("got chunks of %v, %v", sizes, err)
+	}
+	sizes = nil
+	err = a.Chunks(func(rows []document.Row) (bool, error) {
+		sizes = append(sizes, len(rows))
+		return false, nil
+	})
+	if err != nil || len(sizes) != 1 {
+		t.Fatalf("iteration did not stop: %v, %v", sizes, err)
+	}
+
+	// a row which does not fit the schema appends nothing
+	if _, err = a.Append(document.Row{"host": "h10"}, document.Row{"load": "high"}); !errors.Is(err, document.ErrWrongFieldType) {
+		t.Fatalf("expected ErrWrongFieldType, got %v", err)
+	}
+	if _, err = a.Get(11); err != storage.ErrNoSuchKey {
+		t.Fatalf("expected ErrNoSuchKey, got %v", err)
+	}
+	if ids, err = a.Append(document.Row{"host": "h10"}); err != nil || ids[0] != 11 {
+		t.Fatalf("got ids %v, %v", ids, err)
+	}
+}
+
+func TestCompressedChunks(t *testing.T) {
+	bucket := newBucket(t)
+	a, err := analytical.NewAnalytical(nil, bucket, metadata(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := compression.NewCodec(bucket, &metaparser.Compression{Codec: metaparser.CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetCodec(codec)
+	var rows []document.Row
+	for i := 0; i < 40; i++ {
+		rows = append(rows, document.Row{"host": "web.example.com", "load": 0.5})
+	}
+	if _, err = a.Append(rows...); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = a.Chunks(func(rows []document.Row) (bool, error) {
+		for _, row := range rows {
+			if row["host"] != "web.example.com" {
+				return false, fmt.Errorf("bad row %v", row)
+			}
+			n++
+		}
+		return true, nil
+	})
+	if err != nil || n != 40 {
+		t.Fatalf("read %d rows, %v", n, err)
+	}
+
+	rs, err := analytical.EncodeChunk(rows[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := analytical.DecodeChunk(rs)
+	if err != nil || !reflect.DeepEqual(decoded, rows[:3]) {
+		t.Fatalf("got %v, %v", decoded, err)
+	}
+}
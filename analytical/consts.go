@@ -0,0 +1,13 @@
+// Package analytical provides the analytical document storage,
+// every key holds a chunk of 2^k consecutive rows
+package analytical
+
+const (
+	keyInitialCharacter = byte('=')
+)
+
+// DefaultK is the chunk exponent of tables without one
+const DefaultK = 8
+
+// MaxK is the largest chunk exponent accepted
+const MaxK = 16
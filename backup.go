@@ -0,0 +1,74 @@
+package kical
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Checkpoint writes a consistent on-disk copy of every bucket into
+// dir, which must not exist. Each bucket is consistent on its own,
+// writes are not blocked while the checkpoint is taken. The result
+// can be opened as the base directory of a pebble driver.
+func (db *Database) Checkpoint(dir string) error {
+	names, err := db.driver.Buckets()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(dir)
+	if err == nil {
+		return &os.PathError{Op: "checkpoint", Path: dir, Err: os.ErrExist}
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		cp, err := db.checkpointer(name)
+		if err != nil {
+			return err
+		}
+		err = cp.Checkpoint(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup brings the backup in dir up to date with every bucket,
+// only the sstables which are not in dir yet are copied so calling
+// it periodically upon the same dir is incremental. Restore it with
+// storage.RestoreBackup.
+func (db *Database) Backup(dir string) (*storage.BackupStats, error) {
+	names, err := db.driver.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	stats := &storage.BackupStats{}
+	for _, name := range names {
+		cp, err := db.checkpointer(name)
+		if err != nil {
+			return nil, err
+		}
+		s, err := cp.Backup(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		stats.Add(s)
+	}
+	return stats, nil
+}
+
+func (db *Database) checkpointer(name string) (storage.Checkpointer, error) {
+	s, err := db.driver.OpenBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	cp, ok := s.(storage.Checkpointer)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return cp, nil
+}
@@ -0,0 +1,172 @@
+package kical_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func fill(t *testing.T, db *kical.Database, from, to int, flush bool) {
+	tbl, err := db.Table("reg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tbl.KV.NewSession()
+	for i := from; i < to; i++ {
+		s.Set(fmt.Sprintf("key%04d", i), int64(i))
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !flush {
+		return
+	}
+	err = tbl.GetStorage().(*storage.PebbleDriverStorage).GetDB().Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, base string) int {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{BaseDirectory: base})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := db.Table("reg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := tbl.KV.Scan("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestBackup(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		root := tempDir(t)
+		drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+			BaseDirectory: filepath.Join(root, "data"),
+			UseMemory:     memory,
+			// keep both flushed sstables in L0 so the second
+			// backup has something to reuse
+			L0CompactionThreshold: 100,
+			L0StopWritesThreshold: 1000,
+		})
+		db, err := kical.NewDatabase(drv, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, db, 0, 100, true)
+
+		err = db.Checkpoint(filepath.Join(root, "cp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Checkpoint(filepath.Join(root, "cp")); err == nil {
+			t.Fatal("expected an error checkpointing into an existing directory")
+		}
+		_, err = db.Backup(filepath.Join(root, "backup"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, db, 100, 150, true)
+		stats, err := db.Backup(filepath.Join(root, "backup"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.FilesReused == 0 {
+			t.Fatalf("memory=%v: incremental backup reused no sstable: %+v", memory, stats)
+		}
+		// concurrent backups stage their checkpoints apart
+		errs := make(chan error, 2)
+		for _, name := range []string{"a", "b"} {
+			go func(name string) {
+				_, err := db.Backup(filepath.Join(root, "concurrent", name))
+				errs <- err
+			}(name)
+		}
+		for i := 0; i < 2; i++ {
+			if err = <-errs; err != nil {
+				t.Fatalf("memory=%v: %v", memory, err)
+			}
+		}
+		// writes not yet synced to the WAL are backed up too
+		fill(t, db, 150, 160, false)
+		if _, err = db.Backup(filepath.Join(root, "backup")); err != nil {
+			t.Fatal(err)
+		}
+		if !memory {
+			infos, _ := ioutil.ReadDir(filepath.Join(root, "data", "reg"))
+			for _, info := range infos {
+				if info.IsDir() {
+					t.Fatalf("backup left %s in the bucket", info.Name())
+				}
+			}
+			infos, _ = ioutil.ReadDir(filepath.Join(root, "data"))
+			if len(infos) != 1 {
+				t.Fatalf("backup left %d directories next to the bucket", len(infos)-1)
+			}
+		}
+		drv.Close()
+		if !memory {
+			// the scratch directories of killed backups, the old
+			// ones inside the bucket too, are removed on opening
+			leftovers := []string{
+				filepath.Join(root, "data", ".reg.kical-backup-1", "checkpoint"),
+				filepath.Join(root, "data", "reg", "kical-backup-2", "checkpoint"),
+			}
+			for _, dir := range leftovers {
+				if err = os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := count(t, filepath.Join(root, "data")); n != 160 {
+				t.Fatalf("bucket holds %d keys, want 160", n)
+			}
+			for _, dir := range leftovers {
+				if _, err = os.Stat(filepath.Dir(dir)); !os.IsNotExist(err) {
+					t.Fatalf("%s was not removed: %v", dir, err)
+				}
+			}
+		}
+		// a copy left staged by an interrupted backup is not restored
+		if err = os.MkdirAll(filepath.Join(root, "backup", ".reg.new-1"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := count(t, filepath.Join(root, "cp")); n != 100 {
+			t.Fatalf("memory=%v: checkpoint holds %d keys, want 100", memory, n)
+		}
+		restored := filepath.Join(root, "restored")
+		err = storage.RestoreBackup(filepath.Join(root, "backup"), restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, restored); n != 160 {
+			t.Fatalf("memory=%v: restored backup holds %d keys, want 160", memory, n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package kical
+
+import (
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/kv"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// BulkLoader loads rows into a document table or entries into a
+// kv table through a storage.Loader: writes are buffered, sorted
+// and stored a chunk at a time as sstables ingested straight into
+// the bucket when its storage supports it. Indexes, the auto
+// increment counter and the planner statistics are maintained as
+// by sessions, watchers are not notified and the materialized
+// views of the table are rebuilt by Commit. Chunks are stored
+// between rows and visible as soon as they are stored, a failed
+// load keeps the rows of the chunks stored so far, it is meant for
+// tables nobody else writes while they are loaded.
+type BulkLoader struct {
+	tbl    *Table
+	loader *storage.Loader
+	doc    *document.Session
+	kv     *kv.Session
+}
+
+// BulkLoad starts a bulk load of a document or kv table, chunk is
+// the number of bytes buffered before they are stored, the
+// default when it is not positive
+func (tbl *Table) BulkLoad(chunk int) (*BulkLoader, error) {
+	b := &BulkLoader{
+		tbl:    tbl,
+		loader: storage.NewLoader(tbl.bucket, chunk),
+	}
+	switch {
+	case tbl.IsRowDocument():
+		b.doc = tbl.Document.NewBulkSession(b.loader)
+	case tbl.IsKV():
+		b.kv = tbl.KV.NewBulkSession(b.loader)
+	default:
+		return nil, common.ErrWrongStorageType
+	}
+	return b, nil
+}
+
+// Insert inserts a row into a document table, it returns the
+// primary key of the row
+func (b *BulkLoader) Insert(row document.Row) (string, error) {
+	if b.doc == nil {
+		return "", common.ErrWrongStorageType
+	}
+	pk, err := b.doc.Insert(row)
+	if err != nil {
+		return "", err
+	}
+	return pk, b.loader.Spill()
+}
+
+// Set sets an entry of a kv table
+func (b *BulkLoader) Set(key string, value interface{}) error {
+	if b.kv == nil {
+		return common.ErrWrongStorageType
+	}
+	err := b.kv.Set(key, value)
+	if err != nil {
+		return err
+	}
+	return b.loader.Spill()
+}
+
+// Stats returns the work done so far
+func (b *BulkLoader) Stats() storage.LoaderStats {
+	return b.loader.Stats()
+}
+
+// Commit stores the last chunk together with the statistics and
+// rebuilds the views of the table
+func (b *BulkLoader) Commit() error {
+	var err error
+	if b.doc != nil {
+		err = b.doc.Commit()
+	} else {
+		err = b.kv.Commit()
+	}
+	if err != nil || b.doc == nil {
+		return err
+	}
+	views, err := b.tbl.db.views.of(b.tbl.db, b.tbl.name)
+	if err != nil {
+		return err
+	}
+	for _, v := range views {
+		err = b.tbl.db.refresh(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close discards the chunk not stored yet
+func (b *BulkLoader) Close() error {
+	return b.loader.Close()
+}
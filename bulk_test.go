@@ -0,0 +1,91 @@
+package kical_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestBulkLoad(t *testing.T) {
+	db := newServices(t)
+	if _, err := db.CreateView("per_tier", "SELECT tier, COUNT(*) FROM services GROUP BY tier"); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tbl.BulkLoad(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := []string{"gold", "silver", "bronze", "iron"}
+	for i := 0; i < 2000; i++ {
+		_, err := b.Insert(document.Row{"name": fmt.Sprintf("bulk%04d", i), "tier": tiers[i%len(tiers)], "port": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Insert(document.Row{"name": "bulk0001"}); !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("duplicate across chunks: %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.Chunks < 2 || !st.Ingested {
+		t.Fatalf("stats %+v", st)
+	}
+
+	services := mustDocument(t, db, "services")
+	if pk, err := services.LookupUnique("name", "bulk1999"); err != nil || services.KeyText(pk) != "2012" {
+		t.Fatalf("unique index: %v %v", services.KeyText(pk), err)
+	}
+	if pks, err := services.Posting("tier", "iron"); err != nil || len(pks) != 500 {
+		t.Fatalf("posting: %d %v", len(pks), err)
+	}
+	st, err := services.Statistics()
+	if err != nil || st.Rows != 2012 || st.Enums["tier"]["iron"] != 500 || st.Sampled != 2012 {
+		t.Fatalf("statistics: %+v %v", st, err)
+	}
+	if f := st.RangeFraction(document.FormatKey(int64(1007)), ""); f != 0.5 {
+		t.Fatalf("range fraction %v", f)
+	}
+	got := viewRows(t, db, "SELECT tier, `COUNT(*)` FROM per_tier")
+	want := viewRows(t, db, "SELECT tier, COUNT(*) FROM services GROUP BY tier")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("view: got %v, want %v", got, want)
+	}
+	// the rejected duplicate took 2013 as sessions do
+	insert(t, db, "services", document.Row{"name": "after"})
+	if pk, err := services.LookupUnique("name", "after"); err != nil || services.KeyText(pk) != "2014" {
+		t.Fatalf("auto increment: %v %v", services.KeyText(pk), err)
+	}
+
+	reg, err := db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = reg.BulkLoad(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Insert(document.Row{}); !errors.Is(err, common.ErrWrongStorageType) {
+		t.Fatalf("insert into kv: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := b.Set(fmt.Sprintf("key%03d", i), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := reg.KV.Get("key042"); err != nil || v != int64(42) {
+		t.Fatalf("kv entry: %v %v", v, err)
+	}
+}
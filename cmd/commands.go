@@ -0,0 +1,966 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+type cli struct {
+	db       *kical.Database
+	driver   storage.Driver
+	security *security.Store
+	out      io.Writer
+	json     bool
+}
+
+type command struct {
+	usage string
+	help  string
+	fn    func(c *cli, args []string) (*result, error)
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help":       {"help", "show this help", (*cli).help},
+		"tables":     {"tables", "list tables", (*cli).tables},
+		"describe":   {"describe <table>", "show the metadata of a table", (*cli).describe},
+		"create":     {"create <table> kv | create <table> row <pk>:<pk type> [<field>:<type>[:unique][:index][:required][:ref=<table>[/<on delete>]]]...", "create a table, decimal types may be written decimal(precision,scale), on delete is restrict, cascade or set_null", (*cli).create},
+		"get":        {"get <table> <key>", "get a kv entry", (*cli).get},
+		"set":        {"set <table> <key> <value>", "set a kv entry, value is JSON or a plain string", (*cli).set},
+		"del":        {"del <table> <key>...", "delete kv entries or documents", (*cli).del},
+		"scan":       {"scan [-limit n] <table> [prefix]", "list kv entries", (*cli).scan},
+		"doc":        {"doc <table> <pk>", "get a document", (*cli).doc},
+		"insert":     {"insert <table> <json>", "insert a document", (*cli).insert},
+		"find":       {"find [-limit n] <table> [field=value]...", "list documents matching every condition, tag fields match a single tag", (*cli).find},
+		"tag":        {"tag <table> <pk> <field> [+tag|-tag]...", "add and remove tags of a document", (*cli).tag},
+		"patch":      {"patch <table> <pk> [<path>=<value>|-<path>]...", "set and remove values at paths into object fields, value is JSON or a plain string", (*cli).patch},
+		"view":       {"view [-refresh] <name> [\"<select query>\"]", "create a materialized view kept up to date with its source table, or rebuild it", (*cli).view},
+		"index":      {"index [-drop] <table> <path>", "index a path into an object field, or drop its index", (*cli).index},
+		"query":      {"query \"<query>\"", "run a SELECT or MATCH query, quote string literals with '", (*cli).query},
+		"analyze":    {"analyze <table>", "rebuild the planner statistics of a document table", (*cli).analyze},
+		"alter":      {"alter <table> add <field>:<type> [default] | drop <field> | rename <field> <name> | retype <field>:<type>", "change the schema of a document table", (*cli).alter},
+		"rewrite":    {"rewrite <table>", "store the rows written under older schema versions upgraded", (*cli).rewrite},
+		"compress":   {"compress [-rewrite] <table> [none|snappy|zstd|zstd_dict]", "show or set the codec compressing the values written into a table, zstd_dict trains a dictionary on its values, -rewrite recompresses the stored values", (*cli).compress},
+		"stats":      {"stats [table]...", "show storage statistics", (*cli).stats},
+		"dump":       {"dump [-format binary|jsonl] [-out file] [bucket]...", "export buckets, all of them by default", (*cli).dump},
+		"restore":    {"restore [-overwrite] <file>", "import a binary or jsonl dump", (*cli).restore},
+		"load":       {"load [-format csv|jsonl|parquet] [-chunk n] [-max-errors n] <table> <file>", "bulk load rows into a table, a CSV file has a header naming the columns, kv tables have a key and a value column", (*cli).load},
+		"export":     {"export [-format csv|jsonl|parquet] [-out file] <table>", "export the rows of a table", (*cli).export},
+		"checkpoint": {"checkpoint <dir>", "write a consistent on-disk copy of every bucket", (*cli).checkpoint},
+		"backup":     {"backup <dir>", "incrementally update the backup in dir", (*cli).backup},
+		"rotate":     {"rotate", "re-encrypt the values written with older keys than the last one of the key file", (*cli).rotate},
+		"users":      {"users", "list the users of the server front-ends", (*cli).users},
+		"user":       {"user [-delete] <name> [role]...", "create or replace a user holding the roles, or delete it and its tokens", (*cli).user},
+		"roles":      {"roles", "list roles and their grants", (*cli).roles},
+		"role":       {"role [-delete] <name> [<table>[/<prefix>]:read|write|admin]...", "create or replace a role granting permissions on tables or key prefixes, * for every table", (*cli).role},
+		"token":      {"token [-ttl duration] <user> | token -revoke <token>", "issue a token authenticating a user to the server front-ends, or revoke one", (*cli).token},
+		"audit":      {"audit [-since time|duration] [-limit n]", "list the operations denied by the server front-ends", (*cli).audit},
+	}
+}
+
+func printHelp(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "Commands:")
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, []string{"  " + commands[name].usage, commands[name].help})
+	}
+	printTable(out, nil, rows)
+}
+
+func (c *cli) run(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	r, err := cmd.fn(c, args[1:])
+	if err != nil {
+		return err
+	}
+	return c.print(r)
+}
+
+func usageError(name string) error {
+	return fmt.Errorf("usage: %s", commands[name].usage)
+}
+
+// parseFlags parses the flags of a command, setup registers them
+func parseFlags(name string, args []string, setup func(fs *flag.FlagSet)) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	setup(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, usageError(name)
+	}
+	return fs.Args(), nil
+}
+
+// table opens an existing table without creating its bucket
+func (c *cli) table(name string) (*kical.Table, error) {
+	names, err := c.db.Tables()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if n == name {
+			return c.db.Table(name)
+		}
+	}
+	return nil, fmt.Errorf("no such table %q", name)
+}
+
+func (c *cli) help(args []string) (*result, error) {
+	printHelp(c.out)
+	return nil, nil
+}
+
+func (c *cli) tables(args []string) (*result, error) {
+	names, err := c.db.Tables()
+	if err != nil {
+		return nil, err
+	}
+	r := &result{columns: []string{"NAME", "TYPE"}}
+	raw := []map[string]string{}
+	for _, name := range names {
+		tbl, err := c.db.Table(name)
+		if err != nil {
+			return nil, err
+		}
+		typ := metaparser.StorageTypeName(tbl.GetMetadata().StorageType)
+		r.rows = append(r.rows, []string{name, typ})
+		raw = append(raw, map[string]string{"name": name, "type": typ})
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) describe(args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, usageError("describe")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	m := tbl.GetMetadata()
+	raw := map[string]interface{}{
+		"name":         args[0],
+		"storage_type": metaparser.StorageTypeName(m.StorageType),
+	}
+	r := &result{columns: []string{"FIELD", "TYPE", "KEY", "CONSTRAINT"}}
+	var fields []map[string]interface{}
+	if m.PrimaryKey != nil {
+		raw["primary_key"] = map[string]string{
+			"name": m.PrimaryKey.Name,
+			"type": metaparser.PrimaryKeyTypeName(m.PrimaryKey.Type),
+		}
+		if _, ok := m.Field(m.PrimaryKey.Name); !ok {
+			r.rows = append(r.rows, []string{m.PrimaryKey.Name, "-", "primary " + metaparser.PrimaryKeyTypeName(m.PrimaryKey.Type), ""})
+		}
+	}
+	for _, f := range m.Fields {
+		key := ""
+		if m.PrimaryKey != nil && m.PrimaryKey.Name == f.Name {
+			key = "primary " + metaparser.PrimaryKeyTypeName(m.PrimaryKey.Type)
+		} else if m.IsUnique(f.Name) {
+			key = "unique"
+		} else if m.IsIndexed(f.Name) {
+			key = "index"
+		}
+		if r, ok := m.Reference(f.Name); ok {
+			key = strings.TrimSpace(key + " references " + r.Table)
+			if r.OnDelete != "" {
+				key += " on delete " + r.OnDelete
+			}
+		}
+		r.rows = append(r.rows, []string{f.Name, fieldTypeName(f), key, constraintText(&f.Constraint)})
+		field := map[string]interface{}{"name": f.Name, "type": fieldTypeName(f)}
+		if f.Default != "" {
+			field["default"] = f.Default
+		}
+		if !f.Constraint.IsZero() {
+			field["constraint"] = f.Constraint
+		}
+		fields = append(fields, field)
+	}
+	if fields != nil {
+		raw["fields"] = fields
+	}
+	if m.K != 0 {
+		raw["k"] = m.K
+	}
+	if len(m.Unique) != 0 {
+		raw["unique"] = m.Unique
+	}
+	if len(m.Indexes) != 0 {
+		raw["indexes"] = m.Indexes
+	}
+	for _, path := range m.Paths {
+		r.rows = append(r.rows, []string{path, "-", "indexed path", ""})
+	}
+	if len(m.Paths) != 0 {
+		raw["paths"] = m.Paths
+	}
+	if len(m.References) != 0 {
+		raw["references"] = m.References
+	}
+	if m.Version() != 0 {
+		raw["version"] = m.Version()
+	}
+	if m.View != nil {
+		r.rows = append(r.rows, []string{"-", "-", "view of " + m.View.Source, m.View.Query})
+		raw["view"] = m.View
+	}
+	if m.Compression != nil {
+		raw["compression"] = m.Compression
+	}
+	if len(r.rows) == 0 {
+		r.columns = []string{"TYPE"}
+		r.rows = [][]string{{metaparser.StorageTypeName(m.StorageType)}}
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) create(args []string) (*result, error) {
+	if len(args) < 2 {
+		return nil, usageError("create")
+	}
+	typ, ok := metaparser.ParseStorageTypeName(args[1])
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", args[1])
+	}
+	m := &metaparser.Metadata{StorageType: typ}
+	if typ == metaparser.MetaStorageTypeRowDocument {
+		if len(args) < 3 {
+			return nil, usageError("create")
+		}
+		name, pkType, ok := splitPair(args[2])
+		if !ok {
+			return nil, usageError("create")
+		}
+		pt, ok := metaparser.ParsePrimaryKeyTypeName(pkType)
+		if !ok {
+			return nil, fmt.Errorf("unknown primary key type %q", pkType)
+		}
+		m.PrimaryKey = &metaparser.PrimaryKey{Type: pt, Name: name}
+		for _, arg := range args[3:] {
+			required := false
+			for {
+				if strings.HasSuffix(arg, ":unique") {
+					arg = strings.TrimSuffix(arg, ":unique")
+					name, _, _ := splitPair(arg)
+					m.Unique = append(m.Unique, name)
+				} else if strings.HasSuffix(arg, ":index") {
+					arg = strings.TrimSuffix(arg, ":index")
+					name, _, _ := splitPair(arg)
+					m.Indexes = append(m.Indexes, name)
+				} else if strings.HasSuffix(arg, ":required") {
+					arg = strings.TrimSuffix(arg, ":required")
+					required = true
+				} else if i := strings.LastIndex(arg, ":ref="); i > 0 {
+					r := metaparser.Reference{Table: arg[i+len(":ref="):]}
+					if j := strings.IndexByte(r.Table, '/'); j >= 0 {
+						r.Table, r.OnDelete = r.Table[:j], r.Table[j+1:]
+					}
+					arg = arg[:i]
+					r.Field, _, _ = splitPair(arg)
+					m.References = append(m.References, r)
+				} else {
+					break
+				}
+			}
+			name, fieldType, ok := splitPair(arg)
+			if !ok {
+				return nil, usageError("create")
+			}
+			f, ok := parseFieldType(fieldType)
+			if !ok {
+				return nil, fmt.Errorf("unknown field type %q", fieldType)
+			}
+			f.Name = name
+			f.Constraint.Required = required
+			m.Fields = append(m.Fields, f)
+		}
+	} else if len(args) != 2 {
+		return nil, usageError("create")
+	}
+	_, err := c.db.CreateTable(args[0], m)
+	return nil, err
+}
+
+func (c *cli) alter(args []string) (*result, error) {
+	if len(args) < 3 {
+		return nil, usageError("alter")
+	}
+	ch := metaparser.Change{Op: args[1], Field: args[2]}
+	switch {
+	case ch.Op == metaparser.ChangeAddField && (len(args) == 3 || len(args) == 4),
+		ch.Op == metaparser.ChangeRetypeField && len(args) == 3:
+		name, fieldType, ok := splitPair(args[2])
+		if !ok {
+			return nil, usageError("alter")
+		}
+		typ, ok := common.ParseTypeName(fieldType)
+		if !ok {
+			return nil, fmt.Errorf("unknown field type %q", fieldType)
+		}
+		ch.Field, ch.Type = name, typ
+		if len(args) == 4 {
+			ch.Default = args[3]
+		}
+	case ch.Op == metaparser.ChangeDropField && len(args) == 3:
+	case ch.Op == metaparser.ChangeRenameField && len(args) == 4:
+		ch.Name = args[3]
+	default:
+		return nil, usageError("alter")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return nil, tbl.AlterSchema(ch)
+}
+
+func (c *cli) rewrite(args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, usageError("rewrite")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	n, err := tbl.RewriteRows(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		columns: []string{"REWRITTEN"},
+		rows:    [][]string{{strconv.Itoa(n)}},
+		raw:     map[string]int{"rewritten": n},
+	}, nil
+}
+
+func (c *cli) compress(args []string) (*result, error) {
+	var rewrite bool
+	args, err := parseFlags("compress", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&rewrite, "rewrite", false, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return nil, usageError("compress")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 2 {
+		err = tbl.SetCompression(args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	n := 0
+	if rewrite {
+		n, err = tbl.RecompressValues(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &result{
+		columns: []string{"CODEC", "REWRITTEN"},
+		rows:    [][]string{{tbl.Compression(), strconv.Itoa(n)}},
+		raw:     map[string]interface{}{"codec": tbl.Compression(), "rewritten": n},
+	}, nil
+}
+
+// fieldTypeName names the type of f, with the precision and
+// scale of decimal fields such as decimal(10,2)
+func fieldTypeName(f metaparser.Field) string {
+	if f.Precision == 0 {
+		return common.TypeName(f.Type)
+	}
+	return fmt.Sprintf("%s(%d,%d)", common.TypeName(f.Type), f.Precision, f.Scale)
+}
+
+// constraintText is the short form of a constraint shown by
+// describe, such as `required 1..64 in(a,b) ~[a-z]+`
+func constraintText(c *metaparser.Constraint) string {
+	var parts []string
+	if c.Required {
+		parts = append(parts, "required")
+	}
+	if c.Min != "" || c.Max != "" {
+		parts = append(parts, c.Min+".."+c.Max)
+	}
+	if len(c.Members) != 0 {
+		parts = append(parts, "in("+strings.Join(c.Members, ",")+")")
+	}
+	if c.Pattern != "" {
+		parts = append(parts, "~"+c.Pattern)
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseFieldType parses the names written by fieldTypeName
+func parseFieldType(s string) (metaparser.Field, bool) {
+	name := s
+	var f metaparser.Field
+	if i := strings.IndexByte(s, '('); i > 0 && strings.HasSuffix(s, ")") {
+		name = s[:i]
+		n, err := fmt.Sscanf(s[i:], "(%d,%d)", &f.Precision, &f.Scale)
+		if err != nil || n != 2 {
+			return f, false
+		}
+	}
+	typ, ok := common.ParseTypeName(name)
+	f.Type = typ
+	return f, ok
+}
+
+func splitPair(s string) (string, string, bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func (c *cli) get(args []string) (*result, error) {
+	if len(args) != 2 {
+		return nil, usageError("get")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return nil, err
+	}
+	v, err := t.Get(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		columns: []string{"KEY", "VALUE"},
+		rows:    [][]string{{args[1], formatCell(v)}},
+		raw:     map[string]interface{}{"key": args[1], "value": v},
+	}, nil
+}
+
+// parseValue parses s as JSON, falling back to the plain string
+func parseValue(s string) interface{} {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if decoder.Decode(&v) != nil || decoder.More() {
+		return s
+	}
+	return document.PlainValue(v)
+}
+
+func (c *cli) set(args []string) (*result, error) {
+	if len(args) != 3 {
+		return nil, usageError("set")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return nil, err
+	}
+	s := t.NewSession()
+	err = s.Set(args[1], parseValue(args[2]))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return nil, s.Commit()
+}
+
+func (c *cli) del(args []string) (*result, error) {
+	if len(args) < 2 {
+		return nil, usageError("del")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tbl.IsKV():
+		s := tbl.KV.NewSession()
+		for _, key := range args[1:] {
+			err = s.Delete(key)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		return nil, s.Commit()
+	case tbl.IsRowDocument():
+		s := tbl.Document.NewSession()
+		for _, key := range args[1:] {
+			pk, err := tbl.Document.ParseKey(key)
+			if err == nil {
+				err = s.Delete(pk)
+			}
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		return nil, s.Commit()
+	}
+	return nil, common.ErrWrongStorageType
+}
+
+func (c *cli) scan(args []string) (*result, error) {
+	limit := 100
+	args, err := parseFlags("scan", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&limit, "limit", limit, "maximum number of results")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return nil, usageError("scan")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+	r := &result{columns: []string{"KEY", "VALUE"}}
+	raw := []map[string]interface{}{}
+	cursor := prefix
+	for {
+		entries, next, err := t.Scan(cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Key, prefix) || (limit > 0 && len(raw) == limit) {
+				next = ""
+				break
+			}
+			r.rows = append(r.rows, []string{e.Key, formatCell(e.Value)})
+			raw = append(raw, map[string]interface{}{"key": e.Key, "value": e.Value})
+		}
+		if next == "" || (limit > 0 && len(raw) == limit) {
+			break
+		}
+		cursor = next
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) document(name string) (*document.Document, error) {
+	tbl, err := c.table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetDocument()
+}
+
+// Chunked resolves analytical tables, together with document it
+// lets queries read every kind of table
+func (c *cli) Chunked(name string) (query.Chunked, error) {
+	tbl, err := c.table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetAnalytical()
+}
+
+// Document as is
+func (c *cli) Document(name string) (*document.Document, error) {
+	return c.document(name)
+}
+
+// rowsResult renders rows with one column per field
+func rowsResult(d *document.Document, rows []document.Row) *result {
+	m := d.Metadata()
+	var columns []string
+	if m.PrimaryKey != nil {
+		columns = append(columns, m.PrimaryKey.Name)
+	}
+	for _, f := range m.Fields {
+		if m.PrimaryKey == nil || f.Name != m.PrimaryKey.Name {
+			columns = append(columns, f.Name)
+		}
+	}
+	r := &result{columns: columns, raw: rows}
+	if rows == nil {
+		r.raw = []document.Row{}
+	}
+	for _, row := range rows {
+		cells := make([]string, 0, len(columns))
+		for _, col := range columns {
+			cells = append(cells, formatCell(row[col]))
+		}
+		r.rows = append(r.rows, cells)
+	}
+	return r
+}
+
+func (c *cli) doc(args []string) (*result, error) {
+	if len(args) != 2 {
+		return nil, usageError("doc")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	pk, err := d.ParseKey(args[1])
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.Get(pk)
+	if err != nil {
+		return nil, err
+	}
+	r := rowsResult(d, []document.Row{row})
+	r.raw = row
+	return r, nil
+}
+
+func (c *cli) insert(args []string) (*result, error) {
+	if len(args) != 2 {
+		return nil, usageError("insert")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	row, ok := parseValue(args[1]).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("document must be a JSON object")
+	}
+	s := d.NewSession()
+	pk, err := s.Insert(document.Row(row))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	err = s.Commit()
+	if err != nil {
+		return nil, err
+	}
+	pk = d.KeyText(pk)
+	return &result{
+		columns: []string{"PRIMARY KEY"},
+		rows:    [][]string{{pk}},
+		raw:     map[string]string{"key": pk},
+	}, nil
+}
+
+func (c *cli) find(args []string) (*result, error) {
+	limit := 100
+	args, err := parseFlags("find", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&limit, "limit", limit, "maximum number of results")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 {
+		return nil, usageError("find")
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	d, err := tbl.GetDocument()
+	if err != nil {
+		return nil, err
+	}
+	q := tbl.Query()
+	for _, arg := range args[1:] {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return nil, usageError("find")
+		}
+		if d.IsTag(arg[:i]) {
+			q.Tagged(arg[:i], arg[i+1:])
+		} else {
+			q.Where(arg[:i], query.OpEq, arg[i+1:])
+		}
+	}
+	if limit > 0 {
+		q.Limit(limit)
+	}
+	rows, err := q.Rows()
+	if err != nil {
+		return nil, err
+	}
+	return rowsResult(d, rows), nil
+}
+
+func (c *cli) tag(args []string) (*result, error) {
+	if len(args) < 3 {
+		return nil, usageError("tag")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var add, remove []string
+	for _, arg := range args[3:] {
+		switch {
+		case strings.HasPrefix(arg, "-"):
+			remove = append(remove, arg[1:])
+		case strings.HasPrefix(arg, "+"):
+			add = append(add, arg[1:])
+		default:
+			add = append(add, arg)
+		}
+	}
+	pk, err := d.ParseKey(args[1])
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.UpdateTags(pk, args[2], add, remove)
+	if err != nil {
+		return nil, err
+	}
+	r := rowsResult(d, []document.Row{row})
+	r.raw = row
+	return r, nil
+}
+
+func (c *cli) patch(args []string) (*result, error) {
+	if len(args) < 3 {
+		return nil, usageError("patch")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]interface{})
+	var unset []string
+	for _, arg := range args[2:] {
+		if strings.HasPrefix(arg, "-") {
+			unset = append(unset, arg[1:])
+			continue
+		}
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return nil, usageError("patch")
+		}
+		set[arg[:i]] = parseValue(arg[i+1:])
+	}
+	pk, err := d.ParseKey(args[1])
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.UpdatePaths(pk, set, unset)
+	if err != nil {
+		return nil, err
+	}
+	r := rowsResult(d, []document.Row{row})
+	r.raw = row
+	return r, nil
+}
+
+func (c *cli) index(args []string) (*result, error) {
+	drop := false
+	args, err := parseFlags("index", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&drop, "drop", drop, "drop the index instead")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, usageError("index")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if drop {
+		return nil, d.DropPathIndex(args[1])
+	}
+	return nil, d.IndexPath(args[1])
+}
+
+func (c *cli) view(args []string) (*result, error) {
+	refresh := false
+	args, err := parseFlags("view", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&refresh, "refresh", refresh, "rebuild the view from its source")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refresh {
+		if len(args) != 1 {
+			return nil, usageError("view")
+		}
+		return nil, c.db.RefreshView(args[0])
+	}
+	if len(args) != 2 {
+		return nil, usageError("view")
+	}
+	_, err = c.db.CreateView(args[0], args[1])
+	return nil, err
+}
+
+type tableStats struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	DataKeys  int64  `json:"data_keys"`
+	MetaKeys  int64  `json:"meta_keys"`
+	Bytes     int64  `json:"bytes"`
+	DiskBytes uint64 `json:"disk_bytes,omitempty"`
+}
+
+func (c *cli) stats(args []string) (*result, error) {
+	names := args
+	if len(names) == 0 {
+		var err error
+		names, err = c.db.Tables()
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &result{columns: []string{"TABLE", "TYPE", "DATA KEYS", "META KEYS", "BYTES", "DISK BYTES"}}
+	raw := []*tableStats{}
+	for _, name := range names {
+		tbl, err := c.table(name)
+		if err != nil {
+			return nil, err
+		}
+		st := &tableStats{
+			Name: name,
+			Type: metaparser.StorageTypeName(tbl.GetMetadata().StorageType),
+		}
+		iter := tbl.GetStorage().NewIter(nil, nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			k := iter.Key()
+			if len(k) != 0 && k[0] == metaparser.MetaInitCharacter {
+				st.MetaKeys++
+			} else {
+				st.DataKeys++
+			}
+			st.Bytes += int64(len(k) + len(iter.Value()))
+		}
+		iter.Close()
+		if pds, ok := tbl.GetStorage().(*storage.PebbleDriverStorage); ok {
+			m := pds.GetDB().Metrics()
+			st.DiskBytes = uint64(m.Total().Size) + m.WAL.Size
+		}
+		raw = append(raw, st)
+		r.rows = append(r.rows, []string{
+			st.Name, st.Type,
+			strconv.FormatInt(st.DataKeys, 10),
+			strconv.FormatInt(st.MetaKeys, 10),
+			strconv.FormatInt(st.Bytes, 10),
+			strconv.FormatUint(st.DiskBytes, 10),
+		})
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) query(args []string) (*result, error) {
+	if len(args) == 0 {
+		return nil, usageError("query")
+	}
+	rs, err := query.Run(c, strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	r := &result{columns: rs.Columns}
+	raw := make([]map[string]interface{}, 0, len(rs.Rows))
+	for _, row := range rs.Rows {
+		cells := make([]string, len(row))
+		obj := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			if doc, ok := v.(document.Row); ok {
+				v = map[string]interface{}(doc)
+			}
+			cells[i] = formatCell(v)
+			obj[rs.Columns[i]] = v
+		}
+		r.rows = append(r.rows, cells)
+		raw = append(raw, obj)
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) analyze(args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, usageError("analyze")
+	}
+	d, err := c.document(args[0])
+	if err != nil {
+		return nil, err
+	}
+	st, err := d.Analyze()
+	if err != nil {
+		return nil, err
+	}
+	// index values are printed as text, the keys of indexed
+	// numbers and times are binary
+	raw := *st
+	raw.Enums = make(map[string]map[string]int64, len(st.Enums))
+	r := &result{
+		columns: []string{"FIELD", "VALUE", "ROWS"},
+		rows:    [][]string{{"*", "*", strconv.FormatInt(st.Rows, 10)}},
+		raw:     &raw,
+	}
+	fields := make([]string, 0, len(st.Enums))
+	for f := range st.Enums {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		values := make([]string, 0, len(st.Enums[f]))
+		for v := range st.Enums[f] {
+			values = append(values, v)
+		}
+		// sorted by key, so that numbers and times are in order
+		sort.Strings(values)
+		raw.Enums[f] = make(map[string]int64, len(values))
+		for _, v := range values {
+			text := d.IndexText(f, v)
+			raw.Enums[f][text] = st.Enums[f][v]
+			r.rows = append(r.rows, []string{f, text, strconv.FormatInt(st.Enums[f][v], 10)})
+		}
+	}
+	return r, nil
+}
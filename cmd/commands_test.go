@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newCLI opens a cli on an empty in-memory database
+func newCLI(t *testing.T) (*cli, *bytes.Buffer) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		BaseDirectory: filepath.Join(tempDir(t), "data"),
+		UseMemory:     true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, kical.NewDatabaseConfigure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	return &cli{db: db, driver: drv, out: out}, out
+}
+
+// run runs a command and returns what it printed
+func run(t *testing.T, c *cli, out *bytes.Buffer, args ...string) string {
+	t.Helper()
+	out.Reset()
+	if err := c.run(args); err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return out.String()
+}
+
+func TestArguments(t *testing.T) {
+	c, _ := newCLI(t)
+	_, err := c.db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"nope"}, `unknown command "nope", try help`},
+		{[]string{"describe"}, "usage: describe <table>"},
+		{[]string{"describe", "missing"}, `no such table "missing"`},
+		{[]string{"create"}, "usage: create "},
+		{[]string{"create", "t", "heap"}, `unknown storage type "heap"`},
+		{[]string{"create", "t", "kv", "extra"}, "usage: create "},
+		{[]string{"create", "t", "row"}, "usage: create "},
+		{[]string{"create", "t", "row", "id"}, "usage: create "},
+		{[]string{"create", "t", "row", "id:serial"}, `unknown primary key type "serial"`},
+		{[]string{"create", "t", "row", "id:custom", "name"}, "usage: create "},
+		{[]string{"create", "t", "row", "id:custom", "name:"}, "usage: create "},
+		{[]string{"create", "t", "row", "id:custom", "name:blob"}, `unknown field type "blob"`},
+		{[]string{"create", "t", "row", "id:custom", "price:decimal(10)"}, `unknown field type "decimal(10)"`},
+		{[]string{"get", "reg"}, "usage: get <table> <key>"},
+		{[]string{"set", "reg", "k"}, "usage: set <table> <key> <value>"},
+		{[]string{"del", "reg"}, "usage: del <table> <key>..."},
+		{[]string{"scan"}, "usage: scan "},
+		{[]string{"scan", "-limit", "x", "reg"}, "usage: scan "},
+		{[]string{"scan", "reg", "a", "b"}, "usage: scan "},
+		{[]string{"find", "-bogus", "reg"}, "usage: find "},
+		{[]string{"insert", "reg"}, "usage: insert <table> <json>"},
+		{[]string{"query"}, "usage: query "},
+		{[]string{"analyze"}, "usage: analyze <table>"},
+		{[]string{"analyze", "reg", "extra"}, "usage: analyze <table>"},
+		{[]string{"analyze", "reg"}, common.ErrWrongStorageType.Error()},
+		{[]string{"dump", "-format", "xml"}, `unknown dump format "xml"`},
+		{[]string{"dump", "-out"}, "usage: dump "},
+		{[]string{"restore"}, "usage: restore "},
+		{[]string{"restore", "-overwrite"}, "usage: restore "},
+		{[]string{"checkpoint"}, "usage: checkpoint <dir>"},
+		{[]string{"backup"}, "usage: backup <dir>"},
+		{[]string{"backup", "a", "b"}, "usage: backup <dir>"},
+	}
+	for _, test := range tests {
+		err := c.run(test.args)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%q: expected %q, got %v", test.args, test.err, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	pairs := []struct {
+		in          string
+		name, value string
+		ok          bool
+	}{
+		{"id:custom", "id", "custom", true},
+		{"a:b:c", "a:b", "c", true},
+		{"id", "", "", false},
+		{":custom", "", "", false},
+		{"id:", "", "", false},
+	}
+	for _, p := range pairs {
+		name, value, ok := splitPair(p.in)
+		if name != p.name || value != p.value || ok != p.ok {
+			t.Errorf("splitPair(%q) = %q, %q, %v", p.in, name, value, ok)
+		}
+	}
+
+	types := []struct {
+		in  string
+		out metaparser.Field
+		ok  bool
+	}{
+		{"string", metaparser.Field{Type: common.TypeString}, true},
+		{"decimal", metaparser.Field{Type: common.TypeDecimal}, true},
+		{"decimal(10,2)", metaparser.Field{Type: common.TypeDecimal, Precision: 10, Scale: 2}, true},
+		{"decimal(10)", metaparser.Field{}, false},
+		{"blob", metaparser.Field{}, false},
+	}
+	for _, typ := range types {
+		f, ok := parseFieldType(typ.in)
+		if ok != typ.ok || (ok && !reflect.DeepEqual(f, typ.out)) {
+			t.Errorf("parseFieldType(%q) = %+v, %v", typ.in, f, ok)
+		}
+	}
+
+	values := []struct {
+		in  string
+		out interface{}
+	}{
+		{"plain", "plain"},
+		{`"quoted"`, "quoted"},
+		{"42", int64(42)},
+		{"1.5", 1.5},
+		{"true", true},
+		{`{"a":1}`, map[string]interface{}{"a": int64(1)}},
+		{"1 2", "1 2"},
+		{"{", "{"},
+	}
+	for _, v := range values {
+		if got := parseValue(v.in); !reflect.DeepEqual(got, v.out) {
+			t.Errorf("parseValue(%q) = %#v", v.in, got)
+		}
+	}
+
+	c, out := newCLI(t)
+	run(t, c, out, "create", "regions", "row", "code:custom", "name:string")
+	run(t, c, out, "create", "services", "row", "id:auto_increment",
+		"name:string:unique:required", "port:integer:index",
+		"region:string:ref=regions/cascade", "price:decimal(10,2)")
+	tbl, err := c.db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := tbl.GetMetadata()
+	if m.PrimaryKey.Name != "id" || m.PrimaryKey.Type != metaparser.MetaPrimaryKeyAutoIncrementID {
+		t.Fatalf("got primary key %+v", m.PrimaryKey)
+	}
+	if !reflect.DeepEqual(m.Unique, []string{"name"}) || !reflect.DeepEqual(m.Indexes, []string{"port"}) {
+		t.Fatalf("got unique %q and indexes %q", m.Unique, m.Indexes)
+	}
+	want := []metaparser.Reference{{Field: "region", Table: "regions", OnDelete: "cascade"}}
+	if !reflect.DeepEqual(m.References, want) {
+		t.Fatalf("got references %+v", m.References)
+	}
+	if f, _ := m.Field("name"); !f.Constraint.Required {
+		t.Fatal("name is not required")
+	}
+	if f, _ := m.Field("price"); f.Type != common.TypeDecimal || f.Precision != 10 || f.Scale != 2 {
+		t.Fatalf("got price %+v", f)
+	}
+}
+
+func TestRun(t *testing.T) {
+	c, out := newCLI(t)
+	run(t, c, out, "create", "regions", "row", "code:custom", "name:string")
+	run(t, c, out, "create", "services", "row", "id:auto_increment",
+		"name:string:unique", "port:integer:index", "region:string:ref=regions")
+	run(t, c, out, "create", "reg", "kv")
+
+	if got := run(t, c, out, "tables"); got != "NAME      TYPE\nreg       kv\nregions   row\nservices  row\n" {
+		t.Fatalf("tables:\n%s", got)
+	}
+	got := run(t, c, out, "describe", "services")
+	want := "FIELD   TYPE     KEY                     CONSTRAINT\n" +
+		"id      -        primary auto_increment  \n" +
+		"name    string   unique                  \n" +
+		"port    integer  index                   \n" +
+		"region  string   references regions      \n"
+	if got != want {
+		t.Fatalf("describe:\n%s", got)
+	}
+
+	run(t, c, out, "insert", "regions", `{"code":"eu","name":"Europe"}`)
+	run(t, c, out, "insert", "regions", `{"code":"us","name":"America"}`)
+	for _, row := range []string{
+		`{"name":"web","port":8443,"region":"eu"}`,
+		`{"name":"api","port":8080,"region":"us"}`,
+		`{"name":"db","port":5432,"region":"eu"}`,
+	} {
+		run(t, c, out, "insert", "services", row)
+	}
+	if got := run(t, c, out, "doc", "services", "2"); got != "id  name  port  region\n2   api   8080  us\n" {
+		t.Fatalf("doc:\n%s", got)
+	}
+	if got := run(t, c, out, "find", "services", "region=eu"); got != "id  name  port  region\n1   web   8443  eu\n3   db    5432  eu\n" {
+		t.Fatalf("find:\n%s", got)
+	}
+	if got := run(t, c, out, "query", "SELECT name FROM services WHERE port = 8443"); got != "name\nweb\n" {
+		t.Fatalf("query:\n%s", got)
+	}
+	if got := run(t, c, out, "analyze", "services"); got != "FIELD   VALUE  ROWS\n*       *      3\nport    5432   1\nport    8080   1\nport    8443   1\nregion  eu     2\nregion  us     1\n" {
+		t.Fatalf("analyze:\n%s", got)
+	}
+	run(t, c, out, "set", "reg", "greeting", "hello")
+	run(t, c, out, "set", "reg", "answer", "42")
+	if got := run(t, c, out, "scan", "reg"); got != "KEY       VALUE\nanswer    42\ngreeting  hello\n" {
+		t.Fatalf("scan:\n%s", got)
+	}
+
+	c.json = true
+	var st struct {
+		Rows  int64                       `json:"rows"`
+		Enums map[string]map[string]int64 `json:"enums"`
+	}
+	if err := json.Unmarshal([]byte(run(t, c, out, "analyze", "services")), &st); err != nil || st.Rows != 3 || st.Enums["port"]["8080"] != 1 {
+		t.Fatalf("analyze json: %+v, %v", st, err)
+	}
+	c.json = false
+
+	dir := tempDir(t)
+	for _, format := range []string{"binary", "jsonl"} {
+		file := filepath.Join(dir, "dump."+format)
+		run(t, c, out, "dump", "-format", format, "-out", file)
+		restored, rout := newCLI(t)
+		run(t, restored, rout, "restore", file)
+		if got := run(t, restored, rout, "query", "SELECT name FROM services WHERE region = 'eu' ORDER BY id"); got != "name\nweb\ndb\n" {
+			t.Fatalf("%s dump restored:\n%s", format, got)
+		}
+		if got := run(t, restored, rout, "get", "reg", "greeting"); got != "KEY       VALUE\ngreeting  hello\n" {
+			t.Fatalf("%s dump restored:\n%s", format, got)
+		}
+	}
+
+	backup := filepath.Join(dir, "backup")
+	got = run(t, c, out, "backup", backup)
+	if !strings.HasPrefix(got, "COPIED  REUSED  PRUNED  BYTES COPIED\n") {
+		t.Fatalf("backup:\n%s", got)
+	}
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{BaseDirectory: backup})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, kical.NewDatabaseConfigure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &cli{db: db, driver: drv, out: out}
+	if got := run(t, restored, out, "doc", "services", "3"); got != "id  name  port  region\n3   db    5432  eu\n" {
+		t.Fatalf("backup restored:\n%s", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/xtlsoft/kical/dump"
+)
+
+func (c *cli) dump(args []string) (*result, error) {
+	format := "binary"
+	out := ""
+	args, err := parseFlags("dump", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", format, "binary or jsonl")
+		fs.StringVar(&out, "out", out, "output file, standard output by default")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if format != "binary" && format != "jsonl" {
+		return nil, fmt.Errorf("unknown dump format %q", format)
+	}
+	var w io.Writer = c.out
+	var f *os.File
+	if out != "" {
+		f, err = os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	if format == "jsonl" {
+		err = dump.DumpJSONLines(c.driver, w, args)
+	} else {
+		err = dump.Dump(c.driver, w, args)
+	}
+	if f != nil {
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return nil, err
+}
+
+func (c *cli) restore(args []string) (*result, error) {
+	overwrite := false
+	args, err := parseFlags("restore", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&overwrite, "overwrite", overwrite, "replace the content of non-empty buckets")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, usageError("restore")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return nil, dump.Restore(c.driver, f, &dump.RestoreOptions{Overwrite: overwrite})
+}
+
+func (c *cli) checkpoint(args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, usageError("checkpoint")
+	}
+	return nil, c.db.Checkpoint(args[0])
+}
+
+func (c *cli) backup(args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, usageError("backup")
+	}
+	stats, err := c.db.Backup(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		columns: []string{"COPIED", "REUSED", "PRUNED", "BYTES COPIED"},
+		rows: [][]string{{
+			strconv.Itoa(stats.FilesCopied),
+			strconv.Itoa(stats.FilesReused),
+			strconv.Itoa(stats.FilesPruned),
+			strconv.FormatInt(stats.BytesCopied, 10),
+		}},
+		raw: stats,
+	}, nil
+}
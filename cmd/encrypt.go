@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical/storage"
+)
+
+// readKeys reads a key file: one `<version>:<hex encoded AES key>`
+// per line, the highest version being the current one, blank lines
+// and lines starting with # are skipped. A version keeps its key,
+// the values written under the older versions stay readable until
+// a rotation, their lines are removed afterwards.
+func readKeys(path string) (*storage.StaticKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := new(storage.StaticKeys)
+	found := false
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = parseKeyLine(keys, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		found = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no key", path)
+	}
+	return keys, nil
+}
+
+// parseKeyLine adds the key of a `<version>:<hex key>` line
+func parseKeyLine(keys *storage.StaticKeys, line string) error {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return fmt.Errorf("expected <version>:<hex key>")
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(line[:i]), 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad version %q", line[:i])
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return err
+	}
+	return keys.SetKey(uint32(version), key)
+}
+
+func (c *cli) rotate(args []string) (*result, error) {
+	if len(args) != 0 {
+		return nil, usageError("rotate")
+	}
+	drv, ok := c.driver.(*storage.EncryptedDriver)
+	if !ok {
+		return nil, fmt.Errorf("the database is not encrypted, see -key-file")
+	}
+	stats, err := drv.Rotate(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		columns: []string{"BUCKETS", "ENTRIES", "REWRITTEN"},
+		rows: [][]string{{
+			strconv.Itoa(stats.Buckets),
+			strconv.FormatInt(stats.Entries, 10),
+			strconv.FormatInt(stats.Rewritten, 10),
+		}},
+		raw: stats,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/xtlsoft/kical/transfer"
+)
+
+type rejectedRow struct {
+	Row   int64  `json:"row"`
+	Error string `json:"error"`
+}
+
+type loadReport struct {
+	Rows     int64          `json:"rows"`
+	Imported int64          `json:"imported"`
+	Rejected []*rejectedRow `json:"rejected"`
+}
+
+func (c *cli) load(args []string) (*result, error) {
+	format := string(transfer.CSV)
+	chunk := 0
+	maxErrors := 0
+	args, err := parseFlags("load", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", format, "csv, jsonl or parquet")
+		fs.IntVar(&chunk, "chunk", chunk, "bytes buffered before they are stored")
+		fs.IntVar(&maxErrors, "max-errors", maxErrors, "rows rejected before the load fails, unlimited when negative")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, usageError("load")
+	}
+	f, err := transfer.ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	report, err := transfer.Import(tbl, file, &transfer.ImportOptions{
+		Format:    f,
+		Chunk:     chunk,
+		MaxErrors: maxErrors,
+	})
+	if err != nil {
+		if report != nil && len(report.Errors) != 0 {
+			return nil, fmt.Errorf("%w, first %v", err, report.Errors[0])
+		}
+		return nil, err
+	}
+	r := &result{columns: []string{"ROW", "ERROR"}}
+	raw := &loadReport{Rows: report.Rows, Imported: report.Imported, Rejected: []*rejectedRow{}}
+	for _, e := range report.Errors {
+		r.rows = append(r.rows, []string{strconv.FormatInt(e.Row, 10), e.Err.Error()})
+		raw.Rejected = append(raw.Rejected, &rejectedRow{Row: e.Row, Error: e.Err.Error()})
+	}
+	r.rows = append(r.rows, []string{"", fmt.Sprintf("imported %d of %d rows", report.Imported, report.Rows)})
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) export(args []string) (*result, error) {
+	format := string(transfer.CSV)
+	out := ""
+	args, err := parseFlags("export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", format, "csv, jsonl or parquet")
+		fs.StringVar(&out, "out", out, "output file, standard output by default")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, usageError("export")
+	}
+	f, err := transfer.ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := c.table(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var w io.Writer = c.out
+	var file *os.File
+	if out != "" {
+		file, err = os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	_, err = transfer.Export(tbl, w, f)
+	if file != nil {
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return nil, err
+}
@@ -1,2 +1,82 @@
 // Command kical is the command line interface of kical
+//
+// Usage:
+//
+//	kical [flags] [command [args...]]
+//
+// Without a command an interactive shell is started. Run
+// `kical help` to list the commands.
 package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func main() {
+	dir := flag.String("d", "", "data directory of the database, required")
+	output := flag.String("o", "table", "output format, table or json")
+	readOnly := flag.Bool("readonly", false, "open the database read-only")
+	keyFile := flag.String("key-file", "", "encrypt the values with the AES keys of this file, one <version>:<hex key> per line, the highest version current")
+	keyBuckets := flag.String("encrypt-keys", "", "comma separated buckets whose keys are encrypted too, needs -key-file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args...]]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output())
+		printHelp(flag.CommandLine.Output())
+	}
+	flag.Parse()
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "missing the data directory, see -d")
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	pebbleDriver := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		BaseDirectory: *dir,
+		ReadOnly:      *readOnly,
+	})
+	defer pebbleDriver.Close()
+	var drv storage.Driver = pebbleDriver
+	if *keyFile != "" {
+		keys, err := readKeys(*keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		conf := &storage.EncryptedDriverConfigure{Keys: keys}
+		if *keyBuckets != "" {
+			conf.KeyBuckets = strings.Split(*keyBuckets, ",")
+		}
+		drv = storage.NewEncryptedDriver(pebbleDriver, conf)
+	}
+	db, err := kical.NewDatabase(drv, kical.NewDatabaseConfigure())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cli := &cli{
+		db:     db,
+		driver: drv,
+		out:    os.Stdout,
+		json:   *output == "json",
+	}
+	if flag.NArg() == 0 {
+		err = cli.shell(os.Stdin)
+	} else {
+		err = cli.run(flag.Args())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		pebbleDriver.Close()
+		os.Exit(1)
+	}
+}
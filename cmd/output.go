@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// result is the output of a command, raw is printed in json
+// mode while columns and rows are printed as a table
+type result struct {
+	columns []string
+	rows    [][]string
+	raw     interface{}
+}
+
+func (c *cli) print(r *result) error {
+	if r == nil {
+		return nil
+	}
+	if c.json {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r.raw)
+	}
+	return printTable(c.out, r.columns, r.rows)
+}
+
+func printTable(out io.Writer, columns []string, rows [][]string) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if len(columns) != 0 {
+		for i, col := range columns {
+			if i != 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, col)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if i != 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, cell)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// formatCell formats a value for table output
+func formatCell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case map[string]interface{}, []interface{}, []string:
+		rs, err := json.Marshal(x)
+		if err == nil {
+			return string(rs)
+		}
+	}
+	return fmt.Sprint(v)
+}
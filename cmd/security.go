@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/security"
+)
+
+// securityStore opens the users, roles and tokens of the database
+func (c *cli) securityStore() (*security.Store, error) {
+	if c.security == nil {
+		s, err := security.NewStore(c.driver)
+		if err != nil {
+			return nil, err
+		}
+		c.security = s
+	}
+	return c.security, nil
+}
+
+// parseGrant parses <table>[/<prefix>]:<permission>, the prefix
+// may hold any character
+func parseGrant(s string) (security.Grant, error) {
+	var g security.Grant
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return g, fmt.Errorf("%w: %q, expected <table>[/<prefix>]:<permission>", security.ErrInvalidGrant, s)
+	}
+	perm, ok := security.ParsePermission(s[i+1:])
+	if !ok {
+		return g, fmt.Errorf("%w: unknown permission %q", security.ErrInvalidGrant, s[i+1:])
+	}
+	g.Permission = perm
+	g.Table = s[:i]
+	if j := strings.IndexByte(g.Table, '/'); j >= 0 {
+		g.Table, g.Prefix = g.Table[:j], g.Table[j+1:]
+	}
+	return g, nil
+}
+
+func grantText(g security.Grant) string {
+	if g.Prefix == "" {
+		return g.Table + ":" + g.Permission.String()
+	}
+	return g.Table + "/" + g.Prefix + ":" + g.Permission.String()
+}
+
+func (c *cli) users(args []string) (*result, error) {
+	if len(args) != 0 {
+		return nil, usageError("users")
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	r := &result{columns: []string{"NAME", "ROLES"}}
+	raw := []*security.User{}
+	for _, name := range s.Users() {
+		u, err := s.User(name)
+		if err != nil {
+			return nil, err
+		}
+		r.rows = append(r.rows, []string{u.Name, strings.Join(u.Roles, ",")})
+		raw = append(raw, u)
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) user(args []string) (*result, error) {
+	var del bool
+	args, err := parseFlags("user", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&del, "delete", false, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 || (del && len(args) != 1) {
+		return nil, usageError("user")
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	if del {
+		return nil, s.DeleteUser(args[0])
+	}
+	return nil, s.SetUser(&security.User{Name: args[0], Roles: args[1:]})
+}
+
+func (c *cli) roles(args []string) (*result, error) {
+	if len(args) != 0 {
+		return nil, usageError("roles")
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	r := &result{columns: []string{"NAME", "GRANTS"}}
+	raw := []*security.Role{}
+	for _, name := range s.Roles() {
+		role, err := s.Role(name)
+		if err != nil {
+			return nil, err
+		}
+		grants := make([]string, 0, len(role.Grants))
+		for _, g := range role.Grants {
+			grants = append(grants, grantText(g))
+		}
+		r.rows = append(r.rows, []string{role.Name, strings.Join(grants, " ")})
+		raw = append(raw, role)
+	}
+	r.raw = raw
+	return r, nil
+}
+
+func (c *cli) role(args []string) (*result, error) {
+	var del bool
+	args, err := parseFlags("role", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&del, "delete", false, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 || (del && len(args) != 1) {
+		return nil, usageError("role")
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	if del {
+		return nil, s.DeleteRole(args[0])
+	}
+	role := &security.Role{Name: args[0]}
+	for _, arg := range args[1:] {
+		g, err := parseGrant(arg)
+		if err != nil {
+			return nil, err
+		}
+		role.Grants = append(role.Grants, g)
+	}
+	return nil, s.SetRole(role)
+}
+
+func (c *cli) token(args []string) (*result, error) {
+	var ttl time.Duration
+	var revoke bool
+	args, err := parseFlags("token", args, func(fs *flag.FlagSet) {
+		fs.DurationVar(&ttl, "ttl", 0, "")
+		fs.BoolVar(&revoke, "revoke", false, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, usageError("token")
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	if revoke {
+		return nil, s.RevokeToken(args[0])
+	}
+	tok, err := s.IssueToken(args[0], ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		columns: []string{"TOKEN"},
+		rows:    [][]string{{tok}},
+		raw:     map[string]string{"user": args[0], "token": tok},
+	}, nil
+}
+
+// parseSince parses a time as RFC 3339 or as a duration before now
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (c *cli) audit(args []string) (*result, error) {
+	var since string
+	limit := 100
+	args, err := parseFlags("audit", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&since, "since", "", "")
+		fs.IntVar(&limit, "limit", limit, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 0 {
+		return nil, usageError("audit")
+	}
+	var from time.Time
+	if since != "" {
+		from, err = parseSince(since)
+		if err != nil {
+			return nil, fmt.Errorf("bad time %q", since)
+		}
+	}
+	s, err := c.securityStore()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.Audit(from, limit)
+	if err != nil {
+		return nil, err
+	}
+	r := &result{columns: []string{"TIME", "USER", "FRONT", "OPERATION", "TABLE", "KEY", "PERMISSION", "REASON", "COUNT"}}
+	for _, e := range entries {
+		count := e.Count
+		if count == 0 {
+			count = 1
+		}
+		r.rows = append(r.rows, []string{
+			e.Time.Format(time.RFC3339Nano), e.User, e.Front, e.Operation,
+			e.Table, strconv.Quote(e.Key), e.Permission.String(), e.Reason,
+			strconv.FormatInt(count, 10),
+		})
+	}
+	if entries == nil {
+		entries = []security.AuditEntry{}
+	}
+	r.raw = entries
+	return r, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const prompt = "kical> "
+
+func (c *cli) shell(in io.Reader) error {
+	interactive := false
+	if f, ok := in.(*os.File); ok {
+		if st, err := f.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+			interactive = true
+		}
+	}
+	if interactive {
+		fmt.Fprintln(c.out, `kical shell, type "help" for the list of commands`)
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for {
+		if interactive {
+			fmt.Fprint(c.out, prompt)
+		}
+		if !scanner.Scan() {
+			if interactive {
+				fmt.Fprintln(c.out)
+			}
+			return scanner.Err()
+		}
+		args, err := splitWords(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(c.out, "error:", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		err = c.run(args)
+		if err != nil {
+			fmt.Fprintln(c.out, "error:", err)
+		}
+	}
+}
+
+// splitWords splits a shell line into words, honouring single
+// quotes, double quotes and backslash escapes
+func splitWords(line string) ([]string, error) {
+	var ret []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				ret = append(ret, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inWord {
+		ret = append(ret, cur.String())
+	}
+	return ret, nil
+}
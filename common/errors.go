@@ -4,3 +4,6 @@ import "fmt"
 
 // ErrWrongStorageType as is
 var ErrWrongStorageType = fmt.Errorf("Wrong storage type error determined")
+
+// ErrTableExists as is
+var ErrTableExists = fmt.Errorf("Table already exists")
@@ -0,0 +1,21 @@
+package common
+
+// EventType describes the kind of a change event
+type EventType uint8
+
+const (
+	// EventPut is emitted when a key is set
+	EventPut = EventType(1)
+	// EventDelete is emitted when a key is deleted
+	EventDelete = EventType(2)
+)
+
+// Event describes a committed change of a single key
+type Event struct {
+	Type  EventType
+	Key   string
+	Value interface{}
+}
+
+// Notifier receives the events of a committed session
+type Notifier func(events []Event)
@@ -0,0 +1,30 @@
+package common
+
+var typeNames = map[byte]string{
+	TypeString:  "string",
+	TypeInteger: "integer",
+	TypeFloat:   "float",
+	TypeDecimal: "decimal",
+	TypeTime:    "time",
+	TypeObject:  "object",
+	TypeTag:     "tag",
+	TypeEnum:    "enum",
+}
+
+// TypeName returns the human readable name of a field type
+func TypeName(typ byte) string {
+	if name, ok := typeNames[typ]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseTypeName returns the field type named name
+func ParseTypeName(name string) (byte, bool) {
+	for typ, n := range typeNames {
+		if n == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
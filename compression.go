@@ -0,0 +1,199 @@
+package kical
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// CompressionSamples is the number of stored values a compression
+// dictionary is trained on
+const CompressionSamples = 1000
+
+// dataStart and dataEnd bound the keys of the values of kv,
+// document and analytical tables, the ones the codec compresses
+var (
+	dataStart = []byte{'='}
+	dataEnd   = []byte{'=' + 1}
+)
+
+// setCodec makes c compress the values written into the table
+func (tbl *Table) setCodec(c *compression.Codec) {
+	tbl.codec = c
+	switch {
+	case tbl.IsKV():
+		tbl.KV.SetCodec(c)
+	case tbl.IsRowDocument():
+		tbl.Document.SetCodec(c)
+	case tbl.IsAnalytical():
+		tbl.Analytical.SetCodec(c)
+	}
+}
+
+// Compression returns the name of the codec compressing the
+// values written into the table
+func (tbl *Table) Compression() string {
+	return tbl.codec.Name()
+}
+
+// SetCompression sets the codec compressing the values written
+// into the table from now on, one of the metaparser.Compression
+// codecs. A dictionary is trained on the first CompressionSamples
+// stored values for metaparser.CompressionZstdDict, the table must
+// hold data by then. Values already stored keep their compression
+// until RecompressValues rewrites them, previous dictionaries are
+// kept for them.
+func (tbl *Table) SetCompression(name string) error {
+	if !tbl.IsKV() && !tbl.IsRowDocument() && !tbl.IsAnalytical() {
+		return common.ErrWrongStorageType
+	}
+	switch name {
+	case metaparser.CompressionNone, metaparser.CompressionSnappy, metaparser.CompressionZstd, metaparser.CompressionZstdDict:
+	default:
+		return fmt.Errorf("%w: %q", compression.ErrUnknownCodec, name)
+	}
+	if tbl.Document != nil {
+		// no session writes under the old codec meanwhile
+		return tbl.Document.Exclusive(func() error {
+			return tbl.setCompression(name)
+		})
+	}
+	return tbl.setCompression(name)
+}
+
+func (tbl *Table) setCompression(name string) error {
+	c := &metaparser.Compression{Codec: name}
+	batch := tbl.bucket.NewBatch(storage.BatchReadWrite)
+	if name == metaparser.CompressionZstdDict {
+		samples, err := tbl.compressionSamples()
+		if err != nil {
+			batch.Close()
+			return err
+		}
+		dict, err := compression.Train(samples, 0)
+		if err == nil {
+			c.Dictionary, err = compression.DictionaryID(dict)
+		}
+		if err == nil {
+			err = batch.Set(metaparser.DictionaryKey(c.Dictionary), dict, &storage.SetOptions{Synchronized: true})
+		}
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	m := *tbl.GetMetadata()
+	m.Compression = c
+	err := metaparser.RewriteMetadata(batch, &m)
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	// the codec reads the dictionary from the bucket
+	err = batch.Commit()
+	if err != nil {
+		return err
+	}
+	codec, err := compression.NewCodec(tbl.bucket, c)
+	if err != nil {
+		return err
+	}
+	tbl.setCodec(codec)
+	if tbl.Document != nil {
+		return tbl.Document.Reload()
+	}
+	tbl.meta.Compression = c
+	return nil
+}
+
+// compressionSamples returns the first stored values decompressed
+func (tbl *Table) compressionSamples() ([][]byte, error) {
+	iter := tbl.bucket.NewIter(dataStart, dataEnd)
+	defer iter.Close()
+	var ret [][]byte
+	for iter.First(); iter.Valid() && len(ret) < CompressionSamples; iter.Next() {
+		v, err := tbl.codec.Decompress(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, append([]byte(nil), v...))
+	}
+	return ret, nil
+}
+
+// RecompressValues stores every value of the table compressed with
+// its current codec, a page of RewritePageSize values at a time so
+// that the table stays online, it returns the number of values
+// rewritten, callers wanting a background rewrite run it in a
+// goroutine
+func (tbl *Table) RecompressValues(ctx context.Context) (int, error) {
+	if !tbl.IsKV() && !tbl.IsRowDocument() && !tbl.IsAnalytical() {
+		return 0, common.ErrWrongStorageType
+	}
+	total := 0
+	cursor := dataStart
+	for cursor != nil {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		n, next, err := tbl.recompress(cursor)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		cursor = next
+	}
+	return total, nil
+}
+
+// recompress rewrites a page of values starting from the key
+// cursor, it returns the key of the next page, nil at the end. The
+// other writes of the table wait while the page is rewritten so
+// that no value written meanwhile is overwritten.
+func (tbl *Table) recompress(cursor []byte) (int, []byte, error) {
+	ex, ok := tbl.bucket.(storage.Exclusive)
+	if !ok {
+		return 0, nil, storage.ErrNotSupported
+	}
+	var next []byte
+	n := 0
+	err := ex.Exclusive(func(batch storage.Batch) error {
+		iter := batch.NewIter(cursor, dataEnd)
+		var keys, values [][]byte
+		seen := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			if seen == RewritePageSize {
+				next = append([]byte(nil), iter.Key()...)
+				break
+			}
+			seen++
+			v, err := tbl.codec.Decompress(iter.Value())
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if rs := tbl.codec.Compress(v); !bytes.Equal(rs, iter.Value()) {
+				keys = append(keys, append([]byte(nil), iter.Key()...))
+				values = append(values, rs)
+			}
+		}
+		iter.Close()
+		for i := range keys {
+			err := batch.Set(keys[i], values[i], nil)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, next, nil
+}
@@ -0,0 +1,231 @@
+// Package compression compresses the values stored in the buckets
+// of tables, the codec of a table is recorded in its metadata
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// ErrUnknownCodec as is
+var ErrUnknownCodec = fmt.Errorf("Unknown compression codec")
+
+// ErrMalformed is returned for stored values failing to decompress
+var ErrMalformed = fmt.Errorf("Malformed compressed value")
+
+// ErrNoSuchDictionary is returned when a value was compressed with
+// a dictionary the table does not hold
+var ErrNoSuchDictionary = fmt.Errorf("No such compression dictionary")
+
+// MinSize is the size under which values are stored as they are
+const MinSize = 64
+
+// MaxSize is the largest size of a decompressed value
+const MaxSize = 1 << 30
+
+// marker starts every compressed value. Values are gob streams,
+// which start with a non zero message length, so uncompressed
+// values never start with it and stay readable whatever the codec.
+const marker = byte(0)
+
+// Tags following the marker, a dictionary tag is followed by the
+// id of the dictionary
+const (
+	tagSnappy = byte('s')
+	tagZstd   = byte('z')
+	tagDict   = byte('d')
+)
+
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	zstdLock sync.Mutex
+	// encoders and decoders are shared by every table, by id of
+	// their dictionary, 0 for none, as zstd decoders own goroutines
+	encoders = make(map[uint32]*zstd.Encoder)
+	decoders = make(map[uint32]*zstd.Decoder)
+)
+
+// zstdEncoder returns the encoder of the dictionary id, dict is
+// its content
+func zstdEncoder(id uint32, dict []byte) (*zstd.Encoder, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	if e, ok := encoders[id]; ok {
+		return e, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if id != 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	e, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	encoders[id] = e
+	return e, nil
+}
+
+// zstdDecoder returns the decoder of the dictionary id, load reads
+// the content of the dictionary when there is no decoder yet
+func zstdDecoder(id uint32, load func() ([]byte, error)) (*zstd.Decoder, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	if d, ok := decoders[id]; ok {
+		return d, nil
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxSize)}
+	if id != 0 {
+		dict, err := load()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	d, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	decoders[id] = d
+	return d, nil
+}
+
+// Codec compresses the values of a table as its metadata says, it
+// decompresses values whatever codec they were written with
+type Codec struct {
+	bucket  storage.Storage
+	codec   string
+	dict    uint32
+	encoder *zstd.Encoder
+}
+
+// NewCodec creates the codec of the table stored in bucket, c is
+// its compression, nil for none
+func NewCodec(bucket storage.Storage, c *metaparser.Compression) (*Codec, error) {
+	ret := &Codec{bucket: bucket, codec: metaparser.CompressionNone}
+	if c == nil {
+		return ret, nil
+	}
+	ret.codec = c.Codec
+	var err error
+	switch c.Codec {
+	case metaparser.CompressionNone, metaparser.CompressionSnappy:
+	case metaparser.CompressionZstd:
+		ret.encoder, err = zstdEncoder(0, nil)
+	case metaparser.CompressionZstdDict:
+		var dict []byte
+		dict, err = ret.dictionary(c.Dictionary)
+		if err == nil {
+			ret.dict = c.Dictionary
+			ret.encoder, err = zstdEncoder(c.Dictionary, dict)
+		}
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnknownCodec, c.Codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Name returns the name of the codec compressing new values
+func (c *Codec) Name() string {
+	if c == nil {
+		return metaparser.CompressionNone
+	}
+	return c.codec
+}
+
+func (c *Codec) dictionary(id uint32) ([]byte, error) {
+	if c == nil {
+		return nil, ErrNoSuchDictionary
+	}
+	dict, err := metaparser.NewParser(c.bucket).GetDictionary(id)
+	if err == storage.ErrNoSuchKey {
+		return nil, fmt.Errorf("%w: %d", ErrNoSuchDictionary, id)
+	}
+	return dict, err
+}
+
+// Compress returns the value to store for value, which is stored
+// as it is when it is small or does not shrink, a nil codec
+// compresses nothing
+func (c *Codec) Compress(value []byte) []byte {
+	if c == nil || len(value) < MinSize {
+		return value
+	}
+	var ret []byte
+	switch c.codec {
+	case metaparser.CompressionSnappy:
+		ret = make([]byte, 2, 2+snappy.MaxEncodedLen(len(value)))
+		ret[0], ret[1] = marker, tagSnappy
+		ret = ret[:2+len(snappy.Encode(ret[2:cap(ret)], value))]
+	case metaparser.CompressionZstd:
+		ret = c.encoder.EncodeAll(value, []byte{marker, tagZstd})
+	case metaparser.CompressionZstdDict:
+		ret = []byte{marker, tagDict, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(ret[2:], c.dict)
+		ret = c.encoder.EncodeAll(value, ret)
+	default:
+		return value
+	}
+	if len(ret) >= len(value) {
+		return value
+	}
+	return ret
+}
+
+// Decompress returns the value stored as rs
+func (c *Codec) Decompress(rs []byte) ([]byte, error) {
+	if len(rs) == 0 || rs[0] != marker {
+		return rs, nil
+	}
+	if len(rs) < 2 {
+		return nil, ErrMalformed
+	}
+	var ret []byte
+	var err error
+	switch rs[1] {
+	case tagSnappy:
+		var n int
+		n, err = snappy.DecodedLen(rs[2:])
+		if err != nil || n > MaxSize {
+			return nil, ErrMalformed
+		}
+		ret, err = snappy.Decode(nil, rs[2:])
+	case tagZstd, tagDict:
+		id := uint32(0)
+		frame := rs[2:]
+		if rs[1] == tagDict {
+			if len(rs) < 6 {
+				return nil, ErrMalformed
+			}
+			id = binary.BigEndian.Uint32(rs[2:])
+			frame = rs[6:]
+		}
+		// the decoder takes a truncated frame for an empty input
+		if !bytes.HasPrefix(frame, zstdMagic) {
+			return nil, ErrMalformed
+		}
+		var d *zstd.Decoder
+		d, err = zstdDecoder(id, func() ([]byte, error) { return c.dictionary(id) })
+		if err != nil {
+			return nil, err
+		}
+		ret, err = d.DecodeAll(frame, nil)
+	default:
+		return nil, ErrMalformed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package compression_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func sample(r *rand.Rand, i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"name":"host-%d.example.com","labels":{"zone":"eu-west-%d","tier":"backend"},"status":"running","owner":"team-%d","noise":"%x"}`,
+		i, r.Intn(1000), r.Intn(3), r.Intn(20), r.Int63()))
+}
+
+func TestCodecs(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer drv.Close()
+	bucket, err := drv.Bucket("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 500; i++ {
+		samples = append(samples, sample(r, i))
+	}
+	dict, err := compression.Train(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := compression.DictionaryID(dict)
+	if err != nil || id == 0 {
+		t.Fatalf("bad dictionary id %d, %v", id, err)
+	}
+	batch := bucket.NewBatch(storage.BatchWriteOnly)
+	batch.Set(metaparser.DictionaryKey(id), dict, nil)
+	if err = batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	random := make([]byte, 4096)
+	r.Read(random)
+	values := [][]byte{nil, []byte("short"), bytes.Repeat([]byte("abc"), 1000), random}
+	for i := 0; i < 50; i++ {
+		values = append(values, sample(r, 1000+i))
+	}
+	sizes := make(map[string]int)
+	for _, c := range []*metaparser.Compression{
+		nil,
+		{Codec: metaparser.CompressionSnappy},
+		{Codec: metaparser.CompressionZstd},
+		{Codec: metaparser.CompressionZstdDict, Dictionary: id},
+	} {
+		codec, err := compression.NewCodec(bucket, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a codec reads values written by any other
+		none, _ := compression.NewCodec(bucket, nil)
+		for _, v := range values {
+			rs := codec.Compress(v)
+			sizes[codec.Name()] += len(rs)
+			if len(rs) > len(v) {
+				t.Fatalf("%s: value grew from %d to %d bytes", codec.Name(), len(v), len(rs))
+			}
+			got, err := none.Decompress(rs)
+			if err != nil || !bytes.Equal(got, v) {
+				t.Fatalf("%s: round trip failed: %v", codec.Name(), err)
+			}
+		}
+	}
+	if sizes[metaparser.CompressionZstdDict] >= sizes[metaparser.CompressionZstd] || sizes[metaparser.CompressionZstd] >= sizes[metaparser.CompressionNone] {
+		t.Fatalf("dictionaries do not pay off: %v", sizes)
+	}
+
+	_, err = compression.NewCodec(bucket, &metaparser.Compression{Codec: metaparser.CompressionZstdDict, Dictionary: id + 1})
+	if !errors.Is(err, compression.ErrNoSuchDictionary) {
+		t.Fatalf("expected ErrNoSuchDictionary, got %v", err)
+	}
+	if _, err = compression.Train(samples[:1], 0); err != compression.ErrTooFewSamples {
+		t.Fatalf("expected ErrTooFewSamples, got %v", err)
+	}
+	if _, err = (*compression.Codec)(nil).Decompress([]byte{0, 'z', 1, 2}); !errors.Is(err, compression.ErrMalformed) {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+}
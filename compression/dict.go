@@ -0,0 +1,266 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/klauspost/compress/huff0"
+)
+
+// ErrTooFewSamples is returned when the samples given to Train
+// hold too little data to build a dictionary
+var ErrTooFewSamples = fmt.Errorf("Too few samples to train a dictionary")
+
+// DefaultDictionarySize is the size of the content of the
+// dictionaries trained by Train
+const DefaultDictionarySize = 16 << 10
+
+// Dictionaries are in the zstd format: a magic number, the id, the
+// entropy tables of the literals, offsets, match lengths and
+// literal lengths, the three initial repeat offsets and the
+// content frames refer to as if it preceded them. Only the content
+// and the literals table are trained, sequences use the default
+// distributions of the format.
+var dictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// Default distributions of the zstd format, in the order of the
+// dictionary tables, and their accuracy logs
+var (
+	offsetCodes = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+	matchLengthCodes = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}
+	literalLengthCodes = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}
+)
+
+// Segments of samples are selected by the d-grams they hold,
+// segmentSize bytes at a time
+const (
+	dgramSize   = 8
+	segmentSize = 64
+)
+
+// Train builds a zstd dictionary of at most size bytes of content
+// out of samples of the values to compress, DefaultDictionarySize
+// when size is not positive. Its id is derived from its content.
+func Train(samples [][]byte, size int) ([]byte, error) {
+	if size <= 0 {
+		size = DefaultDictionarySize
+	}
+	total := 0
+	for _, s := range samples {
+		total += len(s)
+	}
+	if len(samples) < 2 || total < 2*segmentSize {
+		return nil, ErrTooFewSamples
+	}
+	content := selectContent(samples, size)
+	lits, err := literalsTable(samples)
+	if err != nil {
+		return nil, err
+	}
+	ret := append([]byte(nil), dictMagic...)
+	ret = append(ret, 0, 0, 0, 0)
+	ret = append(ret, lits...)
+	ret = appendNCount(ret, offsetCodes, 5)
+	ret = appendNCount(ret, matchLengthCodes, 6)
+	ret = appendNCount(ret, literalLengthCodes, 6)
+	for _, offset := range []uint32{1, 4, 8} {
+		ret = append(ret, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(ret[len(ret)-4:], offset)
+	}
+	ret = append(ret, content...)
+	binary.LittleEndian.PutUint32(ret[4:], dictionaryID(ret[8:]))
+	return ret, nil
+}
+
+// DictionaryID returns the id of a dictionary built by Train
+func DictionaryID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || !bytes.Equal(dict[:4], dictMagic) {
+		return 0, ErrMalformed
+	}
+	return binary.LittleEndian.Uint32(dict[4:]), nil
+}
+
+// dictionaryID derives an id from the body of a dictionary, out of
+// the ranges the format reserves
+func dictionaryID(body []byte) uint32 {
+	sum := sha256.Sum256(body)
+	return 1<<15 + binary.BigEndian.Uint32(sum[:])%(1<<31-1<<15)
+}
+
+// selectContent picks the segments of samples holding the d-grams
+// found in the most samples, the best ones last as the end of the
+// content is the cheapest to refer to
+func selectContent(samples [][]byte, size int) []byte {
+	freq := make(map[string]int)
+	for _, s := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dgramSize <= len(s); i++ {
+			g := string(s[i : i+dgramSize])
+			if !seen[g] {
+				seen[g] = true
+				freq[g]++
+			}
+		}
+	}
+	type segment struct {
+		data  []byte
+		score int
+	}
+	score := func(data []byte) int {
+		n := 0
+		for i := 0; i+dgramSize <= len(data); i++ {
+			if f := freq[string(data[i:i+dgramSize])]; f > 1 {
+				n += f
+			}
+		}
+		return n
+	}
+	var segments []segment
+	for _, s := range samples {
+		for i := 0; i < len(s); i += segmentSize {
+			end := i + segmentSize
+			if end > len(s) {
+				end = len(s)
+			}
+			if n := score(s[i:end]); n > 0 {
+				segments = append(segments, segment{s[i:end], n})
+			}
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score > segments[j].score })
+	var picked [][]byte
+	n := 0
+	for _, seg := range segments {
+		if n+len(seg.data) > size {
+			break
+		}
+		// a segment only counts the d-grams no picked segment holds
+		if score(seg.data) == 0 {
+			continue
+		}
+		for i := 0; i+dgramSize <= len(seg.data); i++ {
+			delete(freq, string(seg.data[i:i+dgramSize]))
+		}
+		picked = append(picked, seg.data)
+		n += len(seg.data)
+	}
+	content := make([]byte, 0, size)
+	for i := len(picked) - 1; i >= 0; i-- {
+		content = append(content, picked[i]...)
+	}
+	// pad with the last samples, the repeat offsets need 8 bytes
+	for i := len(samples) - 1; i >= 0 && (len(content) < dgramSize || len(picked) == 0 && len(content) < size); i-- {
+		s := samples[i]
+		if room := size - len(content); len(s) > room {
+			s = s[len(s)-room:]
+		}
+		content = append(append([]byte(nil), s...), content...)
+	}
+	return content
+}
+
+// literalsTable returns the huffman table of the bytes of samples,
+// every byte value gets a code
+func literalsTable(samples [][]byte) ([]byte, error) {
+	in := make([]byte, 0, huff0.BlockSizeMax)
+	for i := 0; i < 256; i++ {
+		in = append(in, byte(i))
+	}
+	for _, s := range samples {
+		if room := cap(in) - len(in); len(s) > room {
+			s = s[:room]
+		}
+		in = append(in, s...)
+	}
+	s := &huff0.Scratch{}
+	_, _, err := huff0.Compress1X(in, s)
+	if err == huff0.ErrIncompressible || err == huff0.ErrUseRLE {
+		// samples too uniform, a table favouring zeroes still
+		// codes every byte
+		in = append(in[:256], make([]byte, 1024)...)
+		_, _, err = huff0.Compress1X(in, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), s.OutTable...), nil
+}
+
+// appendNCount appends the normalized counts of an FSE table as
+// the zstd format encodes them, norm sums to 1 << tableLog with
+// -1 standing for a low probability symbol counting as 1
+func appendNCount(dst []byte, norm []int16, tableLog uint) []byte {
+	tableSize := 1 << tableLog
+	remaining := tableSize + 1
+	threshold := tableSize
+	nbBits := tableLog + 1
+	bitStream := uint32(tableLog - 5)
+	bitCount := uint(4)
+	previous0 := false
+	flush := func() {
+		if bitCount > 16 {
+			dst = append(dst, byte(bitStream), byte(bitStream>>8))
+			bitStream >>= 16
+			bitCount -= 16
+		}
+	}
+	for symbol := 0; symbol < len(norm) && remaining > 1; {
+		if previous0 {
+			start := symbol
+			for symbol < len(norm) && norm[symbol] == 0 {
+				symbol++
+			}
+			if symbol == len(norm) {
+				break
+			}
+			for symbol >= start+24 {
+				start += 24
+				bitStream += 0xffff << bitCount
+				dst = append(dst, byte(bitStream), byte(bitStream>>8))
+				bitStream >>= 16
+			}
+			for symbol >= start+3 {
+				start += 3
+				bitStream += 3 << bitCount
+				bitCount += 2
+			}
+			bitStream += uint32(symbol-start) << bitCount
+			bitCount += 2
+			flush()
+		}
+		count := int(norm[symbol])
+		symbol++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		bitStream += uint32(count) << bitCount
+		bitCount += nbBits
+		if count < max {
+			bitCount--
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+		flush()
+	}
+	dst = append(dst, byte(bitStream), byte(bitStream>>8))
+	return dst[:len(dst)-2+int(bitCount+7)/8]
+}
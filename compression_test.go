@@ -0,0 +1,159 @@
+package kical_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func storedBytes(t *testing.T, tbl *kical.Table) int {
+	iter := tbl.GetStorage().NewIter([]byte{'='}, []byte{'=' + 1})
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n += len(iter.Value())
+	}
+	return n
+}
+
+func TestCompression(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "meta", Type: common.TypeObject},
+		},
+		Paths: []string{"meta.zone"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []document.Row
+	for i := 0; i < 300; i++ {
+		rows = append(rows, document.Row{"name": fmt.Sprintf("host%03d", i), "meta": map[string]interface{}{
+			"zone":        fmt.Sprintf("zone-%d", i%4),
+			"description": "a web front end serving the public registry behind the load balancer",
+			"owner":       map[string]interface{}{"team": "platform", "contact": "platform@example.com"},
+		}})
+	}
+	insert(t, db, "hosts", rows...)
+	hosts, _ := db.Table("hosts")
+	plain := storedBytes(t, hosts)
+
+	if err := hosts.SetCompression("lz4"); !errors.Is(err, compression.ErrUnknownCodec) {
+		t.Fatalf("expected ErrUnknownCodec, got %v", err)
+	}
+	_, err = db.CreateTable("early", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeKV,
+		Compression: &metaparser.Compression{Codec: metaparser.CompressionZstdDict, Dictionary: 1},
+	})
+	if !errors.Is(err, metaparser.ErrMalformedMetadata) {
+		t.Fatalf("expected ErrMalformedMetadata, got %v", err)
+	}
+
+	// new rows are compressed, old ones once rewritten
+	sizes := make(map[string]int)
+	for i, codec := range []string{metaparser.CompressionSnappy, metaparser.CompressionZstd, metaparser.CompressionZstdDict} {
+		if err := hosts.SetCompression(codec); err != nil {
+			t.Fatal(err)
+		}
+		insert(t, db, "hosts", document.Row{"name": fmt.Sprintf("new%d", i), "meta": rows[0]["meta"]})
+		n, err := hosts.RecompressValues(context.Background())
+		if err != nil || n == 0 {
+			t.Fatalf("%s: rewrote %d values, %v", codec, n, err)
+		}
+		sizes[codec] = storedBytes(t, hosts)
+		// snappy gains little on rows this small
+		if codec != metaparser.CompressionSnappy && sizes[codec] >= plain {
+			t.Fatalf("%s: %d bytes stored, %d uncompressed", codec, sizes[codec], plain)
+		}
+		if n, _ := hosts.RecompressValues(context.Background()); n != 0 {
+			t.Fatalf("%s: second rewrite rewrote %d values", codec, n)
+		}
+	}
+	if sizes[metaparser.CompressionZstdDict] >= sizes[metaparser.CompressionZstd] {
+		t.Fatalf("the dictionary does not pay off: %v", sizes)
+	}
+
+	// a reopened database reads every codec and keeps the setting
+	db, err = kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, _ = db.Table("hosts")
+	if hosts.Compression() != metaparser.CompressionZstdDict {
+		t.Fatalf("compression %q", hosts.Compression())
+	}
+	got := names(t, db, "SELECT name FROM hosts WHERE meta.zone = 'zone-1' ORDER BY name LIMIT 3")
+	if want := []string{"host001", "host005", "host009"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if row, err := hosts.Document.Get("new0"); err != nil || !reflect.DeepEqual(row["meta"], rows[0]["meta"]) {
+		t.Fatalf("got %v, %v", row, err)
+	}
+
+	events, err := db.CreateTable("events", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeAnalytical,
+		Fields:      []metaparser.Field{{Name: "message", Type: common.TypeString}},
+		Compression: &metaparser.Compression{Codec: metaparser.CompressionZstd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 600; i++ {
+		if _, err := events.Analytical.Append(document.Row{"message": fmt.Sprintf("request %d served in %dms", i, i%7)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if row, err := events.Analytical.Get(599); err != nil || row["message"] != "request 598 served in 3ms" {
+		t.Fatalf("got %v, %v", row, err)
+	}
+	zstd := storedBytes(t, events)
+	if err := events.SetCompression(metaparser.CompressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.RecompressValues(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if plain := storedBytes(t, events); plain < 2*zstd {
+		t.Fatalf("chunks take %d bytes compressed, %d plain", zstd, plain)
+	}
+
+	reg, err := db.CreateTable("reg", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeKV,
+		Compression: &metaparser.Compression{Codec: metaparser.CompressionSnappy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := reg.KV.NewSession()
+	s.Set("blob", strings.Repeat("registry ", 100))
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := reg.KV.Get("blob"); err != nil || v != strings.Repeat("registry ", 100) {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if n := storedBytes(t, reg); n > 200 {
+		t.Fatalf("%d bytes stored", n)
+	}
+}
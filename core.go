@@ -1,17 +1,28 @@
 package kical
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/xtlsoft/kical/analytical"
 	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/document"
 	"github.com/xtlsoft/kical/kv"
 	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/security"
 	"github.com/xtlsoft/kical/storage"
 )
 
 // NewDatabase creates a new database instance
 func NewDatabase(driver storage.Driver, conf *common.DatabaseConfigure) (*Database, error) {
 	db := &Database{
-		driver: driver,
-		conf:   conf,
+		driver:  driver,
+		conf:    conf,
+		watches: newWatchHub(),
+		views:   newViewHub(),
 	}
 	err := db.init()
 	if err != nil {
@@ -22,22 +33,45 @@ func NewDatabase(driver storage.Driver, conf *common.DatabaseConfigure) (*Databa
 
 // Database is the main interface class of Kical
 type Database struct {
-	driver storage.Driver
-	conf   *common.DatabaseConfigure
+	driver  storage.Driver
+	conf    *common.DatabaseConfigure
+	watches *watchHub
+	views   *viewHub
 }
 
 func (db *Database) init() error {
 	return nil
 }
 
-// Table creates a table instance
+// checkTableName rejects the names which are no valid bucket names
+// or are reserved by the database
+func checkTableName(name string) error {
+	err := storage.CheckBucketName(name)
+	if err != nil {
+		return err
+	}
+	if name == security.SystemBucket {
+		return fmt.Errorf("%w: %q is reserved", storage.ErrInvalidBucketName, name)
+	}
+	return nil
+}
+
+// Table opens the existing table name, storage.ErrNoSuchKey is
+// returned when it is missing
 func (db *Database) Table(name string) (*Table, error) {
-	// TODO: finish this
-	s, err := db.driver.Bucket(name)
+	err := checkTableName(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := db.driver.OpenBucket(name)
+	if errors.Is(err, storage.ErrNoSuchBucket) {
+		return nil, storage.ErrNoSuchKey
+	}
 	if err != nil {
 		return nil, err
 	}
 	tbl := &Table{
+		name:   name,
 		bucket: s,
 		db:     db,
 	}
@@ -48,13 +82,102 @@ func (db *Database) Table(name string) (*Table, error) {
 	return tbl, nil
 }
 
+// CreateTable writes the metadata of a new table and returns it,
+// common.ErrTableExists is returned if the table already exists
+func (db *Database) CreateTable(name string, meta *metaparser.Metadata) (*Table, error) {
+	err := checkTableName(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := db.driver.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = metaparser.NewParser(s).GetStorageType()
+	if err == nil {
+		return nil, common.ErrTableExists
+	}
+	if err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m := *meta
+	if m.TableName == "" {
+		m.TableName = name
+	}
+	if m.Compression != nil && m.Compression.Codec == metaparser.CompressionZstdDict {
+		return nil, fmt.Errorf("%w: dictionaries are trained on the values of a table, see SetCompression", metaparser.ErrMalformedMetadata)
+	}
+	if m.StorageType == metaparser.MetaStorageTypeRowDocument {
+		err = document.CheckSchema(&m)
+		if err == nil {
+			err = db.checkReferences(&m)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	batch := s.NewBatch(storage.BatchWriteOnly)
+	err = metaparser.WriteMetadata(batch, &m)
+	if err != nil {
+		batch.Close()
+		return nil, err
+	}
+	err = batch.Commit()
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := db.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	if tbl.IsRowDocument() {
+		_, err = tbl.Document.Analyze()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tbl, nil
+}
+
+// Tables returns the names of all buckets holding a table
+func (db *Database) Tables() ([]string, error) {
+	names, err := db.driver.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, name := range names {
+		if checkTableName(name) != nil {
+			continue
+		}
+		s, err := db.driver.OpenBucket(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = metaparser.NewParser(s).GetStorageType()
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
 // Table is the basic collection type in Kical
 type Table struct {
+	name       string
 	bucket     storage.Storage
 	db         *Database
 	metaParser *metaparser.Parser
 	typ        byte
+	meta       *metaparser.Metadata
+	codec      *compression.Codec
 	KV         *kv.KV
+	Document   *document.Document
+	Analytical *analytical.Analytical
 }
 
 func (tbl *Table) init() error {
@@ -64,17 +187,56 @@ func (tbl *Table) init() error {
 		// TODO: ask user to create a table
 		return err
 	}
+	if err != nil {
+		return err
+	}
 	tbl.typ = typ
+	tbl.meta, err = tbl.metaParser.GetMetadata()
+	if err != nil {
+		return err
+	}
+	tbl.codec, err = compression.NewCodec(tbl.bucket, tbl.meta.Compression)
+	if err != nil {
+		return err
+	}
 	switch typ {
 	case metaparser.MetaStorageTypeKV:
 		tbl.KV = kv.NewKV(tbl.db.conf, tbl.bucket)
+		tbl.KV.SetNotifier(tbl.db.watches.notifier(tbl.name))
+	case metaparser.MetaStorageTypeRowDocument:
+		tbl.Document = document.NewDocument(tbl.db.conf, tbl.bucket, tbl.meta)
+		tbl.Document.SetNotifier(tbl.db.watches.notifier(tbl.name))
+		tbl.Document.SetCatalog(tbl.db)
+		tbl.Document.SetObserver(tbl.db.observer(tbl.name))
+	case metaparser.MetaStorageTypeAnalytical:
+		tbl.Analytical, err = analytical.NewAnalytical(tbl.db.conf, tbl.bucket, tbl.meta)
+		if err != nil {
+			return err
+		}
+		tbl.Analytical.SetNotifier(tbl.db.watches.notifier(tbl.name))
 	// TODO: complete this
+	case metaparser.MetaStorageTypeColumn:
 	default:
 		panic("Reaching theoretical unreachable code")
 	}
+	tbl.setCodec(tbl.codec)
 	return nil
 }
 
+// GetMetadata returns the metadata of the table, the one read
+// last by the document of a row document table
+func (tbl *Table) GetMetadata() *metaparser.Metadata {
+	if tbl.Document != nil {
+		return tbl.Document.Metadata()
+	}
+	return tbl.meta
+}
+
+// GetName returns the name of the table
+func (tbl *Table) GetName() string {
+	return tbl.name
+}
+
 // GetDatabase returns tbl.db
 func (tbl *Table) GetDatabase() *Database {
 	return tbl.db
@@ -112,3 +274,157 @@ func (tbl *Table) GetKV() (*kv.KV, error) {
 	}
 	return tbl.KV, nil
 }
+
+// Query starts a query on the rows of a document or an
+// analytical table
+func (tbl *Table) Query() *query.Builder {
+	if tbl.IsAnalytical() {
+		return query.NewChunkedBuilder(tbl.name, tbl.Analytical)
+	}
+	return query.NewBuilder(tbl.name, tbl.Document)
+}
+
+// AlterSchema applies changes in order to the schema of a row
+// document table, rows written under the previous schema are
+// upgraded when read
+func (tbl *Table) AlterSchema(changes ...metaparser.Change) error {
+	d, err := tbl.GetDocument()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		err = d.Alter(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewritePageSize is the number of rows RewriteRows rewrites per
+// committed batch
+const RewritePageSize = 500
+
+// RewriteRows stores every row of a row document table written
+// under an older schema version upgraded to the current one, a
+// page at a time so that the table stays online, it returns the
+// number of rows rewritten, callers wanting a background rewrite
+// run it in a goroutine
+func (tbl *Table) RewriteRows(ctx context.Context) (int, error) {
+	d, err := tbl.GetDocument()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		n, next, err := d.Rewrite(cursor, RewritePageSize)
+		total += n
+		if err != nil || next == "" {
+			return total, err
+		}
+		cursor = next
+	}
+}
+
+// GetDocument returns tbl.Document or returns common.ErrWrongStorageType
+func (tbl *Table) GetDocument() (*document.Document, error) {
+	if !tbl.IsRowDocument() {
+		return nil, common.ErrWrongStorageType
+	}
+	return tbl.Document, nil
+}
+
+// GetAnalytical returns tbl.Analytical or returns common.ErrWrongStorageType
+func (tbl *Table) GetAnalytical() (*analytical.Analytical, error) {
+	if !tbl.IsAnalytical() {
+		return nil, common.ErrWrongStorageType
+	}
+	return tbl.Analytical, nil
+}
+
+// Document returns the row document table named name, it lets
+// the database serve as a query catalog
+func (db *Database) Document(name string) (*document.Document, error) {
+	tbl, err := db.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetDocument()
+}
+
+// Referrers lists the references of every row document table to
+// the table named name, it lets the database serve as the catalog
+// keeping references valid
+func (db *Database) Referrers(name string) ([]document.Referrer, error) {
+	tables, err := db.Tables()
+	if err != nil {
+		return nil, err
+	}
+	var ret []document.Referrer
+	for _, table := range tables {
+		s, err := db.driver.OpenBucket(table)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := metaparser.NewParser(s).GetReferences()
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range refs {
+			if r.Table == name {
+				ret = append(ret, document.Referrer{Table: table, Field: r.Field, OnDelete: r.OnDelete})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// checkReferences checks that the references of the new table m
+// point to row document tables whose primary key has the type of
+// the referencing field, a table may reference itself
+func (db *Database) checkReferences(m *metaparser.Metadata) error {
+	for _, r := range m.References {
+		f, ok := m.Field(r.Field)
+		if !ok {
+			return fmt.Errorf("%w: no field %s", metaparser.ErrMalformedMetadata, r.Field)
+		}
+		target := document.NewDocument(db.conf, nil, m)
+		if r.Table != m.TableName {
+			var err error
+			target, err = db.Document(r.Table)
+			if err != nil {
+				return fmt.Errorf("%w: %s references %s: %v", metaparser.ErrMalformedMetadata, r.Field, r.Table, err)
+			}
+		}
+		pk := target.Metadata().PrimaryKey
+		if pk == nil {
+			return fmt.Errorf("%w: %s has no primary key", metaparser.ErrMalformedMetadata, r.Table)
+		}
+		typ, _ := target.FieldType(pk.Name)
+		if typ != f.Type && !(typ == common.TypeString && f.Type == common.TypeEnum) {
+			return fmt.Errorf("%w: %s is a %s, the key of %s a %s", metaparser.ErrMalformedMetadata,
+				r.Field, common.TypeName(f.Type), r.Table, common.TypeName(typ))
+		}
+		if r.OnDelete == metaparser.ReferenceSetNull && f.Constraint.Required {
+			return fmt.Errorf("%w: required field %s cannot be set to null", metaparser.ErrMalformedMetadata, r.Field)
+		}
+	}
+	return nil
+}
+
+// Chunked returns the analytical table named name, together with
+// Document it makes the database a query.ChunkCatalog
+func (db *Database) Chunked(name string) (query.Chunked, error) {
+	tbl, err := db.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetAnalytical()
+}
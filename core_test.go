@@ -0,0 +1,134 @@
+package kical_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newDatabase(t *testing.T) *kical.Database {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newServices returns a database holding a services table of
+// twelve rows, every third one without a port
+func newServices(t *testing.T) *kical.Database {
+	db := newDatabase(t)
+	_, err := db.CreateTable("services", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "region", Type: common.TypeString},
+			{Name: "tier", Type: common.TypeEnum},
+			{Name: "port", Type: common.TypeInteger},
+		},
+		Unique: []string{"name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []document.Row
+	for i := 0; i < 12; i++ {
+		row := document.Row{
+			"name":   fmt.Sprintf("svc%02d", i),
+			"region": []string{"eu", "us"}[i%2],
+			"tier":   []string{"gold", "silver", "bronze"}[i%3],
+		}
+		if i%3 != 2 {
+			row["port"] = 8000 + i
+		}
+		rows = append(rows, row)
+	}
+	insert(t, db, "services", rows...)
+	return db
+}
+
+func insert(t *testing.T, db *kical.Database, table string, rows ...document.Row) {
+	d, err := db.Document(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.NewSession()
+	for _, row := range rows {
+		if _, err := s.Insert(row); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// names runs src and returns the first column of every row
+func names(t *testing.T, db *kical.Database, src string) []string {
+	rs, err := query.Run(db, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	ret := []string{}
+	for _, row := range rs.Rows {
+		ret = append(ret, fmt.Sprint(row[0]))
+	}
+	return ret
+}
+
+func mustDocument(t *testing.T, db *kical.Database, name string) *document.Document {
+	d, err := db.Document(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestTableNames(t *testing.T) {
+	base := filepath.Join(tempDir(t), "data")
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{BaseDirectory: base})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV}
+	for _, name := range []string{"", "..", "../escaped", "a/b", "_security"} {
+		if _, err = db.CreateTable(name, meta); !errors.Is(err, storage.ErrInvalidBucketName) {
+			t.Fatalf("%q: expected ErrInvalidBucketName, got %v", name, err)
+		}
+		if _, err = db.Table(name); !errors.Is(err, storage.ErrInvalidBucketName) {
+			t.Fatalf("%q: expected ErrInvalidBucketName, got %v", name, err)
+		}
+	}
+	if _, err = db.Table("missing"); err != storage.ErrNoSuchKey {
+		t.Fatalf("expected ErrNoSuchKey, got %v", err)
+	}
+	for _, dir := range []string{filepath.Join(base, "missing"), filepath.Join(base, "..", "escaped")} {
+		if _, err = os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s was created: %v", dir, err)
+		}
+	}
+	if _, err = db.CreateTable("reg", meta); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := db.Tables()
+	if err != nil || len(tables) != 1 || tables[0] != "reg" {
+		t.Fatalf("got %v, %v", tables, err)
+	}
+}
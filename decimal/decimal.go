@@ -0,0 +1,350 @@
+// Package decimal provides the exact decimal numbers held by
+// decimal fields, together with a binary encoding sorting like
+// the numbers it encodes
+package decimal
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ErrSyntax as is
+var ErrSyntax = fmt.Errorf("Invalid decimal syntax")
+
+// ErrRange as is
+var ErrRange = fmt.Errorf("Decimal out of range")
+
+// ErrPrecision as is
+var ErrPrecision = fmt.Errorf("Decimal does not fit the precision and scale")
+
+// ErrDivisionByZero as is
+var ErrDivisionByZero = fmt.Errorf("Decimal division by zero")
+
+// MaxScale bounds the number of fractional digits of a decimal
+// and the exponent of a parsed one
+const MaxScale = 4096
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// Decimal is an exact decimal number, the unscaled integer
+// divided by ten to the power of the scale, the zero value is 0
+type Decimal struct {
+	unscaled *big.Int
+	scale    int32
+}
+
+// New returns unscaled divided by ten to the power of scale
+func New(unscaled int64, scale int32) Decimal {
+	return NewFromBigInt(big.NewInt(unscaled), scale)
+}
+
+// NewFromBigInt returns unscaled divided by ten to the power of
+// scale, unscaled is copied
+func NewFromBigInt(unscaled *big.Int, scale int32) Decimal {
+	u := new(big.Int).Set(unscaled)
+	if scale < 0 {
+		u.Mul(u, pow10(-scale))
+		scale = 0
+	}
+	return Decimal{unscaled: u, scale: scale}
+}
+
+// NewFromInt returns the integer i
+func NewFromInt(i int64) Decimal {
+	return New(i, 0)
+}
+
+// NewFromFloat returns the shortest decimal that converts back
+// to f, it fails on NaN and infinities
+func NewFromFloat(f float64) (Decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Decimal{}, fmt.Errorf("%w: %v", ErrRange, f)
+	}
+	return Parse(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// Parse parses a decimal in plain or exponent notation such as
+// -12.50 or 1.25e3, the scale is the number of fractional digits
+// written
+func Parse(s string) (Decimal, error) {
+	text := s
+	exp := int64(0)
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		e, err := strconv.ParseInt(text[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, fmt.Errorf("%w: %q", ErrSyntax, s)
+		}
+		exp = e
+		text = text[:i]
+	}
+	neg := false
+	if strings.HasPrefix(text, "-") {
+		neg = true
+		text = text[1:]
+	} else if strings.HasPrefix(text, "+") {
+		text = text[1:]
+	}
+	digits := text
+	frac := 0
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		digits = text[:i] + text[i+1:]
+		frac = len(text) - i - 1
+	}
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrSyntax, s)
+	}
+	scale := int64(frac) - exp
+	if scale > MaxScale || scale < -MaxScale {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	u, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		u.Neg(u)
+	}
+	return NewFromBigInt(u, int32(scale)), nil
+}
+
+// MustParse is like Parse but panics on malformed input
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) bigInt() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// String formats d in plain notation with exactly Scale
+// fractional digits
+func (d Decimal) String() string {
+	u := d.bigInt()
+	s := new(big.Int).Abs(u).String()
+	if n := int(d.scale); n > 0 {
+		if len(s) <= n {
+			s = strings.Repeat("0", n-len(s)+1) + s
+		}
+		s = s[:len(s)-n] + "." + s[len(s)-n:]
+	}
+	if u.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// Float64 returns the float nearest to d
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// Unscaled returns a copy of the unscaled integer of d
+func (d Decimal) Unscaled() *big.Int {
+	return new(big.Int).Set(d.bigInt())
+}
+
+// Scale returns the number of fractional digits of d
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Precision returns the number of digits of the unscaled
+// integer of d
+func (d Decimal) Precision() int {
+	if d.Sign() == 0 {
+		return 1
+	}
+	return len(new(big.Int).Abs(d.bigInt()).String())
+}
+
+// Sign returns -1, 0 or 1 as d is negative, zero or positive
+func (d Decimal) Sign() int {
+	return d.bigInt().Sign()
+}
+
+// withScale returns d with the larger scale, which is exact
+func (d Decimal) withScale(scale int32) *big.Int {
+	if scale == d.scale {
+		return d.bigInt()
+	}
+	return new(big.Int).Mul(d.bigInt(), pow10(scale-d.scale))
+}
+
+// align returns the unscaled integers of x and y at their
+// common scale
+func align(x, y Decimal) (*big.Int, *big.Int, int32) {
+	scale := x.scale
+	if y.scale > scale {
+		scale = y.scale
+	}
+	return x.withScale(scale), y.withScale(scale), scale
+}
+
+// Cmp returns -1, 0 or 1 as d is less than, equal to or greater
+// than y, the scales do not matter
+func (d Decimal) Cmp(y Decimal) int {
+	a, b, _ := align(d, y)
+	return a.Cmp(b)
+}
+
+// Equal reports whether d and y are the same number
+func (d Decimal) Equal(y Decimal) bool {
+	return d.Cmp(y) == 0
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	return Decimal{unscaled: new(big.Int).Neg(d.bigInt()), scale: d.scale}
+}
+
+// Abs returns the absolute value of d
+func (d Decimal) Abs() Decimal {
+	return Decimal{unscaled: new(big.Int).Abs(d.bigInt()), scale: d.scale}
+}
+
+// Add returns d+y with the larger of their scales
+func (d Decimal) Add(y Decimal) Decimal {
+	a, b, scale := align(d, y)
+	return Decimal{unscaled: new(big.Int).Add(a, b), scale: scale}
+}
+
+// Sub returns d-y with the larger of their scales
+func (d Decimal) Sub(y Decimal) Decimal {
+	a, b, scale := align(d, y)
+	return Decimal{unscaled: new(big.Int).Sub(a, b), scale: scale}
+}
+
+// Mul returns d*y with the sum of their scales
+func (d Decimal) Mul(y Decimal) Decimal {
+	return Decimal{unscaled: new(big.Int).Mul(d.bigInt(), y.bigInt()), scale: d.scale + y.scale}
+}
+
+// Quo returns d/y rounded half to even to scale fractional digits
+func (d Decimal) Quo(y Decimal, scale int32) (Decimal, error) {
+	if y.Sign() == 0 {
+		return Decimal{}, ErrDivisionByZero
+	}
+	num := d.bigInt()
+	den := y.bigInt()
+	// d/y = num/den * 10^(y.scale-d.scale), scaled by 10^scale
+	shift := scale + y.scale - d.scale
+	if shift >= 0 {
+		num = new(big.Int).Mul(num, pow10(shift))
+	} else {
+		den = new(big.Int).Mul(den, pow10(-shift))
+	}
+	return Decimal{unscaled: quoRound(num, den), scale: scale}, nil
+}
+
+// quoRound divides num by den rounding half to even
+func quoRound(num, den *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	c := new(big.Int).Abs(r)
+	c.Lsh(c, 1)
+	c2 := c.Cmp(new(big.Int).Abs(den))
+	if c2 > 0 || (c2 == 0 && q.Bit(0) == 1) {
+		if (num.Sign() < 0) != (den.Sign() < 0) {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// Round returns d rounded half to even to scale fractional
+// digits, a larger scale appends zeros
+func (d Decimal) Round(scale int32) Decimal {
+	if scale >= d.scale {
+		return Decimal{unscaled: d.withScale(scale), scale: scale}
+	}
+	return Decimal{unscaled: quoRound(d.bigInt(), pow10(d.scale-scale)), scale: scale}
+}
+
+// Reduce returns d without the trailing zeros of its fraction
+func (d Decimal) Reduce() Decimal {
+	u := d.bigInt()
+	scale := d.scale
+	if u.Sign() == 0 {
+		return Decimal{}
+	}
+	q, r := new(big.Int), new(big.Int)
+	for scale > 0 {
+		q.QuoRem(u, bigTen, r)
+		if r.Sign() != 0 {
+			break
+		}
+		u = new(big.Int).Set(q)
+		scale--
+	}
+	return Decimal{unscaled: u, scale: scale}
+}
+
+// Fit returns d with exactly scale fractional digits, it fails
+// with ErrPrecision if digits would be lost or if the result has
+// more than precision digits, a zero precision is not checked
+func (d Decimal) Fit(precision, scale int) (Decimal, error) {
+	r := d.Round(int32(scale))
+	if r.Cmp(d) != 0 {
+		return Decimal{}, fmt.Errorf("%w: %s has more than %d fractional digits", ErrPrecision, d, scale)
+	}
+	if precision > 0 && r.Precision() > precision {
+		return Decimal{}, fmt.Errorf("%w: %s has more than %d digits", ErrPrecision, d, precision)
+	}
+	return r, nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Decimal) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Decimal) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// MarshalJSON encodes d as a JSON string so that no digit is
+// lost by clients decoding numbers into floats
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON accepts a JSON string or number
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if s, err := strconv.Unquote(text); err == nil {
+		text = s
+	}
+	return d.UnmarshalText([]byte(text))
+}
+
+// GobEncode implements gob.GobEncoder
+func (d Decimal) GobEncode() ([]byte, error) {
+	return d.MarshalText()
+}
+
+// GobDecode implements gob.GobDecoder
+func (d *Decimal) GobDecode(data []byte) error {
+	return d.UnmarshalText(data)
+}
@@ -0,0 +1,161 @@
+package decimal_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/xtlsoft/kical/decimal"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]string{
+		"0":         "0",
+		"-0.00":     "0.00",
+		"12.50":     "12.50",
+		"+.5":       "0.5",
+		"-3.":       "-3",
+		"1.25e3":    "1250",
+		"125E-4":    "0.0125",
+		"-0.000001": "-0.000001",
+		"123456789012345678901234567890.123456789": "123456789012345678901234567890.123456789",
+	}
+	for src, want := range cases {
+		d, err := decimal.Parse(src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if got := d.String(); got != want {
+			t.Fatalf("%s: got %s, want %s", src, got, want)
+		}
+	}
+	for _, src := range []string{"", "-", ".", "1.2.3", "1e", "abc", "1,5", "0x10"} {
+		if _, err := decimal.Parse(src); !errors.Is(err, decimal.ErrSyntax) {
+			t.Fatalf("%q: got %v, want a syntax error", src, err)
+		}
+	}
+	if _, err := decimal.Parse("1e-99999"); !errors.Is(err, decimal.ErrRange) {
+		t.Fatalf("got %v, want a range error", err)
+	}
+	f, err := decimal.NewFromFloat(0.1)
+	if err != nil || f.String() != "0.1" || f.Float64() != 0.1 {
+		t.Fatalf("unexpected float conversion %v %v", f, err)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	p := decimal.MustParse
+	sum := decimal.Decimal{}
+	for i := 0; i < 10; i++ {
+		sum = sum.Add(p("0.1"))
+	}
+	if !sum.Equal(decimal.NewFromInt(1)) || sum.String() != "1.0" {
+		t.Fatalf("unexpected sum %s", sum)
+	}
+	if got := p("1.50").Sub(p("2.125")).String(); got != "-0.625" {
+		t.Fatalf("unexpected difference %s", got)
+	}
+	if got := p("-1.5").Mul(p("0.25")).String(); got != "-0.375" {
+		t.Fatalf("unexpected product %s", got)
+	}
+	quotients := map[[2]string]string{
+		{"1", "3"}:      "0.33",
+		{"2", "3"}:      "0.67",
+		{"0.125", "1"}:  "0.12",
+		{"0.375", "1"}:  "0.38",
+		{"-0.125", "1"}: "-0.12",
+		{"10", "-4"}:    "-2.50",
+	}
+	for in, want := range quotients {
+		q, err := p(in[0]).Quo(p(in[1]), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.String() != want {
+			t.Fatalf("%s / %s: got %s, want %s", in[0], in[1], q, want)
+		}
+	}
+	if _, err := p("1").Quo(decimal.Decimal{}, 2); err != decimal.ErrDivisionByZero {
+		t.Fatalf("got %v, want division by zero", err)
+	}
+	if got := p("2.5").Round(0).String(); got != "2" {
+		t.Fatalf("unexpected rounding %s", got)
+	}
+	if got := p("12.3400").Reduce().String(); got != "12.34" {
+		t.Fatalf("unexpected reduction %s", got)
+	}
+	fitted, err := p("12.3").Fit(5, 2)
+	if err != nil || fitted.String() != "12.30" {
+		t.Fatalf("unexpected fit %v %v", fitted, err)
+	}
+	for _, in := range []string{"12.345", "1234.5"} {
+		if _, err := p(in).Fit(5, 2); !errors.Is(err, decimal.ErrPrecision) {
+			t.Fatalf("%s: got %v, want a precision error", in, err)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := []decimal.Decimal{
+		decimal.MustParse("0"), decimal.MustParse("0.5"), decimal.MustParse("0.50"),
+		decimal.MustParse("0.505"), decimal.MustParse("-0.5"), decimal.MustParse("-0.505"),
+		decimal.MustParse("1e40"), decimal.MustParse("-1e-40"), decimal.MustParse("99.99"),
+	}
+	for i := 0; i < 500; i++ {
+		values = append(values, decimal.New(r.Int63n(2000000)-1000000, int32(r.Intn(8))))
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return bytes.Compare(values[i].Key(), values[j].Key()) < 0
+	})
+	for i := 1; i < len(values); i++ {
+		c := bytes.Compare(values[i-1].Key(), values[i].Key())
+		if values[i-1].Cmp(values[i]) != c {
+			t.Fatalf("%s and %s: key order %d disagrees", values[i-1], values[i], c)
+		}
+	}
+	for _, v := range values {
+		key := append(v.Key(), 'x')
+		got, rest, err := decimal.DecodeKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(v) || string(rest) != "x" {
+			t.Fatalf("%s: decoded %s, rest %q", v, got, rest)
+		}
+	}
+	if _, _, err := decimal.DecodeKey([]byte{0x03, 0x80}); !errors.Is(err, decimal.ErrSyntax) {
+		t.Fatalf("got %v, want a syntax error", err)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	in := map[string]interface{}{"price": decimal.MustParse("19.90")}
+	gob.Register(decimal.Decimal{})
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := gob.NewDecoder(buf).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := out["price"].(decimal.Decimal); !ok || d.String() != "19.90" {
+		t.Fatalf("unexpected gob round trip %v", out)
+	}
+	rs, err := json.Marshal(in)
+	if err != nil || string(rs) != `{"price":"19.90"}` {
+		t.Fatalf("unexpected json %s %v", rs, err)
+	}
+	var v struct{ A, B decimal.Decimal }
+	if err := json.Unmarshal([]byte(`{"A":"1.10","B":2.5}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.A.String() != "1.10" || v.B.String() != "2.5" {
+		t.Fatalf("unexpected json decoding %v", v)
+	}
+}
@@ -0,0 +1,120 @@
+package decimal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Leading bytes of encoded keys, negative numbers sort first
+const (
+	keyNegative = byte(0x01)
+	keyZero     = byte(0x02)
+	keyPositive = byte(0x03)
+)
+
+// AppendKey appends the order preserving encoding of d to dst,
+// byte-wise comparison of encodings orders them like the numbers
+// and equal numbers of different scales are encoded alike
+//
+// A non zero number is written as 0.d1d2...dn * 10^e: a sign
+// byte, e as a big endian biased uint32, then the digits without
+// trailing zeros in pairs as bytes 1 to 100 and a zero byte, so
+// that a shorter fraction sorts first, every byte after the sign
+// is inverted for negative numbers
+func (d Decimal) AppendKey(dst []byte) []byte {
+	u := d.bigInt()
+	if u.Sign() == 0 {
+		return append(dst, keyZero)
+	}
+	digits := new(big.Int).Abs(u).String()
+	exp := int64(len(digits)) - int64(d.scale)
+	digits = strings.TrimRight(digits, "0")
+	start := len(dst) + 1
+	if u.Sign() < 0 {
+		dst = append(dst, keyNegative)
+	} else {
+		dst = append(dst, keyPositive)
+	}
+	var e [4]byte
+	binary.BigEndian.PutUint32(e[:], uint32(int32(exp))^(1<<31))
+	dst = append(dst, e[:]...)
+	for i := 0; i < len(digits); i += 2 {
+		pair := (digits[i] - '0') * 10
+		if i+1 < len(digits) {
+			pair += digits[i+1] - '0'
+		}
+		dst = append(dst, pair+1)
+	}
+	dst = append(dst, 0)
+	if u.Sign() < 0 {
+		for i := start; i < len(dst); i++ {
+			dst[i] = ^dst[i]
+		}
+	}
+	return dst
+}
+
+// Key returns the order preserving encoding of d
+func (d Decimal) Key() []byte {
+	return d.AppendKey(nil)
+}
+
+// DecodeKey decodes a decimal encoded by AppendKey at the start of
+// b and returns it with the rest of b, the scale of the result is
+// the smallest one holding the number
+func DecodeKey(b []byte) (Decimal, []byte, error) {
+	if len(b) == 0 {
+		return Decimal{}, nil, fmt.Errorf("%w: empty key", ErrSyntax)
+	}
+	switch b[0] {
+	case keyZero:
+		return Decimal{}, b[1:], nil
+	case keyNegative, keyPositive:
+	default:
+		return Decimal{}, nil, fmt.Errorf("%w: bad key sign %#x", ErrSyntax, b[0])
+	}
+	neg := b[0] == keyNegative
+	body := b[1:]
+	at := func(i int) byte {
+		if neg {
+			return ^body[i]
+		}
+		return body[i]
+	}
+	if len(body) < 5 {
+		return Decimal{}, nil, fmt.Errorf("%w: truncated key", ErrSyntax)
+	}
+	var e [4]byte
+	for i := range e {
+		e[i] = at(i)
+	}
+	exp := int64(int32(binary.BigEndian.Uint32(e[:]) ^ (1 << 31)))
+	var digits []byte
+	i := 4
+	for ; i < len(body); i++ {
+		c := at(i)
+		if c == 0 {
+			break
+		}
+		if c > 100 {
+			return Decimal{}, nil, fmt.Errorf("%w: bad key digits", ErrSyntax)
+		}
+		c--
+		digits = append(digits, '0'+c/10, '0'+c%10)
+	}
+	if i == len(body) || len(digits) == 0 {
+		return Decimal{}, nil, fmt.Errorf("%w: truncated key", ErrSyntax)
+	}
+	text := strings.TrimRight(string(digits), "0")
+	scale := int64(len(text)) - exp
+	if scale > MaxScale || scale < -MaxScale {
+		return Decimal{}, nil, fmt.Errorf("%w: key exponent %d", ErrRange, exp)
+	}
+	u, _ := new(big.Int).SetString(text, 10)
+	if neg {
+		u.Neg(u)
+	}
+	return NewFromBigInt(u, int32(scale)), body[i+1:], nil
+}
@@ -0,0 +1,268 @@
+package document
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+// FieldError is the failure of a single field of a written row
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return "field " + e.Field + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause of the failure
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError lists every field of a written row failing the
+// schema of the table ordered by name, errors.Is matches it with
+// the causes of the failures of each field
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i := range e.Fields {
+		parts[i] = e.Fields[i].Error()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Is reports whether the failure of a field matches target
+func (e *ValidationError) Is(target error) bool {
+	for i := range e.Fields {
+		if errors.Is(e.Fields[i].Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ValidationError) add(field string, err error) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Err: err})
+}
+
+func (e *ValidationError) has(field string) bool {
+	for i := range e.Fields {
+		if e.Fields[i].Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns e sorted by field, nil if no field failed
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	sort.Slice(e.Fields, func(i, j int) bool {
+		return e.Fields[i].Field < e.Fields[j].Field
+	})
+	return e
+}
+
+// constrain adds the fields of the normalized row failing their
+// constraint to verr, fields already failing are skipped
+func (d *Document) constrain(row Row, verr *ValidationError) {
+	m := d.schema()
+	for i := range m.Fields {
+		f := &m.Fields[i]
+		if f.Constraint.IsZero() || verr.has(f.Name) {
+			continue
+		}
+		err := checkConstraint(f, row[f.Name])
+		if err != nil {
+			verr.add(f.Name, err)
+		}
+	}
+}
+
+// checkConstraint checks a normalized value of the field f
+// against its constraint
+func checkConstraint(f *metaparser.Field, v interface{}) error {
+	c := &f.Constraint
+	if v == nil {
+		if c.Required {
+			return fmt.Errorf("%w: value is required", ErrConstraintViolation)
+		}
+		return nil
+	}
+	switch x := v.(type) {
+	case string:
+		err := checkLength(c, utf8.RuneCountInString(x), "length")
+		if err != nil {
+			return err
+		}
+		return checkMember(c, x)
+	case []string:
+		err := checkLength(c, len(x), "number of tags")
+		if err != nil {
+			return err
+		}
+		for _, tag := range x {
+			err = checkMember(c, tag)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, bound := range []struct {
+		text string
+		sign int
+		name string
+	}{{c.Min, -1, "minimum"}, {c.Max, 1, "maximum"}} {
+		if bound.text == "" {
+			continue
+		}
+		b, err := NormalizeValue(f.Type, bound.text)
+		if err != nil {
+			return fmt.Errorf("%w: bad %s %q", ErrConstraintViolation, bound.name, bound.text)
+		}
+		if compareBound(v, b) == bound.sign {
+			return fmt.Errorf("%w: %v exceeds the %s %s", ErrConstraintViolation, v, bound.name, bound.text)
+		}
+	}
+	return nil
+}
+
+// checkLength checks the length n of a string or a tag set
+func checkLength(c *metaparser.Constraint, n int, what string) error {
+	if min, err := strconv.Atoi(c.Min); err == nil && n < min {
+		return fmt.Errorf("%w: %s %d is below the minimum %d", ErrConstraintViolation, what, n, min)
+	}
+	if max, err := strconv.Atoi(c.Max); err == nil && n > max {
+		return fmt.Errorf("%w: %s %d is above the maximum %d", ErrConstraintViolation, what, n, max)
+	}
+	return nil
+}
+
+// checkMember checks a string or a tag against the members and
+// the pattern of c
+func checkMember(c *metaparser.Constraint, s string) error {
+	if len(c.Members) != 0 {
+		ok := false
+		for _, m := range c.Members {
+			if m == s {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: %q is not one of %s", ErrConstraintViolation, s, strings.Join(c.Members, ", "))
+		}
+	}
+	if c.Pattern != "" {
+		re, err := compilePattern(c.Pattern)
+		if err != nil || !re.MatchString(s) {
+			return fmt.Errorf("%w: %q does not match %s", ErrConstraintViolation, s, c.Pattern)
+		}
+	}
+	return nil
+}
+
+// patterns caches the compiled patterns of constraints
+var patterns sync.Map
+
+// compilePattern compiles the pattern of a constraint, which must
+// match whole strings
+func compilePattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(`^(?:` + expr + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(expr, re)
+	return re, nil
+}
+
+// compareBound orders two normalized values of the same field
+func compareBound(a, b interface{}) int {
+	switch x := a.(type) {
+	case int64:
+		y := b.(int64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case decimal.Decimal:
+		return x.Cmp(b.(decimal.Decimal))
+	case time.Time:
+		y := b.(time.Time)
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+	}
+	return 0
+}
+
+// CheckSchema checks what metaparser leaves to the document layer
+// in the fields of m: defaults and constraint bounds must be
+// values of their field, and defaults must satisfy the constraint
+func CheckSchema(m *metaparser.Metadata) error {
+	for i := range m.Fields {
+		f := &m.Fields[i]
+		switch f.Type {
+		case common.TypeInteger, common.TypeFloat, common.TypeDecimal, common.TypeTime:
+			var bounds [2]interface{}
+			for j, text := range []string{f.Constraint.Min, f.Constraint.Max} {
+				if text == "" {
+					continue
+				}
+				v, err := NormalizeValue(f.Type, text)
+				if err != nil {
+					return fmt.Errorf("%w: bound %q of %s: %v", metaparser.ErrMalformedMetadata, text, f.Name, err)
+				}
+				bounds[j] = v
+			}
+			if bounds[0] != nil && bounds[1] != nil && compareBound(bounds[0], bounds[1]) > 0 {
+				return fmt.Errorf("%w: empty range of %s", metaparser.ErrMalformedMetadata, f.Name)
+			}
+		}
+		if f.Default == "" {
+			continue
+		}
+		v, err := NormalizeValue(f.Type, f.Default)
+		if err == nil {
+			err = checkConstraint(f, v)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: default of %s: %v", metaparser.ErrMalformedMetadata, f.Name, err)
+		}
+	}
+	return nil
+}
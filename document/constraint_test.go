@@ -0,0 +1,108 @@
+package document_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestConstraints(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("agents", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "host", Type: common.TypeString, Constraint: metaparser.Constraint{Required: true, Min: "3", Max: "16", Pattern: `[a-z0-9-]+`}},
+			{Name: "kind", Type: common.TypeEnum, Default: "worker", Constraint: metaparser.Constraint{Members: []string{"worker", "scheduler"}}},
+			{Name: "port", Type: common.TypeInteger, Constraint: metaparser.Constraint{Min: "1", Max: "65535"}},
+			{Name: "price", Type: common.TypeDecimal, Constraint: metaparser.Constraint{Min: "0"}},
+			{Name: "seen", Type: common.TypeTime, Constraint: metaparser.Constraint{Min: "2020-01-01T00:00:00Z"}},
+			{Name: "labels", Type: common.TypeTag, Constraint: metaparser.Constraint{Max: "2", Pattern: `[a-z]+`}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Document("agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Metadata().Fields[1].Constraint.Members[1] != "scheduler" {
+		t.Fatalf("constraints not stored: %+v", d.Metadata().Fields)
+	}
+	insert(t, db, "agents", document.Row{"host": "node-1", "port": 22, "price": "1.5", "labels": []string{"gpu"}})
+	row, err := d.Get(document.FormatKey(int64(1)))
+	if err != nil || row["kind"] != "worker" {
+		t.Fatalf("default not applied: %v %v", row, err)
+	}
+
+	s := d.NewSession()
+	defer s.Close()
+	_, err = s.Insert(document.Row{
+		"kind":   "manager",
+		"port":   "http",
+		"price":  "-1",
+		"seen":   "2019-06-01T00:00:00Z",
+		"labels": []string{"a", "b", "c"},
+		"zone":   "eu",
+	})
+	var verr *document.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("not a validation error: %v", err)
+	}
+	var failing []string
+	for _, f := range verr.Fields {
+		failing = append(failing, f.Field)
+	}
+	if strings.Join(failing, ",") != "host,kind,labels,port,price,seen,zone" {
+		t.Fatalf("failing fields %v: %v", failing, err)
+	}
+	if !errors.Is(err, document.ErrConstraintViolation) || !errors.Is(err, document.ErrWrongFieldType) || !errors.Is(err, document.ErrUnknownField) {
+		t.Fatalf("causes not matched: %v", err)
+	}
+
+	for _, c := range []struct {
+		row  document.Row
+		fail string
+	}{
+		{document.Row{"host": "ab"}, "host"},
+		{document.Row{"host": "Node_1"}, "host"},
+		{document.Row{"host": "node-2", "port": 0}, "port"},
+		{document.Row{"host": "node-2", "labels": []string{"GPU"}}, "labels"},
+		{document.Row{"host": "node-2", "host2": 1}, "host2"},
+	} {
+		_, err = s.Insert(c.row)
+		if !errors.As(err, &verr) || len(verr.Fields) != 1 || verr.Fields[0].Field != c.fail {
+			t.Fatalf("%v: %v", c.row, err)
+		}
+	}
+	if err := s.Set(document.FormatKey(int64(1)), document.Row{"port": 80}); !errors.Is(err, document.ErrConstraintViolation) {
+		t.Fatalf("set without required host: %v", err)
+	}
+	if _, err := s.UpdateTags(document.FormatKey(int64(1)), "labels", []string{"eu", "ssd"}, nil); !errors.Is(err, document.ErrConstraintViolation) {
+		t.Fatalf("too many tags: %v", err)
+	}
+
+	for _, f := range []metaparser.Field{
+		{Name: "n", Type: common.TypeInteger, Constraint: metaparser.Constraint{Min: "ten"}},
+		{Name: "n", Type: common.TypeInteger, Constraint: metaparser.Constraint{Min: "10", Max: "1"}},
+		{Name: "n", Type: common.TypeInteger, Constraint: metaparser.Constraint{Pattern: "[0-9]"}},
+		{Name: "n", Type: common.TypeString, Constraint: metaparser.Constraint{Pattern: "("}},
+		{Name: "n", Type: common.TypeString, Constraint: metaparser.Constraint{Max: "-1"}},
+		{Name: "n", Type: common.TypeObject, Constraint: metaparser.Constraint{Min: "1"}},
+		{Name: "n", Type: common.TypeEnum, Default: "c", Constraint: metaparser.Constraint{Members: []string{"a", "b"}}},
+	} {
+		_, err := db.CreateTable("bad", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+			Fields:      []metaparser.Field{f},
+		})
+		if !errors.Is(err, metaparser.ErrMalformedMetadata) {
+			t.Fatalf("%+v: %v", f, err)
+		}
+	}
+}
@@ -1,2 +1,10 @@
 // Package document provides operations upon document data structures
 package document
+
+const (
+	keyInitialCharacter = byte('=')
+)
+
+var (
+	keyInitialCharacterBytes = []byte{keyInitialCharacter}
+)
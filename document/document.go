@@ -0,0 +1,764 @@
+package document
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/keyenc"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(decimal.Decimal{})
+	gob.Register(time.Time{})
+}
+
+// NewDocument initializes a new row document table
+func NewDocument(conf *common.DatabaseConfigure, bucket storage.Storage, meta *metaparser.Metadata) *Document {
+	changes := schemaCounter(bucket)
+	return &Document{
+		conf:    conf,
+		bucket:  bucket,
+		meta:    meta,
+		changes: changes,
+		loaded:  atomic.LoadUint64(changes),
+		// TODO: Determine sync option from user input configuration
+		sync: false,
+	}
+}
+
+func prepareKey(key string) []byte {
+	return append(keyInitialCharacterBytes, []byte(key)...)
+}
+
+func unprepareKey(prepared []byte) (string, bool) {
+	if len(prepared) == 0 || prepared[0] != keyInitialCharacter {
+		return "", false
+	}
+	return string(prepared[1:]), true
+}
+
+// EncodeRow encodes a row the way it is stored in a document table,
+// before the table codec compresses it
+func EncodeRow(row Row) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	m := map[string]interface{}(row)
+	err := gob.NewEncoder(buf).Encode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeRow decodes a row stored in a document table as it was
+// written, once decompressed, without upgrading it to the current
+// schema
+func DecodeRow(rs []byte) (Row, error) {
+	row, _, err := decodeStored(rs)
+	return row, err
+}
+
+type reader interface {
+	Get(key []byte) ([]byte, error)
+	NewIter(start []byte, stop []byte) storage.Iterator
+}
+
+// Document is the row document table, every row is kept
+// in a single key
+type Document struct {
+	conf   *common.DatabaseConfigure
+	bucket storage.Storage
+	// meta is the schema read after the loaded-th change counted
+	// by changes, it is replaced, never modified
+	metaLock sync.RWMutex
+	meta     *metaparser.Metadata
+	loaded   uint64
+	changes  *uint64
+	sync     bool
+	notifier common.Notifier
+	observer Observer
+	catalog  Catalog
+	codec    *compression.Codec
+}
+
+// RowChange is a change of a row, Old is nil for an inserted row
+// and New is nil for a deleted one
+type RowChange struct {
+	Key string
+	Old Row
+	New Row
+}
+
+// Observer receives the row changes of every committed session,
+// before the tables it wrote are released, its error is returned
+// by the commit, after the rows are stored
+type Observer func(changes []RowChange) error
+
+// SetNotifier sets the function receiving the events of every
+// committed session
+func (d *Document) SetNotifier(n common.Notifier) {
+	d.notifier = n
+}
+
+// SetObserver sets the function receiving the row changes of
+// every committed session
+func (d *Document) SetObserver(o Observer) {
+	d.observer = o
+}
+
+// SetCodec sets the codec compressing the stored rows
+func (d *Document) SetCodec(c *compression.Codec) {
+	d.codec = c
+}
+
+// Metadata returns the metadata of the table, it must not be
+// modified
+func (d *Document) Metadata() *metaparser.Metadata {
+	return d.schema()
+}
+
+// Get gets a row by its primary key
+func (d *Document) Get(pk string) (Row, error) {
+	return d.get(d.bucket, pk)
+}
+
+// Scan returns at most limit rows starting from the primary key
+// cursor, the returned cursor is empty when there is nothing left
+func (d *Document) Scan(cursor string, limit int) ([]Row, string, error) {
+	return d.scan(d.bucket, cursor, limit)
+}
+
+// Range calls fn on every row whose primary key lies in
+// [start, stop) in key order, an empty stop means no upper bound,
+// the iteration ends early when fn returns false
+func (d *Document) Range(start, stop string, fn func(pk string, row Row) (bool, error)) error {
+	end := []byte{keyInitialCharacter + 1}
+	if stop != "" {
+		end = prepareKey(stop)
+	}
+	iter := d.bucket.NewIter(prepareKey(start), end)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		k, ok := unprepareKey(iter.Key())
+		if !ok {
+			continue
+		}
+		row, err := d.decodeRow(iter.Value())
+		if err != nil {
+			return err
+		}
+		more, err := fn(k, row)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSession creates a new read-write session upon the table
+func (d *Document) NewSession() *Session {
+	return &Session{
+		parent: d,
+		batch:  d.bucket.NewBatch(storage.BatchReadWrite),
+	}
+}
+
+// NewBulkSession creates a session writing through batch, such as
+// a storage.Loader, its commit notifies neither the notifier nor
+// the observer
+func (d *Document) NewBulkSession(batch storage.Batch) *Session {
+	return &Session{
+		parent: d,
+		batch:  batch,
+		bulk:   true,
+	}
+}
+
+// NewViewSession creates a session that may write the rows of a
+// materialized view, which every other session gets
+// ErrReadOnlyView for
+func (d *Document) NewViewSession() *Session {
+	s := d.NewSession()
+	s.view = true
+	return s
+}
+
+func (d *Document) get(r reader, pk string) (Row, error) {
+	rs, err := r.Get(prepareKey(pk))
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeRow(rs)
+}
+
+func (d *Document) scan(r reader, cursor string, limit int) ([]Row, string, error) {
+	iter := r.NewIter(prepareKey(cursor), []byte{keyInitialCharacter + 1})
+	defer iter.Close()
+	var ret []Row
+	for iter.First(); iter.Valid(); iter.Next() {
+		k, ok := unprepareKey(iter.Key())
+		if !ok {
+			continue
+		}
+		if limit > 0 && len(ret) == limit {
+			return ret, k, nil
+		}
+		row, err := d.decodeRow(iter.Value())
+		if err != nil {
+			return nil, "", err
+		}
+		ret = append(ret, row)
+	}
+	return ret, "", nil
+}
+
+// Normalize checks row against the schema of the table and
+// converts every value into its canonical type, it returns a
+// *ValidationError listing every failing field
+func (d *Document) Normalize(row Row) (Row, error) {
+	ret, verr := d.normalize(row)
+	if err := verr.err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// normalize converts the values of row into their canonical type,
+// failing fields are left out of the returned row and added to
+// the returned error
+func (d *Document) normalize(row Row) (Row, *ValidationError) {
+	ret := make(Row, len(row))
+	verr := new(ValidationError)
+	for name, v := range row {
+		typ, ok := d.FieldType(name)
+		if !ok {
+			verr.add(name, ErrUnknownField)
+			continue
+		}
+		nv, err := NormalizeValue(typ, v)
+		if err != nil {
+			verr.add(name, err)
+			continue
+		}
+		if dec, ok := nv.(decimal.Decimal); ok {
+			if f, _ := d.schema().Field(name); f.Precision != 0 {
+				nv, err = dec.Fit(f.Precision, f.Scale)
+				if err != nil {
+					verr.add(name, fmt.Errorf("%w: %v", ErrWrongFieldType, err))
+					continue
+				}
+			}
+		}
+		ret[name] = nv
+	}
+	return ret, verr
+}
+
+// FieldType returns the type of the field named name, the primary
+// key is an integer for auto increment tables and a string otherwise
+// unless it is declared as a field
+func (d *Document) FieldType(name string) (byte, bool) {
+	m := d.schema()
+	if f, ok := m.Field(name); ok {
+		return f.Type, true
+	}
+	if m.PrimaryKey != nil && name == m.PrimaryKey.Name {
+		if m.PrimaryKey.Type == metaparser.MetaPrimaryKeyAutoIncrementID {
+			return common.TypeInteger, true
+		}
+		return common.TypeString, true
+	}
+	return 0, false
+}
+
+// PrimaryKeyOf returns the primary key string of row, the value is
+// normalized first so that a row not written yet gets the key it
+// would be stored under
+func (d *Document) PrimaryKeyOf(row Row) (string, error) {
+	pkdef := d.schema().PrimaryKey
+	if pkdef == nil {
+		return "", ErrMissingPrimaryKey
+	}
+	v, ok := row[pkdef.Name]
+	if !ok || v == nil {
+		return "", ErrMissingPrimaryKey
+	}
+	v, err := NormalizeValue(d.keyType(), v)
+	if err != nil {
+		return "", err
+	}
+	return FormatKey(v), nil
+}
+
+// keyType returns the type of the primary key
+func (d *Document) keyType() byte {
+	pkdef := d.schema().PrimaryKey
+	if pkdef == nil {
+		return common.TypeString
+	}
+	typ, _ := d.FieldType(pkdef.Name)
+	return typ
+}
+
+// keyValue converts the key string pk back into the value held
+// by the primary key field
+func (d *Document) keyValue(pk string) (interface{}, error) {
+	v, err := keyenc.DecodeKey([]byte(pk), d.keyType())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongFieldType, err)
+	}
+	return v, nil
+}
+
+// ParseKey converts the text of a primary key, as written in a
+// URL or on a command line, into its key string, string keys are
+// their own text
+func (d *Document) ParseKey(text string) (string, error) {
+	if d.schema().PrimaryKey == nil {
+		return "", ErrMissingPrimaryKey
+	}
+	typ := d.keyType()
+	if typ == common.TypeString {
+		return text, nil
+	}
+	v, err := NormalizeValue(typ, text)
+	if err != nil {
+		return "", err
+	}
+	return FormatKey(v), nil
+}
+
+// KeyText is the inverse of ParseKey, times are written in
+// RFC 3339 form in UTC
+func (d *Document) KeyText(pk string) string {
+	if d.keyType() == common.TypeString {
+		return pk
+	}
+	v, err := d.keyValue(pk)
+	if err != nil {
+		return pk
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// Session is a document session
+type Session struct {
+	parent *Document
+	batch  storage.Batch
+	events []common.Event
+	delta  *Statistics
+	// linked maps the names of the tables written along with
+	// this one by a delete cascade to their sessions
+	linked map[string]*Session
+	// changes lists the row changes passed to the observer
+	changes []RowChange
+	// writer holds the tables written by the session from its
+	// first write until it is committed or closed
+	writer *writer
+	view   bool
+	bulk   bool
+}
+
+// Get gets a row by its primary key
+func (s *Session) Get(pk string) (Row, error) {
+	return s.parent.get(s.batch, pk)
+}
+
+// Scan returns at most limit rows starting from the primary key
+// cursor, the returned cursor is empty when there is nothing left
+func (s *Session) Scan(cursor string, limit int) ([]Row, string, error) {
+	return s.parent.scan(s.batch, cursor, limit)
+}
+
+// Insert inserts a new row, the primary key is generated when
+// the table does not use custom primary keys and missing fields
+// with a default get it, it returns the primary key of the
+// inserted row, a row failing the schema is rejected with a
+// *ValidationError
+func (s *Session) Insert(row Row) (string, error) {
+	err := s.writable()
+	if err != nil {
+		return "", err
+	}
+	row, verr := s.parent.normalize(row)
+	err = s.parent.fillDefaults(row)
+	if err != nil {
+		return "", err
+	}
+	s.parent.constrain(row, verr)
+	err = s.link(row, verr)
+	if err != nil {
+		return "", err
+	}
+	if err := verr.err(); err != nil {
+		return "", err
+	}
+	pkdef := s.parent.schema().PrimaryKey
+	if pkdef == nil {
+		return "", ErrMissingPrimaryKey
+	}
+	if id, ok := row[pkdef.Name].(int64); ok && pkdef.Type == metaparser.MetaPrimaryKeyAutoIncrementID {
+		err = s.advanceID(id)
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, ok := row[pkdef.Name]; !ok || row[pkdef.Name] == nil {
+		switch pkdef.Type {
+		case metaparser.MetaPrimaryKeyAutoIncrementID:
+			id, err := s.nextID()
+			if err != nil {
+				return "", err
+			}
+			row[pkdef.Name] = id
+		case metaparser.MetaPrimaryKeyUUID:
+			id, err := newUUID()
+			if err != nil {
+				return "", err
+			}
+			row[pkdef.Name] = id
+		default:
+			return "", ErrMissingPrimaryKey
+		}
+	}
+	pk, err := s.parent.PrimaryKeyOf(row)
+	if err != nil {
+		return "", err
+	}
+	_, err = s.batch.Get(prepareKey(pk))
+	if err == nil {
+		return "", ErrDuplicateKey
+	}
+	if err != storage.ErrNoSuchKey {
+		return "", err
+	}
+	return pk, s.put(pk, row)
+}
+
+// Set replaces the row with primary key pk, the row is
+// created if it does not exist, a row failing the schema is
+// rejected with a *ValidationError
+func (s *Session) Set(pk string, row Row) error {
+	err := s.writable()
+	if err != nil {
+		return err
+	}
+	row, verr := s.parent.normalize(row)
+	pkdef := s.parent.schema().PrimaryKey
+	if pkdef == nil {
+		return ErrMissingPrimaryKey
+	}
+	if v, ok := row[pkdef.Name]; ok && v != nil {
+		if FormatKey(v) != pk {
+			return fmt.Errorf("%w: primary key mismatch", ErrWrongFieldType)
+		}
+	} else if !verr.has(pkdef.Name) {
+		v, err := s.parent.keyValue(pk)
+		if err != nil {
+			return err
+		}
+		row[pkdef.Name] = v
+	}
+	s.parent.constrain(row, verr)
+	err = s.link(row, verr)
+	if err != nil {
+		return err
+	}
+	if err := verr.err(); err != nil {
+		return err
+	}
+	return s.put(pk, row)
+}
+
+func (s *Session) put(pk string, row Row) error {
+	err := s.writable()
+	if err != nil {
+		return err
+	}
+	rs, err := s.parent.encodeRow(row)
+	if err != nil {
+		return err
+	}
+	old, err := s.old(pk)
+	if err != nil {
+		return err
+	}
+	err = s.unindex(pk, old)
+	if err != nil {
+		return err
+	}
+	err = s.index(pk, row)
+	if err != nil {
+		return err
+	}
+	err = s.batch.Set(prepareKey(pk), rs, &storage.SetOptions{
+		Synchronized: s.parent.sync,
+	})
+	if err != nil {
+		return err
+	}
+	s.track(old, row)
+	s.record(common.EventPut, pk, row)
+	s.observe(pk, old, row)
+	return nil
+}
+
+// writable rejects writes to a materialized view outside of the
+// sessions maintaining it and waits until the session holds the
+// table, bulk sessions are left to their own table
+func (s *Session) writable() error {
+	if s.parent.schema().View != nil && !s.view {
+		return ErrReadOnlyView
+	}
+	if s.bulk {
+		return nil
+	}
+	if s.writer == nil {
+		s.writer = new(writer)
+	}
+	err := s.writer.lock(s.parent.bucket)
+	if err != nil {
+		return err
+	}
+	// the schema cannot change while the table is held
+	_, err = s.parent.reload()
+	return err
+}
+
+// Lock holds the table until s is committed or closed, rows read
+// by s afterwards are not changed by another session before s
+// commits, which read-modify-write updates need
+func (s *Session) Lock() error {
+	return s.writable()
+}
+
+// unlock releases the tables held by the session
+func (s *Session) unlock() {
+	if s.writer != nil {
+		s.writer.unlock()
+	}
+}
+
+// old returns the stored row pk, nil if there is none
+func (s *Session) old(pk string) (Row, error) {
+	row, err := s.parent.get(s.batch, pk)
+	if err == storage.ErrNoSuchKey {
+		return nil, nil
+	}
+	return row, err
+}
+
+// Delete deletes the row with primary key pk and applies the
+// delete actions of the references to it, the rows of other
+// tables it changes are written by sessions committed along with
+// s, right before it, since each table is a separate store a
+// crash between the commits can leave a cascade half applied
+func (s *Session) Delete(pk string) error {
+	err := s.writable()
+	if err != nil {
+		return err
+	}
+	old, err := s.old(pk)
+	if err != nil {
+		return err
+	}
+	err = s.unindex(pk, old)
+	if err != nil {
+		return err
+	}
+	err = s.batch.Delete(prepareKey(pk))
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		s.track(old, nil)
+		s.observe(pk, old, nil)
+	}
+	s.record(common.EventDelete, pk, nil)
+	if old == nil {
+		return nil
+	}
+	return s.release(pk)
+}
+
+// Commit commits the session, together with the sessions of the
+// other tables written by its delete cascades. The other tables are
+// committed first in the order of their names and this one last, each
+// table in its own batch: a cascade across tables is not atomic, if a
+// commit fails the tables committed before it keep their changes and
+// the sessions left are closed.
+func (s *Session) Commit() error {
+	var committed []*Session
+	err := func() error {
+		defer s.unlock()
+		names := make([]string, 0, len(s.linked))
+		for name, ls := range s.linked {
+			if ls != s {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		pending := make([]*Session, 0, len(names)+1)
+		for _, name := range names {
+			pending = append(pending, s.linked[name])
+		}
+		pending = append(pending, s)
+		s.linked = nil
+		var err error
+		for i, ps := range pending {
+			err = ps.commit()
+			if err != nil {
+				for _, rest := range pending[i:] {
+					rest.batch.Close()
+				}
+				break
+			}
+			committed = append(committed, ps)
+		}
+		// the observer gets the changes while the tables are held,
+		// so that Exclusive never sees rows it has not observed yet
+		for _, cs := range committed {
+			oerr := cs.observeCommitted()
+			if err == nil {
+				err = oerr
+			}
+		}
+		return err
+	}()
+	// the events are published once the tables are released
+	for _, cs := range committed {
+		cs.notify()
+	}
+	return err
+}
+
+func (s *Session) commit() error {
+	drifted, err := s.applyDelta()
+	if err != nil {
+		return err
+	}
+	err = s.batch.Commit()
+	if err != nil || !drifted {
+		return err
+	}
+	// the table is still held, so no other commit moves the keys
+	// while they are sampled
+	return s.parent.resample()
+}
+
+// notify passes the committed events to the notifier
+func (s *Session) notify() {
+	if s.parent.notifier != nil && len(s.events) != 0 {
+		s.parent.notifier(s.events)
+	}
+	s.events = nil
+}
+
+// observeCommitted passes the committed row changes to the observer
+func (s *Session) observeCommitted() error {
+	changes := s.changes
+	s.changes = nil
+	if s.parent.observer != nil && len(changes) != 0 {
+		return s.parent.observer(changes)
+	}
+	return nil
+}
+
+func (s *Session) observe(pk string, old, row Row) {
+	if s.parent.observer == nil || s.bulk {
+		return
+	}
+	s.changes = append(s.changes, RowChange{Key: pk, Old: old, New: row})
+}
+
+func (s *Session) record(typ common.EventType, key string, value interface{}) {
+	if s.parent.notifier == nil || s.bulk {
+		return
+	}
+	s.events = append(s.events, common.Event{
+		Type:  typ,
+		Key:   s.parent.KeyText(key),
+		Value: value,
+	})
+}
+
+// Close discards the session, it must be called if the
+// session is not committed
+func (s *Session) Close() error {
+	defer s.unlock()
+	for _, ls := range s.linked {
+		if ls != s {
+			ls.batch.Close()
+		}
+	}
+	return s.batch.Close()
+}
+
+var autoIncrementKey = []byte{metaparser.MetaInitCharacter, metaparser.MetaTypeExtended, metaparser.MetaTypeExtendedAutoIncrement}
+
+func (s *Session) lastID() (int64, error) {
+	rs, err := s.batch.Get(autoIncrementKey)
+	if err == storage.ErrNoSuchKey {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(rs), 10, 64)
+	if err != nil {
+		return 0, metaparser.ErrMalformedMetadata
+	}
+	return id, nil
+}
+
+func (s *Session) setLastID(id int64) error {
+	return s.batch.Set(autoIncrementKey, []byte(strconv.FormatInt(id, 10)), &storage.SetOptions{
+		Synchronized: s.parent.sync,
+	})
+}
+
+func (s *Session) nextID() (int64, error) {
+	id, err := s.lastID()
+	if err != nil {
+		return 0, err
+	}
+	id++
+	return id, s.setLastID(id)
+}
+
+// advanceID moves the auto increment counter past id, written
+// explicitly, so that the ids given later do not collide with it
+func (s *Session) advanceID(id int64) error {
+	last, err := s.lastID()
+	if err != nil || id <= last {
+		return err
+	}
+	return s.setLastID(id)
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
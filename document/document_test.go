@@ -0,0 +1,303 @@
+package document_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newDatabase(t *testing.T) *kical.Database {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func insert(t *testing.T, db *kical.Database, table string, rows ...document.Row) {
+	d, err := db.Document(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.NewSession()
+	for _, row := range rows {
+		if _, err := s.Insert(row); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustDocument(t *testing.T, db *kical.Database, name string) *document.Document {
+	d, err := db.Document(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("users", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		Fields: []metaparser.Field{
+			{Name: "id", Type: common.TypeInteger},
+			{Name: "email", Type: common.TypeString},
+			{Name: "role", Type: common.TypeEnum},
+		},
+		PrimaryKey: &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Unique:     []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Document("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second session waits for the first one to commit before it
+	// reads the counter and the unique index
+	s1 := d.NewSession()
+	if _, err = s1.Insert(document.Row{"email": "first@example.com", "role": "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		d, err := db.Document("users")
+		if err != nil {
+			done <- err
+			return
+		}
+		s2 := d.NewSession()
+		_, err = s2.Insert(document.Row{"email": "first@example.com", "role": "user"})
+		if err != nil {
+			s2.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("the second session did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("expected ErrUniqueViolation, got %v", err)
+	}
+
+	const writers, rows = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*(rows+1))
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// every writer opens its own instance of the table
+			tbl, err := db.Table("users")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < rows; i++ {
+				s := tbl.Document.NewSession()
+				_, err := s.Insert(document.Row{"email": fmt.Sprintf("%d-%d@example.com", w, i), "role": "user"})
+				if err != nil {
+					s.Close()
+					errs <- err
+					return
+				}
+				if err = s.Commit(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			s := tbl.Document.NewSession()
+			_, err = s.Insert(document.Row{"email": "shared@example.com", "role": "admin"})
+			if err != nil {
+				s.Close()
+			} else {
+				err = s.Commit()
+			}
+			errs <- err
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	violations := 0
+	for err := range errs {
+		if errors.Is(err, document.ErrUniqueViolation) {
+			violations++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if violations != writers-1 {
+		t.Fatalf("got %d unique violations, want %d", violations, writers-1)
+	}
+	seen := make(map[int64]bool)
+	err = d.Range("", "", func(pk string, row document.Row) (bool, error) {
+		seen[row["id"].(int64)] = true
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != writers*rows+2 {
+		t.Fatalf("got %d rows, want %d", len(seen), writers*rows+2)
+	}
+	st, err := d.Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Rows != writers*rows+2 || st.EnumCount("role", "user") != writers*rows || st.EnumCount("role", "admin") != 2 {
+		t.Fatalf("bad statistics %+v", st)
+	}
+}
+
+func TestRewriteWaitsForSessions(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "os", Type: common.TypeString},
+		},
+		PrimaryKey: &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tbl.Document.NewSession()
+	pk, err := s.Insert(document.Row{"name": "web", "os": "linux"})
+	if err == nil {
+		err = s.Commit()
+	}
+	if err == nil {
+		err = tbl.AlterSchema(metaparser.Change{Op: metaparser.ChangeAddField, Field: "zone", Type: common.TypeString, Default: "eu"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := tbl.Document
+	s = d.NewSession()
+	if err = s.Set(pk, document.Row{"name": "web", "os": "bsd", "zone": "us"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, _, err := d.Rewrite("", 0)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("the rewrite did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	row, err := d.Get(pk)
+	if err != nil || row["os"] != "bsd" || row["zone"] != "us" {
+		t.Fatalf("got %v, %v", row, err)
+	}
+}
+
+func TestAlterWaitsForSessions(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "os", Type: common.TypeEnum},
+		},
+		PrimaryKey: &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the alter runs through another handle of the table
+	other, err := db.Table("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := tbl.Document
+	s := d.NewSession()
+	if _, err = s.Insert(document.Row{"name": "web", "os": "linux"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- other.AlterSchema(metaparser.Change{Op: metaparser.ChangeRenameField, Field: "os", Name: "system"})
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("the alter did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the first handle writes and reads under the new schema
+	if _, ok := tbl.GetMetadata().Field("system"); !ok {
+		t.Fatalf("stale metadata %+v", tbl.GetMetadata())
+	}
+	s = d.NewSession()
+	if _, err = s.Insert(document.Row{"name": "db", "system": "linux"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*document.Document{d, other.Document} {
+		pks, err := h.Posting("system", "linux")
+		if err != nil || !reflect.DeepEqual(pks, []string{"db", "web"}) {
+			t.Fatalf("got %v, %v", pks, err)
+		}
+		if row, err := h.Get("web"); err != nil || row["system"] != "linux" || row["os"] != nil {
+			t.Fatalf("got %v, %v", row, err)
+		}
+	}
+}
+
+func TestPlainValue(t *testing.T) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"n": 3, "f": 1.5, "list": [7, {"big": 1e300}], "s": "x"}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"n":    int64(3),
+		"f":    1.5,
+		"list": []interface{}{int64(7), map[string]interface{}{"big": 1e300}},
+		"s":    "x",
+	}
+	if got := document.PlainValue(v); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,45 @@
+package document
+
+import "fmt"
+
+// ErrUnknownField as is
+var ErrUnknownField = fmt.Errorf("Unknown field in document")
+
+// ErrWrongFieldType as is
+var ErrWrongFieldType = fmt.Errorf("Wrong value type for document field")
+
+// ErrMissingPrimaryKey as is
+var ErrMissingPrimaryKey = fmt.Errorf("Missing primary key in document")
+
+// ErrDuplicateKey as is
+var ErrDuplicateKey = fmt.Errorf("Duplicate primary key in document table")
+
+// ErrUniqueViolation as is
+var ErrUniqueViolation = fmt.Errorf("Unique index violation in document table")
+
+// ErrNoIndex as is
+var ErrNoIndex = fmt.Errorf("No such index in document table")
+
+// ErrInvalidTag as is
+var ErrInvalidTag = fmt.Errorf("Invalid tag in document")
+
+// ErrInvalidSchemaChange as is
+var ErrInvalidSchemaChange = fmt.Errorf("Invalid schema change of document table")
+
+// ErrMalformedObject as is
+var ErrMalformedObject = fmt.Errorf("Malformed object value in document")
+
+// ErrInvalidPath as is
+var ErrInvalidPath = fmt.Errorf("Invalid object path in document")
+
+// ErrConstraintViolation as is
+var ErrConstraintViolation = fmt.Errorf("Constraint violation in document")
+
+// ErrReferenceViolation as is
+var ErrReferenceViolation = fmt.Errorf("Reference violation in document table")
+
+// ErrReadOnlyView as is
+var ErrReadOnlyView = fmt.Errorf("Materialized view is read only")
+
+// ErrDeadlock as is
+var ErrDeadlock = fmt.Errorf("Deadlock between sessions writing document tables")
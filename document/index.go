@@ -0,0 +1,290 @@
+package document
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/keyenc"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Index key prefixes, a unique index maps a value to its primary
+// key and a posting list holds one key per row with the value of
+// an enum, a reference or an indexed field, the tag of a tag field
+// or the value at an indexed path into an object field, the value of a posting key is escaped
+// by keyenc so that a value holding a zero byte cannot run into
+// the primary key following it, the posting lists of a path are
+// named by the path
+const (
+	uniqueInitialCharacter  = byte('#')
+	postingInitialCharacter = byte('~')
+	indexSeparator          = byte(0)
+)
+
+func uniqueKey(field, value string) []byte {
+	ret := make([]byte, 0, len(field)+len(value)+2)
+	ret = append(ret, uniqueInitialCharacter)
+	ret = append(ret, field...)
+	ret = append(ret, indexSeparator)
+	return append(ret, value...)
+}
+
+func postingPrefix(field, value string) []byte {
+	ret := make([]byte, 0, len(field)+len(value)+4)
+	ret = append(ret, postingInitialCharacter)
+	ret = append(ret, field...)
+	ret = append(ret, indexSeparator)
+	return keyenc.AppendString(ret, value)
+}
+
+func postingKey(field, value, pk string) []byte {
+	return append(postingPrefix(field, value), pk...)
+}
+
+// pathIndexPrefix returns the prefix of every posting key of the
+// indexed path
+func pathIndexPrefix(path string) []byte {
+	return append(append([]byte{postingInitialCharacter}, path...), indexSeparator)
+}
+
+// prefixEnd returns the smallest key greater than every key
+// starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// IsEnum reports whether field is an enum field, enum fields
+// always hold a posting list
+func (d *Document) IsEnum(field string) bool {
+	f, ok := d.schema().Field(field)
+	return ok && f.Type == common.TypeEnum
+}
+
+// IsTag reports whether field is a tag field, tag fields hold a
+// posting list per tag
+func (d *Document) IsTag(field string) bool {
+	f, ok := d.schema().Field(field)
+	return ok && f.Type == common.TypeTag
+}
+
+// IsReference reports whether field references another table,
+// reference fields always hold a posting list so that the rows
+// referencing a row are found without a scan
+func (d *Document) IsReference(field string) bool {
+	_, ok := d.schema().Reference(field)
+	return ok
+}
+
+// HasPosting reports whether field, or the path into an object
+// field, holds posting lists
+func (d *Document) HasPosting(field string) bool {
+	m := d.schema()
+	return d.IsEnum(field) || d.IsTag(field) || d.IsReference(field) || m.IsIndexed(field) || m.IsPath(field)
+}
+
+// IsUnique reports whether field holds a unique index
+func (d *Document) IsUnique(field string) bool {
+	return d.schema().IsUnique(field)
+}
+
+// IndexValue converts v to the string form used in index keys of
+// field, it fails if v cannot be converted to the type of field,
+// the index value of a tag field is a single tag and the index
+// value of an indexed path a string, a number or a boolean
+func (d *Document) IndexValue(field string, v interface{}) (string, error) {
+	if d.schema().IsPath(field) {
+		nv, err := normalizeObject(v)
+		if err != nil {
+			return "", err
+		}
+		iv, ok := pathIndexValue(nv)
+		if !ok {
+			return "", fmt.Errorf("%w: %T for an indexed path", ErrWrongFieldType, v)
+		}
+		return iv, nil
+	}
+	f, ok := d.schema().Field(field)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownField, field)
+	}
+	if f.Type == common.TypeTag {
+		tag, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("%w: %T for a tag", ErrWrongFieldType, v)
+		}
+		return tag, CheckTag(tag)
+	}
+	nv, err := NormalizeValue(f.Type, v)
+	if err != nil {
+		return "", err
+	}
+	return FormatKey(nv), nil
+}
+
+// IndexText is the inverse of IndexValue, it writes the index
+// value iv of field like KeyText writes a primary key
+func (d *Document) IndexText(field, iv string) string {
+	f, ok := d.schema().Field(field)
+	if !ok {
+		return iv
+	}
+	switch f.Type {
+	case common.TypeString, common.TypeEnum, common.TypeTag, common.TypeObject:
+		return iv
+	}
+	v, err := keyenc.DecodeKey([]byte(iv), f.Type)
+	if err != nil {
+		return iv
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// LookupUnique returns the primary key of the row whose field
+// holds value, field must hold a unique index
+func (d *Document) LookupUnique(field string, value interface{}) (string, error) {
+	if !d.IsUnique(field) {
+		return "", fmt.Errorf("%w: %s has no unique index", ErrNoIndex, field)
+	}
+	v, err := d.IndexValue(field, value)
+	if err != nil {
+		return "", err
+	}
+	rs, err := d.bucket.Get(uniqueKey(field, v))
+	if err != nil {
+		return "", err
+	}
+	return string(rs), nil
+}
+
+// Posting returns the sorted primary keys of the rows whose enum,
+// reference or indexed field holds value, whose tag field holds the
+// tag value or whose indexed path holds value
+func (d *Document) Posting(field string, value interface{}) ([]string, error) {
+	if !d.HasPosting(field) {
+		return nil, fmt.Errorf("%w: %s is neither an enum, a tag, a reference, an indexed field nor an indexed path", ErrNoIndex, field)
+	}
+	v, err := d.IndexValue(field, value)
+	if err != nil {
+		return nil, err
+	}
+	prefix := postingPrefix(field, v)
+	iter := d.bucket.NewIter(prefix, prefixEnd(prefix))
+	defer iter.Close()
+	var ret []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		ret = append(ret, string(iter.Key()[len(prefix):]))
+	}
+	return ret, nil
+}
+
+// EnumValues returns every value of an enum field, or every tag
+// of a tag field, held by at least one row together with the
+// number of such rows
+func (d *Document) EnumValues(field string) (map[string]int64, error) {
+	if !d.IsEnum(field) && !d.IsTag(field) {
+		return nil, fmt.Errorf("%w: %s is neither an enum nor a tag", ErrNoIndex, field)
+	}
+	prefix := append(append([]byte{postingInitialCharacter}, field...), indexSeparator)
+	iter := d.bucket.NewIter(prefix, prefixEnd(prefix))
+	defer iter.Close()
+	ret := make(map[string]int64)
+	for iter.First(); iter.Valid(); iter.Next() {
+		v, _, err := keyenc.DecodeString(iter.Key()[len(prefix):])
+		if err != nil {
+			continue
+		}
+		ret[v]++
+	}
+	return ret, nil
+}
+
+// indexKeys lists the index keys of row, unique keys map to the
+// primary key while posting keys hold no value
+func (d *Document) indexKeys(pk string, row Row) (unique [][]byte, posting [][]byte) {
+	m := d.schema()
+	for _, f := range m.Fields {
+		v, ok := row[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+		if m.IsUnique(f.Name) {
+			unique = append(unique, uniqueKey(f.Name, FormatKey(v)))
+		}
+		for _, pv := range d.postingValues(f, v) {
+			posting = append(posting, postingKey(f.Name, pv, pk))
+		}
+	}
+	for _, path := range m.Paths {
+		if v, ok := row.Lookup(path); ok {
+			if pv, ok := pathIndexValue(v); ok {
+				posting = append(posting, postingKey(path, pv, pk))
+			}
+		}
+	}
+	return
+}
+
+// postingValues returns the values of a posting list a field
+// value is listed under, one per tag of a tag field
+func (d *Document) postingValues(f metaparser.Field, v interface{}) []string {
+	switch {
+	case f.Type == common.TypeEnum, d.IsReference(f.Name), d.schema().IsIndexed(f.Name):
+		return []string{FormatKey(v)}
+	case f.Type == common.TypeTag:
+		tags, _ := v.([]string)
+		return tags
+	}
+	return nil
+}
+
+// unindex removes the index keys of old, the stored row pk
+func (s *Session) unindex(pk string, old Row) error {
+	unique, posting := s.parent.indexKeys(pk, old)
+	for _, k := range append(unique, posting...) {
+		err := s.batch.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index adds the index keys of row, failing on unique violations
+func (s *Session) index(pk string, row Row) error {
+	unique, posting := s.parent.indexKeys(pk, row)
+	opts := &storage.SetOptions{Synchronized: s.parent.sync}
+	for _, k := range unique {
+		rs, err := s.batch.Get(k)
+		if err == nil && string(rs) != pk {
+			i := bytes.IndexByte(k, indexSeparator)
+			return fmt.Errorf("%w: %s", ErrUniqueViolation, k[1:i])
+		}
+		if err != nil && err != storage.ErrNoSuchKey {
+			return err
+		}
+		err = s.batch.Set(k, []byte(pk), opts)
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range posting {
+		err := s.batch.Set(k, nil, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package document
+
+import (
+	"sync"
+
+	"github.com/xtlsoft/kical/storage"
+)
+
+// tableLocks lets a single writer at a time write the rows of a
+// table, so that the auto increment counter, the unique index and
+// the statistics read by a session are not changed by another one
+// before it commits. The sessions of a delete cascade share their
+// writer, a writer waiting for a table held by a writer which is
+// itself waiting for one of its tables gets ErrDeadlock.
+var tableLocks = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	holders map[storage.Storage]*writer
+}{holders: make(map[storage.Storage]*writer)}
+
+func init() {
+	tableLocks.cond = sync.NewCond(&tableLocks)
+}
+
+// schemaChanges counts the schema changes of every table, so that
+// the documents opened on a table before a change read it again
+var schemaChanges = struct {
+	sync.Mutex
+	counters map[storage.Storage]*uint64
+}{counters: make(map[storage.Storage]*uint64)}
+
+// schemaCounter returns the counter of the schema changes of bucket
+func schemaCounter(bucket storage.Storage) *uint64 {
+	schemaChanges.Lock()
+	defer schemaChanges.Unlock()
+	c, ok := schemaChanges.counters[bucket]
+	if !ok {
+		c = new(uint64)
+		schemaChanges.counters[bucket] = c
+	}
+	return c
+}
+
+// writer holds the tables written by a session and the sessions
+// committed along with it
+type writer struct {
+	tables  []storage.Storage
+	waiting storage.Storage
+}
+
+// lock waits until w holds bucket
+func (w *writer) lock(bucket storage.Storage) error {
+	tableLocks.Lock()
+	defer tableLocks.Unlock()
+	for {
+		h, ok := tableLocks.holders[bucket]
+		if h == w {
+			return nil
+		}
+		if !ok {
+			tableLocks.holders[bucket] = w
+			w.tables = append(w.tables, bucket)
+			return nil
+		}
+		for h != nil {
+			if h == w {
+				return ErrDeadlock
+			}
+			if h.waiting == nil {
+				break
+			}
+			h = tableLocks.holders[h.waiting]
+		}
+		w.waiting = bucket
+		tableLocks.cond.Wait()
+		w.waiting = nil
+	}
+}
+
+// unlock releases the tables held by w
+func (w *writer) unlock() {
+	tableLocks.Lock()
+	defer tableLocks.Unlock()
+	for _, bucket := range w.tables {
+		delete(tableLocks.holders, bucket)
+	}
+	w.tables = nil
+	tableLocks.cond.Broadcast()
+}
+
+// Exclusive runs fn while no session writes the table, the changes
+// of the sessions committed before are passed to the observer
+func (d *Document) Exclusive(fn func() error) error {
+	w := new(writer)
+	err := w.lock(d.bucket)
+	if err != nil {
+		return err
+	}
+	defer w.unlock()
+	return fn()
+}
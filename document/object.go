@@ -0,0 +1,547 @@
+package document
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/keyenc"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// objectBytes is an object value in its stable encoding, object
+// fields are stored as objectBytes in the gob map of a row so that
+// equal objects are stored as equal bytes
+type objectBytes []byte
+
+func init() {
+	gob.RegisterName("kical.object", objectBytes(nil))
+}
+
+// Tags of the stable object encoding, every value starts with
+// its tag: integers and floats are followed by their keyenc
+// encoding, strings by their uvarint length and bytes, arrays by
+// their uvarint length and elements and objects by their uvarint
+// length and entries, each a string key followed by its value,
+// in key order
+const (
+	objectNull   = byte('n')
+	objectFalse  = byte('f')
+	objectTrue   = byte('t')
+	objectInt    = byte('i')
+	objectFloat  = byte('d')
+	objectString = byte('s')
+	objectArray  = byte('a')
+	objectMap    = byte('o')
+)
+
+// normalizeObject converts v into the canonical Go types of an
+// object value: map[string]interface{}, []interface{}, string,
+// int64, float64, bool and nil
+func normalizeObject(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, string, int64, float64, bool:
+		return x, nil
+	case int:
+		return int64(x), nil
+	case int32:
+		return int64(x), nil
+	case float32:
+		return float64(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %s", ErrWrongFieldType, x)
+		}
+		return f, nil
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			ne, err := normalizeObject(e)
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = ne
+		}
+		return ret, nil
+	case map[string]string:
+		ret := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			ret[k] = e
+		}
+		return ret, nil
+	case []interface{}:
+		ret := make([]interface{}, len(x))
+		for i, e := range x {
+			ne, err := normalizeObject(e)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = ne
+		}
+		return ret, nil
+	case []string:
+		ret := make([]interface{}, len(x))
+		for i, e := range x {
+			ret[i] = e
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("%w: %T in an object", ErrWrongFieldType, v)
+}
+
+// EncodeObject encodes an object value in its stable binary
+// encoding, objects are encoded with their keys sorted so that
+// equal values have equal encodings, v must be normalized
+func EncodeObject(v interface{}) ([]byte, error) {
+	return appendObject(nil, v)
+}
+
+func appendObject(b []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(b, objectNull), nil
+	case bool:
+		if x {
+			return append(b, objectTrue), nil
+		}
+		return append(b, objectFalse), nil
+	case int64:
+		return keyenc.AppendInt(append(b, objectInt), x), nil
+	case float64:
+		return keyenc.AppendFloat(append(b, objectFloat), x), nil
+	case string:
+		b = appendUvarint(append(b, objectString), uint64(len(x)))
+		return append(b, x...), nil
+	case []interface{}:
+		b = appendUvarint(append(b, objectArray), uint64(len(x)))
+		for _, e := range x {
+			var err error
+			b, err = appendObject(b, e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendUvarint(append(b, objectMap), uint64(len(x)))
+		for _, k := range keys {
+			b = appendUvarint(b, uint64(len(k)))
+			b = append(b, k...)
+			var err error
+			b, err = appendObject(b, x[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: %T in an object", ErrWrongFieldType, v)
+}
+
+// DecodeObject decodes the encoding written by EncodeObject
+func DecodeObject(b []byte) (interface{}, error) {
+	v, rest, err := decodeObject(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes", ErrMalformedObject)
+	}
+	return v, nil
+}
+
+func decodeObject(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: truncated value", ErrMalformedObject)
+	}
+	tag, b := b[0], b[1:]
+	switch tag {
+	case objectNull:
+		return nil, b, nil
+	case objectFalse:
+		return false, b, nil
+	case objectTrue:
+		return true, b, nil
+	case objectInt:
+		i, rest, err := keyenc.DecodeInt(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMalformedObject, err)
+		}
+		return i, rest, nil
+	case objectFloat:
+		f, rest, err := keyenc.DecodeFloat(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMalformedObject, err)
+		}
+		return f, rest, nil
+	case objectString:
+		return decodeObjectString(b)
+	case objectArray:
+		n, b, err := decodeObjectLength(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			var e interface{}
+			e, b, err = decodeObject(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			ret = append(ret, e)
+		}
+		return ret, b, nil
+	case objectMap:
+		n, b, err := decodeObjectLength(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			var k, e interface{}
+			k, b, err = decodeObjectString(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			e, b, err = decodeObject(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			ret[k.(string)] = e
+		}
+		return ret, b, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown tag %q", ErrMalformedObject, tag)
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+// decodeObjectLength decodes a length, which cannot exceed the
+// remaining bytes since every element takes at least one
+func decodeObjectLength(b []byte) (int, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return 0, nil, fmt.Errorf("%w: invalid length", ErrMalformedObject)
+	}
+	return int(n), b[size:], nil
+}
+
+func decodeObjectString(b []byte) (interface{}, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, fmt.Errorf("%w: invalid string length", ErrMalformedObject)
+	}
+	b = b[size:]
+	return string(b[:n]), b[n:], nil
+}
+
+// SplitPath splits a dotted path into its components, the first
+// one names the field
+func SplitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// Lookup returns the value at a dotted path such as
+// meta.labels.zone, components following the field name select
+// object keys or, when numeric, array elements
+func (r Row) Lookup(path string) (interface{}, bool) {
+	parts := SplitPath(path)
+	v, ok := r[parts[0]]
+	for _, p := range parts[1:] {
+		if !ok {
+			return nil, false
+		}
+		v, ok = child(v, p)
+	}
+	return v, ok
+}
+
+// child returns the key or the element p of an object value
+func child(v interface{}, p string) (interface{}, bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		e, ok := x[p]
+		return e, ok
+	case []interface{}:
+		i, err := strconv.Atoi(p)
+		if err != nil || i < 0 || i >= len(x) {
+			return nil, false
+		}
+		return x[i], true
+	}
+	return nil, false
+}
+
+// IsObject reports whether field is an object field
+func (d *Document) IsObject(field string) bool {
+	f, ok := d.schema().Field(field)
+	return ok && f.Type == common.TypeObject
+}
+
+// checkPath checks that path leads into an object field and
+// returns its components
+func (d *Document) checkPath(path string) ([]string, error) {
+	parts := SplitPath(path)
+	if !d.IsObject(parts[0]) {
+		if _, ok := d.schema().Field(parts[0]); ok {
+			return nil, fmt.Errorf("%w: %s is not an object field", ErrInvalidPath, parts[0])
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnknownField, parts[0])
+	}
+	for _, p := range parts[1:] {
+		if p == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPath, path)
+		}
+	}
+	return parts, nil
+}
+
+// setChild returns v with the value at path replaced by e,
+// missing objects along path are created, an array element can
+// be appended by using the length of the array as its index
+func setChild(v interface{}, path []string, e interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return e, nil
+	}
+	switch x := v.(type) {
+	case nil:
+		inner, err := setChild(nil, path[1:], e)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{path[0]: inner}, nil
+	case map[string]interface{}:
+		inner, err := setChild(x[path[0]], path[1:], e)
+		if err != nil {
+			return nil, err
+		}
+		x[path[0]] = inner
+		return x, nil
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > len(x) {
+			return nil, fmt.Errorf("%w: no element %s in an array of %d", ErrInvalidPath, path[0], len(x))
+		}
+		if i == len(x) {
+			x = append(x, nil)
+		}
+		x[i], err = setChild(x[i], path[1:], e)
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("%w: %s is inside a %T", ErrInvalidPath, path[0], v)
+}
+
+// deleteChild returns v without the value at path, removing an
+// array element shifts the following ones
+func deleteChild(v interface{}, path []string) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(x, path[0])
+		} else if e, ok := x[path[0]]; ok {
+			x[path[0]] = deleteChild(e, path[1:])
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(x) {
+			return v
+		}
+		if len(path) == 1 {
+			return append(x[:i], x[i+1:]...)
+		}
+		x[i] = deleteChild(x[i], path[1:])
+	}
+	return v
+}
+
+// UpdatePaths sets and removes values at paths into the object
+// fields of the row pk and returns the updated row, the row must
+// exist, values are set before the paths in unset are removed. The
+// row is read once the session holds the table.
+func (s *Session) UpdatePaths(pk string, set map[string]interface{}, unset []string) (Row, error) {
+	err := s.writable()
+	if err != nil {
+		return nil, err
+	}
+	row, err := s.Get(pk)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		parts, err := s.parent.checkPath(path)
+		if err != nil {
+			return nil, err
+		}
+		v, err := normalizeObject(set[path])
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %w", path, err)
+		}
+		nv, err := setChild(row[parts[0]], parts[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		row[parts[0]] = nv
+	}
+	for _, path := range unset {
+		parts, err := s.parent.checkPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 {
+			delete(row, parts[0])
+		} else if v, ok := row[parts[0]]; ok {
+			row[parts[0]] = deleteChild(v, parts[1:])
+		}
+	}
+	err = s.validate(row)
+	if err != nil {
+		return nil, err
+	}
+	return row, s.put(pk, row)
+}
+
+// UpdatePaths sets and removes values at paths into the object
+// fields of the row pk in a single commit, concurrent updates of
+// a row are applied one after another so none of them is lost
+func (d *Document) UpdatePaths(pk string, set map[string]interface{}, unset []string) (Row, error) {
+	s := d.NewSession()
+	row, err := s.UpdatePaths(pk, set, unset)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return row, s.Commit()
+}
+
+// SetPath sets the value at path in the row pk
+func (d *Document) SetPath(pk, path string, v interface{}) (Row, error) {
+	return d.UpdatePaths(pk, map[string]interface{}{path: v}, nil)
+}
+
+// DeletePath removes the value at path from the row pk
+func (d *Document) DeletePath(pk, path string) (Row, error) {
+	return d.UpdatePaths(pk, nil, []string{path})
+}
+
+// pathIndexValue returns the value a path index lists v under,
+// a type letter followed by its text, integral floats are listed
+// like the equal integer, ok is false for values which are not
+// indexed: null, arrays and objects
+func pathIndexValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return "s" + x, true
+	case bool:
+		return "b" + strconv.FormatBool(x), true
+	case int64:
+		return "n" + strconv.FormatInt(x, 10), true
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<63 {
+			return "n" + strconv.FormatInt(int64(x), 10), true
+		}
+		return "n" + strconv.FormatFloat(x, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// IndexPath adds a posting list over the scalar values at a path
+// into an object field, rows are listed under the string, number
+// or boolean found at the path and equality tests on the path can
+// be answered from the index
+func (d *Document) IndexPath(path string) error {
+	parts, err := d.checkPath(path)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 2 {
+		return fmt.Errorf("%w: %s is not a path into %s", ErrInvalidPath, path, parts[0])
+	}
+	w := new(writer)
+	err = w.lock(d.bucket)
+	if err != nil {
+		return err
+	}
+	defer w.unlock()
+	old, err := d.reload()
+	if err != nil || old.IsPath(path) {
+		return err
+	}
+	m := *old
+	m.Paths = append(append([]string(nil), old.Paths...), path)
+	batch := d.bucket.NewBatch(storage.BatchReadWrite)
+	err = metaparser.RewriteMetadata(batch, &m)
+	if err == nil {
+		err = d.rebuildIndexes(batch, &m, path)
+	}
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	err = d.commitSchema(batch, &m)
+	if err != nil {
+		return err
+	}
+	_, err = d.Analyze()
+	return err
+}
+
+// DropPathIndex removes the posting list of an indexed path
+func (d *Document) DropPathIndex(path string) error {
+	w := new(writer)
+	err := w.lock(d.bucket)
+	if err != nil {
+		return err
+	}
+	defer w.unlock()
+	old, err := d.reload()
+	if err != nil {
+		return err
+	}
+	if !old.IsPath(path) {
+		return fmt.Errorf("%w: %s", ErrNoIndex, path)
+	}
+	m := *old
+	m.Paths = removeString(append([]string(nil), old.Paths...), path)
+	batch := d.bucket.NewBatch(storage.BatchReadWrite)
+	err = metaparser.RewriteMetadata(batch, &m)
+	if err == nil {
+		err = deletePrefixes(batch, [][]byte{pathIndexPrefix(path)})
+	}
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	err = d.commitSchema(batch, &m)
+	if err != nil {
+		return err
+	}
+	_, err = d.Analyze()
+	return err
+}
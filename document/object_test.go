@@ -0,0 +1,251 @@
+package document_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func TestObjects(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		Fields: []metaparser.Field{
+			{Name: "meta", Type: common.TypeObject},
+			{Name: "port", Type: common.TypeInteger},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := []string{"eu", "us", "ap"}
+	var rows []document.Row
+	for i := 0; i < 30; i++ {
+		rows = append(rows, document.Row{
+			"name": fmt.Sprintf("h%02d", i),
+			"port": 22,
+			"meta": map[string]interface{}{
+				"labels": map[string]interface{}{"zone": zones[i%3]},
+				"cpu":    i % 8,
+				"disks":  []interface{}{"sda", "sdb"},
+				"spot":   i%2 == 0,
+			},
+		})
+	}
+	insert(t, db, "hosts", rows...)
+	d, err := db.Document("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := d.Get("h04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"meta.labels.zone": "us",
+		"meta.cpu":         int64(4),
+		"meta.disks.1":     "sdb",
+		"meta.spot":        true,
+	} {
+		if v, ok := row.Lookup(path); !ok || v != want {
+			t.Fatalf("%s: got %v, want %v", path, v, want)
+		}
+	}
+	if _, ok := row.Lookup("meta.disks.2"); ok {
+		t.Fatal("found a missing array element")
+	}
+
+	// objects are encoded the same whatever their construction
+	a, err := document.EncodeObject(row["meta"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := document.EncodeObject(map[string]interface{}{
+		"spot": true, "disks": []interface{}{"sda", "sdb"}, "cpu": int64(4),
+		"labels": map[string]interface{}{"zone": "us"},
+	})
+	if err != nil || string(a) != string(b) {
+		t.Fatalf("unstable encoding %q, %q, %v", a, b, err)
+	}
+	if v, err := document.DecodeObject(a); err != nil || !reflect.DeepEqual(v, row["meta"]) {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err := document.DecodeObject(a[:len(a)-1]); !errors.Is(err, document.ErrMalformedObject) {
+		t.Fatalf("got %v, want a malformed object", err)
+	}
+
+	hosts := func(keep func(i int) bool) []string {
+		ret := []string{}
+		for i := range rows {
+			if keep(i) {
+				ret = append(ret, fmt.Sprintf("h%02d", i))
+			}
+		}
+		return ret
+	}
+	// an indexed path lists rows under the scalar at the path
+	if err := d.IndexPath("meta.labels.zone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IndexPath("meta.cpu"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.HasPosting("meta.labels.zone") || d.HasPosting("meta.disks") {
+		t.Fatal("unexpected path indexes")
+	}
+	four, err := d.Posting("meta.cpu", 4.0)
+	if err != nil || !reflect.DeepEqual(four, hosts(func(i int) bool { return i%8 == 4 })) {
+		t.Fatalf("got %v, %v", four, err)
+	}
+	if _, err := d.EnumValues("meta.cpu"); !errors.Is(err, document.ErrNoIndex) {
+		t.Fatalf("got %v, want no index", err)
+	}
+	for path, target := range map[string]error{
+		"port.x":      document.ErrInvalidPath,
+		"meta":        document.ErrInvalidPath,
+		"meta..x":     document.ErrInvalidPath,
+		"owner.x":     document.ErrUnknownField,
+		"meta.labels": nil,
+	} {
+		if err := d.IndexPath(path); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", path, err, target)
+		}
+	}
+	if err := d.DropPathIndex("meta.labels"); err != nil {
+		t.Fatal(err)
+	}
+
+	// partial updates keep the path indexes up to date
+	row, err = d.SetPath("h00", "meta.labels.zone", "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := row.Lookup("meta.labels.zone"); v != "us" {
+		t.Fatalf("got %v", v)
+	}
+	row, err = d.UpdatePaths("h03", map[string]interface{}{
+		"meta.disks.2":     "sdc",
+		"meta.owner.team":  "infra",
+		"meta.labels.rack": json.Number("12"),
+	}, []string{"meta.labels.zone", "meta.disks.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"labels": map[string]interface{}{"rack": int64(12)},
+		"cpu":    int64(3),
+		"disks":  []interface{}{"sdb", "sdc"},
+		"spot":   false,
+		"owner":  map[string]interface{}{"team": "infra"},
+	}
+	if got, err := d.Get("h03"); err != nil || !reflect.DeepEqual(got["meta"], want) {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	eu, err := d.Posting("meta.labels.zone", "eu")
+	if err != nil || len(eu) != 8 || eu[0] != "h06" {
+		t.Fatalf("got %v, %v", eu, err)
+	}
+	for path, target := range map[string]error{
+		"meta.disks.5":     document.ErrInvalidPath,
+		"meta.spot.x":      document.ErrInvalidPath,
+		"port":             document.ErrInvalidPath,
+		"owner.team":       document.ErrUnknownField,
+		"meta.labels.zone": nil,
+	} {
+		if _, err := d.SetPath("h01", path, "x"); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", path, err, target)
+		}
+	}
+	if _, err := d.SetPath("missing", "meta.cpu", 1); err != storage.ErrNoSuchKey {
+		t.Fatalf("got %v, want no such key", err)
+	}
+	st, err := d.Statistics()
+	if err != nil || st.EnumCount("meta.labels.zone", "seu") != 8 || st.EnumCount("meta.labels.zone", "sx") != 1 {
+		t.Fatalf("unexpected statistics %+v, %v", st, err)
+	}
+
+	// path indexes follow their field through schema changes
+	tbl, err := db.Table("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.AlterSchema(metaparser.Change{Op: metaparser.ChangeRenameField, Field: "meta", Name: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	d = tbl.Document
+	if got := d.Metadata().Paths; !reflect.DeepEqual(got, []string{"info.labels.zone", "info.cpu"}) {
+		t.Fatalf("unexpected paths %v", got)
+	}
+	if pks, err := d.Posting("info.labels.zone", "eu"); err != nil || !reflect.DeepEqual(pks, eu) {
+		t.Fatalf("got %v, %v", pks, err)
+	}
+	if pks, err := d.Posting("info.cpu", 7); err != nil || !reflect.DeepEqual(pks, hosts(func(i int) bool { return i%8 == 7 })) {
+		t.Fatalf("got %v, %v", pks, err)
+	}
+	err = tbl.AlterSchema(
+		metaparser.Change{Op: metaparser.ChangeDropField, Field: "info"},
+		metaparser.Change{Op: metaparser.ChangeAddField, Field: "info", Type: common.TypeObject},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := db.Table("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := reopened.GetMetadata().Paths; len(paths) != 0 {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	if row, err := reopened.Document.Get("h05"); err != nil || row["info"] != nil {
+		t.Fatalf("got %v, %v", row, err)
+	}
+}
+
+func TestConcurrentPathUpdates(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "host"},
+		Fields:      []metaparser.Field{{Name: "meta", Type: common.TypeObject}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "hosts", document.Row{"host": "web", "meta": map[string]interface{}{"cpu": int64(4)}})
+	d := tbl.Document
+	s1 := d.NewSession()
+	if _, err = s1.UpdatePaths("web", map[string]interface{}{"meta.owner": "ops"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := d.SetPath("web", "meta.rack", "r1")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("the second update did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	row, err := d.Get("web")
+	want := map[string]interface{}{"cpu": int64(4), "owner": "ops", "rack": "r1"}
+	if err != nil || !reflect.DeepEqual(row["meta"], want) {
+		t.Fatalf("got %v, %v", row, err)
+	}
+}
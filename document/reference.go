@@ -0,0 +1,154 @@
+package document
+
+import (
+	"fmt"
+
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Catalog resolves the tables around a document table, writes use
+// it to keep the references between tables valid
+type Catalog interface {
+	// Document returns the row document table named name
+	Document(name string) (*Document, error)
+	// Referrers lists the references to the table named name
+	Referrers(name string) ([]Referrer, error)
+}
+
+// Referrer is a reference held by a field of a table
+type Referrer struct {
+	Table    string
+	Field    string
+	OnDelete string
+}
+
+// SetCatalog sets the catalog resolving referenced tables, the
+// references of a table without a catalog are not enforced
+func (d *Document) SetCatalog(c Catalog) {
+	d.catalog = c
+}
+
+// link adds the reference fields of row holding the key of a
+// missing row to verr
+func (s *Session) link(row Row, verr *ValidationError) error {
+	c := s.parent.catalog
+	if c == nil {
+		return nil
+	}
+	m := s.parent.schema()
+	for _, r := range m.References {
+		v := row[r.Field]
+		if v == nil || verr.has(r.Field) {
+			continue
+		}
+		pk := FormatKey(v)
+		var err error
+		if r.Table == m.TableName {
+			_, err = s.Get(pk)
+		} else if ls, ok := s.linked[r.Table]; ok {
+			_, err = ls.Get(pk)
+		} else {
+			var d *Document
+			d, err = c.Document(r.Table)
+			if err != nil {
+				return err
+			}
+			_, err = d.Get(pk)
+		}
+		if err == storage.ErrNoSuchKey {
+			verr.add(r.Field, fmt.Errorf("%w: no row %v in %s", ErrReferenceViolation, v, r.Table))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks the normalized row against the constraints and
+// the references of the fields
+func (s *Session) validate(row Row) error {
+	verr := new(ValidationError)
+	s.parent.constrain(row, verr)
+	err := s.link(row, verr)
+	if err != nil {
+		return err
+	}
+	return verr.err()
+}
+
+// release applies the delete actions of the references to the
+// deleted row pk: referencing rows are deleted, have their field
+// removed, or make the delete fail
+func (s *Session) release(pk string) error {
+	c := s.parent.catalog
+	if c == nil {
+		return nil
+	}
+	referrers, err := c.Referrers(s.parent.schema().TableName)
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		ls, err := s.linkedSession(r.Table)
+		if err != nil {
+			return err
+		}
+		for _, rpk := range ls.posting(r.Field, pk) {
+			switch r.OnDelete {
+			case metaparser.ReferenceCascade:
+				err = ls.Delete(rpk)
+			case metaparser.ReferenceSetNull:
+				var row Row
+				row, err = ls.Get(rpk)
+				if err == nil {
+					delete(row, r.Field)
+					err = ls.put(rpk, row)
+				}
+			default:
+				err = fmt.Errorf("%w: %s %s references %s %s", ErrReferenceViolation,
+					r.Table, ls.parent.KeyText(rpk), s.parent.schema().TableName, s.parent.KeyText(pk))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkedSession returns the session writing the table named name
+// along with s, sessions of a delete cascade share the map of
+// the sessions of every table they write
+func (s *Session) linkedSession(name string) (*Session, error) {
+	if s.linked == nil {
+		s.linked = map[string]*Session{s.parent.schema().TableName: s}
+	}
+	if ls, ok := s.linked[name]; ok {
+		return ls, nil
+	}
+	d, err := s.parent.catalog.Document(name)
+	if err != nil {
+		return nil, err
+	}
+	ls := d.NewSession()
+	ls.linked = s.linked
+	ls.writer = s.writer
+	s.linked[name] = ls
+	return ls, nil
+}
+
+// posting returns the primary keys of the rows whose field holds
+// the value with key string v as seen by the session
+func (s *Session) posting(field, v string) []string {
+	prefix := postingPrefix(field, v)
+	iter := s.batch.NewIter(prefix, prefixEnd(prefix))
+	defer iter.Close()
+	var ret []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		ret = append(ret, string(iter.Key()[len(prefix):]))
+	}
+	return ret
+}
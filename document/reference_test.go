@@ -0,0 +1,211 @@
+package document_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestReferences(t *testing.T) {
+	db := newDatabase(t)
+	tables := []struct {
+		name string
+		meta *metaparser.Metadata
+	}{
+		{"regions", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "code"},
+		}},
+		{"hosts", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+			Fields: []metaparser.Field{
+				{Name: "name", Type: common.TypeString},
+				{Name: "parent", Type: common.TypeString},
+			},
+			References: []metaparser.Reference{{Field: "parent", Table: "hosts", OnDelete: metaparser.ReferenceSetNull}},
+		}},
+		{"apps", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+			Fields: []metaparser.Field{
+				{Name: "host", Type: common.TypeString},
+				{Name: "region", Type: common.TypeString},
+			},
+			References: []metaparser.Reference{
+				{Field: "host", Table: "hosts", OnDelete: metaparser.ReferenceCascade},
+				{Field: "region", Table: "regions"},
+			},
+		}},
+		{"checks", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+			Fields:      []metaparser.Field{{Name: "app", Type: common.TypeInteger}},
+			References:  []metaparser.Reference{{Field: "app", Table: "apps", OnDelete: metaparser.ReferenceCascade}},
+		}},
+	}
+	for _, tbl := range tables {
+		if _, err := db.CreateTable(tbl.name, tbl.meta); err != nil {
+			t.Fatalf("%s: %v", tbl.name, err)
+		}
+	}
+	insert(t, db, "regions", document.Row{"code": "eu"}, document.Row{"code": "us"}, document.Row{"code": "ap"})
+	insert(t, db, "hosts", document.Row{"name": "h1"}, document.Row{"name": "h2", "parent": "h1"})
+	insert(t, db, "apps",
+		document.Row{"host": "h1", "region": "eu"},
+		document.Row{"host": "h1"},
+		document.Row{"host": "h2", "region": "us"},
+	)
+	insert(t, db, "checks", document.Row{"app": 1}, document.Row{"app": 1}, document.Row{"app": 3})
+
+	apps, err := db.Document("apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := apps.NewSession()
+	_, err = s.Insert(document.Row{"host": "h9", "region": "mars"})
+	var verr *document.ValidationError
+	if !errors.As(err, &verr) || len(verr.Fields) != 2 || !errors.Is(err, document.ErrReferenceViolation) {
+		t.Fatalf("dangling references: %v", err)
+	}
+	s.Close()
+	if pks, err := apps.Posting("host", "h1"); err != nil || len(pks) != 2 {
+		t.Fatalf("posting of h1: %v %v", pks, err)
+	}
+	if pks, err := apps.Posting("region", "us"); err != nil || len(pks) != 1 || apps.KeyText(pks[0]) != "3" {
+		t.Fatalf("posting of us: %v %v", pks, err)
+	}
+
+	regions, err := db.Document("regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = regions.NewSession()
+	if err := s.Delete("eu"); !errors.Is(err, document.ErrReferenceViolation) {
+		t.Fatalf("restricted delete: %v", err)
+	}
+	s.Close()
+
+	hosts, err := db.Document("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = hosts.NewSession()
+	if err := s.Delete("h1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	row, err := hosts.Get("h2")
+	if err != nil || row["parent"] != nil {
+		t.Fatalf("parent not cleared: %v %v", row, err)
+	}
+	for table, want := range map[string]int{"apps": 1, "checks": 1, "regions": 3} {
+		rows, _, err := mustDocument(t, db, table).Scan("", 0)
+		if err != nil || len(rows) != want {
+			t.Fatalf("%s: %v %v", table, rows, err)
+		}
+	}
+	s = regions.NewSession()
+	if err := s.Delete("eu"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for _, r := range []metaparser.Reference{
+		{Field: "ref", Table: "nowhere"},
+		{Field: "ref", Table: "apps"},
+		{Field: "ref", Table: "hosts", OnDelete: "explode"},
+	} {
+		_, err := db.CreateTable("bad", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+			Fields:      []metaparser.Field{{Name: "ref", Type: common.TypeString}},
+			References:  []metaparser.Reference{r},
+		})
+		if !errors.Is(err, metaparser.ErrMalformedMetadata) {
+			t.Fatalf("%+v: %v", r, err)
+		}
+	}
+}
+
+func TestCascadeCommit(t *testing.T) {
+	db := newDatabase(t)
+	for _, name := range []string{"hosts", "disks", "apps"} {
+		meta := &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+			Fields: []metaparser.Field{
+				{Name: "name", Type: common.TypeString},
+				{Name: "host", Type: common.TypeString},
+			},
+		}
+		if name != "hosts" {
+			meta.References = []metaparser.Reference{{Field: "host", Table: "hosts", OnDelete: metaparser.ReferenceCascade}}
+		}
+		if _, err := db.CreateTable(name, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []struct {
+		table string
+		row   document.Row
+	}{
+		{"hosts", document.Row{"name": "h1"}},
+		{"disks", document.Row{"name": "sda", "host": "h1"}},
+		{"apps", document.Row{"name": "web", "host": "h1"}},
+	} {
+		d, err := db.Document(r.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := d.NewSession()
+		if _, err = s.Insert(r.row); err == nil {
+			err = s.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts, err := db.Document("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := hosts.NewSession()
+	if err = s.Delete("h1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// every table of the cascade is released once it is committed
+	for _, name := range []string{"hosts", "disks", "apps"} {
+		d, err := db.Document(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows, _, err := d.Scan("", 0); err != nil || len(rows) != 0 {
+			t.Fatalf("%s: %v %v", name, rows, err)
+		}
+		s := d.NewSession()
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.Insert(document.Row{"name": "h2"})
+			done <- err
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s is still locked", name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,518 @@
+package document
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// rowVersionField holds the schema version a row was written
+// under, field names cannot hold a zero byte so it never
+// collides with a field, rows of version 0 do not store it
+const rowVersionField = "\x00v"
+
+// widenings lists the type changes of a retype, every value of
+// the old type converts into a value of the new one
+var widenings = map[[2]byte]bool{
+	{common.TypeInteger, common.TypeFloat}:   true,
+	{common.TypeInteger, common.TypeDecimal}: true,
+	{common.TypeString, common.TypeEnum}:     true,
+	{common.TypeEnum, common.TypeString}:     true,
+}
+
+// decodeStored decodes a stored row and the schema version it
+// was written under
+func decodeStored(rs []byte) (Row, int, error) {
+	var m map[string]interface{}
+	err := gob.NewDecoder(bytes.NewBuffer(rs)).Decode(&m)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, _ := m[rowVersionField].(int64)
+	delete(m, rowVersionField)
+	for k, v := range m {
+		if b, ok := v.(objectBytes); ok {
+			m[k], err = DecodeObject(b)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return Row(m), int(version), nil
+}
+
+// encodeRow encodes row tagged with the current schema version,
+// object fields are stored in their stable encoding
+func (d *Document) encodeRow(row Row) ([]byte, error) {
+	version := d.schema().Version()
+	stored := make(Row, len(row)+1)
+	for k, v := range row {
+		if v != nil && d.IsObject(k) {
+			b, err := EncodeObject(v)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", k, err)
+			}
+			v = objectBytes(b)
+		}
+		stored[k] = v
+	}
+	if version != 0 {
+		stored[rowVersionField] = int64(version)
+	}
+	rs, err := EncodeRow(stored)
+	if err != nil {
+		return nil, err
+	}
+	return d.codec.Compress(rs), nil
+}
+
+// decodeStored decompresses and decodes a stored row and the
+// schema version it was written under
+func (d *Document) decodeStored(rs []byte) (Row, int, error) {
+	rs, err := d.codec.Decompress(rs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeStored(rs)
+}
+
+// decodeRow decodes a stored row and upgrades it to the current
+// schema
+func (d *Document) decodeRow(rs []byte) (Row, error) {
+	row, version, err := d.decodeStored(rs)
+	if err != nil {
+		return nil, err
+	}
+	return d.upgrade(row, version), nil
+}
+
+// upgrade applies the schema changes made since version to row,
+// values an upgrade cannot convert are left as they are
+func (d *Document) upgrade(row Row, version int) Row {
+	changes := d.schema().Changes
+	if version >= len(changes) {
+		return row
+	}
+	for _, c := range changes[version:] {
+		switch c.Op {
+		case metaparser.ChangeAddField:
+			if _, ok := row[c.Field]; !ok && c.Default != "" {
+				if v, err := NormalizeValue(c.Type, c.Default); err == nil {
+					row[c.Field] = v
+				}
+			}
+		case metaparser.ChangeDropField:
+			delete(row, c.Field)
+		case metaparser.ChangeRenameField:
+			if v, ok := row[c.Field]; ok {
+				delete(row, c.Field)
+				row[c.Name] = v
+			}
+		case metaparser.ChangeRetypeField:
+			if v := row[c.Field]; v != nil {
+				if nv, err := NormalizeValue(c.Type, v); err == nil {
+					row[c.Field] = nv
+				}
+			}
+		}
+	}
+	return row
+}
+
+// fillDefaults sets the fields of row that are missing and have
+// a default to their default
+func (d *Document) fillDefaults(row Row) error {
+	for _, f := range d.schema().Fields {
+		if _, ok := row[f.Name]; ok || f.Default == "" {
+			continue
+		}
+		v, err := NormalizeValue(f.Type, f.Default)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		row[f.Name] = v
+	}
+	return nil
+}
+
+// evolve returns the metadata of the table after the change c,
+// it fails if c does not apply to the schema old
+func evolve(old *metaparser.Metadata, c metaparser.Change) (*metaparser.Metadata, error) {
+	m := *old
+	m.Fields = append([]metaparser.Field(nil), old.Fields...)
+	m.Unique = append([]string(nil), old.Unique...)
+	m.Indexes = append([]string(nil), old.Indexes...)
+	m.Changes = append(append([]metaparser.Change(nil), old.Changes...), c)
+	m.Paths = append([]string(nil), old.Paths...)
+	m.References = append([]metaparser.Reference(nil), old.References...)
+	if m.PrimaryKey != nil && (c.Field == m.PrimaryKey.Name || c.Name == m.PrimaryKey.Name) {
+		return nil, fmt.Errorf("%w: %s is the primary key", ErrInvalidSchemaChange, m.PrimaryKey.Name)
+	}
+	i := -1
+	for j, f := range m.Fields {
+		if f.Name == c.Field {
+			i = j
+		}
+	}
+	if c.Op != metaparser.ChangeAddField && i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownField, c.Field)
+	}
+	switch c.Op {
+	case metaparser.ChangeAddField:
+		if i >= 0 {
+			return nil, fmt.Errorf("%w: %s already exists", ErrInvalidSchemaChange, c.Field)
+		}
+		if _, ok := common.ParseTypeName(common.TypeName(c.Type)); !ok {
+			return nil, fmt.Errorf("%w: unknown type %c", ErrInvalidSchemaChange, c.Type)
+		}
+		if c.Type == common.TypeObject && c.Default != "" {
+			return nil, fmt.Errorf("%w: object field %s cannot have a default", ErrInvalidSchemaChange, c.Field)
+		}
+		if c.Default != "" {
+			if _, err := NormalizeValue(c.Type, c.Default); err != nil {
+				return nil, fmt.Errorf("%w: default of %s: %v", ErrInvalidSchemaChange, c.Field, err)
+			}
+		}
+		m.Fields = append(m.Fields, metaparser.Field{Name: c.Field, Type: c.Type, Default: c.Default})
+	case metaparser.ChangeDropField:
+		m.Fields = append(m.Fields[:i], m.Fields[i+1:]...)
+		m.Unique = removeString(m.Unique, c.Field)
+		m.Indexes = removeString(m.Indexes, c.Field)
+		for _, path := range fieldPaths(old, c.Field) {
+			m.Paths = removeString(m.Paths, path)
+		}
+		for j := len(m.References) - 1; j >= 0; j-- {
+			if m.References[j].Field == c.Field {
+				m.References = append(m.References[:j], m.References[j+1:]...)
+			}
+		}
+	case metaparser.ChangeRenameField:
+		if c.Name == "" {
+			return nil, fmt.Errorf("%w: missing new name of %s", ErrInvalidSchemaChange, c.Field)
+		}
+		if _, ok := m.Field(c.Name); ok {
+			return nil, fmt.Errorf("%w: %s already exists", ErrInvalidSchemaChange, c.Name)
+		}
+		m.Fields[i].Name = c.Name
+		for j, name := range m.Unique {
+			if name == c.Field {
+				m.Unique[j] = c.Name
+			}
+		}
+		for j, name := range m.Indexes {
+			if name == c.Field {
+				m.Indexes[j] = c.Name
+			}
+		}
+		for j, path := range m.Paths {
+			if strings.HasPrefix(path, c.Field+".") {
+				m.Paths[j] = c.Name + path[len(c.Field):]
+			}
+		}
+		for j := range m.References {
+			if m.References[j].Field == c.Field {
+				m.References[j].Field = c.Name
+			}
+		}
+	case metaparser.ChangeRetypeField:
+		if r, ok := m.Reference(c.Field); ok {
+			return nil, fmt.Errorf("%w: %s references %s", ErrInvalidSchemaChange, c.Field, r.Table)
+		}
+		from := m.Fields[i].Type
+		if !widenings[[2]byte{from, c.Type}] {
+			return nil, fmt.Errorf("%w: cannot change %s from %s to %s", ErrInvalidSchemaChange, c.Field, common.TypeName(from), common.TypeName(c.Type))
+		}
+		m.Fields[i].Type = c.Type
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidSchemaChange, c.Op)
+	}
+	return &m, nil
+}
+
+func removeString(list []string, s string) []string {
+	ret := list[:0]
+	for _, item := range list {
+		if item != s {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// fieldPaths returns the indexed paths into field under the
+// schema m
+func fieldPaths(m *metaparser.Metadata, field string) []string {
+	var ret []string
+	for _, path := range m.Paths {
+		if strings.HasPrefix(path, field+".") {
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
+
+// fieldIndexPrefixes returns the prefixes of the unique and the
+// posting keys of field
+func fieldIndexPrefixes(field string) [][]byte {
+	return [][]byte{
+		append(append([]byte{uniqueInitialCharacter}, field...), indexSeparator),
+		pathIndexPrefix(field),
+	}
+}
+
+// indexPrefixes returns the prefixes of the index keys of field
+// and of the indexed paths into it under the schema m
+func indexPrefixes(m *metaparser.Metadata, field string) [][]byte {
+	ret := fieldIndexPrefixes(field)
+	for _, path := range fieldPaths(m, field) {
+		ret = append(ret, pathIndexPrefix(path))
+	}
+	return ret
+}
+
+// schema returns the schema of the table, read again once it was
+// changed through another document
+func (d *Document) schema() *metaparser.Metadata {
+	m, _ := d.reload()
+	return m
+}
+
+// reload reads the schema again if it was changed through another
+// document since it was read, the schema read before is returned
+// along with the error of a failed read
+func (d *Document) reload() (*metaparser.Metadata, error) {
+	changes := atomic.LoadUint64(d.changes)
+	d.metaLock.RLock()
+	m, loaded := d.meta, d.loaded
+	d.metaLock.RUnlock()
+	if loaded == changes {
+		return m, nil
+	}
+	fresh, err := metaparser.NewParser(d.bucket).GetMetadata()
+	if err != nil {
+		return m, err
+	}
+	d.setSchema(fresh, changes)
+	return fresh, nil
+}
+
+// setSchema replaces the schema by m, read after the changes-th
+// change
+func (d *Document) setSchema(m *metaparser.Metadata, changes uint64) {
+	d.metaLock.Lock()
+	defer d.metaLock.Unlock()
+	if changes >= d.loaded {
+		d.meta, d.loaded = m, changes
+	}
+}
+
+// commitSchema commits batch, which rewrites the metadata into m,
+// and has every document of the table read m, the table must be
+// held
+func (d *Document) commitSchema(batch storage.Batch, m *metaparser.Metadata) error {
+	err := batch.Commit()
+	if err != nil {
+		return err
+	}
+	d.setSchema(m, atomic.AddUint64(d.changes, 1))
+	return nil
+}
+
+// Reload has every document of the table read its metadata again,
+// after it was rewritten without the document
+func (d *Document) Reload() error {
+	atomic.AddUint64(d.changes, 1)
+	_, err := d.reload()
+	return err
+}
+
+// Alter applies the schema change c: the schema gets a new
+// version, the indexes of the changed field are moved or rebuilt
+// and rows written under older versions are upgraded whenever
+// they are read, Rewrite stores them upgraded. The table is held
+// until the new schema is in place so that no session writes rows
+// or index keys under the old one meanwhile.
+func (d *Document) Alter(c metaparser.Change) error {
+	w := new(writer)
+	err := w.lock(d.bucket)
+	if err != nil {
+		return err
+	}
+	defer w.unlock()
+	old, err := d.reload()
+	if err != nil {
+		return err
+	}
+	if old.View != nil {
+		return ErrReadOnlyView
+	}
+	m, err := evolve(old, c)
+	if err != nil {
+		return err
+	}
+	batch := d.bucket.NewBatch(storage.BatchReadWrite)
+	err = metaparser.RewriteMetadata(batch, m)
+	if err == nil {
+		err = d.alterIndexes(batch, old, m, c)
+	}
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	err = d.commitSchema(batch, m)
+	if err != nil {
+		return err
+	}
+	_, err = d.Analyze()
+	return err
+}
+
+// alterIndexes updates the index keys of the field changed by c
+// from the schema old to m
+func (d *Document) alterIndexes(batch storage.Batch, old, m *metaparser.Metadata, c metaparser.Change) error {
+	opts := &storage.SetOptions{Synchronized: d.sync}
+	switch c.Op {
+	case metaparser.ChangeDropField:
+		return deletePrefixes(batch, indexPrefixes(old, c.Field))
+	case metaparser.ChangeRenameField:
+		from := indexPrefixes(old, c.Field)
+		to := indexPrefixes(m, c.Name)
+		var keys, values [][]byte
+		for i, prefix := range from {
+			iter := batch.NewIter(prefix, prefixEnd(prefix))
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, append(append([]byte(nil), to[i]...), iter.Key()[len(prefix):]...))
+				values = append(values, append([]byte(nil), iter.Value()...))
+			}
+			iter.Close()
+		}
+		err := deletePrefixes(batch, from)
+		for i := 0; err == nil && i < len(keys); i++ {
+			err = batch.Set(keys[i], values[i], opts)
+		}
+		return err
+	case metaparser.ChangeRetypeField:
+		if !d.indexed(old, c.Field) && !d.indexed(m, c.Field) {
+			return nil
+		}
+		err := deletePrefixes(batch, fieldIndexPrefixes(c.Field))
+		if err != nil {
+			return err
+		}
+	case metaparser.ChangeAddField:
+		if c.Default == "" || !d.indexed(m, c.Field) {
+			return nil
+		}
+	}
+	return d.rebuildIndexes(batch, m, c.Field)
+}
+
+// indexed reports whether field holds an index under the schema m
+func (d *Document) indexed(m *metaparser.Metadata, field string) bool {
+	f, ok := m.Field(field)
+	_, ref := m.Reference(field)
+	return ok && (m.IsUnique(field) || m.IsIndexed(field) || ref || f.Type == common.TypeEnum || f.Type == common.TypeTag)
+}
+
+// rebuildIndexes writes the index keys of field of every row as
+// read under the schema m
+func (d *Document) rebuildIndexes(batch storage.Batch, m *metaparser.Metadata, field string) error {
+	nd := &Document{conf: d.conf, bucket: d.bucket, meta: m, changes: d.changes, loaded: atomic.LoadUint64(d.changes), sync: d.sync, codec: d.codec}
+	prefixes := fieldIndexPrefixes(field)
+	opts := &storage.SetOptions{Synchronized: d.sync}
+	return nd.Range("", "", func(pk string, row Row) (bool, error) {
+		unique, posting := nd.indexKeys(pk, row)
+		for _, k := range unique {
+			if !bytes.HasPrefix(k, prefixes[0]) {
+				continue
+			}
+			if rs, err := batch.Get(k); err == nil && string(rs) != pk {
+				return false, fmt.Errorf("%w: %s", ErrUniqueViolation, field)
+			}
+			if err := batch.Set(k, []byte(pk), opts); err != nil {
+				return false, err
+			}
+		}
+		for _, k := range posting {
+			if !bytes.HasPrefix(k, prefixes[1]) {
+				continue
+			}
+			if err := batch.Set(k, nil, opts); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+func deletePrefixes(batch storage.Batch, prefixes [][]byte) error {
+	for _, prefix := range prefixes {
+		err := batch.DeleteRange(prefix, prefixEnd(prefix))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite stores at most limit rows written under an older schema
+// version, starting from the primary key cursor, upgraded to the
+// current version, it returns the number of rows rewritten and
+// the cursor of the next page, empty when there is nothing left,
+// the indexes already match the upgraded rows. The table is held
+// while the page is rewritten so that no row written meanwhile by
+// a session is overwritten.
+func (d *Document) Rewrite(cursor string, limit int) (int, string, error) {
+	w := new(writer)
+	err := w.lock(d.bucket)
+	if err != nil {
+		return 0, "", err
+	}
+	defer w.unlock()
+	version := d.schema().Version()
+	batch := d.bucket.NewBatch(storage.BatchReadWrite)
+	iter := batch.NewIter(prepareKey(cursor), []byte{keyInitialCharacter + 1})
+	var keys []string
+	var rows []Row
+	seen, next := 0, ""
+	for iter.First(); iter.Valid(); iter.Next() {
+		pk, ok := unprepareKey(iter.Key())
+		if !ok {
+			continue
+		}
+		if limit > 0 && seen == limit {
+			next = pk
+			break
+		}
+		seen++
+		row, v, err := d.decodeStored(iter.Value())
+		if err != nil {
+			iter.Close()
+			batch.Close()
+			return 0, "", err
+		}
+		if v < version {
+			keys = append(keys, pk)
+			rows = append(rows, d.upgrade(row, v))
+		}
+	}
+	iter.Close()
+	opts := &storage.SetOptions{Synchronized: d.sync}
+	for i, pk := range keys {
+		rs, err := d.encodeRow(rows[i])
+		if err == nil {
+			err = batch.Set(prepareKey(pk), rs, opts)
+		}
+		if err != nil {
+			batch.Close()
+			return 0, "", err
+		}
+	}
+	return len(keys), next, batch.Commit()
+}
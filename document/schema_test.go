@@ -0,0 +1,131 @@
+package document_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestSchemaEvolution(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("services", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "region", Type: common.TypeString},
+			{Name: "tier", Type: common.TypeEnum},
+			{Name: "port", Type: common.TypeInteger},
+		},
+		Unique: []string{"name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "services",
+		document.Row{"name": "svc00", "region": "eu", "tier": "gold"},
+		document.Row{"name": "svc01", "region": "us", "tier": "silver", "port": 8001},
+		document.Row{"name": "svc02", "region": "ap", "tier": "bronze", "port": 8002},
+		document.Row{"name": "svc03", "region": "eu", "tier": "gold", "port": 8003},
+		document.Row{"name": "svc04", "region": "ap", "tier": "silver", "port": 8004},
+		document.Row{"name": "svc05", "region": "eu", "tier": "bronze"},
+	)
+	err = tbl.AlterSchema(
+		metaparser.Change{Op: metaparser.ChangeAddField, Field: "owner", Type: common.TypeString, Default: "platform"},
+		metaparser.Change{Op: metaparser.ChangeRenameField, Field: "region", Name: "zone"},
+		metaparser.Change{Op: metaparser.ChangeRenameField, Field: "name", Name: "title"},
+		metaparser.Change{Op: metaparser.ChangeRetypeField, Field: "port", Type: common.TypeFloat},
+		metaparser.Change{Op: metaparser.ChangeRetypeField, Field: "zone", Type: common.TypeEnum},
+		metaparser.Change{Op: metaparser.ChangeDropField, Field: "tier"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "services", document.Row{"title": "svc06", "zone": "eu", "port": 9000})
+
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.Metadata().Version(); v != 6 {
+		t.Fatalf("got version %d, want 6", v)
+	}
+	row, err := d.Get(document.FormatKey(int64(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := document.Row{"id": int64(2), "title": "svc01", "zone": "us", "port": float64(8001), "owner": "platform"}
+	if !reflect.DeepEqual(row, want) {
+		t.Fatalf("got %v, want %v", row, want)
+	}
+	// the default of the added field fills the rows written before
+	rows, _, err := d.Scan("", 0)
+	if err != nil || len(rows) != 7 {
+		t.Fatalf("got %d rows, %v", len(rows), err)
+	}
+	for _, row := range rows {
+		if row["owner"] != "platform" {
+			t.Fatalf("unexpected row %v", row)
+		}
+	}
+	if pk, err := d.LookupUnique("title", "svc01"); err != nil || pk != document.FormatKey(int64(2)) {
+		t.Fatalf("got %q, %v", pk, err)
+	}
+
+	// the retyped field holds a posting list built from the rows
+	if pks, err := d.Posting("zone", "ap"); err != nil || len(pks) != 2 {
+		t.Fatalf("got %d postings, %v", len(pks), err)
+	}
+	if pks, err := d.Posting("zone", "eu"); err != nil || len(pks) != 4 || d.KeyText(pks[3]) != "7" {
+		t.Fatalf("got %v, %v", pks, err)
+	}
+	for _, field := range []string{"name", "tier"} {
+		if _, err := d.IndexValue(field, "gold"); !errors.Is(err, document.ErrUnknownField) {
+			t.Fatalf("%s: got %v, want an unknown field", field, err)
+		}
+	}
+	if _, err := d.EnumValues("tier"); !errors.Is(err, document.ErrNoIndex) {
+		t.Fatalf("got %v, want no index", err)
+	}
+
+	for _, c := range []metaparser.Change{
+		{Op: metaparser.ChangeRetypeField, Field: "zone", Type: common.TypeInteger},
+		{Op: metaparser.ChangeDropField, Field: "id"},
+		{Op: metaparser.ChangeRenameField, Field: "zone", Name: "title"},
+		{Op: metaparser.ChangeAddField, Field: "owner", Type: common.TypeString},
+		{Op: metaparser.ChangeAddField, Field: "weight", Type: common.TypeInteger, Default: "heavy"},
+	} {
+		if err := tbl.AlterSchema(c); !errors.Is(err, document.ErrInvalidSchemaChange) {
+			t.Fatalf("%v: got %v, want an invalid schema change", c, err)
+		}
+	}
+	if err := tbl.AlterSchema(metaparser.Change{Op: metaparser.ChangeDropField, Field: "tier"}); !errors.Is(err, document.ErrUnknownField) {
+		t.Fatalf("got %v, want an unknown field", err)
+	}
+
+	// a rewrite stores the rows written before the changes
+	// upgraded, the row inserted since is left alone
+	n, err := tbl.RewriteRows(context.Background())
+	if err != nil || n != 6 {
+		t.Fatalf("rewrote %d rows, %v", n, err)
+	}
+	if n, err = tbl.RewriteRows(context.Background()); err != nil || n != 0 {
+		t.Fatalf("rewrote %d rows, %v", n, err)
+	}
+	reopened, err := db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := reopened.GetMetadata().Field("owner"); !ok || f.Default != "platform" || reopened.GetMetadata().Version() != 6 {
+		t.Fatalf("unexpected metadata %+v", reopened.GetMetadata())
+	}
+	row, err = reopened.Document.Get(document.FormatKey(int64(2)))
+	if err != nil || !reflect.DeepEqual(row, want) {
+		t.Fatalf("got %v, %v", row, err)
+	}
+}
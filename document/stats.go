@@ -0,0 +1,295 @@
+package document
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// HistogramBuckets is the number of buckets of the primary key
+// histogram
+const HistogramBuckets = 16
+
+var statisticsKey = []byte{metaparser.MetaInitCharacter, metaparser.MetaTypeExtended, metaparser.MetaTypeExtendedStatistics}
+
+// Statistics are the lightweight statistics of a document table
+// used for query planning, row and enum counts are maintained on
+// every commit while the histogram is rebuilt by Analyze and by the
+// commits that leave the row count at least double or less than
+// half of the one it was built from
+type Statistics struct {
+	Rows int64 `json:"rows"`
+	// Enums counts the rows holding each value of every enum field,
+	// each tag of every tag field and each value of every indexed
+	// path
+	Enums map[string]map[string]int64 `json:"enums,omitempty"`
+	// Bounds holds the first primary key of each bucket of an
+	// equi-depth histogram over the primary keys
+	Bounds []string `json:"bounds,omitempty"`
+	// Sampled is the number of rows the histogram was built from
+	Sampled int64 `json:"sampled,omitempty"`
+	// Analyzed is the unix time of the last Analyze
+	Analyzed int64 `json:"analyzed,omitempty"`
+}
+
+// RangeFraction estimates the fraction of rows whose primary key
+// lies in [start, stop), an empty stop means no upper bound, each
+// bound is guessed to halve the rows without a histogram
+func (st *Statistics) RangeFraction(start, stop string) float64 {
+	n := len(st.Bounds)
+	if n == 0 {
+		ret := 1.0
+		if start != "" {
+			ret /= 2
+		}
+		if stop != "" {
+			ret /= 2
+		}
+		return ret
+	}
+	hit := 0
+	for i, lo := range st.Bounds {
+		if stop != "" && lo >= stop {
+			break
+		}
+		if i+1 < n && st.Bounds[i+1] <= start {
+			continue
+		}
+		hit++
+	}
+	return float64(hit) / float64(n)
+}
+
+// EnumCount returns the number of rows whose enum or tag field,
+// or indexed path, holds the index value v
+func (st *Statistics) EnumCount(field, v string) int64 {
+	return st.Enums[field][v]
+}
+
+// storedStatistics is the JSON form of Statistics, the bounds are
+// base64 encoded since time and decimal primary keys are binary,
+// bounds written as strings by earlier versions are still read
+type storedStatistics struct {
+	*statisticsFields
+	Bounds    []string `json:"bounds,omitempty"`
+	KeyBounds [][]byte `json:"key_bounds,omitempty"`
+}
+
+type statisticsFields Statistics
+
+// MarshalJSON implements json.Marshaler
+func (st *Statistics) MarshalJSON() ([]byte, error) {
+	out := storedStatistics{statisticsFields: (*statisticsFields)(st)}
+	for _, b := range st.Bounds {
+		out.KeyBounds = append(out.KeyBounds, []byte(b))
+	}
+	return json.Marshal(&out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (st *Statistics) UnmarshalJSON(data []byte) error {
+	in := storedStatistics{statisticsFields: (*statisticsFields)(st)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	st.Bounds = in.Bounds
+	if in.KeyBounds != nil {
+		st.Bounds = make([]string, len(in.KeyBounds))
+		for i, b := range in.KeyBounds {
+			st.Bounds[i] = string(b)
+		}
+	}
+	return nil
+}
+
+func decodeStatistics(rs []byte) (*Statistics, error) {
+	st := new(Statistics)
+	err := json.Unmarshal(rs, st)
+	if err != nil {
+		return nil, metaparser.ErrMalformedMetadata
+	}
+	return st, nil
+}
+
+// Statistics returns the statistics of the table, it returns
+// storage.ErrNoSuchKey if the table has never been analyzed
+func (d *Document) Statistics() (*Statistics, error) {
+	rs, err := d.bucket.Get(statisticsKey)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStatistics(rs)
+}
+
+// Analyze scans the whole table and rewrites its statistics
+func (d *Document) Analyze() (*Statistics, error) {
+	st := &Statistics{Enums: make(map[string]map[string]int64)}
+	var keys []string
+	err := d.Range("", "", func(pk string, row Row) (bool, error) {
+		st.Rows++
+		keys = append(keys, pk)
+		st.count(d, row, 1)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.Bounds = histogram(keys)
+	st.Sampled = st.Rows
+	st.Analyzed = time.Now().Unix()
+	return st, d.storeStatistics(st)
+}
+
+// resample rebuilds the histogram of the stored statistics from the
+// primary keys of the table
+func (d *Document) resample() error {
+	st, err := d.Statistics()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	iter := d.bucket.NewIter(prepareKey(""), []byte{keyInitialCharacter + 1})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if k, ok := unprepareKey(iter.Key()); ok {
+			keys = append(keys, k)
+		}
+	}
+	st.Bounds = histogram(keys)
+	st.Sampled = int64(len(keys))
+	return d.storeStatistics(st)
+}
+
+func (d *Document) storeStatistics(st *Statistics) error {
+	rs, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	batch := d.bucket.NewBatch(storage.BatchWriteOnly)
+	err = batch.Set(statisticsKey, rs, &storage.SetOptions{Synchronized: d.sync})
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
+
+// histogram returns the first key of each bucket of an equi-depth
+// histogram over the sorted keys
+func histogram(keys []string) []string {
+	buckets := HistogramBuckets
+	if len(keys) < buckets {
+		buckets = len(keys)
+	}
+	var bounds []string
+	for i := 0; i < buckets; i++ {
+		bounds = append(bounds, keys[i*len(keys)/buckets])
+	}
+	return bounds
+}
+
+// drifted reports whether the row count is at least double or less
+// than half of the one the histogram was built from, rebuilding it
+// then keeps the scans amortized to a constant per written row
+func (st *Statistics) drifted() bool {
+	if st.Rows == 0 {
+		return len(st.Bounds) != 0
+	}
+	return st.Rows >= 2*st.Sampled || 2*st.Rows < st.Sampled
+}
+
+// count adds n to the enum, tag, reference and path counters of
+// the values of row
+func (st *Statistics) count(d *Document, row Row, n int64) {
+	m := d.schema()
+	for _, f := range m.Fields {
+		if row[f.Name] == nil {
+			continue
+		}
+		st.add(f.Name, d.postingValues(f, row[f.Name]), n)
+	}
+	for _, path := range m.Paths {
+		if v, ok := row.Lookup(path); ok {
+			if pv, ok := pathIndexValue(v); ok {
+				st.add(path, []string{pv}, n)
+			}
+		}
+	}
+}
+
+func (st *Statistics) add(field string, pvs []string, n int64) {
+	if len(pvs) == 0 {
+		return
+	}
+	values, ok := st.Enums[field]
+	if !ok {
+		values = make(map[string]int64)
+		st.Enums[field] = values
+	}
+	for _, v := range pvs {
+		values[v] += n
+	}
+}
+
+// track records the change of a row from old to row in the
+// statistics delta of the session, nil means no row
+func (s *Session) track(old, row Row) {
+	if s.delta == nil {
+		s.delta = &Statistics{Enums: make(map[string]map[string]int64)}
+	}
+	if old != nil {
+		s.delta.Rows--
+		s.delta.count(s.parent, old, -1)
+	}
+	if row != nil {
+		s.delta.Rows++
+		s.delta.count(s.parent, row, 1)
+	}
+}
+
+// applyDelta merges the statistics delta into the stored
+// statistics, tables that have never been analyzed are skipped, it
+// reports whether the histogram is due to be rebuilt
+func (s *Session) applyDelta() (bool, error) {
+	if s.delta == nil {
+		return false, nil
+	}
+	delta := s.delta
+	s.delta = nil
+	rs, err := s.batch.Get(statisticsKey)
+	if err == storage.ErrNoSuchKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	st, err := decodeStatistics(rs)
+	if err != nil {
+		return false, err
+	}
+	st.Rows += delta.Rows
+	if st.Rows < 0 {
+		st.Rows = 0
+	}
+	if st.Enums == nil {
+		st.Enums = make(map[string]map[string]int64)
+	}
+	for f, values := range delta.Enums {
+		for v, n := range values {
+			if st.Enums[f] == nil {
+				st.Enums[f] = make(map[string]int64)
+			}
+			st.Enums[f][v] += n
+			if st.Enums[f][v] <= 0 {
+				delete(st.Enums[f], v)
+			}
+		}
+	}
+	rs, err = json.Marshal(st)
+	if err != nil {
+		return false, err
+	}
+	return st.drifted(), s.batch.Set(statisticsKey, rs, &storage.SetOptions{Synchronized: s.parent.sync})
+}
@@ -0,0 +1,78 @@
+package document
+
+import "fmt"
+
+// UpdateTags adds and removes tags of the tag field of the row
+// pk and returns the updated row, the row must exist. The row is
+// read once the session holds the table, so that no other session
+// changes it before s commits.
+func (s *Session) UpdateTags(pk, field string, add, remove []string) (Row, error) {
+	if !s.parent.IsTag(field) {
+		return nil, fmt.Errorf("%w: %s is not a tag field", ErrWrongFieldType, field)
+	}
+	for _, tag := range add {
+		if err := CheckTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	err := s.writable()
+	if err != nil {
+		return nil, err
+	}
+	row, err := s.Get(pk)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	current, _ := row[field].([]string)
+	for _, tag := range current {
+		set[tag] = true
+	}
+	for _, tag := range add {
+		set[tag] = true
+	}
+	for _, tag := range remove {
+		delete(set, tag)
+	}
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	updated := make(Row, len(row))
+	for k, v := range row {
+		updated[k] = v
+	}
+	if len(tags) == 0 {
+		delete(updated, field)
+	} else {
+		updated[field] = tagSet(tags)
+	}
+	err = s.validate(updated)
+	if err != nil {
+		return nil, err
+	}
+	return updated, s.put(pk, updated)
+}
+
+// UpdateTags adds and removes tags of the tag field of the row
+// pk in a single commit, concurrent tag updates of a row are
+// applied one after another so none of them is lost
+func (d *Document) UpdateTags(pk, field string, add, remove []string) (Row, error) {
+	s := d.NewSession()
+	row, err := s.UpdateTags(pk, field, add, remove)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return row, s.Commit()
+}
+
+// AddTags adds tags to the tag field of the row pk
+func (d *Document) AddTags(pk, field string, tags ...string) (Row, error) {
+	return d.UpdateTags(pk, field, tags, nil)
+}
+
+// RemoveTags removes tags from the tag field of the row pk
+func (d *Document) RemoveTags(pk, field string, tags ...string) (Row, error) {
+	return d.UpdateTags(pk, field, nil, tags)
+}
@@ -0,0 +1,156 @@
+package document_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func TestTags(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "host"},
+		Fields: []metaparser.Field{
+			{Name: "tags", Type: common.TypeTag},
+			{Name: "tier", Type: common.TypeEnum},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "hosts",
+		document.Row{"host": "h1", "tier": "gold", "tags": []interface{}{"edge", "canary", "gpu-free", "canary"}},
+		document.Row{"host": "h2", "tier": "silver", "tags": []string{"arm", "edge"}},
+		document.Row{"host": "h3", "tier": "silver"},
+	)
+	d, err := db.Document("hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tags are stored sorted and without duplicates
+	row, err := d.Get("h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(row["tags"], []string{"canary", "edge", "gpu-free"}) {
+		t.Fatalf("unexpected tags %v", row["tags"])
+	}
+	for tag, want := range map[string][]string{"edge": {"h1", "h2"}, "arm": {"h2"}, "blue": nil} {
+		if pks, err := d.Posting("tags", tag); err != nil || !reflect.DeepEqual(pks, want) {
+			t.Fatalf("%s: got %v, %v", tag, pks, err)
+		}
+	}
+	if counts, err := d.EnumValues("tags"); err != nil || counts["edge"] != 2 || counts["canary"] != 1 {
+		t.Fatalf("got %v, %v", counts, err)
+	}
+	s := d.NewSession()
+	for _, tags := range []interface{}{[]string{""}, []string{"a\x00b"}, []interface{}{1}, 42} {
+		if _, err := s.Insert(document.Row{"host": "h4", "tags": tags}); !errors.Is(err, document.ErrInvalidTag) && !errors.Is(err, document.ErrWrongFieldType) {
+			t.Fatalf("%v: got %v", tags, err)
+		}
+	}
+	s.Close()
+
+	row, err = d.UpdateTags("h2", "tags", []string{"canary", "blue"}, []string{"edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(row["tags"], []string{"arm", "blue", "canary"}) {
+		t.Fatalf("unexpected tags %v", row["tags"])
+	}
+	if _, err = d.RemoveTags("h2", "tags", "blue", "canary"); err != nil {
+		t.Fatal(err)
+	}
+	if pks, err := d.Posting("tags", "blue"); err != nil || len(pks) != 0 {
+		t.Fatalf("stale posting list %v, %v", pks, err)
+	}
+	if pks, err := d.Posting("tags", "edge"); err != nil || !reflect.DeepEqual(pks, []string{"h1"}) {
+		t.Fatalf("stale posting list %v, %v", pks, err)
+	}
+	if _, err = d.AddTags("nope", "tags", "x"); err != storage.ErrNoSuchKey {
+		t.Fatalf("got %v, want storage.ErrNoSuchKey", err)
+	}
+	if _, err = d.AddTags("h2", "tier", "x"); !errors.Is(err, document.ErrWrongFieldType) {
+		t.Fatalf("got %v, want document.ErrWrongFieldType", err)
+	}
+	if _, err = d.AddTags("h2", "tags", ""); !errors.Is(err, document.ErrInvalidTag) {
+		t.Fatalf("got %v, want document.ErrInvalidTag", err)
+	}
+
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			_, err := d.AddTags("h3", "tags", fmt.Sprintf("t%d", i))
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	row, err = d.Get("h3")
+	if err != nil || !reflect.DeepEqual(row["tags"], []string{"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7"}) {
+		t.Fatalf("lost concurrent tag updates: %v, %v", row, err)
+	}
+	st, err := d.Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Enums["tags"]["t3"] != 1 || st.Enums["tags"]["blue"] != 0 || st.Enums["tags"]["arm"] != 1 {
+		t.Fatalf("unexpected tag statistics %v", st.Enums["tags"])
+	}
+}
+
+func TestConcurrentTagUpdates(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "host"},
+		Fields:      []metaparser.Field{{Name: "tags", Type: common.TypeTag}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "hosts", document.Row{"host": "web", "tags": []string{"old"}})
+	d := tbl.Document
+	s1 := d.NewSession()
+	if _, err = s1.UpdateTags("web", "tags", []string{"a"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the second update reads the row once the first one committed
+	done := make(chan error)
+	go func() {
+		s2 := d.NewSession()
+		_, err := s2.UpdateTags("web", "tags", []string{"b"}, []string{"old"})
+		if err != nil {
+			s2.Close()
+			done <- err
+			return
+		}
+		done <- s2.Commit()
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("the second update did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err = s1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	row, err := d.Get("web")
+	if err != nil || !reflect.DeepEqual(row["tags"], []string{"a", "b"}) {
+		t.Fatalf("got %v, %v", row, err)
+	}
+}
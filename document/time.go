@@ -0,0 +1,111 @@
+package document
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+)
+
+// Bounds of the times a time field can hold, those whose UTC
+// nanoseconds since the unix epoch fit an int64
+var (
+	MinTime = time.Unix(0, -1<<63).UTC()
+	MaxTime = time.Unix(0, 1<<63-1).UTC()
+)
+
+// timeLayouts are the layouts accepted for times written as
+// strings, a time without an offset is in UTC
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTime parses a time in RFC 3339 form, with a space instead
+// of the T or only a date, times without an offset are in UTC
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: invalid time %q", ErrWrongFieldType, s)
+}
+
+// normalizeTime converts times and strings into times, keeping
+// the offset they were written with
+func normalizeTime(v interface{}) (interface{}, error) {
+	var t time.Time
+	switch x := v.(type) {
+	case time.Time:
+		t = x
+	case *time.Time:
+		t = *x
+	case string:
+		var err error
+		t, err = ParseTime(x)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %T for type %c", ErrWrongFieldType, v, common.TypeTime)
+	}
+	if t.Before(MinTime) || t.After(MaxTime) {
+		return nil, fmt.Errorf("%w: time %s out of range", ErrWrongFieldType, t.Format(time.RFC3339))
+	}
+	// monotonic readings do not survive encoding, drop them so
+	// that a stored time equals the one written
+	return t.Round(0), nil
+}
+
+// TimeUnit is a unit times are truncated to
+type TimeUnit int
+
+// Truncation units
+const (
+	Minute TimeUnit = iota
+	Hour
+	Day
+)
+
+var timeUnitNames = [...]string{"MINUTE", "HOUR", "DAY"}
+
+func (u TimeUnit) String() string {
+	if int(u) < len(timeUnitNames) {
+		return timeUnitNames[u]
+	}
+	return "?"
+}
+
+// ParseTimeUnit returns the unit named name, case insensitively
+func ParseTimeUnit(name string) (TimeUnit, bool) {
+	for i, n := range timeUnitNames {
+		if strings.EqualFold(n, name) {
+			return TimeUnit(i), true
+		}
+	}
+	return 0, false
+}
+
+// Duration returns the length of the unit
+func (u TimeUnit) Duration() time.Duration {
+	switch u {
+	case Minute:
+		return time.Minute
+	case Hour:
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// TruncateTime returns the start of the minute, hour or day
+// holding t, buckets are aligned on UTC so that times written
+// with different offsets fall into the same buckets
+func TruncateTime(t time.Time, unit TimeUnit) time.Time {
+	return t.UTC().Truncate(unit.Duration())
+}
@@ -0,0 +1,120 @@
+package document_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestTime(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("heartbeats", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "at"},
+		Fields: []metaparser.Field{
+			{Name: "at", Type: common.TypeTime},
+			{Name: "host", Type: common.TypeString},
+			{Name: "seen", Type: common.TypeTime},
+		},
+		Unique: []string{"seen"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a day of hourly beats written with offsets on both sides of
+	// UTC so that local and UTC orders differ
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	zones := []*time.Location{time.FixedZone("", 8*3600), time.FixedZone("", -5*3600), time.UTC}
+	var rows []document.Row
+	for i := 0; i < 24; i++ {
+		at := start.Add(time.Duration(i) * time.Hour).In(zones[i%len(zones)])
+		row := document.Row{"at": at, "host": fmt.Sprintf("h%d", i%4)}
+		if i%2 == 0 {
+			row["seen"] = at.Add(-time.Minute).Format(time.RFC3339)
+		}
+		rows = append(rows, row)
+	}
+	insert(t, db, "heartbeats", rows...)
+	d, err := db.Document("heartbeats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stored time keeps the offset it was written with
+	at := start.Add(13 * time.Hour)
+	row, err := d.Get(document.FormatKey(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := row["at"].(time.Time)
+	if _, offset := got.Zone(); !ok || !got.Equal(at) || offset != -5*3600 {
+		t.Fatalf("unexpected time %v", row["at"])
+	}
+	pk, err := d.ParseKey("2024-03-01T18:00:00+05:00")
+	if err != nil || pk != document.FormatKey(at) {
+		t.Fatalf("unexpected key %q %v", pk, err)
+	}
+	if text := d.KeyText(pk); text != "2024-03-01T13:00:00Z" {
+		t.Fatalf("unexpected key text %s", text)
+	}
+	if key, err := d.PrimaryKeyOf(document.Row{"at": "2024-03-01T18:00:00+05:00"}); err != nil || key != pk {
+		t.Fatalf("unexpected primary key %q %v", key, err)
+	}
+	for _, v := range []string{"yesterday", "2500-01-01"} {
+		if _, err := d.ParseKey(v); !errors.Is(err, document.ErrWrongFieldType) {
+			t.Fatalf("%s: got %v, want document.ErrWrongFieldType", v, err)
+		}
+	}
+
+	// keys sort by the instant whatever the offsets
+	var seen []time.Time
+	err = d.Range(document.FormatKey(start.Add(2*time.Hour)), document.FormatKey(start.Add(6*time.Hour)), func(pk string, row document.Row) (bool, error) {
+		seen = append(seen, row["at"].(time.Time))
+		return true, nil
+	})
+	if err != nil || len(seen) != 4 {
+		t.Fatalf("got %v, %v", seen, err)
+	}
+	for i, v := range seen {
+		if want := start.Add(time.Duration(2+i) * time.Hour); !v.Equal(want) {
+			t.Fatalf("row %d: got %v, want %v", i, v, want)
+		}
+	}
+
+	// the unique index compares instants too
+	if pk, err := d.LookupUnique("seen", "2024-03-01T07:59:00+08:00"); err != nil || pk != document.FormatKey(start) {
+		t.Fatalf("got %q, %v", pk, err)
+	}
+	iv, err := d.IndexValue("seen", "2024-03-01T07:59:00+08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := d.IndexText("seen", iv); text != "2024-02-29T23:59:00Z" {
+		t.Fatalf("unexpected index text %s", text)
+	}
+	if text := d.IndexText("host", "h1"); text != "h1" {
+		t.Fatalf("unexpected index text %s", text)
+	}
+	s := d.NewSession()
+	_, err = s.Insert(document.Row{"at": "2030-01-01", "seen": "2024-03-01T02:59:00+03:00"})
+	s.Close()
+	if !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("got %v, want a unique violation", err)
+	}
+
+	if _, err := d.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := d.Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Bounds) != document.HistogramBuckets || st.Bounds[0] != document.FormatKey(start) {
+		t.Fatalf("unexpected bounds %q", st.Bounds)
+	}
+}
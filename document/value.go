@@ -0,0 +1,248 @@
+package document
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/keyenc"
+)
+
+// Row is a single document, it maps field names to values
+type Row map[string]interface{}
+
+// MaxTagLength is the maximum length of a tag in bytes
+const MaxTagLength = 64
+
+// NormalizeValue converts v into the canonical Go type of a
+// field of type typ: string for strings and enums, int64 for
+// integers, float64 for floats, decimal.Decimal for decimals,
+// time.Time for times, a sorted []string without duplicates
+// for tags and nested maps, arrays and scalars for objects
+func NormalizeValue(typ byte, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch typ {
+	case common.TypeTag:
+		return normalizeTags(v)
+	case common.TypeDecimal:
+		return normalizeDecimal(v)
+	case common.TypeTime:
+		return normalizeTime(v)
+	case common.TypeObject:
+		return normalizeObject(v)
+	case common.TypeString, common.TypeEnum:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []byte:
+			return string(x), nil
+		}
+	case common.TypeInteger:
+		switch x := v.(type) {
+		case int:
+			return int64(x), nil
+		case int8:
+			return int64(x), nil
+		case int16:
+			return int64(x), nil
+		case int32:
+			return int64(x), nil
+		case int64:
+			return x, nil
+		case uint:
+			if uint64(x) <= math.MaxInt64 {
+				return int64(x), nil
+			}
+		case uint8:
+			return int64(x), nil
+		case uint16:
+			return int64(x), nil
+		case uint32:
+			return int64(x), nil
+		case uint64:
+			if x <= math.MaxInt64 {
+				return int64(x), nil
+			}
+		case float64:
+			if x == math.Trunc(x) && math.Abs(x) < 1<<63 {
+				return int64(x), nil
+			}
+		case json.Number:
+			i, err := x.Int64()
+			if err == nil {
+				return i, nil
+			}
+			f, err := x.Float64()
+			if err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+				return int64(f), nil
+			}
+		case string:
+			i, err := strconv.ParseInt(x, 10, 64)
+			if err == nil {
+				return i, nil
+			}
+		}
+	case common.TypeFloat:
+		switch x := v.(type) {
+		case float32:
+			return float64(x), nil
+		case float64:
+			return x, nil
+		case int:
+			return float64(x), nil
+		case int64:
+			return float64(x), nil
+		case json.Number:
+			f, err := x.Float64()
+			if err == nil {
+				return f, nil
+			}
+		case string:
+			f, err := strconv.ParseFloat(x, 64)
+			if err == nil {
+				return f, nil
+			}
+		}
+	default:
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+			f, err := n.Float64()
+			if err == nil {
+				return f, nil
+			}
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("%w: %T for type %c", ErrWrongFieldType, v, typ)
+}
+
+// PlainValue replaces json.Number in v, nested maps and arrays
+// included, with int64 or float64 so that a value decoded with
+// UseNumber can be stored without a schema, maps and arrays are
+// changed in place
+func PlainValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = PlainValue(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = PlainValue(e)
+		}
+	}
+	return v
+}
+
+// FormatKey formats a primary key or index value into its key
+// string, the order preserving encoding of keyenc.Key, so that
+// keys sort like their values, equal numbers of different scales
+// and equal instants written with different offsets share a key
+func FormatKey(v interface{}) string {
+	key, err := keyenc.Key(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(key)
+}
+
+// CheckTag checks that tag can be held by a tag field
+func CheckTag(tag string) error {
+	if tag == "" || len(tag) > MaxTagLength || bytes.IndexByte([]byte(tag), 0) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+	}
+	return nil
+}
+
+// normalizeTags converts a single tag or a list of tags into a
+// sorted set, an empty set is null
+func normalizeTags(v interface{}) (interface{}, error) {
+	var tags []string
+	switch x := v.(type) {
+	case string:
+		tags = []string{x}
+	case []string:
+		tags = append(tags, x...)
+	case []interface{}:
+		for _, item := range x {
+			tag, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %T in tags", ErrWrongFieldType, item)
+			}
+			tags = append(tags, tag)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %T for type %c", ErrWrongFieldType, v, common.TypeTag)
+	}
+	for _, tag := range tags {
+		if err := CheckTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	tags = tagSet(tags)
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+// tagSet sorts tags and removes duplicates in place
+func tagSet(tags []string) []string {
+	sort.Strings(tags)
+	ret := tags[:0]
+	for i, tag := range tags {
+		if i == 0 || tag != tags[i-1] {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// normalizeDecimal converts integers, floats, json numbers and
+// strings into decimals, floats are converted to the shortest
+// decimal reading back as the same float
+func normalizeDecimal(v interface{}) (interface{}, error) {
+	var err error
+	var d decimal.Decimal
+	switch x := v.(type) {
+	case decimal.Decimal:
+		return x, nil
+	case *decimal.Decimal:
+		return *x, nil
+	case int:
+		return decimal.NewFromInt(int64(x)), nil
+	case int32:
+		return decimal.NewFromInt(int64(x)), nil
+	case int64:
+		return decimal.NewFromInt(x), nil
+	case float32:
+		d, err = decimal.NewFromFloat(float64(x))
+	case float64:
+		d, err = decimal.NewFromFloat(x)
+	case json.Number:
+		d, err = decimal.Parse(string(x))
+	case string:
+		d, err = decimal.Parse(x)
+	default:
+		return nil, fmt.Errorf("%w: %T for type %c", ErrWrongFieldType, v, common.TypeDecimal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongFieldType, err)
+	}
+	return d, nil
+}
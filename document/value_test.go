@@ -0,0 +1,87 @@
+package document_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+func TestNormalizeInteger(t *testing.T) {
+	for _, v := range []interface{}{int64(7), 7.0, "7", uint(7), json.Number("7"), json.Number("7e0")} {
+		if got, err := document.NormalizeValue(common.TypeInteger, v); err != nil || got != int64(7) {
+			t.Fatalf("%#v: got %#v, %v", v, got, err)
+		}
+	}
+	// floats beyond the integers must not wrap around
+	for _, v := range []interface{}{1e19, -1e19, math.Inf(1), math.Inf(-1), math.NaN(), 0.5,
+		uint64(math.MaxUint64), uint(math.MaxUint64), json.Number("1e19")} {
+		if got, err := document.NormalizeValue(common.TypeInteger, v); !errors.Is(err, document.ErrWrongFieldType) {
+			t.Fatalf("%#v: got %#v, %v", v, got, err)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("invoices", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "ref", Type: common.TypeDecimal, Precision: 6, Scale: 2},
+			{Name: "amount", Type: common.TypeDecimal, Precision: 12, Scale: 2},
+		},
+		Unique: []string{"ref"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "invoices",
+		document.Row{"ref": "1.5", "amount": "1234567890.01"},
+		document.Row{"ref": 7.5, "amount": 0.1},
+		document.Row{"ref": json.Number("10"), "amount": int64(3)},
+	)
+	d, err := db.Document("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// values are stored at the scale of their field
+	for id, want := range map[int64][2]string{1: {"1.50", "1234567890.01"}, 2: {"7.50", "0.10"}, 3: {"10.00", "3.00"}} {
+		row, err := d.Get(document.FormatKey(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, ok := row["ref"].(decimal.Decimal)
+		amount, ok2 := row["amount"].(decimal.Decimal)
+		if !ok || !ok2 || ref.String() != want[0] || amount.String() != want[1] {
+			t.Fatalf("%d: unexpected row %#v", id, row)
+		}
+	}
+	if pk, err := d.LookupUnique("ref", "7.50"); err != nil || pk != document.FormatKey(int64(2)) {
+		t.Fatalf("got %q, %v", pk, err)
+	}
+	// keys of decimals sort by value
+	a, _ := document.NormalizeValue(common.TypeDecimal, "-2.5")
+	b, _ := document.NormalizeValue(common.TypeDecimal, "10")
+	c, _ := document.NormalizeValue(common.TypeDecimal, "9.99")
+	if !(document.FormatKey(a) < document.FormatKey(c) && document.FormatKey(c) < document.FormatKey(b)) {
+		t.Fatalf("unordered keys %q %q %q", document.FormatKey(a), document.FormatKey(c), document.FormatKey(b))
+	}
+
+	// 1.5 and 1.50 are the same number for the unique index
+	s := d.NewSession()
+	defer s.Close()
+	if _, err := s.Insert(document.Row{"ref": "1.50"}); !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("got %v, want a unique violation", err)
+	}
+	for _, v := range []interface{}{"0.001", "12345678901.5", 1e11, "abc"} {
+		if _, err := s.Insert(document.Row{"amount": v}); !errors.Is(err, document.ErrWrongFieldType) {
+			t.Fatalf("%v: got %v, want a wrong field type", v, err)
+		}
+	}
+}
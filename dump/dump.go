@@ -0,0 +1,440 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf8"
+
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/kv"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// DefaultBatchSize is the number of entries restored per batch
+const DefaultBatchSize = 1024
+
+// JSONLinesFormat names the JSON lines format in its header line
+const JSONLinesFormat = "kical-dump-jsonl"
+
+// ErrBucketNotEmpty is returned when restoring into a bucket that
+// already holds data without RestoreOptions.Overwrite
+var ErrBucketNotEmpty = fmt.Errorf("Bucket is not empty")
+
+// Dump writes buckets of drv to w in the binary format, every
+// bucket is dumped when buckets is empty. Each bucket is read
+// through a single iterator so it is dumped consistently.
+func Dump(drv storage.Driver, w io.Writer, buckets []string) error {
+	buckets, err := bucketList(drv, buckets)
+	if err != nil {
+		return err
+	}
+	dw, err := NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, name := range buckets {
+		err = dw.Bucket(name)
+		if err != nil {
+			return err
+		}
+		err = walk(drv, name, func(k, v []byte) error {
+			return dw.Entry(k, v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+func bucketList(drv storage.Driver, buckets []string) ([]string, error) {
+	if len(buckets) != 0 {
+		return buckets, nil
+	}
+	return drv.Buckets()
+}
+
+func walk(drv storage.Driver, name string, fn func(k, v []byte) error) error {
+	s, err := drv.OpenBucket(name)
+	if err != nil {
+		return err
+	}
+	iter := s.NewIter(nil, nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		err = fn(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Line is a line of the JSON lines format, keys and values are
+// kept as strings when they are valid UTF-8 and as base64 in the
+// *Base64 members otherwise. Decoded holds the decoded value of
+// kv entries and document rows, it is ignored when restoring. The
+// last line is the trailer, with End set, Counts holding the number
+// of entries of every dumped bucket and CRC the CRC-32C of every
+// line before it, restoring fails without it.
+type Line struct {
+	Format      string           `json:"format,omitempty"`
+	Version     uint16           `json:"version,omitempty"`
+	Bucket      string           `json:"bucket,omitempty"`
+	Key         *string          `json:"key,omitempty"`
+	KeyBase64   []byte           `json:"key_base64,omitempty"`
+	Value       *string          `json:"value,omitempty"`
+	ValueBase64 []byte           `json:"value_base64,omitempty"`
+	Decoded     interface{}      `json:"decoded,omitempty"`
+	End         bool             `json:"end,omitempty"`
+	Counts      map[string]int64 `json:"counts,omitempty"`
+	CRC         uint32           `json:"crc,omitempty"`
+}
+
+func textOrBinary(rs []byte) (*string, []byte) {
+	if utf8.Valid(rs) {
+		s := string(rs)
+		for _, r := range s {
+			if r < 0x20 && r != '\t' && r != '\n' {
+				return nil, rs
+			}
+		}
+		return &s, nil
+	}
+	return nil, rs
+}
+
+func (l *Line) key() []byte {
+	if l.Key != nil {
+		return []byte(*l.Key)
+	}
+	return l.KeyBase64
+}
+
+func (l *Line) value() []byte {
+	if l.Value != nil {
+		return []byte(*l.Value)
+	}
+	if l.ValueBase64 == nil {
+		return []byte{}
+	}
+	return l.ValueBase64
+}
+
+// DumpJSONLines writes buckets of drv to w as JSON lines for human
+// inspection, every bucket is dumped when buckets is empty
+func DumpJSONLines(drv storage.Driver, w io.Writer, buckets []string) error {
+	buckets, err := bucketList(drv, buckets)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	encoder := json.NewEncoder(io.MultiWriter(bw, crc))
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(&Line{Format: JSONLinesFormat, Version: Version})
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int64, len(buckets))
+	for _, name := range buckets {
+		counts[name] = 0
+		var typ byte
+		bucket, err := drv.OpenBucket(name)
+		if err != nil {
+			return err
+		}
+		// decompresses values whatever their codec
+		codec, err := compression.NewCodec(bucket, nil)
+		if err != nil {
+			return err
+		}
+		err = walk(drv, name, func(k, v []byte) error {
+			l := &Line{Bucket: name}
+			l.Key, l.KeyBase64 = textOrBinary(k)
+			l.Value, l.ValueBase64 = textOrBinary(v)
+			if len(k) == 2 && k[0] == metaparser.MetaInitCharacter && k[1] == metaparser.MetaTypeStorageType && len(v) == 1 {
+				typ = v[0]
+			}
+			l.Decoded = decode(typ, codec, k, v)
+			counts[name]++
+			return encoder.Encode(l)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = encoder.Encode(&Line{End: true, Counts: counts, CRC: crc.Sum32()})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// decode decodes the data keys of kv and row document tables,
+// metadata sorts before data keys so typ is known by then
+func decode(typ byte, codec *compression.Codec, k, v []byte) interface{} {
+	if len(k) == 0 || k[0] != '=' {
+		return nil
+	}
+	v, err := codec.Decompress(v)
+	if err != nil {
+		return nil
+	}
+	switch typ {
+	case metaparser.MetaStorageTypeKV:
+		ret, err := kv.DecodeValue(v)
+		if err == nil {
+			return ret
+		}
+	case metaparser.MetaStorageTypeRowDocument:
+		ret, err := document.DecodeRow(v)
+		if err == nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+// RestoreOptions are the options of Restore
+type RestoreOptions struct {
+	// Overwrite clears buckets holding data before restoring them,
+	// otherwise ErrBucketNotEmpty is returned
+	Overwrite bool
+	// BatchSize is the number of entries per committed batch
+	BatchSize int
+}
+
+// Restore reads a dump in either the binary or the JSON lines
+// format from r and writes it into drv. A bucket is committed in
+// several batches, so a failed restore can leave it incomplete.
+func Restore(drv storage.Driver, r io.Reader, opts *RestoreOptions) error {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	rs := &restorer{drv: drv, opts: *opts}
+	if rs.opts.BatchSize <= 0 {
+		rs.opts.BatchSize = DefaultBatchSize
+	}
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(Magic))
+	if err == nil && IsDump(head) {
+		err = rs.binary(br)
+	} else {
+		err = rs.jsonLines(br)
+	}
+	if err != nil {
+		rs.abort()
+		return err
+	}
+	return rs.flush()
+}
+
+type restorer struct {
+	drv     storage.Driver
+	opts    RestoreOptions
+	bucket  storage.Storage
+	batch   storage.Batch
+	pending int
+}
+
+func (rs *restorer) begin(name string) error {
+	err := rs.flush()
+	if err != nil {
+		return err
+	}
+	rs.bucket, err = rs.drv.Bucket(name)
+	if err != nil {
+		return err
+	}
+	iter := rs.bucket.NewIter(nil, nil)
+	var keys [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !rs.opts.Overwrite {
+			iter.Close()
+			return fmt.Errorf("%w: %s", ErrBucketNotEmpty, name)
+		}
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	iter.Close()
+	if len(keys) == 0 {
+		return nil
+	}
+	batch := rs.bucket.NewBatch(storage.BatchWriteOnly)
+	for _, k := range keys {
+		err = batch.Delete(k)
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+func (rs *restorer) set(k, v []byte) error {
+	if rs.bucket == nil {
+		return fmt.Errorf("%w: entry outside of a bucket", ErrCorrupted)
+	}
+	if rs.batch == nil {
+		rs.batch = rs.bucket.NewBatch(storage.BatchWriteOnly)
+	}
+	err := rs.batch.Set(k, v, nil)
+	if err != nil {
+		return err
+	}
+	rs.pending++
+	if rs.pending >= rs.opts.BatchSize {
+		return rs.flush()
+	}
+	return nil
+}
+
+func (rs *restorer) flush() error {
+	if rs.batch == nil {
+		return nil
+	}
+	batch := rs.batch
+	rs.batch = nil
+	rs.pending = 0
+	return batch.Commit()
+}
+
+func (rs *restorer) abort() {
+	if rs.batch != nil {
+		rs.batch.Close()
+		rs.batch = nil
+	}
+}
+
+func (rs *restorer) binary(r io.Reader) error {
+	dr, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch rec.Type {
+		case RecordBucket:
+			err = rs.begin(rec.Bucket)
+		case RecordEntry:
+			err = rs.set(rec.Key, rec.Value)
+		case RecordBucketEnd:
+			err = rs.flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rs *restorer) jsonLines(r *bufio.Reader) error {
+	crc := crc32.New(crcTable)
+	var head Line
+	raw, err := readLine(r)
+	if err == nil {
+		err = json.Unmarshal(raw, &head)
+	}
+	if err != nil || head.Format != JSONLinesFormat {
+		return ErrBadMagic
+	}
+	if head.Version == 0 || head.Version > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, head.Version)
+	}
+	crc.Write(raw)
+	current := ""
+	begun := make(map[string]bool)
+	counts := make(map[string]int64)
+	for {
+		raw, err = readLine(r)
+		if err == io.EOF {
+			return fmt.Errorf("%w: missing trailer", ErrCorrupted)
+		}
+		if err != nil {
+			return err
+		}
+		var l Line
+		err = json.Unmarshal(raw, &l)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+		if l.End {
+			return checkTrailer(r, &l, counts, crc.Sum32())
+		}
+		crc.Write(raw)
+		if l.Bucket == "" || (l.Key == nil && l.KeyBase64 == nil) {
+			return fmt.Errorf("%w: line without bucket or key", ErrCorrupted)
+		}
+		if rs.bucket == nil || l.Bucket != current {
+			current = l.Bucket
+			if begun[current] {
+				err = rs.flush()
+				if err == nil {
+					rs.bucket, err = rs.drv.Bucket(current)
+				}
+			} else {
+				begun[current] = true
+				err = rs.begin(current)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		counts[current]++
+		err = rs.set(l.key(), l.value())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a line with its newline, a last line without one
+// is returned as is
+func readLine(r *bufio.Reader) ([]byte, error) {
+	raw, err := r.ReadBytes('\n')
+	if err == io.EOF && len(raw) != 0 {
+		return raw, nil
+	}
+	return raw, err
+}
+
+// checkTrailer checks the counts and the CRC of the trailer l
+// against the lines read before it, nothing may follow it
+func checkTrailer(r *bufio.Reader, l *Line, counts map[string]int64, crc uint32) error {
+	if l.CRC != crc {
+		return ErrChecksum
+	}
+	for name, n := range counts {
+		if l.Counts[name] != n {
+			return fmt.Errorf("%w: %d entries of %s, the trailer counts %d", ErrCorrupted, n, name, l.Counts[name])
+		}
+	}
+	for name, n := range l.Counts {
+		if counts[name] != n {
+			return fmt.Errorf("%w: %d entries of %s, the trailer counts %d", ErrCorrupted, counts[name], name, n)
+		}
+	}
+	for {
+		raw, err := readLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(raw)) != 0 {
+			return fmt.Errorf("%w: data after the trailer", ErrCorrupted)
+		}
+	}
+}
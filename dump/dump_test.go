@@ -0,0 +1,171 @@
+package dump_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/dump"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newDriver(t *testing.T) *storage.PebbleDriver {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	return drv
+}
+
+func seed(t *testing.T, drv storage.Driver) {
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tbl.KV.NewSession()
+	s.Set("a", "x")
+	s.Set("b", int64(2))
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err = db.CreateTable("svc", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := tbl.Document.NewSession()
+	ds.Insert(document.Row{})
+	if err = ds.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contents(t *testing.T, drv storage.Driver) map[string]string {
+	ret := make(map[string]string)
+	names, err := drv.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		s, err := drv.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter := s.NewIter(nil, nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			ret[name+"/"+string(iter.Key())] = string(iter.Value())
+		}
+		iter.Close()
+	}
+	return ret
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := newDriver(t)
+	seed(t, src)
+	want := contents(t, src)
+
+	for _, jsonl := range []bool{false, true} {
+		var buf bytes.Buffer
+		var err error
+		if jsonl {
+			err = dump.DumpJSONLines(src, &buf, nil)
+		} else {
+			err = dump.Dump(src, &buf, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := newDriver(t)
+		err = dump.Restore(dst, bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := contents(t, dst)
+		if len(got) != len(want) {
+			t.Fatalf("jsonl=%v: got %d keys, want %d", jsonl, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("jsonl=%v: key %q differs", jsonl, k)
+			}
+		}
+		err = dump.Restore(dst, bytes.NewReader(buf.Bytes()), nil)
+		if !errors.Is(err, dump.ErrBucketNotEmpty) {
+			t.Fatalf("expected ErrBucketNotEmpty, got %v", err)
+		}
+		err = dump.Restore(dst, bytes.NewReader(buf.Bytes()), &dump.RestoreOptions{Overwrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	src := newDriver(t)
+	seed(t, src)
+	var buf bytes.Buffer
+	err := dump.Dump(src, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := buf.Bytes()
+
+	flipped := append([]byte(nil), rs...)
+	flipped[len(flipped)/2] ^= 0xff
+	err = dump.Restore(newDriver(t), bytes.NewReader(flipped), nil)
+	if !errors.Is(err, dump.ErrChecksum) && !errors.Is(err, dump.ErrCorrupted) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+	err = dump.Restore(newDriver(t), bytes.NewReader(rs[:len(rs)-3]), nil)
+	if !errors.Is(err, dump.ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted on truncation, got %v", err)
+	}
+}
+
+func TestJSONLinesTrailer(t *testing.T) {
+	src := newDriver(t)
+	seed(t, src)
+	var buf bytes.Buffer
+	err := dump.DumpJSONLines(src, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) < 3 || !bytes.Contains(lines[len(lines)-1], []byte(`"end":true`)) {
+		t.Fatalf("no trailer in %q", buf.Bytes())
+	}
+
+	// a dump cut between lines misses its trailer
+	cut := bytes.Join(lines[:len(lines)-2], nil)
+	err = dump.Restore(newDriver(t), bytes.NewReader(cut), nil)
+	if !errors.Is(err, dump.ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted on truncation, got %v", err)
+	}
+	// a dropped line fails the checksum
+	dropped := bytes.Join(append(append([][]byte{}, lines[:1]...), lines[2:]...), nil)
+	err = dump.Restore(newDriver(t), bytes.NewReader(dropped), nil)
+	if !errors.Is(err, dump.ErrChecksum) {
+		t.Fatalf("expected ErrChecksum, got %v", err)
+	}
+	// an edited value fails the checksum
+	edited := bytes.Replace(buf.Bytes(), []byte(`"value":"`), []byte(`"value":"x`), 1)
+	err = dump.Restore(newDriver(t), bytes.NewReader(edited), nil)
+	if !errors.Is(err, dump.ErrChecksum) {
+		t.Fatalf("expected ErrChecksum, got %v", err)
+	}
+	trailing := append(append([]byte(nil), buf.Bytes()...), lines[1]...)
+	err = dump.Restore(newDriver(t), bytes.NewReader(trailing), nil)
+	if !errors.Is(err, dump.ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted for data after the trailer, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Package dump provides a portable, versioned and checksummed
+// format to export every bucket of a storage driver and to
+// restore it into another one
+//
+// A dump starts with the 8 byte magic "KICALDMP" followed by a
+// big endian uint16 version, then a stream of records. Every
+// record is a type byte, an uvarint payload length, the payload
+// and the big endian CRC-32C of the type and payload:
+//
+//	'B' name                  starts a bucket
+//	'K' uvarint(len(key)) key value
+//	'E' uvarint(count)        ends a bucket, count is its 'K' records
+//	'Z' uvarint(count)        ends the dump, count is its buckets
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Magic starts every dump
+const Magic = "KICALDMP"
+
+// Version is the current format version
+const Version = uint16(1)
+
+// MaxRecordSize is the largest record payload accepted when reading
+const MaxRecordSize = 1 << 30
+
+// Record types
+const (
+	RecordBucket    = byte('B')
+	RecordEntry     = byte('K')
+	RecordBucketEnd = byte('E')
+	RecordEnd       = byte('Z')
+)
+
+// ErrBadMagic is returned when the input is not a dump
+var ErrBadMagic = fmt.Errorf("Not a kical dump")
+
+// ErrUnsupportedVersion is returned for dumps of a newer format
+var ErrUnsupportedVersion = fmt.Errorf("Unsupported dump version")
+
+// ErrChecksum is returned when a record is corrupted
+var ErrChecksum = fmt.Errorf("Dump checksum mismatch")
+
+// ErrCorrupted is returned when the record stream is inconsistent
+var ErrCorrupted = fmt.Errorf("Corrupted dump")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a decoded record
+type Record struct {
+	Type   byte
+	Bucket string
+	Key    []byte
+	Value  []byte
+	Count  uint64
+}
+
+// Writer writes a dump
+type Writer struct {
+	w       *bufio.Writer
+	bucket  string
+	open    bool
+	entries uint64
+	buckets uint64
+	buf     []byte
+}
+
+// NewWriter writes the header of a dump to w and returns a writer
+func NewWriter(w io.Writer) (*Writer, error) {
+	dw := &Writer{w: bufio.NewWriter(w)}
+	_, err := dw.w.WriteString(Magic)
+	if err != nil {
+		return nil, err
+	}
+	var v [2]byte
+	binary.BigEndian.PutUint16(v[:], Version)
+	_, err = dw.w.Write(v[:])
+	if err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+func (w *Writer) record(typ byte, payload []byte) error {
+	w.buf = append(w.buf[:0], typ)
+	w.buf = appendUvarint(w.buf, uint64(len(payload)))
+	w.buf = append(w.buf, payload...)
+	crc := crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload)
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], crc)
+	w.buf = append(w.buf, c[:]...)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+// Bucket starts a new bucket, ending the previous one
+func (w *Writer) Bucket(name string) error {
+	err := w.endBucket()
+	if err != nil {
+		return err
+	}
+	w.bucket = name
+	w.open = true
+	w.entries = 0
+	w.buckets++
+	return w.record(RecordBucket, []byte(name))
+}
+
+func (w *Writer) endBucket() error {
+	if !w.open {
+		return nil
+	}
+	w.open = false
+	return w.record(RecordBucketEnd, appendUvarint(nil, w.entries))
+}
+
+// Entry writes a key value pair into the current bucket
+func (w *Writer) Entry(key, value []byte) error {
+	if !w.open {
+		return fmt.Errorf("%w: entry outside of a bucket", ErrCorrupted)
+	}
+	payload := appendUvarint(nil, uint64(len(key)))
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+	w.entries++
+	return w.record(RecordEntry, payload)
+}
+
+// Close ends the dump and flushes it, it does not close the
+// underlying writer
+func (w *Writer) Close() error {
+	err := w.endBucket()
+	if err != nil {
+		return err
+	}
+	err = w.record(RecordEnd, appendUvarint(nil, w.buckets))
+	if err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Reader reads a dump record by record
+type Reader struct {
+	r       *bufio.Reader
+	Version uint16
+
+	bucket  string
+	open    bool
+	entries uint64
+	buckets uint64
+	done    bool
+}
+
+// NewReader reads the header of a dump from r
+func NewReader(r io.Reader) (*Reader, error) {
+	dr := &Reader{r: bufio.NewReader(r)}
+	var head [len(Magic) + 2]byte
+	_, err := io.ReadFull(dr.r, head[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBadMagic
+		}
+		return nil, err
+	}
+	if string(head[:len(Magic)]) != Magic {
+		return nil, ErrBadMagic
+	}
+	dr.Version = binary.BigEndian.Uint16(head[len(Magic):])
+	if dr.Version == 0 || dr.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, dr.Version)
+	}
+	return dr, nil
+}
+
+// Next returns the next record, io.EOF is returned after the end
+// record has been read, a stream ending before it is corrupted
+func (r *Reader) Next() (*Record, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	typ, err := r.r.ReadByte()
+	if err != nil {
+		return nil, truncated(err)
+	}
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if l > MaxRecordSize {
+		return nil, fmt.Errorf("%w: record too large", ErrCorrupted)
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r.r, payload)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	var c [4]byte
+	_, err = io.ReadFull(r.r, c[:])
+	if err != nil {
+		return nil, truncated(err)
+	}
+	crc := crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload)
+	if crc != binary.BigEndian.Uint32(c[:]) {
+		return nil, ErrChecksum
+	}
+	return r.decode(typ, payload)
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of dump", ErrCorrupted)
+	}
+	return err
+}
+
+func (r *Reader) decode(typ byte, payload []byte) (*Record, error) {
+	rec := &Record{Type: typ}
+	switch typ {
+	case RecordBucket:
+		if r.open {
+			return nil, fmt.Errorf("%w: nested bucket", ErrCorrupted)
+		}
+		r.bucket = string(payload)
+		r.open = true
+		r.entries = 0
+		r.buckets++
+		rec.Bucket = r.bucket
+	case RecordEntry:
+		if !r.open {
+			return nil, fmt.Errorf("%w: entry outside of a bucket", ErrCorrupted)
+		}
+		kl, n := binary.Uvarint(payload)
+		if n <= 0 || kl > uint64(len(payload)-n) {
+			return nil, fmt.Errorf("%w: bad entry", ErrCorrupted)
+		}
+		rec.Bucket = r.bucket
+		rec.Key = payload[n : n+int(kl)]
+		rec.Value = payload[n+int(kl):]
+		r.entries++
+	case RecordBucketEnd, RecordEnd:
+		count, n := binary.Uvarint(payload)
+		if n <= 0 || n != len(payload) {
+			return nil, fmt.Errorf("%w: bad trailer", ErrCorrupted)
+		}
+		rec.Count = count
+		if typ == RecordBucketEnd {
+			if !r.open || count != r.entries {
+				return nil, fmt.Errorf("%w: bucket %q entry count mismatch", ErrCorrupted, r.bucket)
+			}
+			rec.Bucket = r.bucket
+			r.open = false
+		} else {
+			if r.open || count != r.buckets {
+				return nil, fmt.Errorf("%w: bucket count mismatch", ErrCorrupted)
+			}
+			r.done = true
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown record type %q", ErrCorrupted, typ)
+	}
+	return rec, nil
+}
+
+// IsDump reports whether rs starts like a dump
+func IsDump(rs []byte) bool {
+	return bytes.HasPrefix(rs, []byte(Magic))
+}
@@ -6,10 +6,12 @@ require (
 	github.com/cockroachdb/errors v1.8.2 // indirect
 	github.com/cockroachdb/pebble v0.0.0-20210205133808-a516e691fb72
 	github.com/cockroachdb/redact v1.0.9 // indirect
-	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang/snappy v0.0.2 // indirect
+	github.com/gogo/protobuf v1.3.2
+	github.com/golang/snappy v0.0.2
+	github.com/klauspost/compress v1.11.7
 	github.com/kr/pretty v0.2.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	golang.org/x/exp v0.0.0-20210201131500-d352d2db2ceb // indirect
 	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
+	google.golang.org/grpc v1.35.0
 )
@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/xtlsoft/kical/security"
+)
+
+// Front is the front-end name of the handler in the audit trail
+const Front = "http"
+
+type principalKey struct{}
+
+// SetSecurity makes the handler authenticate the requests with the
+// token of their `Authorization: Bearer <token>` header and only
+// serve the operations the user is granted by s. Listings only
+// show the tables the user can read, scans only return the keys
+// the user can read.
+func (h *Handler) SetSecurity(s *security.Store) {
+	h.security = s
+}
+
+// bearerToken returns the token of the Authorization header of r
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authenticate attaches the principal of r to its context, a
+// request without a valid token is denied, the denial being
+// counted with the other unauthenticated ones of its window in
+// the audit trail
+func (h *Handler) authenticate(r *http.Request) (*http.Request, error) {
+	if h.security == nil {
+		return r, nil
+	}
+	p, err := h.security.Authenticate(bearerToken(r))
+	if err != nil {
+		return nil, h.security.Authorize(nil, operation(r, "", "", security.Read))
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), nil
+}
+
+func principalOf(r *http.Request) *security.Principal {
+	p, _ := r.Context().Value(principalKey{}).(*security.Principal)
+	return p
+}
+
+func operation(r *http.Request, table, key string, perm security.Permission) *security.Operation {
+	return &security.Operation{
+		Front:      Front,
+		Name:       r.Method + " " + r.URL.Path,
+		Table:      table,
+		Key:        key,
+		Permission: perm,
+	}
+}
+
+// authorize checks that the user of r is granted perm on the key
+// of table, an empty key standing for the whole table
+func (h *Handler) authorize(r *http.Request, table, key string, perm security.Permission) error {
+	if h.security == nil {
+		return nil
+	}
+	return h.security.Authorize(principalOf(r), operation(r, table, key, perm))
+}
+
+// filter authorizes reading the keys of table starting with
+// prefix, it returns nil when every key may be read
+func (h *Handler) filter(r *http.Request, table, prefix string) (func(key string) bool, error) {
+	if h.security == nil {
+		return nil, nil
+	}
+	return h.security.Filter(principalOf(r), operation(r, table, prefix, security.Read))
+}
+
+// visible reports whether the user of r may read some keys of
+// table
+func (h *Handler) visible(r *http.Request, table string) bool {
+	return h.security == nil || h.security.Visible(principalOf(r), table)
+}
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Error codes returned in the `code` member of error responses
+const (
+	CodeBadRequest         = "bad_request"
+	CodeNotFound           = "not_found"
+	CodeTableNotFound      = "table_not_found"
+	CodeTableExists        = "table_exists"
+	CodeDuplicateKey       = "duplicate_key"
+	CodeUniqueViolation    = "unique_violation"
+	CodeReferenceViolation = "reference_violation"
+	CodeReadOnlyView       = "read_only_view"
+	CodeInvalidQuery       = "invalid_query"
+	CodeInvalidDocument    = "invalid_document"
+	CodeWrongStorageType   = "wrong_storage_type"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeUnauthenticated    = "unauthenticated"
+	CodeForbidden          = "forbidden"
+	CodeInternal           = "internal"
+)
+
+// Error is the body of every non-2xx response
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists the failing fields of a rejected document
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is the failure of a field of a rejected document
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error Error `json:"error"`
+}
+
+type apiError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func newError(status int, code string, err error) error {
+	return &apiError{status: status, code: code, err: err}
+}
+
+func classify(err error) (int, string) {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return ae.status, ae.code
+	}
+	switch {
+	case errors.Is(err, security.ErrUnauthenticated):
+		return http.StatusUnauthorized, CodeUnauthenticated
+	case errors.Is(err, security.ErrDenied):
+		return http.StatusForbidden, CodeForbidden
+	case errors.Is(err, storage.ErrNoSuchKey):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, common.ErrTableExists):
+		return http.StatusConflict, CodeTableExists
+	case errors.Is(err, common.ErrWrongStorageType):
+		return http.StatusBadRequest, CodeWrongStorageType
+	case errors.Is(err, document.ErrDuplicateKey):
+		return http.StatusConflict, CodeDuplicateKey
+	case errors.Is(err, document.ErrUniqueViolation):
+		return http.StatusConflict, CodeUniqueViolation
+	case errors.Is(err, document.ErrReferenceViolation):
+		return http.StatusConflict, CodeReferenceViolation
+	case errors.Is(err, document.ErrReadOnlyView):
+		return http.StatusConflict, CodeReadOnlyView
+	case errors.Is(err, query.ErrSyntax),
+		errors.Is(err, query.ErrUnknownVariable),
+		errors.Is(err, query.ErrInvalidAggregate),
+		errors.Is(err, query.ErrInvalidView),
+		errors.Is(err, document.ErrNoIndex):
+		return http.StatusBadRequest, CodeInvalidQuery
+	case errors.Is(err, document.ErrUnknownField),
+		errors.Is(err, document.ErrWrongFieldType),
+		errors.Is(err, document.ErrInvalidTag),
+		errors.Is(err, document.ErrInvalidPath),
+		errors.Is(err, document.ErrConstraintViolation),
+		errors.Is(err, document.ErrMissingPrimaryKey):
+		return http.StatusBadRequest, CodeInvalidDocument
+	case errors.Is(err, metaparser.ErrMalformedMetadata),
+		errors.Is(err, storage.ErrInvalidBucketName),
+		errors.Is(err, metaparser.ErrNoSuchStorageType),
+		errors.Is(err, document.ErrInvalidSchemaChange):
+		return http.StatusBadRequest, CodeBadRequest
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, code := classify(err)
+	body := &errorResponse{Error: Error{
+		Code:    code,
+		Message: err.Error(),
+	}}
+	var verr *document.ValidationError
+	if errors.As(err, &verr) {
+		for _, f := range verr.Fields {
+			body.Error.Fields = append(body.Error.Fields, FieldError{Field: f.Field, Message: f.Err.Error()})
+		}
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
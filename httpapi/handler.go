@@ -0,0 +1,876 @@
+// Package httpapi provides an HTTP/JSON interface to a kical
+// database, it is an http.Handler so it can be mounted anywhere
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/kv"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// DefaultLimit is the page size of scans without a limit
+const DefaultLimit = 100
+
+// MaxLimit is the largest page size accepted by scans
+const MaxLimit = 10000
+
+// Handler serves the REST API of a database
+//
+// Routes, relative to where the handler is mounted:
+//
+//	GET    /tables                        list tables
+//	POST   /tables                        create a table
+//	GET    /tables/{table}                table metadata
+//	POST   /tables/{table}/schema         change the schema of a document table
+//	GET    /tables/{table}/keys           scan a kv table
+//	GET    /tables/{table}/keys/{key}     get a kv entry
+//	PUT    /tables/{table}/keys/{key}     set a kv entry
+//	DELETE /tables/{table}/keys/{key}     delete a kv entry
+//	GET    /tables/{table}/documents      scan a document table
+//	POST   /tables/{table}/documents      insert a document
+//	GET    /tables/{table}/documents/{pk} get a document
+//	PUT    /tables/{table}/documents/{pk} replace a document
+//	PATCH  /tables/{table}/documents/{pk} set and unset paths into object fields
+//	DELETE /tables/{table}/documents/{pk} delete a document
+//	POST   /tables/{table}/documents/{pk}/tags/{field}
+//	                                      add and remove tags
+//	PUT    /tables/{table}/paths/{path}   index a path into an object field
+//	DELETE /tables/{table}/paths/{path}   drop the index of a path
+//	POST   /tables/{table}/batch          apply several writes atomically
+//	POST   /tables/{table}/refresh        rebuild a materialized view
+//	POST   /query                         run a query
+//
+// Scans accept the `cursor` and `limit` query parameters and
+// return the cursor of the next page in `next`.
+//
+// With SetSecurity, reads need the read permission on the keys or
+// tables they return, writes the write permission on the keys
+// they write and table changes the admin permission on the table.
+type Handler struct {
+	db       *kical.Database
+	security *security.Store
+}
+
+// NewHandler creates a new handler serving db
+func NewHandler(db *kical.Database) *Handler {
+	return &Handler{db: db}
+}
+
+// ScanResponse is the body of a scan
+type ScanResponse struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// Entry is the JSON form of a kv entry
+type Entry struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// BatchOp is a single write of a batch request, Op is one of
+// `set`, `delete` for kv tables and `insert`, `set`, `delete`
+// for document tables
+type BatchOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// BatchRequest is the body of a batch request
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// BatchResponse is the body returned by a batch request, Keys
+// holds the primary key of every insert in order
+type BatchResponse struct {
+	Applied int      `json:"applied"`
+	Keys    []string `json:"keys,omitempty"`
+}
+
+// TagsRequest is the body of a tag update, tags are added
+// before the removed ones are taken away
+type TagsRequest struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// PatchRequest is the body of a partial document update, Set maps
+// dotted paths into object fields, such as meta.labels.zone, to
+// their new value and Unset lists the paths removed afterwards
+type PatchRequest struct {
+	Set   map[string]interface{} `json:"set,omitempty"`
+	Unset []string               `json:"unset,omitempty"`
+}
+
+// QueryRequest is the body of a query request
+type QueryRequest struct {
+	Query string `json:"query"`
+}
+
+// QueryResponse is the body returned by a query request
+type QueryResponse struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, CodeBadRequest, err))
+		return
+	}
+	r, err = h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "query" {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed(r))
+			return
+		}
+		h.query(w, r)
+		return
+	}
+	if len(parts) == 0 || parts[0] != "tables" {
+		writeError(w, notFound(r))
+		return
+	}
+	switch len(parts) {
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			h.listTables(w, r)
+		case http.MethodPost:
+			h.createTable(w, r)
+		default:
+			writeError(w, methodNotAllowed(r))
+		}
+		return
+	case 2:
+		if r.Method != http.MethodGet {
+			writeError(w, methodNotAllowed(r))
+			return
+		}
+		h.describeTable(w, r, parts[1])
+		return
+	}
+	// the user must be granted some keys of the table before it is
+	// looked up, the missing tables are only told to the users who
+	// may see them
+	_, err = h.filter(r, parts[1], "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tbl, err := h.table(parts[1])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case parts[2] == "keys" && len(parts) == 3 && r.Method == http.MethodGet:
+		h.scanKeys(w, r, tbl)
+	case parts[2] == "keys" && len(parts) == 4:
+		h.key(w, r, tbl, parts[3])
+	case parts[2] == "documents" && len(parts) == 3:
+		switch r.Method {
+		case http.MethodGet:
+			h.scanDocuments(w, r, tbl)
+		case http.MethodPost:
+			h.insertDocument(w, r, tbl)
+		default:
+			writeError(w, methodNotAllowed(r))
+		}
+	case parts[2] == "documents" && len(parts) == 4:
+		h.document(w, r, tbl, parts[3])
+	case parts[2] == "documents" && len(parts) == 6 && parts[4] == "tags":
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed(r))
+			return
+		}
+		h.updateTags(w, r, tbl, parts[3], parts[5])
+	case parts[2] == "paths" && len(parts) == 4:
+		h.path(w, r, tbl, parts[3])
+	case parts[2] == "batch" && len(parts) == 3 && r.Method == http.MethodPost:
+		h.batch(w, r, tbl)
+	case parts[2] == "schema" && len(parts) == 3 && r.Method == http.MethodPost:
+		h.alterTable(w, r, tbl)
+	case parts[2] == "refresh" && len(parts) == 3 && r.Method == http.MethodPost:
+		h.refreshView(w, r, tbl)
+	case len(parts) <= 4 && (parts[2] == "keys" || parts[2] == "documents" || parts[2] == "batch" || parts[2] == "schema" || parts[2] == "refresh"):
+		writeError(w, methodNotAllowed(r))
+	default:
+		writeError(w, notFound(r))
+	}
+}
+
+func splitPath(p string) ([]string, error) {
+	var ret []string
+	for _, s := range strings.Split(p, "/") {
+		if s == "" {
+			continue
+		}
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+func notFound(r *http.Request) error {
+	return newError(http.StatusNotFound, CodeNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return newError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Errorf("method %s not allowed on %s", r.Method, r.URL.Path))
+}
+
+func (h *Handler) table(name string) (*kical.Table, error) {
+	tbl, err := h.db.Table(name)
+	if err == storage.ErrNoSuchKey {
+		return nil, newError(http.StatusNotFound, CodeTableNotFound, fmt.Errorf("no such table %q", name))
+	}
+	return tbl, err
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, err)
+	}
+	return nil
+}
+
+func decodeRaw(rs json.RawMessage, v interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(string(rs)))
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, err)
+	}
+	return nil
+}
+
+// plainRow converts the nested numbers of row, numbers held
+// directly by fields are left to the schema so that decimal
+// fields read them exactly
+func plainRow(row document.Row) document.Row {
+	for k, v := range row {
+		if _, ok := v.(json.Number); !ok {
+			row[k] = document.PlainValue(v)
+		}
+	}
+	return row
+}
+
+func pageParams(r *http.Request) (string, int, error) {
+	q := r.URL.Query()
+	limit := DefaultLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > MaxLimit {
+			return "", 0, newError(http.StatusBadRequest, CodeBadRequest, fmt.Errorf("bad limit %q", l))
+		}
+		limit = n
+	}
+	return q.Get("cursor"), limit, nil
+}
+
+func (h *Handler) listTables(w http.ResponseWriter, r *http.Request) {
+	names, err := h.db.Tables()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ret := []string{}
+	for _, name := range names {
+		if h.visible(r, name) {
+			ret = append(ret, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (h *Handler) createTable(w http.ResponseWriter, r *http.Request) {
+	var s TableSchema
+	err := decodeBody(r, &s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if s.Name == "" {
+		writeError(w, newError(http.StatusBadRequest, CodeBadRequest, fmt.Errorf("missing table name")))
+		return
+	}
+	err = h.authorize(r, s.Name, "", security.Admin)
+	if err == nil && s.View != nil {
+		// a view exposes the rows of its source
+		if sel, ok := parseSelect(s.View.Query); ok {
+			err = h.authorize(r, sel.Table, "", security.Read)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var tbl *kical.Table
+	if s.View != nil {
+		tbl, err = h.db.CreateView(s.Name, s.View.Query)
+	} else {
+		var m *metaparser.Metadata
+		m, err = s.metadata()
+		if err == nil {
+			tbl, err = h.db.CreateTable(s.Name, m)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, schemaOf(s.Name, tbl.GetMetadata()))
+}
+
+func parseSelect(src string) (*query.Select, bool) {
+	stmt, err := query.Parse(src)
+	if err != nil {
+		return nil, false
+	}
+	sel, ok := stmt.(*query.Select)
+	return sel, ok
+}
+
+func (h *Handler) refreshView(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	err := h.authorize(r, tbl.GetName(), "", security.Admin)
+	if err == nil {
+		err = h.db.RefreshView(tbl.GetName())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schemaOf(tbl.GetName(), tbl.GetMetadata()))
+}
+
+func (h *Handler) describeTable(w http.ResponseWriter, r *http.Request, name string) {
+	_, err := h.filter(r, name, "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tbl, err := h.table(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schemaOf(name, tbl.GetMetadata()))
+}
+
+// alterTable applies the changes in order and stops at the first
+// failing one, the changes before it stay applied, it answers
+// 202 Accepted when the rows are rewritten in the background
+func (h *Handler) alterTable(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	var req AlterRequest
+	err := h.authorize(r, tbl.GetName(), "", security.Admin)
+	if err == nil {
+		err = decodeBody(r, &req)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	changes := make([]metaparser.Change, len(req.Changes))
+	for i := range req.Changes {
+		changes[i], err = req.Changes[i].change()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	err = tbl.AlterSchema(changes...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if req.Rewrite {
+		go tbl.RewriteRows(context.Background())
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, schemaOf(tbl.GetName(), tbl.GetMetadata()))
+}
+
+func (h *Handler) scanKeys(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	t, err := tbl.GetKV()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	allowed, err := h.filter(r, tbl.GetName(), "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entries, next, err := t.Scan(cursor, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	items := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		if allowed == nil || allowed(e.Key) {
+			items = append(items, Entry{Key: e.Key, Value: e.Value})
+		}
+	}
+	writeJSON(w, http.StatusOK, &ScanResponse{Items: items, Next: next})
+}
+
+func (h *Handler) key(w http.ResponseWriter, r *http.Request, tbl *kical.Table, key string) {
+	t, err := tbl.GetKV()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		err = h.authorize(r, tbl.GetName(), key, security.Read)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		v, err := t.Get(key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &Entry{Key: key, Value: v})
+	case http.MethodPut, http.MethodDelete:
+		err = h.authorize(r, tbl.GetName(), key, security.Write)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s := t.NewSession()
+		if r.Method == http.MethodPut {
+			var v interface{}
+			err = decodeBody(r, &v)
+			if err == nil {
+				err = s.Set(key, document.PlainValue(v))
+			}
+		} else {
+			err = s.Delete(key)
+		}
+		if err != nil {
+			s.Close()
+			writeError(w, err)
+			return
+		}
+		err = s.Commit()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, methodNotAllowed(r))
+	}
+}
+
+func (h *Handler) scanDocuments(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	d, err := tbl.GetDocument()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	allowed, err := h.filter(r, tbl.GetName(), "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cursor, limit, err := pageParams(r)
+	if err == nil && cursor != "" {
+		cursor, err = d.ParseKey(cursor)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rows, next, err := d.Scan(cursor, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if allowed != nil {
+		rows = filterRows(d, rows, allowed)
+	}
+	if rows == nil {
+		rows = []document.Row{}
+	}
+	if next != "" {
+		next = d.KeyText(next)
+	}
+	writeJSON(w, http.StatusOK, &ScanResponse{Items: rows, Next: next})
+}
+
+func (h *Handler) insertDocument(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	d, err := tbl.GetDocument()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var row document.Row
+	err = decodeBody(r, &row)
+	if err == nil {
+		err = h.authorize(r, tbl.GetName(), rowKey(d, row), security.Write)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s := d.NewSession()
+	pk, err := s.Insert(plainRow(row))
+	if err != nil {
+		s.Close()
+		writeError(w, err)
+		return
+	}
+	err = s.Commit()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	row, err = d.Get(pk)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, row)
+}
+
+func (h *Handler) document(w http.ResponseWriter, r *http.Request, tbl *kical.Table, pk string) {
+	perm := security.Write
+	if r.Method == http.MethodGet {
+		perm = security.Read
+	}
+	d, err := tbl.GetDocument()
+	if err == nil {
+		pk, err = d.ParseKey(pk)
+	}
+	if err == nil {
+		err = h.authorize(r, tbl.GetName(), d.KeyText(pk), perm)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		row, err := d.Get(pk)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, row)
+	case http.MethodPut, http.MethodDelete:
+		s := d.NewSession()
+		if r.Method == http.MethodPut {
+			var row document.Row
+			err = decodeBody(r, &row)
+			if err == nil {
+				err = s.Set(pk, plainRow(row))
+			}
+		} else {
+			err = s.Delete(pk)
+		}
+		if err != nil {
+			s.Close()
+			writeError(w, err)
+			return
+		}
+		err = s.Commit()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var req PatchRequest
+		err = decodeBody(r, &req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		row, err := d.UpdatePaths(pk, req.Set, req.Unset)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, row)
+	default:
+		writeError(w, methodNotAllowed(r))
+	}
+}
+
+// path indexes a path into an object field or drops its index
+func (h *Handler) path(w http.ResponseWriter, r *http.Request, tbl *kical.Table, path string) {
+	d, err := tbl.GetDocument()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = h.authorize(r, tbl.GetName(), "", security.Admin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		err = d.IndexPath(path)
+	case http.MethodDelete:
+		err = d.DropPathIndex(path)
+	default:
+		err = methodNotAllowed(r)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request, tbl *kical.Table) {
+	var req BatchRequest
+	err := decodeBody(r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	authorize := func(key string) error {
+		return h.authorize(r, tbl.GetName(), key, security.Write)
+	}
+	var resp *BatchResponse
+	switch {
+	case tbl.IsKV():
+		resp, err = batchKV(tbl.KV.NewSession(), req.Ops, authorize)
+	case tbl.IsRowDocument():
+		resp, err = batchDocument(tbl.Document, req.Ops, authorize)
+	default:
+		err = newError(http.StatusBadRequest, CodeWrongStorageType, fmt.Errorf("batch is not supported on this table"))
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func badOp(i int, op string) error {
+	return newError(http.StatusBadRequest, CodeBadRequest, fmt.Errorf("op %d: unsupported op %q", i, op))
+}
+
+// batchKV applies ops in s, authorize checks the key of every op
+// before it is applied
+func batchKV(s *kv.Session, ops []BatchOp, authorize func(key string) error) (*BatchResponse, error) {
+	for i, op := range ops {
+		err := authorize(op.Key)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		switch op.Op {
+		case "set":
+			var v interface{}
+			err = decodeRaw(op.Value, &v)
+			if err == nil {
+				err = s.Set(op.Key, document.PlainValue(v))
+			}
+		case "delete":
+			err = s.Delete(op.Key)
+		default:
+			err = badOp(i, op.Op)
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	err := s.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &BatchResponse{Applied: len(ops)}, nil
+}
+
+// batchDocument applies ops in a session of d, authorize checks
+// the key of every op before it is applied
+func batchDocument(d *document.Document, ops []BatchOp, authorize func(key string) error) (*BatchResponse, error) {
+	s := d.NewSession()
+	resp := &BatchResponse{}
+	var err error
+	for i, op := range ops {
+		var row document.Row
+		var pk string
+		switch op.Op {
+		case "insert":
+			err = decodeRaw(op.Value, &row)
+			if err == nil {
+				err = authorize(rowKey(d, row))
+			}
+			if err == nil {
+				pk, err = s.Insert(plainRow(row))
+				resp.Keys = append(resp.Keys, d.KeyText(pk))
+			}
+		case "set":
+			pk, err = d.ParseKey(op.Key)
+			if err == nil {
+				err = authorize(d.KeyText(pk))
+			}
+			if err == nil {
+				err = decodeRaw(op.Value, &row)
+			}
+			if err == nil {
+				err = s.Set(pk, plainRow(row))
+			}
+		case "delete":
+			pk, err = d.ParseKey(op.Key)
+			if err == nil {
+				err = authorize(d.KeyText(pk))
+			}
+			if err == nil {
+				err = s.Delete(pk)
+			}
+		default:
+			err = badOp(i, op.Op)
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	err = s.Commit()
+	if err != nil {
+		return nil, err
+	}
+	resp.Applied = len(ops)
+	return resp, nil
+}
+
+func (h *Handler) updateTags(w http.ResponseWriter, r *http.Request, tbl *kical.Table, pk, field string) {
+	d, err := tbl.GetDocument()
+	if err == nil {
+		pk, err = d.ParseKey(pk)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req TagsRequest
+	err = h.authorize(r, tbl.GetName(), d.KeyText(pk), security.Write)
+	if err == nil {
+		err = decodeBody(r, &req)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	row, err := d.UpdateTags(pk, field, req.Add, req.Remove)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, row)
+}
+
+// catalog resolves the tables of queries, the user of r needs to
+// read them whole
+type catalog struct {
+	h *Handler
+	r *http.Request
+}
+
+func (c catalog) Document(name string) (*document.Document, error) {
+	err := c.h.authorize(c.r, name, "", security.Read)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := c.h.table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetDocument()
+}
+
+func (c catalog) Chunked(name string) (query.Chunked, error) {
+	err := c.h.authorize(c.r, name, "", security.Read)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := c.h.table(name)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.GetAnalytical()
+}
+
+func (h *Handler) query(w http.ResponseWriter, r *http.Request) {
+	var q QueryRequest
+	err := decodeBody(r, &q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rs, err := query.Run(catalog{h, r}, q.Query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if rs.Rows == nil {
+		rs.Rows = [][]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, &QueryResponse{Columns: rs.Columns, Rows: rs.Rows})
+}
+
+// rowKey returns the primary key row is stored under in text form,
+// empty when it is generated on insert or invalid
+func rowKey(d *document.Document, row document.Row) string {
+	pk, err := d.PrimaryKeyOf(plainRow(row))
+	if err != nil {
+		return ""
+	}
+	return d.KeyText(pk)
+}
+
+// filterRows returns the rows whose primary key allowed accepts
+func filterRows(d *document.Document, rows []document.Row, allowed func(key string) bool) []document.Row {
+	ret := rows[:0]
+	for _, row := range rows {
+		if pk, err := d.PrimaryKeyOf(row); err == nil && allowed(d.KeyText(pk)) {
+			ret = append(ret, row)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,554 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/httpapi"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(httpapi.NewHandler(db))
+	t.Cleanup(func() {
+		srv.Close()
+		drv.Close()
+	})
+	return srv
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string, status int, out interface{}) {
+	doAs(t, srv, "", method, path, body, status, out)
+}
+
+// doAs sends the request authenticated with token
+func doAs(t *testing.T, srv *httptest.Server, token, method, path, body string, status int, out interface{}) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		var e map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		t.Fatalf("%s %s: got status %d, want %d: %v", method, path, resp.StatusCode, status, e)
+	}
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKV(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{"name":"reg","storage_type":"kv"}`, 201, nil)
+	do(t, srv, "POST", "/tables", `{"name":"reg","storage_type":"kv"}`, 409, nil)
+	do(t, srv, "PUT", "/tables/reg/keys/a%2Fb", `{"port":8080}`, 204, nil)
+	do(t, srv, "POST", "/tables/reg/batch", `{"ops":[{"op":"set","key":"b","value":"x"},{"op":"set","key":"c","value":1.5},{"op":"delete","key":"c"}]}`, 200, nil)
+
+	var e httpapi.Entry
+	do(t, srv, "GET", "/tables/reg/keys/a%2Fb", "", 200, &e)
+	if m, ok := e.Value.(map[string]interface{}); !ok || m["port"] != float64(8080) {
+		t.Fatalf("unexpected value %v", e.Value)
+	}
+	do(t, srv, "GET", "/tables/reg/keys/c", "", 404, nil)
+
+	var page struct {
+		Items []httpapi.Entry `json:"items"`
+		Next  string          `json:"next"`
+	}
+	do(t, srv, "GET", "/tables/reg/keys?limit=1", "", 200, &page)
+	if len(page.Items) != 1 || page.Items[0].Key != "a/b" || page.Next != "b" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	cursor := page.Next
+	page.Next = ""
+	do(t, srv, "GET", "/tables/reg/keys?limit=1&cursor="+cursor, "", 200, &page)
+	if len(page.Items) != 1 || page.Items[0].Value != "x" || page.Next != "" {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+
+	var names []string
+	do(t, srv, "GET", "/tables", "", 200, &names)
+	if len(names) != 1 || names[0] != "reg" {
+		t.Fatalf("unexpected tables %v", names)
+	}
+	do(t, srv, "GET", "/tables/reg/documents", "", 400, nil)
+	do(t, srv, "GET", "/tables/nope/keys", "", 404, nil)
+}
+
+func TestDocuments(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "services",
+		"storage_type": "row",
+		"fields": [{"name": "name", "type": "string"}, {"name": "port", "type": "integer"}],
+		"primary_key": {"type": "auto_increment", "name": "id"}
+	}`, 201, nil)
+
+	var schema httpapi.TableSchema
+	do(t, srv, "GET", "/tables/services", "", 200, &schema)
+	if len(schema.Fields) != 2 || schema.Fields[1].Type != "integer" || schema.PrimaryKey.Name != "id" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+
+	var row map[string]interface{}
+	do(t, srv, "POST", "/tables/services/documents", `{"name":"api","port":80}`, 201, &row)
+	if row["id"] != float64(1) {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "POST", "/tables/services/documents", `{"name":"api","port":"eighty"}`, 400, nil)
+	do(t, srv, "POST", "/tables/services/documents", `{"name":"api","color":"red"}`, 400, nil)
+
+	var br httpapi.BatchResponse
+	do(t, srv, "POST", "/tables/services/batch", `{"ops":[{"op":"insert","value":{"name":"db","port":5432}},{"op":"set","key":"1","value":{"name":"api","port":443}}]}`, 200, &br)
+	if br.Applied != 2 || len(br.Keys) != 1 || br.Keys[0] != "2" {
+		t.Fatalf("unexpected batch response %+v", br)
+	}
+	do(t, srv, "GET", "/tables/services/documents/1", "", 200, &row)
+	if row["port"] != float64(443) {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "DELETE", "/tables/services/documents/2", "", 204, nil)
+	do(t, srv, "GET", "/tables/services/documents/2", "", 404, nil)
+	do(t, srv, "POST", "/tables/services/documents/1", "", 405, nil)
+}
+
+func TestQuery(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "services",
+		"storage_type": "row",
+		"fields": [{"name": "name", "type": "string"}, {"name": "tier", "type": "enum"}],
+		"primary_key": {"type": "auto_increment", "name": "id"},
+		"unique": ["name"]
+	}`, 201, nil)
+	do(t, srv, "POST", "/tables/services/batch", `{"ops":[
+		{"op":"insert","value":{"name":"api","tier":"gold"}},
+		{"op":"insert","value":{"name":"db","tier":"gold"}},
+		{"op":"insert","value":{"name":"cache","tier":"silver"}}
+	]}`, 200, nil)
+	do(t, srv, "POST", "/tables/services/documents", `{"name":"api"}`, 409, nil)
+
+	var rs httpapi.QueryResponse
+	do(t, srv, "POST", "/query", `{"query":"SELECT name FROM services WHERE tier = 'gold' ORDER BY name DESC"}`, 200, &rs)
+	if len(rs.Columns) != 1 || len(rs.Rows) != 2 || rs.Rows[0][0] != "db" || rs.Rows[1][0] != "api" {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+	do(t, srv, "POST", "/query", `{"query":"SELECT name FROM services WHERE"}`, 400, nil)
+	do(t, srv, "POST", "/query", `{"query":"SELECT * FROM nope"}`, 404, nil)
+	do(t, srv, "GET", "/query", "", 405, nil)
+}
+
+func TestTags(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "hosts",
+		"storage_type": "row",
+		"fields": [{"name": "tags", "type": "tag"}],
+		"primary_key": {"type": "custom", "name": "host"}
+	}`, 201, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/a", `{"tags":["gpu","canary","gpu"]}`, 204, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/b", `{"tags":["gpu"]}`, 204, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/c", `{"tags":[""]}`, 400, nil)
+
+	var row map[string]interface{}
+	do(t, srv, "POST", "/tables/hosts/documents/b/tags/tags", `{"add":["canary","edge"],"remove":["gpu"]}`, 200, &row)
+	if tags, ok := row["tags"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "canary" || tags[1] != "edge" {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "POST", "/tables/hosts/documents/z/tags/tags", `{"add":["x"]}`, 404, nil)
+	do(t, srv, "GET", "/tables/hosts/documents/b/tags/tags", "", 405, nil)
+
+	var rs httpapi.QueryResponse
+	do(t, srv, "POST", "/query", `{"query":"SELECT host FROM hosts WHERE tags HAS 'canary' AND NOT tags HAS 'gpu'"}`, 200, &rs)
+	if len(rs.Rows) != 1 || rs.Rows[0][0] != "b" {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "ledger",
+		"storage_type": "row",
+		"fields": [{"name": "amount", "type": "decimal", "precision": 20, "scale": 2}],
+		"primary_key": {"type": "custom", "name": "entry"}
+	}`, 201, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "GET", "/tables/ledger", "", 200, &schema)
+	if len(schema.Fields) != 1 || schema.Fields[0].Precision != 20 || schema.Fields[0].Scale != 2 {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	do(t, srv, "PUT", "/tables/ledger/documents/a", `{"amount":12345678901234567.89}`, 204, nil)
+	do(t, srv, "PUT", "/tables/ledger/documents/b", `{"amount":"0.1"}`, 204, nil)
+	do(t, srv, "PUT", "/tables/ledger/documents/c", `{"amount":0.001}`, 400, nil)
+
+	var row map[string]interface{}
+	do(t, srv, "GET", "/tables/ledger/documents/a", "", 200, &row)
+	if row["amount"] != "12345678901234567.89" {
+		t.Fatalf("unexpected row %v", row)
+	}
+	var rs httpapi.QueryResponse
+	do(t, srv, "POST", "/query", `{"query":"SELECT SUM(amount) FROM ledger"}`, 200, &rs)
+	if len(rs.Rows) != 1 || rs.Rows[0][0] != "12345678901234567.99" {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+}
+
+func TestTime(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "beats",
+		"storage_type": "row",
+		"fields": [{"name": "at", "type": "time"}, {"name": "host", "type": "string"}],
+		"primary_key": {"type": "custom", "name": "at"}
+	}`, 201, nil)
+	do(t, srv, "PUT", "/tables/beats/documents/2024-03-01T08:00:00+08:00", `{"host":"a"}`, 204, nil)
+	var br httpapi.BatchResponse
+	do(t, srv, "POST", "/tables/beats/batch", `{"ops":[{"op":"insert","value":{"at":"2024-03-01T01:00:00-05:00","host":"b"}}]}`, 200, &br)
+	if len(br.Keys) != 1 || br.Keys[0] != "2024-03-01T06:00:00Z" {
+		t.Fatalf("unexpected batch response %+v", br)
+	}
+	do(t, srv, "PUT", "/tables/beats/documents/soon", `{"host":"c"}`, 400, nil)
+
+	var row map[string]interface{}
+	do(t, srv, "GET", "/tables/beats/documents/2024-03-01T00:00:00Z", "", 200, &row)
+	if row["at"] != "2024-03-01T00:00:00Z" || row["host"] != "a" {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "GET", "/tables/beats/documents/2024-03-01T06:00:00Z", "", 200, &row)
+	if row["at"] != "2024-03-01T01:00:00-05:00" {
+		t.Fatalf("the offset was not kept: %v", row)
+	}
+	var rs httpapi.QueryResponse
+	do(t, srv, "POST", "/query", `{"query":"SELECT host FROM beats WHERE at > '2024-03-01T03:00:00+02:00' ORDER BY at"}`, 200, &rs)
+	if len(rs.Rows) != 1 || rs.Rows[0][0] != "b" {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+}
+
+func TestAlterSchema(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "hosts",
+		"storage_type": "row",
+		"fields": [{"name": "addr", "type": "string"}, {"name": "cores", "type": "integer"}],
+		"primary_key": {"type": "custom", "name": "host"}
+	}`, 201, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/a", `{"addr":"10.0.0.1","cores":4}`, 204, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "POST", "/tables/hosts/schema", `{"changes":[
+		{"op":"rename","field":"addr","name":"ip"},
+		{"op":"retype","field":"cores","type":"float"},
+		{"op":"add","field":"rack","type":"enum","default":"r1"}
+	]}`, 200, &schema)
+	if schema.Version != 3 || len(schema.Fields) != 3 || schema.Fields[2].Default != "r1" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	var row map[string]interface{}
+	do(t, srv, "GET", "/tables/hosts/documents/a", "", 200, &row)
+	if row["ip"] != "10.0.0.1" || row["cores"] != 4.0 || row["rack"] != "r1" || row["addr"] != nil {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "POST", "/tables/hosts/schema", `{"changes":[{"op":"retype","field":"ip","type":"integer"}]}`, 400, nil)
+	do(t, srv, "POST", "/tables/hosts/schema", `{"changes":[{"op":"drop","field":"rack"}]}`, 200, &schema)
+	if schema.Version != 4 {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	do(t, srv, "GET", "/tables/hosts/schema", "", 405, nil)
+}
+
+func TestObjects(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "hosts",
+		"storage_type": "row",
+		"fields": [{"name": "meta", "type": "object"}],
+		"primary_key": {"type": "custom", "name": "host"},
+		"paths": ["meta.labels.zone"]
+	}`, 201, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/a", `{"meta":{"labels":{"zone":"eu"},"cpu":4,"disks":["sda"]}}`, 204, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/b", `{"meta":{"labels":{"zone":"us"},"cpu":2.5}}`, 204, nil)
+	var row map[string]interface{}
+	do(t, srv, "PATCH", "/tables/hosts/documents/a", `{"set":{"meta.labels.zone":"us","meta.disks.1":"sdb"},"unset":["meta.cpu"]}`, 200, &row)
+	meta, _ := row["meta"].(map[string]interface{})
+	if meta["cpu"] != nil || len(meta["disks"].([]interface{})) != 2 || meta["labels"].(map[string]interface{})["zone"] != "us" {
+		t.Fatalf("unexpected row %v", row)
+	}
+	do(t, srv, "PATCH", "/tables/hosts/documents/a", `{"set":{"meta.disks.5":"sdc"}}`, 400, nil)
+	do(t, srv, "PATCH", "/tables/hosts/documents/c", `{"set":{"meta.cpu":1}}`, 404, nil)
+
+	do(t, srv, "PUT", "/tables/hosts/paths/meta.cpu", "", 204, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "GET", "/tables/hosts", "", 200, &schema)
+	if len(schema.Paths) != 2 || schema.Paths[1] != "meta.cpu" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	var rs httpapi.QueryResponse
+	do(t, srv, "POST", "/query", `{"query":"SELECT host, meta.cpu FROM hosts WHERE meta.labels.zone = 'us' ORDER BY host"}`, 200, &rs)
+	if len(rs.Rows) != 2 || rs.Rows[0][1] != nil || rs.Rows[1][1] != 2.5 {
+		t.Fatalf("unexpected rows %v", rs.Rows)
+	}
+	do(t, srv, "DELETE", "/tables/hosts/paths/meta.cpu", "", 204, nil)
+	do(t, srv, "DELETE", "/tables/hosts/paths/meta.cpu", "", 400, nil)
+	do(t, srv, "PUT", "/tables/hosts/paths/host.x", "", 400, nil)
+}
+
+func TestConstraints(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "agents",
+		"storage_type": "row",
+		"fields": [
+			{"name": "host", "type": "string", "constraint": {"required": true, "pattern": "[a-z]+"}},
+			{"name": "port", "type": "integer", "default": "22", "constraint": {"min": "1", "max": "65535"}}
+		],
+		"primary_key": {"type": "auto_increment", "name": "id"}
+	}`, 201, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "GET", "/tables/agents", "", 200, &schema)
+	if schema.Fields[0].Constraint == nil || !schema.Fields[0].Constraint.Required || schema.Fields[1].Default != "22" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	var e struct {
+		Error httpapi.Error `json:"error"`
+	}
+	do(t, srv, "POST", "/tables/agents/documents", `{"port": 70000}`, 400, &e)
+	if e.Error.Code != httpapi.CodeInvalidDocument || len(e.Error.Fields) != 2 || e.Error.Fields[0].Field != "host" || e.Error.Fields[1].Field != "port" {
+		t.Fatalf("unexpected error %+v", e.Error)
+	}
+	do(t, srv, "POST", "/tables/agents/documents", `{"host": "web"}`, 201, nil)
+}
+
+func TestReferences(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "hosts",
+		"storage_type": "row",
+		"primary_key": {"type": "custom", "name": "name"}
+	}`, 201, nil)
+	do(t, srv, "POST", "/tables", `{
+		"name": "services",
+		"storage_type": "row",
+		"fields": [{"name": "host", "type": "string"}],
+		"primary_key": {"type": "custom", "name": "name"},
+		"references": [{"field": "host", "table": "hosts"}]
+	}`, 201, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "GET", "/tables/services", "", 200, &schema)
+	if len(schema.References) != 1 || schema.References[0].Table != "hosts" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	do(t, srv, "PUT", "/tables/services/documents/api", `{"host": "web"}`, 409, nil)
+	do(t, srv, "PUT", "/tables/hosts/documents/web", `{}`, 204, nil)
+	do(t, srv, "PUT", "/tables/services/documents/api", `{"host": "web"}`, 204, nil)
+	var e struct {
+		Error httpapi.Error `json:"error"`
+	}
+	do(t, srv, "DELETE", "/tables/hosts/documents/web", "", 409, &e)
+	if e.Error.Code != httpapi.CodeReferenceViolation {
+		t.Fatalf("unexpected error %+v", e.Error)
+	}
+	do(t, srv, "DELETE", "/tables/services/documents/api", "", 204, nil)
+	do(t, srv, "DELETE", "/tables/hosts/documents/web", "", 204, nil)
+}
+
+func TestViews(t *testing.T) {
+	srv := newServer(t)
+	do(t, srv, "POST", "/tables", `{
+		"name": "endpoints",
+		"storage_type": "row",
+		"fields": [{"name": "service", "type": "enum"}, {"name": "status", "type": "enum"}],
+		"primary_key": {"type": "custom", "name": "addr"}
+	}`, 201, nil)
+	var schema httpapi.TableSchema
+	do(t, srv, "POST", "/tables", `{
+		"name": "healthy",
+		"view": {"query": "SELECT service, COUNT(*) FROM endpoints WHERE status = 'up' GROUP BY service"}
+	}`, 201, &schema)
+	if schema.View == nil || schema.View.Source != "endpoints" || schema.PrimaryKey.Name != "_group" {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+	do(t, srv, "POST", "/tables", `{"name": "bad", "view": {"query": "SELECT addr FROM endpoints LIMIT 1"}}`, 400, nil)
+	do(t, srv, "PUT", "/tables/endpoints/documents/a", `{"service": "api", "status": "up"}`, 204, nil)
+	do(t, srv, "PUT", "/tables/endpoints/documents/b", `{"service": "api", "status": "up"}`, 204, nil)
+	do(t, srv, "PUT", "/tables/endpoints/documents/c", `{"service": "api", "status": "down"}`, 204, nil)
+	var row map[string]interface{}
+	do(t, srv, "GET", "/tables/healthy/documents/"+url.PathEscape(`["api"]`), "", 200, &row)
+	if row["COUNT(*)"] != 2.0 {
+		t.Fatalf("unexpected row %v", row)
+	}
+	var e struct {
+		Error httpapi.Error `json:"error"`
+	}
+	do(t, srv, "DELETE", "/tables/healthy/documents/"+url.PathEscape(`["api"]`), "", 409, &e)
+	if e.Error.Code != httpapi.CodeReadOnlyView {
+		t.Fatalf("unexpected error %+v", e.Error)
+	}
+	do(t, srv, "POST", "/tables/healthy/refresh", "", 200, nil)
+	do(t, srv, "POST", "/tables/endpoints/refresh", "", 400, nil)
+}
+
+func TestSecurity(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetRole(&security.Role{Name: "ops", Grants: []security.Grant{{Table: security.AllTables, Permission: security.Admin}}})
+	store.SetRole(&security.Role{Name: "tenant", Grants: []security.Grant{{Table: "reg", Prefix: "acme/", Permission: security.Write}}})
+	store.SetUser(&security.User{Name: "root", Roles: []string{"ops"}})
+	store.SetUser(&security.User{Name: "alice", Roles: []string{"tenant"}})
+	root, _ := store.IssueToken("root", 0)
+	alice, _ := store.IssueToken("alice", 0)
+	h := httpapi.NewHandler(db)
+	h.SetSecurity(store)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do(t, srv, "GET", "/tables", "", 401, nil)
+	doAs(t, srv, "forged", "GET", "/tables", "", 401, nil)
+	doAs(t, srv, root, "POST", "/tables", `{"name":"reg","storage_type":"kv"}`, 201, nil)
+	doAs(t, srv, root, "POST", "/tables", `{"name":"hosts","storage_type":"row","primary_key":{"type":"custom","name":"name"},"fields":[{"name":"name","type":"string"}]}`, 201, nil)
+	doAs(t, srv, root, "PUT", "/tables/reg/keys/globex%2Fdb", `"10.0.0.1"`, 204, nil)
+	doAs(t, srv, root, "POST", "/tables/hosts/documents", `{"name":"web"}`, 201, nil)
+
+	var names []string
+	doAs(t, srv, alice, "GET", "/tables", "", 200, &names)
+	if len(names) != 1 || names[0] != "reg" {
+		t.Fatalf("alice sees tables %v", names)
+	}
+	doAs(t, srv, alice, "PUT", "/tables/reg/keys/acme%2Fdb", `"10.0.0.2"`, 204, nil)
+	doAs(t, srv, alice, "GET", "/tables/reg/keys/acme%2Fdb", "", 200, nil)
+	doAs(t, srv, alice, "GET", "/tables/reg/keys/globex%2Fdb", "", 403, nil)
+	doAs(t, srv, alice, "DELETE", "/tables/reg/keys/globex%2Fdb", "", 403, nil)
+	doAs(t, srv, alice, "POST", "/tables/reg/batch", `{"ops":[{"op":"set","key":"acme/x","value":1},{"op":"set","key":"globex/x","value":1}]}`, 403, nil)
+	doAs(t, srv, alice, "GET", "/tables/reg/keys/acme%2Fx", "", 404, nil)
+	var page struct {
+		Items []httpapi.Entry `json:"items"`
+	}
+	doAs(t, srv, alice, "GET", "/tables/reg/keys", "", 200, &page)
+	if len(page.Items) != 1 || page.Items[0].Key != "acme/db" {
+		t.Fatalf("alice scans %+v", page.Items)
+	}
+	doAs(t, srv, alice, "GET", "/tables/hosts", "", 403, nil)
+	doAs(t, srv, alice, "GET", "/tables/hosts/documents/web", "", 403, nil)
+	doAs(t, srv, alice, "POST", "/query", `{"query":"SELECT * FROM hosts"}`, 403, nil)
+	doAs(t, srv, alice, "POST", "/tables", `{"name":"mine","storage_type":"kv"}`, 403, nil)
+	doAs(t, srv, alice, "POST", "/tables/reg/schema", `{"changes":[]}`, 403, nil)
+	doAs(t, srv, root, "POST", "/query", `{"query":"SELECT * FROM hosts"}`, 200, nil)
+	// the tables are looked up once authorized, without creating them
+	doAs(t, srv, alice, "GET", "/tables/missing/keys/x", "", 403, nil)
+	doAs(t, srv, root, "GET", "/tables/missing/keys/x", "", 404, nil)
+	doAs(t, srv, root, "GET", "/tables/..%2Fescaped/keys/x", "", 400, nil)
+	if tables, _ := db.Tables(); len(tables) != 2 {
+		t.Fatalf("got tables %v", tables)
+	}
+
+	entries, err := store.Audit(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unauthenticated denials are counted together
+	var anonymous int64
+	var denied []security.AuditEntry
+	for _, e := range entries {
+		if e.User == "" {
+			anonymous += e.Count
+		} else {
+			denied = append(denied, e)
+		}
+	}
+	if anonymous != 2 || len(denied) != 9 {
+		t.Fatalf("got %d audit entries: %+v", len(entries), entries)
+	}
+	if e := denied[0]; e.User != "alice" || e.Front != httpapi.Front || e.Operation != "GET /tables/reg/keys/globex/db" || e.Key != "globex/db" {
+		t.Fatalf("bad entry %+v", e)
+	}
+}
+
+func TestCanonicalKeys(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetRole(&security.Role{Name: "ops", Grants: []security.Grant{{Table: security.AllTables, Permission: security.Admin}}})
+	store.SetRole(&security.Role{Name: "tenant", Grants: []security.Grant{
+		{Table: "beats", Prefix: "2024-03-01", Permission: security.Write},
+		{Table: "jobs", Prefix: "7", Permission: security.Write},
+	}})
+	store.SetUser(&security.User{Name: "root", Roles: []string{"ops"}})
+	store.SetUser(&security.User{Name: "alice", Roles: []string{"tenant"}})
+	root, _ := store.IssueToken("root", 0)
+	alice, _ := store.IssueToken("alice", 0)
+	h := httpapi.NewHandler(db)
+	h.SetSecurity(store)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	doAs(t, srv, root, "POST", "/tables", `{"name":"beats","storage_type":"row","primary_key":{"type":"custom","name":"at"},"fields":[{"name":"at","type":"time"}]}`, 201, nil)
+	doAs(t, srv, root, "POST", "/tables", `{"name":"jobs","storage_type":"row","primary_key":{"type":"custom","name":"id"},"fields":[{"name":"id","type":"integer"}]}`, 201, nil)
+	doAs(t, srv, root, "POST", "/tables/beats/documents", `{"at":"2024-03-02T04:00:00Z"}`, 201, nil)
+
+	// the grant sees the key the row is stored under, not the text
+	// the client wrote, this evening of March 1st in New York is
+	// March 2nd in UTC
+	doAs(t, srv, alice, "POST", "/tables/beats/documents", `{"at":"2024-03-01T23:00:00-05:00"}`, 403, nil)
+	doAs(t, srv, alice, "POST", "/tables/beats/batch", `{"ops":[{"op":"insert","value":{"at":"2024-03-01T23:00:00-05:00"}}]}`, 403, nil)
+	doAs(t, srv, alice, "POST", "/tables/beats/batch", `{"ops":[{"op":"delete","key":"2024-03-01T23:00:00-05:00"}]}`, 403, nil)
+	doAs(t, srv, alice, "POST", "/tables/beats/documents", `{"at":"2024-03-01T12:00:00+02:00"}`, 201, nil)
+	doAs(t, srv, alice, "POST", "/tables/jobs/documents", `{"id":"007"}`, 201, nil)
+	doAs(t, srv, alice, "POST", "/tables/jobs/batch", `{"ops":[{"op":"set","key":"0070","value":{}},{"op":"insert","value":{"id":"0071"}}]}`, 200, nil)
+	doAs(t, srv, alice, "POST", "/tables/jobs/documents", `{"id":"017"}`, 403, nil)
+
+	var page struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	doAs(t, srv, root, "GET", "/tables/jobs/documents", "", 200, &page)
+	if len(page.Items) != 3 {
+		t.Fatalf("got jobs %+v", page.Items)
+	}
+	doAs(t, srv, root, "GET", "/tables/beats/documents", "", 200, &page)
+	if len(page.Items) != 2 || page.Items[0]["at"] != "2024-03-01T12:00:00+02:00" {
+		t.Fatalf("got beats %+v", page.Items)
+	}
+}
@@ -0,0 +1,149 @@
+package httpapi
+
+import (
+	"fmt"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+// FieldSchema is the JSON form of metaparser.Field
+type FieldSchema struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Precision int    `json:"precision,omitempty"`
+	Scale     int    `json:"scale,omitempty"`
+	Default   string `json:"default,omitempty"`
+	// Constraint restricts the values written into the field
+	Constraint *metaparser.Constraint `json:"constraint,omitempty"`
+}
+
+// PrimaryKeySchema is the JSON form of metaparser.PrimaryKey
+type PrimaryKeySchema struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// TableSchema is the JSON form of metaparser.Metadata
+type TableSchema struct {
+	Name        string            `json:"name"`
+	StorageType string            `json:"storage_type"`
+	Fields      []FieldSchema     `json:"fields,omitempty"`
+	PrimaryKey  *PrimaryKeySchema `json:"primary_key,omitempty"`
+	K           int               `json:"k,omitempty"`
+	Unique      []string          `json:"unique,omitempty"`
+	// Indexes lists the fields holding a secondary index which is
+	// not unique
+	Indexes []string `json:"indexes,omitempty"`
+	// Paths lists the indexed paths into object fields
+	Paths []string `json:"paths,omitempty"`
+	// References lists the fields holding primary keys of other
+	// tables
+	References []metaparser.Reference `json:"references,omitempty"`
+	// Version is the number of schema changes applied to the table
+	Version int `json:"version,omitempty"`
+	// View defines a materialized view, creating a table with a
+	// view only needs its query
+	View *metaparser.View `json:"view,omitempty"`
+}
+
+// ChangeSchema is the JSON form of metaparser.Change, Op is one of
+// `add`, `drop`, `rename` and `retype`
+type ChangeSchema struct {
+	Op      string `json:"op"`
+	Field   string `json:"field"`
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Default string `json:"default,omitempty"`
+}
+
+// AlterRequest is the body of a schema change, with Rewrite the
+// rows written under older schema versions are rewritten in the
+// background
+type AlterRequest struct {
+	Changes []ChangeSchema `json:"changes"`
+	Rewrite bool           `json:"rewrite,omitempty"`
+}
+
+func (c *ChangeSchema) change() (metaparser.Change, error) {
+	ret := metaparser.Change{Op: c.Op, Field: c.Field, Name: c.Name, Default: c.Default}
+	if c.Type != "" {
+		typ, ok := common.ParseTypeName(c.Type)
+		if !ok {
+			return ret, fmt.Errorf("%w: unknown field type %q", document.ErrInvalidSchemaChange, c.Type)
+		}
+		ret.Type = typ
+	}
+	return ret, nil
+}
+
+func schemaOf(name string, m *metaparser.Metadata) *TableSchema {
+	ret := &TableSchema{
+		Name:        name,
+		StorageType: metaparser.StorageTypeName(m.StorageType),
+		K:           m.K,
+		Unique:      m.Unique,
+		Indexes:     m.Indexes,
+		Paths:       m.Paths,
+		References:  m.References,
+		Version:     m.Version(),
+		View:        m.View,
+	}
+	for _, f := range m.Fields {
+		fs := FieldSchema{
+			Name:      f.Name,
+			Type:      common.TypeName(f.Type),
+			Precision: f.Precision,
+			Scale:     f.Scale,
+			Default:   f.Default,
+		}
+		if !f.Constraint.IsZero() {
+			c := f.Constraint
+			fs.Constraint = &c
+		}
+		ret.Fields = append(ret.Fields, fs)
+	}
+	if m.PrimaryKey != nil {
+		ret.PrimaryKey = &PrimaryKeySchema{
+			Type: metaparser.PrimaryKeyTypeName(m.PrimaryKey.Type),
+			Name: m.PrimaryKey.Name,
+		}
+	}
+	return ret
+}
+
+func (s *TableSchema) metadata() (*metaparser.Metadata, error) {
+	typ, ok := metaparser.ParseStorageTypeName(s.StorageType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", metaparser.ErrNoSuchStorageType, s.StorageType)
+	}
+	m := &metaparser.Metadata{
+		StorageType: typ,
+		TableName:   s.Name,
+		K:           s.K,
+		Unique:      s.Unique,
+		Indexes:     s.Indexes,
+		Paths:       s.Paths,
+		References:  s.References,
+	}
+	for _, f := range s.Fields {
+		ft, ok := common.ParseTypeName(f.Type)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field type %q", metaparser.ErrMalformedMetadata, f.Type)
+		}
+		field := metaparser.Field{Name: f.Name, Type: ft, Precision: f.Precision, Scale: f.Scale, Default: f.Default}
+		if f.Constraint != nil {
+			field.Constraint = *f.Constraint
+		}
+		m.Fields = append(m.Fields, field)
+	}
+	if s.PrimaryKey != nil {
+		pt, ok := metaparser.ParsePrimaryKeyTypeName(s.PrimaryKey.Type)
+		if !ok || s.PrimaryKey.Name == "" {
+			return nil, fmt.Errorf("%w: bad primary key", metaparser.ErrMalformedMetadata)
+		}
+		m.PrimaryKey = &metaparser.PrimaryKey{Type: pt, Name: s.PrimaryKey.Name}
+	}
+	return m, nil
+}
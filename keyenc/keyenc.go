@@ -0,0 +1,254 @@
+// Package keyenc provides the order preserving encodings of the
+// values held by keys: byte-wise comparison of two encodings
+// orders them like the values they encode, and the encodings of
+// the elements of a tuple concatenate into the encoding of the
+// tuple, compared element by element
+package keyenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+)
+
+// ErrUnsupportedType as is
+var ErrUnsupportedType = fmt.Errorf("Value cannot be encoded in a key")
+
+// ErrMalformedKey as is
+var ErrMalformedKey = fmt.Errorf("Malformed key")
+
+// Escaping of strings: a zero byte is written as 0x00 0xff and
+// the string ends with 0x00 0x01, which sorts before every other
+// byte so that a string sorts before its extensions
+const (
+	escape     = byte(0x00)
+	escapedNul = byte(0xff)
+	terminator = byte(0x01)
+)
+
+// Lengths of the fixed size encodings
+const (
+	IntLength   = 8
+	FloatLength = 8
+	TimeLength  = 8
+)
+
+// AppendString appends the escaped encoding of s to dst
+func AppendString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == escape {
+			dst = append(dst, escape, escapedNul)
+		} else {
+			dst = append(dst, s[i])
+		}
+	}
+	return append(dst, escape, terminator)
+}
+
+// DecodeString decodes a string encoded by AppendString at the
+// start of b and returns it with the rest of b
+func DecodeString(b []byte) (string, []byte, error) {
+	var sb strings.Builder
+	for i := 0; i < len(b); i++ {
+		if b[i] != escape {
+			sb.WriteByte(b[i])
+			continue
+		}
+		if i+1 == len(b) {
+			break
+		}
+		switch b[i+1] {
+		case terminator:
+			return sb.String(), b[i+2:], nil
+		case escapedNul:
+			sb.WriteByte(0)
+			i++
+		default:
+			return "", nil, fmt.Errorf("%w: bad string escape %#x", ErrMalformedKey, b[i+1])
+		}
+	}
+	return "", nil, fmt.Errorf("%w: unterminated string", ErrMalformedKey)
+}
+
+// AppendInt appends i in big endian with the sign bit flipped
+func AppendInt(dst []byte, i int64) []byte {
+	var b [IntLength]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i)^(1<<63))
+	return append(dst, b[:]...)
+}
+
+// DecodeInt decodes an integer encoded by AppendInt
+func DecodeInt(b []byte) (int64, []byte, error) {
+	if len(b) < IntLength {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrMalformedKey)
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), b[IntLength:], nil
+}
+
+// AppendFloat appends the IEEE 754 bits of f in big endian, with
+// the sign bit flipped for positive numbers and every bit flipped
+// for negative ones, negative zero is written as zero and NaN
+// sorts after positive infinity
+func AppendFloat(dst []byte, f float64) []byte {
+	if f == 0 {
+		f = 0
+	}
+	if math.IsNaN(f) {
+		f = math.NaN()
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	var b [FloatLength]byte
+	binary.BigEndian.PutUint64(b[:], bits)
+	return append(dst, b[:]...)
+}
+
+// DecodeFloat decodes a float encoded by AppendFloat
+func DecodeFloat(b []byte) (float64, []byte, error) {
+	if len(b) < FloatLength {
+		return 0, nil, fmt.Errorf("%w: truncated float", ErrMalformedKey)
+	}
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), b[FloatLength:], nil
+}
+
+// AppendDecimal appends the encoding of d described by
+// decimal.Decimal.AppendKey, equal numbers of different scales
+// are encoded alike
+func AppendDecimal(dst []byte, d decimal.Decimal) []byte {
+	return d.AppendKey(dst)
+}
+
+// DecodeDecimal decodes a decimal encoded by AppendDecimal
+func DecodeDecimal(b []byte) (decimal.Decimal, []byte, error) {
+	d, rest, err := decimal.DecodeKey(b)
+	if err != nil {
+		return decimal.Decimal{}, nil, fmt.Errorf("%w: %v", ErrMalformedKey, err)
+	}
+	return d, rest, nil
+}
+
+// AppendTime appends the UTC nanoseconds of t since the unix
+// epoch like an integer, the offset of t is not encoded so equal
+// instants are encoded alike, t must lie between 1677-09-21 and
+// 2262-04-11 for its nanoseconds to fit an int64
+func AppendTime(dst []byte, t time.Time) []byte {
+	return AppendInt(dst, t.UnixNano())
+}
+
+// DecodeTime decodes a time encoded by AppendTime, in UTC
+func DecodeTime(b []byte) (time.Time, []byte, error) {
+	ns, rest, err := DecodeInt(b)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return time.Unix(0, ns).UTC(), rest, nil
+}
+
+// Append appends the encoding of v to dst, v is a string, an
+// int64, a float64, a decimal.Decimal or a time.Time, the
+// canonical values of the field types with keys
+func Append(dst []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case string:
+		return AppendString(dst, x), nil
+	case int64:
+		return AppendInt(dst, x), nil
+	case float64:
+		return AppendFloat(dst, x), nil
+	case decimal.Decimal:
+		return AppendDecimal(dst, x), nil
+	case time.Time:
+		return AppendTime(dst, x), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+}
+
+// Decode decodes a value of the field type typ at the start of b
+// and returns it with the rest of b, enums and tags are strings
+func Decode(b []byte, typ byte) (interface{}, []byte, error) {
+	switch typ {
+	case common.TypeString, common.TypeEnum, common.TypeTag:
+		return DecodeString(b)
+	case common.TypeInteger:
+		return DecodeInt(b)
+	case common.TypeFloat:
+		return DecodeFloat(b)
+	case common.TypeDecimal:
+		return DecodeDecimal(b)
+	case common.TypeTime:
+		return DecodeTime(b)
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedType, common.TypeName(typ))
+}
+
+// Tuple returns the encoding of the tuple of values, tuples sort
+// by their first element, then by their second one and so on
+func Tuple(values ...interface{}) ([]byte, error) {
+	var ret []byte
+	var err error
+	for _, v := range values {
+		ret, err = Append(ret, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// DecodeTuple decodes a tuple encoded by Tuple whose elements
+// have the field types types, b must hold nothing else
+func DecodeTuple(b []byte, types ...byte) ([]interface{}, error) {
+	ret := make([]interface{}, len(types))
+	for i, typ := range types {
+		var err error
+		ret[i], b, err = Decode(b, typ)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedKey, len(b))
+	}
+	return ret, nil
+}
+
+// Key returns the encoding of a key made of v alone, like Append
+// but writing strings as they are since nothing follows them
+func Key(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return Append(nil, v)
+}
+
+// DecodeKey decodes a key returned by Key holding a value of the
+// field type typ
+func DecodeKey(b []byte, typ byte) (interface{}, error) {
+	switch typ {
+	case common.TypeString, common.TypeEnum, common.TypeTag:
+		return string(b), nil
+	}
+	v, rest, err := Decode(b, typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedKey, len(rest))
+	}
+	return v, nil
+}
@@ -0,0 +1,159 @@
+package keyenc_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/keyenc"
+)
+
+// checkOrder fails unless the encodings of values, which are
+// sorted, are sorted too
+func checkOrder(t *testing.T, values []interface{}) {
+	t.Helper()
+	var prev []byte
+	for i, v := range values {
+		b, err := keyenc.Append(nil, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && bytes.Compare(prev, b) >= 0 {
+			t.Fatalf("%v does not sort after %v", v, values[i-1])
+		}
+		prev = b
+	}
+}
+
+func TestInt(t *testing.T) {
+	ints := []int64{math.MinInt64, math.MaxInt64, 0, -1, 1, 9, 10, 100, -100}
+	for i := 0; i < 200; i++ {
+		ints = append(ints, rand.Int63()-rand.Int63())
+	}
+	sort.Slice(ints, func(i, j int) bool { return ints[i] < ints[j] })
+	var values []interface{}
+	for i, n := range ints {
+		if i > 0 && n == ints[i-1] {
+			continue
+		}
+		values = append(values, n)
+		got, rest, err := keyenc.DecodeInt(keyenc.AppendInt(nil, n))
+		if err != nil || got != n || len(rest) != 0 {
+			t.Fatalf("%d: got %d, %v", n, got, err)
+		}
+	}
+	checkOrder(t, values)
+}
+
+func TestFloat(t *testing.T) {
+	floats := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 0.1, 1, 2.5, math.MaxFloat64, math.Inf(1)}
+	var values []interface{}
+	for _, f := range floats {
+		values = append(values, f)
+		got, _, err := keyenc.DecodeFloat(keyenc.AppendFloat(nil, f))
+		if err != nil || got != f {
+			t.Fatalf("%v: got %v, %v", f, got, err)
+		}
+	}
+	checkOrder(t, append(values, math.NaN()))
+	if !bytes.Equal(keyenc.AppendFloat(nil, math.Copysign(0, -1)), keyenc.AppendFloat(nil, 0)) {
+		t.Fatal("negative zero is not encoded like zero")
+	}
+	if got, _, _ := keyenc.DecodeFloat(keyenc.AppendFloat(nil, math.NaN())); !math.IsNaN(got) {
+		t.Fatalf("got %v, want NaN", got)
+	}
+}
+
+func TestString(t *testing.T) {
+	strs := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x00\xff", "\x01", "a", "a\x00", "a\x00b", "ab", "b", "\xff"}
+	var values []interface{}
+	for _, s := range strs {
+		values = append(values, s)
+		b := keyenc.AppendString(nil, s)
+		got, rest, err := keyenc.DecodeString(append(b, 'x'))
+		if err != nil || got != s || string(rest) != "x" {
+			t.Fatalf("%q: got %q, %q, %v", s, got, rest, err)
+		}
+	}
+	checkOrder(t, values)
+	for _, b := range []string{"abc", "a\x00", "a\x00\x02"} {
+		if _, _, err := keyenc.DecodeString([]byte(b)); !errors.Is(err, keyenc.ErrMalformedKey) {
+			t.Fatalf("%q: got %v, want a malformed key", b, err)
+		}
+	}
+}
+
+func TestTuple(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tuples := [][]interface{}{
+		{"a", int64(-5)},
+		{"a", int64(3)},
+		{"a", int64(10)},
+		{"a\x00", int64(-100)},
+		{"ab", int64(0)},
+		{"b", int64(0)},
+	}
+	var prev []byte
+	for i, tuple := range tuples {
+		b, err := keyenc.Tuple(tuple...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && bytes.Compare(prev, b) >= 0 {
+			t.Fatalf("%v does not sort after %v", tuple, tuples[i-1])
+		}
+		prev = b
+		got, err := keyenc.DecodeTuple(b, common.TypeString, common.TypeInteger)
+		if err != nil || got[0] != tuple[0] || got[1] != tuple[1] {
+			t.Fatalf("%v: got %v, %v", tuple, got, err)
+		}
+	}
+
+	b, err := keyenc.Tuple(decimal.MustParse("-1.50"), at, 2.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := keyenc.DecodeTuple(b, common.TypeDecimal, common.TypeTime, common.TypeFloat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].(decimal.Decimal).Cmp(decimal.MustParse("-1.5")) != 0 || !got[1].(time.Time).Equal(at) || got[2] != 2.5 {
+		t.Fatalf("unexpected tuple %v", got)
+	}
+	if _, err := keyenc.DecodeTuple(append(b, 0), common.TypeDecimal, common.TypeTime, common.TypeFloat); !errors.Is(err, keyenc.ErrMalformedKey) {
+		t.Fatalf("got %v, want a malformed key", err)
+	}
+	if _, err := keyenc.Tuple(true); !errors.Is(err, keyenc.ErrUnsupportedType) {
+		t.Fatalf("got %v, want an unsupported type", err)
+	}
+}
+
+func TestKey(t *testing.T) {
+	b, err := keyenc.Key("a\x00b")
+	if err != nil || string(b) != "a\x00b" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	checkKey := func(v interface{}, typ byte) {
+		b, err := keyenc.Key(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := keyenc.DecodeKey(b, typ)
+		if err != nil || got != v {
+			t.Fatalf("%v: got %v, %v", v, got, err)
+		}
+	}
+	checkKey("svc", common.TypeString)
+	checkKey(int64(-42), common.TypeInteger)
+	checkKey(0.25, common.TypeFloat)
+	if _, err := keyenc.DecodeKey([]byte("42"), common.TypeInteger); !errors.Is(err, keyenc.ErrMalformedKey) {
+		t.Fatalf("got %v, want a malformed key", err)
+	}
+}
@@ -0,0 +1,112 @@
+package kv
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/xtlsoft/kical/compression"
+	"github.com/xtlsoft/kical/storage"
+)
+
+const metaTypeExpire = byte('e')
+
+func prepareExpireKey(key string) []byte {
+	return append([]byte{metaInitialCharacter, metaTypeExpire}, []byte(key)...)
+}
+
+// expireAt returns the expiration time of key, ok is false if
+// the key never expires
+func expireAt(r reader, key string) (at time.Time, ok bool, err error) {
+	rs, err := r.Get(prepareExpireKey(key))
+	if err == storage.ErrNoSuchKey {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	ns, err := strconv.ParseInt(string(rs), 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, ns), true, nil
+}
+
+func expired(r reader, key string, now time.Time) (bool, error) {
+	at, ok, err := expireAt(r, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return !now.Before(at), nil
+}
+
+func ttl(r reader, c *compression.Codec, key string) (time.Duration, bool, error) {
+	_, err := get(r, c, key)
+	if err != nil {
+		return 0, false, err
+	}
+	at, ok, err := expireAt(r, key)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return time.Until(at), true, nil
+}
+
+// TTL returns the remaining time to live of key, ok is false if
+// the key never expires
+func (t *KV) TTL(key string) (d time.Duration, ok bool, err error) {
+	return ttl(t.bucket, t.codec, key)
+}
+
+// PurgeExpired deletes every expired key and returns how many
+// keys were deleted, expired keys are already invisible to reads
+// so calling it only reclaims space
+func (t *KV) PurgeExpired() (int, error) {
+	s := t.NewSession()
+	start := []byte{metaInitialCharacter, metaTypeExpire}
+	iter := s.batch.NewIter(start, []byte{metaInitialCharacter, metaTypeExpire + 1})
+	now := time.Now()
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		ns, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil {
+			iter.Close()
+			s.Close()
+			return 0, err
+		}
+		if !now.Before(time.Unix(0, ns)) {
+			keys = append(keys, string(iter.Key()[len(start):]))
+		}
+	}
+	iter.Close()
+	for _, key := range keys {
+		err := s.Delete(key)
+		if err != nil {
+			s.Close()
+			return 0, err
+		}
+	}
+	return len(keys), s.Commit()
+}
+
+// TTL returns the remaining time to live of key, ok is false if
+// the key never expires
+func (s *Session) TTL(key string) (d time.Duration, ok bool, err error) {
+	return ttl(s.batch, s.parent.codec, key)
+}
+
+// Expire makes key expire at the given time, storage.ErrNoSuchKey
+// is returned if the key does not exist
+func (s *Session) Expire(key string, at time.Time) error {
+	_, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	return s.batch.Set(prepareExpireKey(key), []byte(strconv.FormatInt(at.UnixNano(), 10)), &storage.SetOptions{
+		Synchronized: s.parent.sync,
+	})
+}
+
+// Persist removes the expiration of key
+func (s *Session) Persist(key string) error {
+	return s.batch.Delete(prepareExpireKey(key))
+}
@@ -3,11 +3,18 @@ package kv
 import (
 	"bytes"
 	"encoding/gob"
+	"time"
 
 	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/compression"
 	"github.com/xtlsoft/kical/storage"
 )
 
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
 // NewKV initializes a new KV document
 func NewKV(conf *common.DatabaseConfigure, bucket storage.Storage) *KV {
 	return &KV{
@@ -23,83 +30,252 @@ func prepareKey(key string) []byte {
 }
 
 func unprepareKey(prepared []byte) (string, bool) {
-	if prepared[0] != keyInitialCharacter {
+	if len(prepared) == 0 || prepared[0] != keyInitialCharacter {
 		return "", false
 	}
 	return string(prepared[1:]), true
 }
 
+// EncodeValue encodes a value the way it is stored in a kv table,
+// before the table codec compresses it
+func EncodeValue(value interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	encoder := gob.NewEncoder(buf)
+	err := encoder.Encode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeValue decodes a value stored in a kv table once
+// decompressed
+func DecodeValue(r []byte) (interface{}, error) {
+	decoder := gob.NewDecoder(bytes.NewBuffer(r))
+	var ret interface{}
+	err := decoder.Decode(&ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// reader is implemented by both storage.Storage and storage.Batch
+type reader interface {
+	Get(key []byte) ([]byte, error)
+	NewIter(start []byte, stop []byte) storage.Iterator
+}
+
 // KV is the KV table
 // KV data structure acts like map[string]interface{}
 type KV struct {
-	conf   *common.DatabaseConfigure
-	bucket storage.Storage
-	sync   bool
+	conf     *common.DatabaseConfigure
+	bucket   storage.Storage
+	sync     bool
+	notifier common.Notifier
+	codec    *compression.Codec
+}
+
+// SetNotifier sets the function receiving the events of every
+// committed session
+func (t *KV) SetNotifier(n common.Notifier) {
+	t.notifier = n
+}
+
+// SetCodec sets the codec compressing the stored values
+func (t *KV) SetCodec(c *compression.Codec) {
+	t.codec = c
+}
+
+// Entry is a key value pair returned by scans
+type Entry struct {
+	Key   string
+	Value interface{}
 }
 
 // Get gets an entry from the KV table
 func (t *KV) Get(key string) (interface{}, error) {
-	r, err := t.bucket.Get(prepareKey(key))
+	return get(t.bucket, t.codec, key)
+}
+
+// Scan returns at most limit entries starting from cursor, the
+// returned cursor is empty when there is nothing left
+func (t *KV) Scan(cursor string, limit int) ([]Entry, string, error) {
+	return scan(t.bucket, t.codec, cursor, limit)
+}
+
+// NewSession creates a new read-write session upon the table
+func (t *KV) NewSession() *Session {
+	return &Session{
+		parent: t,
+		batch:  t.bucket.NewBatch(storage.BatchReadWrite),
+	}
+}
+
+// NewBulkSession creates a session writing through batch, such as
+// a storage.Loader, its commit notifies no watcher
+func (t *KV) NewBulkSession(batch storage.Batch) *Session {
+	return &Session{
+		parent: t,
+		batch:  batch,
+		bulk:   true,
+	}
+}
+
+func get(r reader, c *compression.Codec, key string) (interface{}, error) {
+	rs, err := r.Get(prepareKey(key))
 	if err != nil {
 		return nil, err
 	}
-	decoder := gob.NewDecoder(bytes.NewBuffer(r))
-	var ret interface{}
-	err = decoder.Decode(ret)
+	exp, err := expired(r, key, time.Now())
 	if err != nil {
 		return nil, err
 	}
-	return ret, nil
+	if exp {
+		return nil, storage.ErrNoSuchKey
+	}
+	rs, err = c.Decompress(rs)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeValue(rs)
+}
+
+func scan(r reader, c *compression.Codec, cursor string, limit int) ([]Entry, string, error) {
+	iter := r.NewIter(prepareKey(cursor), []byte{keyInitialCharacter + 1})
+	defer iter.Close()
+	var ret []Entry
+	now := time.Now()
+	for iter.First(); iter.Valid(); iter.Next() {
+		k, ok := unprepareKey(iter.Key())
+		if !ok {
+			continue
+		}
+		exp, err := expired(r, k, now)
+		if err != nil {
+			return nil, "", err
+		}
+		if exp {
+			continue
+		}
+		if limit > 0 && len(ret) == limit {
+			return ret, k, nil
+		}
+		rs, err := c.Decompress(iter.Value())
+		if err != nil {
+			return nil, "", err
+		}
+		v, err := DecodeValue(rs)
+		if err != nil {
+			return nil, "", err
+		}
+		ret = append(ret, Entry{Key: k, Value: v})
+	}
+	return ret, "", nil
 }
 
 // Session is a KV session
 type Session struct {
 	parent *KV
 	batch  storage.Batch
+	events []common.Event
+	bulk   bool
 }
 
 // Get gets an entry from the KV table
 func (s *Session) Get(key string) (interface{}, error) {
-	r, err := s.batch.Get(prepareKey(key))
-	if err != nil {
-		return nil, err
-	}
-	decoder := gob.NewDecoder(bytes.NewBuffer(r))
-	var ret interface{}
-	err = decoder.Decode(ret)
-	if err != nil {
-		return nil, err
-	}
-	return ret, nil
+	return get(s.batch, s.parent.codec, key)
 }
 
 // Set sets something to the kv table
 func (s *Session) Set(key string, value interface{}) error {
-	buf := bytes.NewBuffer([]byte{})
-	encoder := gob.NewEncoder(buf)
-	encoder.Encode(value)
-	err := s.batch.Set(prepareKey(key), buf.Bytes(), &storage.SetOptions{
+	rs, err := EncodeValue(value)
+	if err != nil {
+		return err
+	}
+	err = s.batch.Set(prepareKey(key), s.parent.codec.Compress(rs), &storage.SetOptions{
 		Synchronized: s.parent.sync,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	err = s.Persist(key)
+	if err != nil {
+		return err
+	}
+	s.record(common.EventPut, key, value)
+	return nil
 }
 
 // Delete deletes something in the tv table
 func (s *Session) Delete(key string) error {
-	return s.batch.Delete(prepareKey(key))
+	err := s.batch.Delete(prepareKey(key))
+	if err != nil {
+		return err
+	}
+	err = s.Persist(key)
+	if err != nil {
+		return err
+	}
+	s.record(common.EventDelete, key, nil)
+	return nil
+}
+
+// Scan returns at most limit entries starting from cursor, the
+// returned cursor is empty when there is nothing left
+func (s *Session) Scan(cursor string, limit int) ([]Entry, string, error) {
+	return scan(s.batch, s.parent.codec, cursor, limit)
 }
 
 // GetKeyList returns a full list of keys
 func (s *Session) GetKeyList() ([]string, error) {
 	iter := s.batch.NewIter(nil, nil)
+	defer iter.Close()
 	iter.First()
 	var ret []string
+	now := time.Now()
 	for iter.Valid() {
 		k, ok := unprepareKey(iter.Key())
 		if ok {
-			ret = append(ret, k)
+			exp, err := expired(s.batch, k, now)
+			if err != nil {
+				return nil, err
+			}
+			if !exp {
+				ret = append(ret, k)
+			}
 		}
 		iter.Next()
 	}
 	return ret, nil
 }
+
+// Commit commits the session
+func (s *Session) Commit() error {
+	err := s.batch.Commit()
+	if err != nil {
+		return err
+	}
+	if s.parent.notifier != nil && len(s.events) != 0 {
+		s.parent.notifier(s.events)
+	}
+	s.events = nil
+	return nil
+}
+
+func (s *Session) record(typ common.EventType, key string, value interface{}) {
+	if s.parent.notifier == nil || s.bulk {
+		return
+	}
+	s.events = append(s.events, common.Event{
+		Type:  typ,
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Close discards the session, it must be called if the
+// session is not committed
+func (s *Session) Close() error {
+	return s.batch.Close()
+}
@@ -2,11 +2,74 @@ package kv_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/kv"
 	"github.com/xtlsoft/kical/storage"
 )
 
+func TestPurgeExpired(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer drv.Close()
+	bucket, err := drv.Bucket("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := kv.NewKV(nil, bucket)
+	s := table.NewSession()
+	for _, key := range []string{"gone", "later", "kept", "reset"} {
+		if err = s.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for key, at := range map[string]time.Time{
+		"gone":  now.Add(-time.Second),
+		"later": now.Add(time.Hour),
+		"reset": now.Add(-time.Second),
+	} {
+		if err = s.Expire(key, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// setting a key again drops its expiration
+	if err = s.Set("reset", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.Get("gone"); err != storage.ErrNoSuchKey {
+		t.Fatalf("expired key readable: %v", err)
+	}
+	if d, ok, err := table.TTL("later"); err != nil || !ok || d <= 0 || d > time.Hour {
+		t.Fatalf("got ttl %v %v %v", d, ok, err)
+	}
+
+	n, err := table.PurgeExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d keys, %v", n, err)
+	}
+	if n, err = table.PurgeExpired(); err != nil || n != 0 {
+		t.Fatalf("purged %d keys again, %v", n, err)
+	}
+	entries, _, err := table.Scan("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 3 || keys[0] != "kept" || keys[1] != "later" || keys[2] != "reset" {
+		t.Fatalf("got keys %v", keys)
+	}
+	if v, err := table.Get("reset"); err != nil || v != "again" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
 		BaseDirectory: "",
@@ -0,0 +1,458 @@
+// Package mapper binds Go structs to row document tables: the
+// tags of a struct describe the schema of a table and typed
+// values are converted to and from rows by encoders built once
+// per struct type
+//
+// Fields are mapped by their `kical` tag, `kical:"name,opts"`,
+// an empty name keeps the name of the Go field and `-` skips the
+// field, options are
+//
+//	pk        the primary key, custom unless auto or uuid is given
+//	auto      an auto increment primary key, an integer
+//	uuid      a uuid primary key, a string
+//	enum      a string field holding an enum
+//	unique    a field holding a unique index
+//	index     a field holding a secondary index which is not unique
+//	required  a field that must not be null
+//
+// Strings, integers, floats, decimal.Decimal and time.Time map to
+// the fields of the same type, []string to tag fields and every
+// other type, booleans included, to object fields holding its
+// JSON form. A nil pointer, slice or map and a zero time leave
+// their field null, embedded structs without a tag are flattened
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+)
+
+// ErrNotStruct as is
+var ErrNotStruct = fmt.Errorf("Value is not a struct")
+
+// ErrInvalidTag as is
+var ErrInvalidTag = fmt.Errorf("Invalid kical struct tag")
+
+// ErrNoPrimaryKey as is
+var ErrNoPrimaryKey = fmt.Errorf("Struct has no primary key field")
+
+// ErrSchemaMismatch as is
+var ErrSchemaMismatch = fmt.Errorf("Struct does not match the table schema")
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	decimalType = reflect.TypeOf(decimal.Decimal{})
+	tagsType    = reflect.TypeOf([]string(nil))
+)
+
+// field is a mapped struct field with its cached converters
+type field struct {
+	name     string
+	index    []int
+	typ      byte
+	required bool
+	// pointer reports whether the Go field is a pointer, nil
+	// pointers leave the field null
+	pointer bool
+	encode  func(v reflect.Value) (interface{}, error)
+	decode  func(x interface{}, v reflect.Value) error
+}
+
+// Mapping is the mapping of a struct type onto a document table
+type Mapping struct {
+	typ     reflect.Type
+	fields  []*field
+	pk      *field
+	pkType  byte
+	unique  []string
+	indexes []string
+}
+
+var mappings sync.Map
+
+// Of returns the mapping of the struct type of v, v is a struct
+// or a pointer to one, mappings are built once per type
+func Of(v interface{}) (*Mapping, error) {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %T", ErrNotStruct, v)
+	}
+	return typeMapping(t)
+}
+
+func typeMapping(t reflect.Type) (*Mapping, error) {
+	if m, ok := mappings.Load(t); ok {
+		return m.(*Mapping), nil
+	}
+	m := &Mapping{typ: t}
+	err := m.add(t, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.pk == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPrimaryKey, t)
+	}
+	seen := make(map[string]bool)
+	for _, f := range m.fields {
+		if seen[f.name] {
+			return nil, fmt.Errorf("%w: %s maps %s twice", ErrInvalidTag, t, f.name)
+		}
+		seen[f.name] = true
+	}
+	actual, _ := mappings.LoadOrStore(t, m)
+	return actual.(*Mapping), nil
+}
+
+// add maps the fields of the struct type t, found at index
+// within the mapped struct
+func (m *Mapping) add(t reflect.Type, index []int) error {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, hasTag := sf.Tag.Lookup("kical")
+		if tag == "-" {
+			continue
+		}
+		at := append(append([]int(nil), index...), i)
+		if sf.Anonymous && !hasTag && sf.Type.Kind() == reflect.Struct && sf.Type != timeType && sf.Type != decimalType {
+			err := m.add(sf.Type, at)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := &field{name: opts[0], index: at}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			f.pointer = true
+			ft = ft.Elem()
+		}
+		f.typ = fieldType(ft)
+		pk, pkType, indexed := false, metaparser.MetaPrimaryKeyCustom, false
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "pk":
+				pk = true
+			case "auto":
+				pk, pkType = true, metaparser.MetaPrimaryKeyAutoIncrementID
+			case "uuid":
+				pk, pkType = true, metaparser.MetaPrimaryKeyUUID
+			case "enum":
+				if f.typ != common.TypeString {
+					return fmt.Errorf("%w: enum field %s is a %s", ErrInvalidTag, sf.Name, ft)
+				}
+				f.typ = common.TypeEnum
+			case "unique":
+				m.unique = append(m.unique, f.name)
+			case "index":
+				indexed = true
+			case "required":
+				f.required = true
+			default:
+				return fmt.Errorf("%w: unknown option %q of %s", ErrInvalidTag, opt, sf.Name)
+			}
+		}
+		// primary keys are looked up directly, enums and tags hold
+		// a posting list already
+		switch {
+		case !indexed, pk, f.typ == common.TypeEnum, f.typ == common.TypeTag:
+		case f.typ == common.TypeObject:
+			return fmt.Errorf("%w: object field %s cannot be indexed", ErrInvalidTag, sf.Name)
+		default:
+			m.indexes = append(m.indexes, f.name)
+		}
+		if pk {
+			if m.pk != nil {
+				return fmt.Errorf("%w: %s and %s are both primary keys", ErrInvalidTag, m.pk.name, f.name)
+			}
+			switch {
+			case pkType == metaparser.MetaPrimaryKeyAutoIncrementID && f.typ != common.TypeInteger,
+				pkType == metaparser.MetaPrimaryKeyUUID && f.typ != common.TypeString,
+				f.typ == common.TypeObject || f.typ == common.TypeTag:
+				return fmt.Errorf("%w: %s cannot be a primary key", ErrInvalidTag, sf.Name)
+			}
+			m.pk, m.pkType = f, pkType
+		}
+		f.encode, f.decode = converters(f.typ, ft)
+		m.fields = append(m.fields, f)
+	}
+	return nil
+}
+
+// fieldType returns the type of the field a Go type maps to
+func fieldType(t reflect.Type) byte {
+	switch t {
+	case timeType:
+		return common.TypeTime
+	case decimalType:
+		return common.TypeDecimal
+	case tagsType:
+		return common.TypeTag
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return common.TypeString
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return common.TypeInteger
+	case reflect.Float32, reflect.Float64:
+		return common.TypeFloat
+	}
+	return common.TypeObject
+}
+
+// converters returns the encoder and the decoder of the values
+// of Go type t held by a field of type typ
+func converters(typ byte, t reflect.Type) (func(reflect.Value) (interface{}, error), func(interface{}, reflect.Value) error) {
+	wrong := func(x interface{}) error {
+		return fmt.Errorf("%w: %T into %s", document.ErrWrongFieldType, x, t)
+	}
+	switch typ {
+	case common.TypeString, common.TypeEnum:
+		return func(v reflect.Value) (interface{}, error) {
+				return v.String(), nil
+			}, func(x interface{}, v reflect.Value) error {
+				s, ok := x.(string)
+				if !ok {
+					return wrong(x)
+				}
+				v.SetString(s)
+				return nil
+			}
+	case common.TypeInteger:
+		if t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64 {
+			return func(v reflect.Value) (interface{}, error) {
+					n := v.Uint()
+					if n > math.MaxInt64 {
+						return nil, fmt.Errorf("%w: %d overflows an integer", document.ErrWrongFieldType, n)
+					}
+					return int64(n), nil
+				}, func(x interface{}, v reflect.Value) error {
+					n, ok := x.(int64)
+					if !ok || n < 0 || v.OverflowUint(uint64(n)) {
+						return wrong(x)
+					}
+					v.SetUint(uint64(n))
+					return nil
+				}
+		}
+		return func(v reflect.Value) (interface{}, error) {
+				return v.Int(), nil
+			}, func(x interface{}, v reflect.Value) error {
+				n, ok := x.(int64)
+				if !ok || v.OverflowInt(n) {
+					return wrong(x)
+				}
+				v.SetInt(n)
+				return nil
+			}
+	case common.TypeFloat:
+		return func(v reflect.Value) (interface{}, error) {
+				return v.Float(), nil
+			}, func(x interface{}, v reflect.Value) error {
+				f, ok := x.(float64)
+				if !ok {
+					return wrong(x)
+				}
+				v.SetFloat(f)
+				return nil
+			}
+	case common.TypeDecimal, common.TypeTime, common.TypeTag:
+		return func(v reflect.Value) (interface{}, error) {
+				return v.Interface(), nil
+			}, func(x interface{}, v reflect.Value) error {
+				xv := reflect.ValueOf(x)
+				if !xv.IsValid() || xv.Type() != t {
+					return wrong(x)
+				}
+				v.Set(xv)
+				return nil
+			}
+	}
+	return func(v reflect.Value) (interface{}, error) {
+			rs, err := json.Marshal(v.Interface())
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", document.ErrWrongFieldType, err)
+			}
+			var ret interface{}
+			decoder := json.NewDecoder(strings.NewReader(string(rs)))
+			decoder.UseNumber()
+			err = decoder.Decode(&ret)
+			return ret, err
+		}, func(x interface{}, v reflect.Value) error {
+			rs, err := json.Marshal(x)
+			if err == nil {
+				err = json.Unmarshal(rs, v.Addr().Interface())
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", document.ErrWrongFieldType, err)
+			}
+			return nil
+		}
+}
+
+// Metadata returns the schema of the tables the struct maps to
+func (m *Mapping) Metadata() *metaparser.Metadata {
+	ret := &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: m.pkType, Name: m.pk.name},
+		Unique:      append([]string(nil), m.unique...),
+		Indexes:     append([]string(nil), m.indexes...),
+	}
+	for _, f := range m.fields {
+		if f == m.pk && m.pkType != metaparser.MetaPrimaryKeyCustom {
+			continue
+		}
+		ret.Fields = append(ret.Fields, metaparser.Field{
+			Name:       f.name,
+			Type:       f.typ,
+			Constraint: metaparser.Constraint{Required: f.required},
+		})
+	}
+	return ret
+}
+
+// Check reports whether the table of schema meta can hold the
+// struct: the primary keys match and every mapped field exists
+// with the same type, fields the struct does not map are allowed
+func (m *Mapping) Check(meta *metaparser.Metadata) error {
+	if meta.StorageType != metaparser.MetaStorageTypeRowDocument {
+		return fmt.Errorf("%w: not a row document table", ErrSchemaMismatch)
+	}
+	want := m.Metadata()
+	if meta.PrimaryKey == nil || *meta.PrimaryKey != *want.PrimaryKey {
+		return fmt.Errorf("%w: primary key %s", ErrSchemaMismatch, m.pk.name)
+	}
+	for _, f := range want.Fields {
+		got, ok := meta.Field(f.Name)
+		if !ok {
+			return fmt.Errorf("%w: no field %s", ErrSchemaMismatch, f.Name)
+		}
+		if got.Type != f.Type {
+			return fmt.Errorf("%w: %s is a %s, not a %s", ErrSchemaMismatch, f.Name, common.TypeName(got.Type), common.TypeName(f.Type))
+		}
+	}
+	return nil
+}
+
+// value returns the struct v points to or holds
+func (m *Mapping) value(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Type() != m.typ {
+		return reflect.Value{}, fmt.Errorf("%w: %T is not a %s", ErrNotStruct, v, m.typ)
+	}
+	return rv, nil
+}
+
+// Encode converts the struct v into a row, nil pointers, slices
+// and maps, zero times and zero generated primary keys are left
+// out
+func (m *Mapping) Encode(v interface{}) (document.Row, error) {
+	rv, err := m.value(v)
+	if err != nil {
+		return nil, err
+	}
+	row := make(document.Row, len(m.fields))
+	for _, f := range m.fields {
+		fv := rv.FieldByIndex(f.index)
+		if f.pointer {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		switch fv.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Interface:
+			if fv.IsNil() {
+				continue
+			}
+		}
+		if f.typ == common.TypeTime && fv.IsZero() {
+			continue
+		}
+		if f == m.pk && m.pkType != metaparser.MetaPrimaryKeyCustom && fv.IsZero() {
+			continue
+		}
+		x, err := f.encode(fv)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		row[f.name] = x
+	}
+	return row, nil
+}
+
+// Decode stores row into the struct v points to, mapped fields
+// missing from row are zeroed
+func (m *Mapping) Decode(row document.Row, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Type() != m.typ {
+		return fmt.Errorf("%w: %T is not a pointer to %s", ErrNotStruct, v, m.typ)
+	}
+	rv = rv.Elem()
+	for _, f := range m.fields {
+		fv := rv.FieldByIndex(f.index)
+		x := row[f.name]
+		if x == nil {
+			fv.Set(reflect.Zero(fv.Type()))
+			continue
+		}
+		if f.pointer {
+			p := reflect.New(fv.Type().Elem())
+			fv.Set(p)
+			fv = p.Elem()
+		}
+		err := f.decode(x, fv)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// Key returns the primary key string of the struct v
+func (m *Mapping) Key(v interface{}) (string, error) {
+	row, err := m.Encode(v)
+	if err != nil {
+		return "", err
+	}
+	x, ok := row[m.pk.name]
+	if !ok {
+		return "", document.ErrMissingPrimaryKey
+	}
+	return m.keyOf(x)
+}
+
+// keyOf converts a primary key value into its key string
+func (m *Mapping) keyOf(x interface{}) (string, error) {
+	nv, err := document.NormalizeValue(m.pk.typ, x)
+	if err != nil {
+		return "", err
+	}
+	if nv == nil {
+		return "", document.ErrMissingPrimaryKey
+	}
+	return document.FormatKey(nv), nil
+}
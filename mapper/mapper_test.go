@@ -0,0 +1,259 @@
+package mapper_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/mapper"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/storage"
+)
+
+type audit struct {
+	Created time.Time `kical:"created"`
+	secret  string
+}
+
+type server struct {
+	ID      int64             `kical:"id,pk,auto"`
+	Name    string            `kical:"name,unique"`
+	Tier    string            `kical:"tier,enum"`
+	Port    uint16            `kical:"port,index"`
+	Load    *float64          `kical:"load"`
+	Price   decimal.Decimal   `kical:"price"`
+	Tags    []string          `kical:"tags"`
+	Labels  map[string]string `kical:"labels"`
+	Enabled bool              `kical:"enabled"`
+	Skip    string            `kical:"-"`
+	audit
+}
+
+type region struct {
+	Code string `kical:"code,pk"`
+	Name string
+}
+
+func newDatabase(t *testing.T) *kical.Database {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMetadata(t *testing.T) {
+	m, err := mapper.Of(&server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := m.Metadata()
+	if *meta.PrimaryKey != (metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"}) {
+		t.Fatalf("primary key %+v", meta.PrimaryKey)
+	}
+	want := []metaparser.Field{
+		{Name: "name", Type: common.TypeString},
+		{Name: "tier", Type: common.TypeEnum},
+		{Name: "port", Type: common.TypeInteger},
+		{Name: "load", Type: common.TypeFloat},
+		{Name: "price", Type: common.TypeDecimal},
+		{Name: "tags", Type: common.TypeTag},
+		{Name: "labels", Type: common.TypeObject},
+		{Name: "enabled", Type: common.TypeObject},
+		{Name: "created", Type: common.TypeTime},
+	}
+	if !reflect.DeepEqual(meta.Fields, want) {
+		t.Fatalf("fields %+v", meta.Fields)
+	}
+	if !reflect.DeepEqual(meta.Unique, []string{"name"}) {
+		t.Fatalf("unique %v", meta.Unique)
+	}
+	if !reflect.DeepEqual(meta.Indexes, []string{"port"}) {
+		t.Fatalf("indexes %v", meta.Indexes)
+	}
+	again, _ := mapper.Of(server{})
+	if again != m {
+		t.Fatal("mapping not cached")
+	}
+
+	bad := []interface{}{
+		42,
+		struct{ Name string }{},
+		struct {
+			ID string `kical:"id,pk,auto"`
+		}{},
+		struct {
+			ID   int64 `kical:"id,pk"`
+			Kind int   `kical:"kind,enum"`
+		}{},
+		struct {
+			ID int64 `kical:"id,pk,sorted"`
+		}{},
+		struct {
+			A int64 `kical:"a,pk"`
+			B int64 `kical:"b,pk"`
+		}{},
+		struct {
+			A int64 `kical:"a,pk"`
+			B int64 `kical:"a"`
+		}{},
+		struct {
+			ID     int64             `kical:"id,pk"`
+			Labels map[string]string `kical:"labels,index"`
+		}{},
+	}
+	errs := []error{mapper.ErrNotStruct, mapper.ErrNoPrimaryKey, mapper.ErrInvalidTag,
+		mapper.ErrInvalidTag, mapper.ErrInvalidTag, mapper.ErrInvalidTag, mapper.ErrInvalidTag,
+		mapper.ErrInvalidTag}
+	for i, v := range bad {
+		if _, err := mapper.Of(v); !errors.Is(err, errs[i]) {
+			t.Fatalf("%T: %v", v, err)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := mapper.CreateTable(db, "servers", &server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := 0.5
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := &server{
+		Name:    "web",
+		Tier:    "gold",
+		Port:    8080,
+		Load:    &load,
+		Price:   decimal.MustParse("12.50"),
+		Tags:    []string{"prod", "eu"},
+		Labels:  map[string]string{"team": "core"},
+		Enabled: true,
+		Skip:    "lost",
+		audit:   audit{Created: created},
+	}
+	if _, err := tbl.Insert(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != 1 {
+		t.Fatalf("generated id %d", s.ID)
+	}
+	if _, err := tbl.Insert(&server{Name: "db", Tier: "silver", Port: 5432}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Insert(&server{Name: "web"}); !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("duplicate name: %v", err)
+	}
+
+	var got server
+	if err := tbl.Get(1, &got); err != nil {
+		t.Fatal(err)
+	}
+	s.Skip = ""
+	s.Tags = []string{"eu", "prod"}
+	if !got.Created.Equal(created) || got.Price.Cmp(s.Price) != 0 {
+		t.Fatalf("got %+v", got)
+	}
+	got.Created, got.Price = s.Created, s.Price
+	if !reflect.DeepEqual(got, *s) {
+		t.Fatalf("got %+v, want %+v", got, *s)
+	}
+	if err := tbl.Get(int64(9), &got); err != storage.ErrNoSuchKey {
+		t.Fatalf("missing row: %v", err)
+	}
+
+	got.Load, got.Port = nil, 8443
+	if err := tbl.Update(&got); err != nil {
+		t.Fatal(err)
+	}
+	var updated server
+	if err := tbl.Get(1, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Load != nil || updated.Port != 8443 || updated.Name != "web" {
+		t.Fatalf("updated %+v", updated)
+	}
+	d, err := db.Document("servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, want := range map[int]int{8080: 0, 8443: 1, 5432: 1} {
+		if pks, err := d.Posting("port", port); err != nil || len(pks) != want {
+			t.Fatalf("port %d: %v %v", port, pks, err)
+		}
+	}
+
+	var all []server
+	if err := tbl.Find(nil, &all); err != nil || len(all) != 2 {
+		t.Fatalf("find all: %v %v", all, err)
+	}
+	var found []*server
+	err = tbl.Find(tbl.Query().Where("port", query.OpLt, 8000), &found)
+	if err != nil || len(found) != 1 || found[0].Name != "db" {
+		t.Fatalf("find: %v %v", found, err)
+	}
+	plan, err := tbl.Query().Where("port", query.OpEq, 8443).Plan()
+	if err != nil || plan.Access.Kind != query.AccessPosting {
+		t.Fatalf("plan: %+v %v", plan, err)
+	}
+	err = tbl.Find(tbl.Query().Where("port", query.OpEq, 8443), &found)
+	if err != nil || len(found) != 1 || found[0].Name != "web" {
+		t.Fatalf("find by index: %v %v", found, err)
+	}
+	if err := tbl.Find(nil, &[]region{}); !errors.Is(err, mapper.ErrNotStruct) {
+		t.Fatalf("find into regions: %v", err)
+	}
+
+	if err := tbl.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Get(2, &got); err != storage.ErrNoSuchKey {
+		t.Fatalf("deleted row: %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	db := newDatabase(t)
+	if _, err := mapper.CreateTable(db, "regions", region{}); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := mapper.Open(db, "regions", region{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Insert(region{Code: "eu", Name: "Europe"}); err != nil {
+		t.Fatal(err)
+	}
+	var r region
+	if err := tbl.Get("eu", &r); err != nil || r.Name != "Europe" {
+		t.Fatalf("get: %+v %v", r, err)
+	}
+	if _, err := tbl.Insert(region{Code: "eu"}); !errors.Is(err, document.ErrDuplicateKey) {
+		t.Fatalf("duplicate key: %v", err)
+	}
+
+	type renamed struct {
+		Code  string `kical:"code,pk"`
+		Title string
+	}
+	if _, err := mapper.Open(db, "regions", renamed{}); !errors.Is(err, mapper.ErrSchemaMismatch) {
+		t.Fatalf("renamed field: %v", err)
+	}
+	type retyped struct {
+		Code string `kical:"code,pk"`
+		Name int
+	}
+	if _, err := mapper.Open(db, "regions", retyped{}); !errors.Is(err, mapper.ErrSchemaMismatch) {
+		t.Fatalf("retyped field: %v", err)
+	}
+}
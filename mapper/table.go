@@ -0,0 +1,215 @@
+package mapper
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/keyenc"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+)
+
+// Table is a row document table holding the structs of a mapping
+type Table struct {
+	*Mapping
+	tbl *kical.Table
+	doc *document.Document
+}
+
+// CreateTable creates the table name with the schema derived from
+// the struct type of v and returns it
+func CreateTable(db *kical.Database, name string, v interface{}) (*Table, error) {
+	m, err := Of(v)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := db.CreateTable(name, m.Metadata())
+	if err != nil {
+		return nil, err
+	}
+	return m.bind(tbl)
+}
+
+// Open returns the existing table name, ErrSchemaMismatch is
+// returned if it cannot hold the struct type of v
+func Open(db *kical.Database, name string, v interface{}) (*Table, error) {
+	m, err := Of(v)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := db.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.bind(tbl)
+}
+
+func (m *Mapping) bind(tbl *kical.Table) (*Table, error) {
+	doc, err := tbl.GetDocument()
+	if err != nil {
+		return nil, err
+	}
+	err = m.Check(doc.Metadata())
+	if err != nil {
+		return nil, err
+	}
+	return &Table{Mapping: m, tbl: tbl, doc: doc}, nil
+}
+
+// Document returns the underlying document table
+func (t *Table) Document() *document.Document {
+	return t.doc
+}
+
+// Insert inserts the struct v, when the primary key is generated
+// and v is a pointer the new key is stored back into it, it
+// returns the primary key string of the inserted row
+func (t *Table) Insert(v interface{}) (string, error) {
+	row, err := t.Encode(v)
+	if err != nil {
+		return "", err
+	}
+	s := t.doc.NewSession()
+	pk, err := s.Insert(row)
+	if err != nil {
+		s.Close()
+		return "", err
+	}
+	err = s.Commit()
+	if err != nil {
+		return "", err
+	}
+	rv := reflect.ValueOf(v)
+	if t.pkType == metaparser.MetaPrimaryKeyCustom || rv.Kind() != reflect.Ptr {
+		return pk, nil
+	}
+	typ := common.TypeString
+	if t.pkType == metaparser.MetaPrimaryKeyAutoIncrementID {
+		typ = common.TypeInteger
+	}
+	key, err := keyenc.DecodeKey([]byte(pk), typ)
+	if err != nil {
+		return pk, err
+	}
+	fv := rv.Elem().FieldByIndex(t.pk.index)
+	if t.pk.pointer {
+		p := reflect.New(fv.Type().Elem())
+		fv.Set(p)
+		fv = p.Elem()
+	}
+	return pk, t.pk.decode(key, fv)
+}
+
+// Get reads the row with primary key value pk into the struct out
+// points to, storage.ErrNoSuchKey is returned if there is none
+func (t *Table) Get(pk interface{}, out interface{}) error {
+	key, err := t.keyOf(pk)
+	if err != nil {
+		return err
+	}
+	row, err := t.doc.Get(key)
+	if err != nil {
+		return err
+	}
+	return t.Decode(row, out)
+}
+
+// Update stores the struct v over the row with the same primary
+// key, fields of the row the struct does not map are kept, the
+// row is created if it does not exist
+func (t *Table) Update(v interface{}) error {
+	pk, err := t.Key(v)
+	if err != nil {
+		return err
+	}
+	row, err := t.Encode(v)
+	if err != nil {
+		return err
+	}
+	s := t.doc.NewSession()
+	err = s.Lock()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	old, err := s.Get(pk)
+	if err == nil {
+		for _, f := range t.fields {
+			delete(old, f.name)
+		}
+		for k, x := range row {
+			old[k] = x
+		}
+		row = old
+	}
+	err = s.Set(pk, row)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	return s.Commit()
+}
+
+// Delete deletes the row with primary key value pk
+func (t *Table) Delete(pk interface{}) error {
+	key, err := t.keyOf(pk)
+	if err != nil {
+		return err
+	}
+	s := t.doc.NewSession()
+	err = s.Delete(key)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	return s.Commit()
+}
+
+// Query starts a query on the rows of the table
+func (t *Table) Query() *query.Builder {
+	return t.tbl.Query()
+}
+
+// Find runs the query b, all rows when b is nil, and stores its
+// rows into the slice out points to, whose elements are structs
+// or pointers to structs of the mapping
+func (t *Table) Find(b *query.Builder, out interface{}) error {
+	sv := reflect.ValueOf(out)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("%w: %T is not a pointer to a slice", ErrNotStruct, out)
+	}
+	sv = sv.Elem()
+	et := sv.Type().Elem()
+	pointers := et.Kind() == reflect.Ptr
+	if pointers {
+		et = et.Elem()
+	}
+	if et != t.typ {
+		return fmt.Errorf("%w: %T does not hold %s", ErrNotStruct, out, t.typ)
+	}
+	if b == nil {
+		b = t.Query()
+	}
+	rows, err := b.Rows()
+	if err != nil {
+		return err
+	}
+	ret := reflect.MakeSlice(sv.Type(), len(rows), len(rows))
+	for i, row := range rows {
+		p := reflect.New(et)
+		err = t.Decode(row, p.Interface())
+		if err != nil {
+			return err
+		}
+		if pointers {
+			ret.Index(i).Set(p)
+		} else {
+			ret.Index(i).Set(p.Elem())
+		}
+	}
+	sv.Set(ret)
+	return nil
+}
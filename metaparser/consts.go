@@ -12,6 +12,7 @@ const (
 	MetaTypeKeys        = byte('|')
 	MetaTypeTableName   = byte('@')
 	MetaTypePrimaryKey  = byte('*')
+	MetaTypeUnique      = byte('#')
 )
 
 // MetaKeysSeparator as is
@@ -19,7 +20,43 @@ const MetaKeysSeparator = byte('|')
 
 // Metadata Extended Enum
 const (
-	MetaTypeExtendedK = byte('k')
+	MetaTypeExtendedK             = byte('k')
+	MetaTypeExtendedAutoIncrement = byte('i')
+	MetaTypeExtendedStatistics    = byte('s')
+	MetaTypeExtendedDecimal       = byte('d')
+	MetaTypeExtendedDefault       = byte('f')
+	MetaTypeExtendedChanges       = byte('h')
+	MetaTypeExtendedPaths         = byte('p')
+	MetaTypeExtendedConstraints   = byte('c')
+	MetaTypeExtendedReferences    = byte('r')
+	MetaTypeExtendedView          = byte('v')
+	MetaTypeExtendedCompression   = byte('z')
+	MetaTypeExtendedDictionary    = byte('y')
+	MetaTypeExtendedIndexes       = byte('x')
+)
+
+// Schema change operations
+const (
+	ChangeAddField    = "add"
+	ChangeDropField   = "drop"
+	ChangeRenameField = "rename"
+	ChangeRetypeField = "retype"
+)
+
+// Reference delete actions, what deleting a referenced row does
+// to the rows referencing it
+const (
+	ReferenceRestrict = "restrict"
+	ReferenceCascade  = "cascade"
+	ReferenceSetNull  = "set_null"
+)
+
+// Compression codecs of the stored values of a table
+const (
+	CompressionNone     = "none"
+	CompressionSnappy   = "snappy"
+	CompressionZstd     = "zstd"
+	CompressionZstdDict = "zstd_dict"
 )
 
 // Metadata Primary Key Type
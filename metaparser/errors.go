@@ -4,3 +4,6 @@ import "fmt"
 
 // ErrNoSuchStorageType as is
 var ErrNoSuchStorageType = fmt.Errorf("No such storage type when parsing metadata")
+
+// ErrMalformedMetadata as is
+var ErrMalformedMetadata = fmt.Errorf("Malformed metadata when parsing metadata")
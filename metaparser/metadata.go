@@ -0,0 +1,810 @@
+package metaparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Field describes a field of a document table
+type Field struct {
+	Name string
+	Type byte
+	// Precision and Scale constrain the values of a decimal field
+	// to Precision digits, Scale of them fractional, a zero
+	// Precision leaves the field unconstrained
+	Precision int
+	Scale     int
+	// Default is the text of the value the field takes in rows
+	// written before it was added, empty for none
+	Default string
+	// Constraint restricts the values written into the field
+	Constraint Constraint
+}
+
+// Constraint restricts the values of a field, it is enforced on
+// every write of a row document, the zero value allows anything
+type Constraint struct {
+	// Required rejects rows where the field is missing or null
+	Required bool `json:"required,omitempty"`
+	// Min and Max are the texts of the inclusive bounds of the
+	// values of integer, float, decimal and time fields, and of
+	// the length of strings and enums and the number of tags
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+	// Pattern is a regular expression strings, enums and each tag
+	// must match
+	Pattern string `json:"pattern,omitempty"`
+	// Members lists the values strings, enums and each tag may
+	// take, empty for any
+	Members []string `json:"members,omitempty"`
+}
+
+// IsZero reports whether c allows anything
+func (c *Constraint) IsZero() bool {
+	return !c.Required && c.Min == "" && c.Max == "" && c.Pattern == "" && len(c.Members) == 0
+}
+
+// PrimaryKey describes the primary key of a document table
+type PrimaryKey struct {
+	Type byte
+	Name string
+}
+
+// Metadata is the decoded metadata of a table
+type Metadata struct {
+	StorageType byte
+	TableName   string
+	Fields      []Field
+	PrimaryKey  *PrimaryKey
+	K           int
+	// Unique lists the fields holding a unique index
+	Unique []string
+	// Indexes lists the fields holding a posting list over their
+	// values, a secondary index which is not unique
+	Indexes []string
+	// Changes lists the schema changes applied to the table in
+	// order, the change at index i moves the schema from version
+	// i to version i+1
+	Changes []Change
+	// Paths lists the indexed paths into object fields, such as
+	// meta.labels.zone
+	Paths []string
+	// References lists the fields holding primary keys of rows
+	// of other tables
+	References []Reference
+	// View is the definition of a materialized view, nil for
+	// plain tables
+	View *View
+	// Compression is the compression of the stored values, nil
+	// for none
+	Compression *Compression
+}
+
+// Compression describes how the values of a table are compressed,
+// values written under a previous compression stay readable
+type Compression struct {
+	// Codec is one of CompressionNone, CompressionSnappy,
+	// CompressionZstd and CompressionZstdDict
+	Codec string `json:"codec"`
+	// Dictionary is the id of the dictionary of a
+	// CompressionZstdDict codec, its content is stored apart
+	Dictionary uint32 `json:"dictionary,omitempty"`
+}
+
+// View defines a materialized view, a row document table holding
+// the result of a select query on another table
+type View struct {
+	Source string `json:"source"`
+	// Query is the text of the select query
+	Query string `json:"query"`
+}
+
+// Reference declares that a field holds the primary key of a row
+// of a document table, which must exist
+type Reference struct {
+	Field string `json:"field"`
+	Table string `json:"table"`
+	// OnDelete is one of ReferenceRestrict, the default,
+	// ReferenceCascade and ReferenceSetNull
+	OnDelete string `json:"on_delete,omitempty"`
+}
+
+// Change is a schema change of a document table
+type Change struct {
+	// Op is one of ChangeAddField, ChangeDropField,
+	// ChangeRenameField and ChangeRetypeField
+	Op    string `json:"op"`
+	Field string `json:"field"`
+	// Name is the new name of a renamed field
+	Name string `json:"name,omitempty"`
+	// Type is the type of an added field or the new type of a
+	// retyped one
+	Type byte `json:"type,omitempty"`
+	// Default is the text of the value of an added field in the
+	// rows written before the change
+	Default string `json:"default,omitempty"`
+}
+
+// Version returns the schema version, the number of changes
+// applied since the table was created
+func (m *Metadata) Version() int {
+	return len(m.Changes)
+}
+
+// IsUnique reports whether field holds a unique index
+func (m *Metadata) IsUnique(field string) bool {
+	for _, f := range m.Unique {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIndexed reports whether field holds a secondary index
+func (m *Metadata) IsIndexed(field string) bool {
+	for _, f := range m.Indexes {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPath reports whether path is an indexed path
+func (m *Metadata) IsPath(path string) bool {
+	for _, p := range m.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Reference returns the reference held by field
+func (m *Metadata) Reference(field string) (Reference, bool) {
+	for _, r := range m.References {
+		if r.Field == field {
+			return r, true
+		}
+	}
+	return Reference{}, false
+}
+
+// Field returns the field named name
+func (m *Metadata) Field(name string) (Field, bool) {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+func metaKey(typ ...byte) []byte {
+	return append([]byte{MetaInitCharacter}, typ...)
+}
+
+// GetTableName returns the name of the table
+func (p *Parser) GetTableName() (string, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeTableName))
+	if err != nil {
+		return "", err
+	}
+	return string(rs), nil
+}
+
+// GetFields returns the field list of the table
+func (p *Parser) GetFields() ([]Field, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeKeys))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeFields(rs)
+}
+
+// GetPrimaryKey returns the primary key definition of the table
+func (p *Parser) GetPrimaryKey() (*PrimaryKey, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypePrimaryKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) < 2 {
+		return nil, ErrMalformedMetadata
+	}
+	switch rs[0] {
+	case MetaPrimaryKeyAutoIncrementID, MetaPrimaryKeyUUID, MetaPrimaryKeyCustom:
+	default:
+		return nil, ErrMalformedMetadata
+	}
+	return &PrimaryKey{
+		Type: rs[0],
+		Name: string(rs[1:]),
+	}, nil
+}
+
+// GetUnique returns the fields holding a unique index
+func (p *Parser) GetUnique() ([]string, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeUnique))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(rs), string(MetaKeysSeparator)), nil
+}
+
+// GetIndexes returns the fields holding a secondary index
+func (p *Parser) GetIndexes() ([]string, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedIndexes))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(rs), string(MetaKeysSeparator)), nil
+}
+
+// GetDecimals returns the precision and scale of the decimal
+// fields declaring them, as stored by EncodeDecimals
+func (p *Parser) GetDecimals() (map[string][2]int, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedDecimal))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeDecimals(rs)
+}
+
+// GetDefaults returns the defaults of the fields declaring one,
+// as stored by EncodeDefaults
+func (p *Parser) GetDefaults() (map[string]string, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedDefault))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	if json.Unmarshal(rs, &ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// GetConstraints returns the constraints of the fields declaring
+// one, as stored by EncodeConstraints
+func (p *Parser) GetConstraints() (map[string]Constraint, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedConstraints))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]Constraint)
+	if json.Unmarshal(rs, &ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// GetChanges returns the schema changes applied to the table
+func (p *Parser) GetChanges() ([]Change, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedChanges))
+	if err != nil {
+		return nil, err
+	}
+	var ret []Change
+	if json.Unmarshal(rs, &ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// GetPaths returns the indexed paths into object fields
+func (p *Parser) GetPaths() ([]string, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedPaths))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(rs), string(MetaKeysSeparator)), nil
+}
+
+// GetReferences returns the references of the fields of the table
+func (p *Parser) GetReferences() ([]Reference, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedReferences))
+	if err != nil {
+		return nil, err
+	}
+	var ret []Reference
+	if json.Unmarshal(rs, &ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// GetView returns the definition of a materialized view
+func (p *Parser) GetView() (*View, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedView))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(View)
+	if json.Unmarshal(rs, ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// GetCompression returns the compression of the stored values
+func (p *Parser) GetCompression() (*Compression, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedCompression))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(Compression)
+	if json.Unmarshal(rs, ret) != nil {
+		return nil, ErrMalformedMetadata
+	}
+	return ret, nil
+}
+
+// DictionaryKey returns the key holding the compression dictionary
+// id
+func DictionaryKey(id uint32) []byte {
+	ret := metaKey(MetaTypeExtended, MetaTypeExtendedDictionary, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(ret[3:], id)
+	return ret
+}
+
+// GetDictionary returns the content of the compression dictionary
+// id
+func (p *Parser) GetDictionary(id uint32) ([]byte, error) {
+	return p.storage.Get(DictionaryKey(id))
+}
+
+// GetK returns the chunk exponent k of an analytical table
+func (p *Parser) GetK() (int, error) {
+	rs, err := p.storage.Get(metaKey(MetaTypeExtended, MetaTypeExtendedK))
+	if err != nil {
+		return 0, err
+	}
+	k, err := strconv.Atoi(string(rs))
+	if err != nil {
+		return 0, ErrMalformedMetadata
+	}
+	return k, nil
+}
+
+// GetMetadata reads every known metadata entry of the table,
+// missing optional entries are left empty
+func (p *Parser) GetMetadata() (*Metadata, error) {
+	typ, err := p.GetStorageType()
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{StorageType: typ}
+	m.TableName, err = p.GetTableName()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.Fields, err = p.GetFields()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.PrimaryKey, err = p.GetPrimaryKey()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.K, err = p.GetK()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.Unique, err = p.GetUnique()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.Indexes, err = p.GetIndexes()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	decimals, err := p.GetDecimals()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	defaults, err := p.GetDefaults()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	constraints, err := p.GetConstraints()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	for i, f := range m.Fields {
+		if ps, ok := decimals[f.Name]; ok {
+			m.Fields[i].Precision, m.Fields[i].Scale = ps[0], ps[1]
+		}
+		m.Fields[i].Default = defaults[f.Name]
+		m.Fields[i].Constraint = constraints[f.Name]
+	}
+	m.Changes, err = p.GetChanges()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.Paths, err = p.GetPaths()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.References, err = p.GetReferences()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.View, err = p.GetView()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	m.Compression, err = p.GetCompression()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EncodeFields encodes a field list into the `&|` format
+func EncodeFields(fields []Field) []byte {
+	buf := bytes.NewBuffer(nil)
+	for i, f := range fields {
+		if i != 0 {
+			buf.WriteByte(MetaKeysSeparator)
+		}
+		buf.WriteByte(f.Type)
+		buf.WriteString(f.Name)
+	}
+	return buf.Bytes()
+}
+
+// DecodeFields decodes a field list from the `&|` format
+func DecodeFields(rs []byte) ([]Field, error) {
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	parts := bytes.Split(rs, []byte{MetaKeysSeparator})
+	ret := make([]Field, 0, len(parts))
+	for _, part := range parts {
+		if len(part) < 2 {
+			return nil, ErrMalformedMetadata
+		}
+		ret = append(ret, Field{
+			Type: part[0],
+			Name: string(part[1:]),
+		})
+	}
+	return ret, nil
+}
+
+// EncodeDecimals encodes the precision and scale of the decimal
+// fields declaring them as `precision,scale,name` entries
+// separated by `|`, it returns nil if no field declares them
+func EncodeDecimals(fields []Field) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, f := range fields {
+		if f.Precision == 0 {
+			continue
+		}
+		if buf.Len() != 0 {
+			buf.WriteByte(MetaKeysSeparator)
+		}
+		buf.WriteString(strconv.Itoa(f.Precision))
+		buf.WriteByte(',')
+		buf.WriteString(strconv.Itoa(f.Scale))
+		buf.WriteByte(',')
+		buf.WriteString(f.Name)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// DecodeDecimals decodes the format written by EncodeDecimals
+func DecodeDecimals(rs []byte) (map[string][2]int, error) {
+	ret := make(map[string][2]int)
+	if len(rs) == 0 {
+		return ret, nil
+	}
+	for _, part := range strings.Split(string(rs), string(MetaKeysSeparator)) {
+		items := strings.SplitN(part, ",", 3)
+		if len(items) != 3 || items[2] == "" {
+			return nil, ErrMalformedMetadata
+		}
+		precision, err := strconv.Atoi(items[0])
+		if err != nil {
+			return nil, ErrMalformedMetadata
+		}
+		scale, err := strconv.Atoi(items[1])
+		if err != nil {
+			return nil, ErrMalformedMetadata
+		}
+		ret[items[2]] = [2]int{precision, scale}
+	}
+	return ret, nil
+}
+
+// EncodeDefaults encodes the defaults of the fields declaring
+// one as a JSON object mapping field names to the text of their
+// default, it returns nil if no field declares one
+func EncodeDefaults(fields []Field) []byte {
+	defaults := make(map[string]string)
+	for _, f := range fields {
+		if f.Default != "" {
+			defaults[f.Name] = f.Default
+		}
+	}
+	if len(defaults) == 0 {
+		return nil
+	}
+	rs, _ := json.Marshal(defaults)
+	return rs
+}
+
+// EncodeConstraints encodes the constraints of the fields
+// declaring one as a JSON object mapping field names to their
+// constraint, it returns nil if no field declares one
+func EncodeConstraints(fields []Field) []byte {
+	constraints := make(map[string]Constraint)
+	for _, f := range fields {
+		if !f.Constraint.IsZero() {
+			constraints[f.Name] = f.Constraint
+		}
+	}
+	if len(constraints) == 0 {
+		return nil
+	}
+	rs, _ := json.Marshal(constraints)
+	return rs
+}
+
+// checkConstraint checks that c can apply to a field of type typ,
+// the bounds themselves are checked by the document layer
+func checkConstraint(c *Constraint, typ byte) bool {
+	switch typ {
+	case common.TypeString, common.TypeEnum, common.TypeTag:
+		for _, bound := range []string{c.Min, c.Max} {
+			if n, err := strconv.Atoi(bound); bound != "" && (err != nil || n < 0) {
+				return false
+			}
+		}
+		if c.Pattern != "" {
+			if _, err := regexp.Compile(c.Pattern); err != nil {
+				return false
+			}
+		}
+		return true
+	case common.TypeInteger, common.TypeFloat, common.TypeDecimal, common.TypeTime:
+	default:
+		if c.Min != "" || c.Max != "" {
+			return false
+		}
+	}
+	return c.Pattern == "" && len(c.Members) == 0
+}
+
+// MaxDecimalPrecision is the largest precision of a decimal field
+const MaxDecimalPrecision = 1000
+
+// WriteMetadata writes the metadata m into batch
+func WriteMetadata(batch storage.Batch, m *Metadata) error {
+	if !IsStorageType(m.StorageType) {
+		return ErrNoSuchStorageType
+	}
+	opts := &storage.SetOptions{Synchronized: true}
+	err := batch.Set(metaKey(MetaTypeStorageType), []byte{m.StorageType}, opts)
+	if err != nil {
+		return err
+	}
+	if m.TableName != "" {
+		err = batch.Set(metaKey(MetaTypeTableName), []byte(m.TableName), opts)
+		if err != nil {
+			return err
+		}
+	}
+	if m.Fields != nil {
+		for _, f := range m.Fields {
+			if f.Name == "" || strings.IndexByte(f.Name, MetaKeysSeparator) >= 0 || strings.IndexByte(f.Name, 0) >= 0 {
+				return ErrMalformedMetadata
+			}
+			if f.Precision != 0 || f.Scale != 0 {
+				if f.Type != common.TypeDecimal || f.Precision <= 0 || f.Precision > MaxDecimalPrecision || f.Scale < 0 || f.Scale > f.Precision {
+					return ErrMalformedMetadata
+				}
+			}
+			if !checkConstraint(&f.Constraint, f.Type) {
+				return ErrMalformedMetadata
+			}
+		}
+		err = batch.Set(metaKey(MetaTypeKeys), EncodeFields(m.Fields), opts)
+		if err != nil {
+			return err
+		}
+		if rs := EncodeDecimals(m.Fields); rs != nil {
+			err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedDecimal), rs, opts)
+			if err != nil {
+				return err
+			}
+		}
+		if rs := EncodeDefaults(m.Fields); rs != nil {
+			err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedDefault), rs, opts)
+			if err != nil {
+				return err
+			}
+		}
+		if rs := EncodeConstraints(m.Fields); rs != nil {
+			err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedConstraints), rs, opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if m.PrimaryKey != nil {
+		v := append([]byte{m.PrimaryKey.Type}, m.PrimaryKey.Name...)
+		err = batch.Set(metaKey(MetaTypePrimaryKey), v, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if m.K != 0 {
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedK), []byte(strconv.Itoa(m.K)), opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Unique) != 0 {
+		for _, name := range m.Unique {
+			if _, ok := m.Field(name); !ok {
+				return ErrMalformedMetadata
+			}
+		}
+		err = batch.Set(metaKey(MetaTypeUnique), []byte(strings.Join(m.Unique, string(MetaKeysSeparator))), opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Indexes) != 0 {
+		for _, name := range m.Indexes {
+			f, ok := m.Field(name)
+			if !ok || f.Type == common.TypeObject || f.Type == common.TypeTag {
+				return ErrMalformedMetadata
+			}
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedIndexes), []byte(strings.Join(m.Indexes, string(MetaKeysSeparator))), opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Changes) != 0 {
+		rs, err := json.Marshal(m.Changes)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedChanges), rs, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Paths) != 0 {
+		for _, path := range m.Paths {
+			i := strings.IndexByte(path, '.')
+			if i < 0 || strings.IndexByte(path, MetaKeysSeparator) >= 0 || strings.IndexByte(path, 0) >= 0 {
+				return ErrMalformedMetadata
+			}
+			if f, ok := m.Field(path[:i]); !ok || f.Type != common.TypeObject {
+				return ErrMalformedMetadata
+			}
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedPaths), []byte(strings.Join(m.Paths, string(MetaKeysSeparator))), opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.References) != 0 {
+		seen := make(map[string]bool)
+		for _, r := range m.References {
+			f, ok := m.Field(r.Field)
+			if !ok || seen[r.Field] || r.Table == "" {
+				return ErrMalformedMetadata
+			}
+			switch f.Type {
+			case common.TypeObject, common.TypeTag:
+				return ErrMalformedMetadata
+			}
+			switch r.OnDelete {
+			case "", ReferenceRestrict, ReferenceCascade, ReferenceSetNull:
+			default:
+				return ErrMalformedMetadata
+			}
+			seen[r.Field] = true
+		}
+		rs, err := json.Marshal(m.References)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedReferences), rs, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if m.View != nil {
+		if m.View.Source == "" || m.View.Query == "" {
+			return ErrMalformedMetadata
+		}
+		rs, err := json.Marshal(m.View)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedView), rs, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if m.Compression != nil {
+		switch m.Compression.Codec {
+		case CompressionNone, CompressionSnappy, CompressionZstd:
+			if m.Compression.Dictionary != 0 {
+				return ErrMalformedMetadata
+			}
+		case CompressionZstdDict:
+			if m.Compression.Dictionary == 0 {
+				return ErrMalformedMetadata
+			}
+		default:
+			return ErrMalformedMetadata
+		}
+		rs, err := json.Marshal(m.Compression)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(metaKey(MetaTypeExtended, MetaTypeExtendedCompression), rs, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteMetadata replaces the metadata of a table by m in batch,
+// entries m leaves empty are deleted
+func RewriteMetadata(batch storage.Batch, m *Metadata) error {
+	for _, k := range [][]byte{
+		metaKey(MetaTypeUnique),
+		metaKey(MetaTypeExtended, MetaTypeExtendedIndexes),
+		metaKey(MetaTypeExtended, MetaTypeExtendedDecimal),
+		metaKey(MetaTypeExtended, MetaTypeExtendedDefault),
+		metaKey(MetaTypeExtended, MetaTypeExtendedChanges),
+		metaKey(MetaTypeExtended, MetaTypeExtendedPaths),
+		metaKey(MetaTypeExtended, MetaTypeExtendedConstraints),
+		metaKey(MetaTypeExtended, MetaTypeExtendedReferences),
+		metaKey(MetaTypeExtended, MetaTypeExtendedView),
+		metaKey(MetaTypeExtended, MetaTypeExtendedCompression),
+	} {
+		err := batch.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return WriteMetadata(batch, m)
+}
+
+// IsStorageType reports whether typ is a known storage type
+func IsStorageType(typ byte) bool {
+	return (typ == MetaStorageTypeKV) ||
+		(typ == MetaStorageTypeRowDocument) ||
+		(typ == MetaStorageTypeColumn) ||
+		(typ == MetaStorageTypeAnalytical)
+}
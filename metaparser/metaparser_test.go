@@ -0,0 +1,155 @@
+package metaparser_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newBucket(t *testing.T) storage.Storage {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	t.Cleanup(func() { drv.Close() })
+	bucket, err := drv.Bucket("meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func write(bucket storage.Storage, m *metaparser.Metadata, rewrite bool) error {
+	batch := bucket.NewBatch(storage.BatchReadWrite)
+	var err error
+	if rewrite {
+		err = metaparser.RewriteMetadata(batch, m)
+	} else {
+		err = metaparser.WriteMetadata(batch, m)
+	}
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
+
+func sample() *metaparser.Metadata {
+	return &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		TableName:   "hosts",
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString, Constraint: metaparser.Constraint{Required: true, Pattern: "^[a-z]+$"}},
+			{Name: "price", Type: common.TypeDecimal, Precision: 8, Scale: 2},
+			{Name: "zone", Type: common.TypeString, Default: "eu"},
+			{Name: "meta", Type: common.TypeObject},
+			{Name: "rack", Type: common.TypeString},
+		},
+		PrimaryKey: &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		Unique:     []string{"rack"},
+		Indexes:    []string{"zone"},
+		Changes:    []metaparser.Change{{Op: metaparser.ChangeAddField, Field: "zone", Type: common.TypeString, Default: "eu"}},
+		Paths:      []string{"meta.labels.team"},
+		References: []metaparser.Reference{{Field: "rack", Table: "racks", OnDelete: metaparser.ReferenceSetNull}},
+		Compression: &metaparser.Compression{
+			Codec: metaparser.CompressionSnappy,
+		},
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	bucket := newBucket(t)
+	if _, err := metaparser.NewParser(bucket).GetMetadata(); err != storage.ErrNoSuchKey {
+		t.Fatalf("expected ErrNoSuchKey, got %v", err)
+	}
+	want := sample()
+	if err := write(bucket, want, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := metaparser.NewParser(bucket).GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.Version() != 1 || !got.IsUnique("rack") || got.IsUnique("zone") || !got.IsIndexed("zone") || !got.IsPath("meta.labels.team") {
+		t.Fatalf("bad accessors on %+v", got)
+	}
+	if r, ok := got.Reference("rack"); !ok || r.Table != "racks" {
+		t.Fatalf("got reference %+v", r)
+	}
+	if f, ok := got.Field("price"); !ok || f.Precision != 8 || f.Scale != 2 {
+		t.Fatalf("got field %+v", f)
+	}
+
+	// a rewrite drops the entries left empty
+	want = &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		TableName:   "hosts",
+		Fields:      []metaparser.Field{{Name: "name", Type: common.TypeString}},
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		View:        &metaparser.View{Source: "all", Query: "SELECT name FROM all"},
+	}
+	if err = write(bucket, want, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = metaparser.NewParser(bucket).GetMetadata(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestMalformedMetadata(t *testing.T) {
+	for name, change := range map[string]func(m *metaparser.Metadata){
+		"storage type":     func(m *metaparser.Metadata) { m.StorageType = 'z' },
+		"empty field name": func(m *metaparser.Metadata) { m.Fields[0].Name = "" },
+		"separator":        func(m *metaparser.Metadata) { m.Fields[0].Name = "a|b" },
+		"string precision": func(m *metaparser.Metadata) { m.Fields[0].Precision = 4 },
+		"scale":            func(m *metaparser.Metadata) { m.Fields[1].Scale = 9 },
+		"bad pattern":      func(m *metaparser.Metadata) { m.Fields[0].Constraint.Pattern = "(" },
+		"object bounds":    func(m *metaparser.Metadata) { m.Fields[3].Constraint.Min = "1" },
+		"unknown unique":   func(m *metaparser.Metadata) { m.Unique = []string{"nope"} },
+		"object index":     func(m *metaparser.Metadata) { m.Indexes = []string{"meta"} },
+		"plain path":       func(m *metaparser.Metadata) { m.Paths = []string{"zone.x"} },
+		"object reference": func(m *metaparser.Metadata) { m.References[0].Field = "meta" },
+		"on delete":        func(m *metaparser.Metadata) { m.References[0].OnDelete = "explode" },
+		"view source":      func(m *metaparser.Metadata) { m.View = &metaparser.View{Query: "SELECT 1"} },
+		"dictionary":       func(m *metaparser.Metadata) { m.Compression.Dictionary = 3 },
+		"codec":            func(m *metaparser.Metadata) { m.Compression.Codec = "lzma" },
+	} {
+		m := sample()
+		change(m)
+		err := write(newBucket(t), m, false)
+		if !errors.Is(err, metaparser.ErrMalformedMetadata) && !errors.Is(err, metaparser.ErrNoSuchStorageType) {
+			t.Fatalf("%s: got %v", name, err)
+		}
+	}
+	if _, err := metaparser.DecodeFields([]byte("s")); err != metaparser.ErrMalformedMetadata {
+		t.Fatalf("expected ErrMalformedMetadata, got %v", err)
+	}
+	if _, err := metaparser.DecodeDecimals([]byte("8,x,price")); err != metaparser.ErrMalformedMetadata {
+		t.Fatalf("expected ErrMalformedMetadata, got %v", err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, typ := range []byte{
+		metaparser.MetaStorageTypeKV, metaparser.MetaStorageTypeRowDocument,
+		metaparser.MetaStorageTypeColumn, metaparser.MetaStorageTypeAnalytical,
+	} {
+		if got, ok := metaparser.ParseStorageTypeName(metaparser.StorageTypeName(typ)); !ok || got != typ {
+			t.Fatalf("storage type %c: got %c", typ, got)
+		}
+	}
+	for _, typ := range []byte{
+		metaparser.MetaPrimaryKeyAutoIncrementID, metaparser.MetaPrimaryKeyUUID, metaparser.MetaPrimaryKeyCustom,
+	} {
+		if got, ok := metaparser.ParsePrimaryKeyTypeName(metaparser.PrimaryKeyTypeName(typ)); !ok || got != typ {
+			t.Fatalf("primary key type %c: got %c", typ, got)
+		}
+	}
+	if _, ok := metaparser.ParseStorageTypeName("unknown"); ok || metaparser.StorageTypeName('z') != "unknown" {
+		t.Fatal("unknown storage type accepted")
+	}
+}
@@ -0,0 +1,50 @@
+package metaparser
+
+var storageTypeNames = map[byte]string{
+	MetaStorageTypeKV:          "kv",
+	MetaStorageTypeRowDocument: "row",
+	MetaStorageTypeColumn:      "column",
+	MetaStorageTypeAnalytical:  "analytical",
+}
+
+var primaryKeyNames = map[byte]string{
+	MetaPrimaryKeyAutoIncrementID: "auto_increment",
+	MetaPrimaryKeyUUID:            "uuid",
+	MetaPrimaryKeyCustom:          "custom",
+}
+
+// StorageTypeName returns the human readable name of a storage type
+func StorageTypeName(typ byte) string {
+	if name, ok := storageTypeNames[typ]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseStorageTypeName returns the storage type named name
+func ParseStorageTypeName(name string) (byte, bool) {
+	for typ, n := range storageTypeNames {
+		if n == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// PrimaryKeyTypeName returns the human readable name of a primary key type
+func PrimaryKeyTypeName(typ byte) string {
+	if name, ok := primaryKeyNames[typ]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParsePrimaryKeyTypeName returns the primary key type named name
+func ParsePrimaryKeyTypeName(name string) (byte, bool) {
+	for typ, n := range primaryKeyNames {
+		if n == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
@@ -24,7 +24,7 @@ func (p *Parser) GetStorageType() (byte, error) {
 		return ' ', err
 	}
 	if len(rs) != 1 {
-		return ' ', err
+		return ' ', ErrNoSuchStorageType
 	}
 	r := rs[0]
 	if (r != MetaStorageTypeKV) &&
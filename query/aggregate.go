@@ -0,0 +1,438 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+)
+
+// Aggregating reports whether the plan aggregates rows
+func (p *Plan) Aggregating() bool {
+	return len(p.GroupBy) != 0 || len(p.Aggregates) != 0
+}
+
+// bindAggregates checks the grouped and aggregated fields and
+// that every column and ORDER BY term is one of them
+func (p *Plan) bindAggregates(s *Select, resolve typeResolver) error {
+	p.GroupBy = s.GroupBy
+	p.Aggregates = s.Aggregates
+	truncations := make(map[string]Truncation, len(s.Truncations))
+	for _, t := range s.Truncations {
+		truncations[t.Name()] = t
+	}
+	known := make(map[string]bool)
+	for _, f := range p.GroupBy {
+		if t, ok := truncations[f]; ok {
+			typ, err := resolve(t.Field)
+			if err != nil {
+				return err
+			}
+			if typ != common.TypeTime {
+				return fmt.Errorf("%w: TRUNC of %s field %s", document.ErrWrongFieldType, common.TypeName(typ), t.Field)
+			}
+			p.Truncations = append(p.Truncations, t)
+		} else if _, err := resolve(f); err != nil {
+			return err
+		}
+		known[f] = true
+	}
+	for _, a := range p.Aggregates {
+		if a.Field != "" {
+			typ, err := resolve(a.Field)
+			if err != nil {
+				return err
+			}
+			if (a.Func == AggSum || a.Func == AggAvg) && !isNumeric(typ) {
+				return fmt.Errorf("%w: %s of %s field %s", document.ErrWrongFieldType, a.Func, common.TypeName(typ), a.Field)
+			}
+		} else if a.Func != AggCount {
+			return fmt.Errorf("%w: %s needs a field", ErrInvalidAggregate, a.Func)
+		}
+		known[a.Name()] = true
+	}
+	if p.Columns == nil {
+		p.Columns = append([]string(nil), p.GroupBy...)
+		for _, a := range p.Aggregates {
+			p.Columns = append(p.Columns, a.Name())
+		}
+	}
+	for _, c := range p.Columns {
+		if !known[c] {
+			return fmt.Errorf("%w: %s is neither grouped nor aggregated", ErrInvalidAggregate, c)
+		}
+	}
+	for _, o := range p.OrderBy {
+		if !known[o.Field] {
+			return fmt.Errorf("%w: cannot order by %s", ErrInvalidAggregate, o.Field)
+		}
+	}
+	return nil
+}
+
+func isNumeric(typ byte) bool {
+	return typ == common.TypeInteger || typ == common.TypeFloat || typ == common.TypeDecimal
+}
+
+// avgScale is the number of fractional digits the average of
+// decimals gets beyond the scale of their sum
+const avgScale = 6
+
+// accumulator computes a single aggregate of a group, a sum of
+// integers overflowing an int64 goes on as a decimal
+type accumulator struct {
+	agg   Aggregate
+	count int64
+	isum  int64
+	fsum  float64
+	fcomp float64
+	float bool
+	dsum  decimal.Decimal
+	dec   bool
+	best  interface{}
+}
+
+func (acc *accumulator) add(row document.Row) {
+	if acc.agg.Field == "" {
+		acc.count++
+		return
+	}
+	v := fieldValue(row, acc.agg.Field)
+	if v == nil {
+		return
+	}
+	acc.count++
+	switch acc.agg.Func {
+	case AggSum, AggAvg:
+		switch x := v.(type) {
+		case int64:
+			sum := acc.isum + x
+			if (x > 0 && sum < acc.isum) || (x < 0 && sum > acc.isum) {
+				acc.dec = true
+				acc.dsum = acc.dsum.Add(decimal.NewFromInt(acc.isum))
+				sum = x
+			}
+			acc.isum = sum
+		case float64:
+			acc.float = true
+			acc.addFloat(x)
+		case decimal.Decimal:
+			acc.dec = true
+			acc.dsum = acc.dsum.Add(x)
+		}
+	case AggMin:
+		if acc.best == nil || sortCompare(v, acc.best) < 0 {
+			acc.best = v
+		}
+	case AggMax:
+		if acc.best == nil || sortCompare(v, acc.best) > 0 {
+			acc.best = v
+		}
+	}
+}
+
+// addFloat adds x with Neumaier compensated summation so that
+// the sum does not depend on the order rows are read in
+func (acc *accumulator) addFloat(x float64) {
+	t := acc.fsum + x
+	if abs(acc.fsum) >= abs(x) {
+		acc.fcomp += (acc.fsum - t) + x
+	} else {
+		acc.fcomp += (x - t) + acc.fsum
+	}
+	acc.fsum = t
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (acc *accumulator) result() interface{} {
+	switch acc.agg.Func {
+	case AggCount:
+		return acc.count
+	case AggSum, AggAvg:
+		if acc.count == 0 {
+			return nil
+		}
+		var sum interface{} = acc.isum
+		if acc.dec {
+			sum = acc.dsum.Add(decimal.NewFromInt(acc.isum))
+		} else if acc.float {
+			sum = float64(acc.isum) + acc.fsum + acc.fcomp
+		}
+		if acc.agg.Func == AggAvg {
+			return average(sum, acc.count)
+		}
+		return sum
+	}
+	return acc.best
+}
+
+// average divides the sum of count values, the average of integers
+// is a float
+func average(sum interface{}, count int64) interface{} {
+	switch x := sum.(type) {
+	case int64:
+		return float64(x) / float64(count)
+	case float64:
+		return x / float64(count)
+	case decimal.Decimal:
+		avg, _ := x.Quo(decimal.NewFromInt(count), x.Scale()+avgScale)
+		return avg
+	}
+	return nil
+}
+
+type group struct {
+	keys []interface{}
+	accs []*accumulator
+}
+
+func (p *Plan) newGroup(keys []interface{}) *group {
+	g := &group{keys: keys, accs: make([]*accumulator, len(p.Aggregates))}
+	for i, a := range p.Aggregates {
+		g.accs[i] = &accumulator{agg: a}
+	}
+	return g
+}
+
+func (g *group) row(p *Plan) document.Row {
+	row := make(document.Row, len(p.GroupBy)+len(p.Aggregates))
+	for i, f := range p.GroupBy {
+		row[f] = g.keys[i]
+	}
+	for i, a := range p.Aggregates {
+		row[a.Name()] = g.accs[i].result()
+	}
+	return row
+}
+
+// groupValue returns the value of the grouped field or
+// truncation f of row
+func (p *Plan) groupValue(f string, row document.Row) interface{} {
+	for _, t := range p.Truncations {
+		if t.Name() == f {
+			v, ok := fieldValue(row, t.Field).(time.Time)
+			if !ok {
+				return nil
+			}
+			return document.TruncateTime(v, t.Unit)
+		}
+	}
+	return fieldValue(row, f)
+}
+
+// groupKeys lists the groups row belongs to, a row belongs to
+// the group of every tag of a grouped tag field
+func (p *Plan) groupKeys(row document.Row) [][]interface{} {
+	ret := [][]interface{}{make([]interface{}, 0, len(p.GroupBy))}
+	for _, f := range p.GroupBy {
+		v := p.groupValue(f, row)
+		values := []interface{}{v}
+		if tags, ok := v.([]string); ok {
+			values = make([]interface{}, len(tags))
+			for i, tag := range tags {
+				values[i] = tag
+			}
+		}
+		next := make([][]interface{}, 0, len(ret)*len(values))
+		for _, keys := range ret {
+			for _, v := range values {
+				next = append(next, append(keys[:len(keys):len(keys)], v))
+			}
+		}
+		ret = next
+	}
+	return ret
+}
+
+// groupKey encodes the values of a group into a map key
+func groupKey(keys []interface{}) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		switch x := k.(type) {
+		case decimal.Decimal:
+			k = x.Reduce()
+		case time.Time:
+			k = x.UnixNano()
+		}
+		parts[i] = fmt.Sprintf("%T:%v", k, k)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// aggregate folds every row read by the plan into its group, a
+// query without GROUP BY always yields a single group
+func (p *Plan) aggregate(exec *Execution) ([]document.Row, error) {
+	if p.PostingGroups {
+		return p.countPostings()
+	}
+	groups := make(map[string]*group)
+	var order []*group
+	if len(p.GroupBy) == 0 {
+		g := p.newGroup(nil)
+		groups[""] = g
+		order = append(order, g)
+	}
+	err := p.each(func(row document.Row) (bool, error) {
+		exec.RowsRead++
+		if p.Filter != nil && !eval(p.Filter, rowGetter(row)) {
+			return true, nil
+		}
+		for _, keys := range p.groupKeys(row) {
+			k := groupKey(keys)
+			g, ok := groups[k]
+			if !ok {
+				g = p.newGroup(keys)
+				groups[k] = g
+				order = append(order, g)
+			}
+			for _, acc := range g.accs {
+				acc.add(row)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]document.Row, len(order))
+	for i, g := range order {
+		ret[i] = g.row(p)
+	}
+	p.sortGroups(ret)
+	return ret, nil
+}
+
+// sortGroups orders groups by their values when the query has
+// no ORDER BY, so that results do not depend on the access path
+func (p *Plan) sortGroups(rows []document.Row) {
+	if len(p.OrderBy) != 0 {
+		return
+	}
+	orders := make([]Order, len(p.GroupBy))
+	for i, f := range p.GroupBy {
+		orders[i] = Order{Field: f}
+	}
+	sortRows(rows, orders)
+}
+
+// postingGroupable reports whether the groups can be counted
+// from posting lists: the query counts rows grouped by a single
+// enum or tag field and filters only on enum equalities and tags
+func (p *Plan) postingGroupable() bool {
+	if p.doc == nil || len(p.GroupBy) != 1 || !p.doc.HasPosting(p.GroupBy[0]) {
+		return false
+	}
+	for _, a := range p.Aggregates {
+		if a.Func != AggCount || a.Field != "" {
+			return false
+		}
+	}
+	terms := conjuncts(p.Filter)
+	for _, t := range terms {
+		field, _, ok := equalities(t)
+		if !ok || !p.doc.HasPosting(field) {
+			return false
+		}
+	}
+	return len(terms) != 0 || p.Statistics != nil
+}
+
+// countPostings counts the rows of every group from the posting
+// lists of the grouped field, intersected with the posting lists
+// of the filter, rows without a value form the null group, whose
+// size is found from the distinct rows of the groups since a row
+// may hold several tags
+func (p *Plan) countPostings() ([]document.Row, error) {
+	field := p.GroupBy[0]
+	var base map[string]bool
+	total := int64(0)
+	terms := conjuncts(p.Filter)
+	if len(terms) != 0 {
+		var keys []string
+		for i, t := range terms {
+			f, values, _ := equalities(t)
+			var union []string
+			for _, v := range values {
+				pks, err := p.doc.Posting(f, v)
+				if err != nil {
+					return nil, err
+				}
+				union = append(union, pks...)
+			}
+			union = sortUnique(union)
+			if i == 0 {
+				keys = union
+			} else {
+				keys = intersect(keys, union)
+			}
+		}
+		base = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			base[k] = true
+		}
+		total = int64(len(keys))
+	} else {
+		total = p.Statistics.Rows
+	}
+	values, err := p.doc.EnumValues(field)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(values))
+	for v := range values {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	var ret []document.Row
+	counted := int64(0)
+	tags := p.doc.IsTag(field)
+	seen := make(map[string]bool)
+	for _, v := range names {
+		n := values[v]
+		if base != nil || tags {
+			pks, err := p.doc.Posting(field, v)
+			if err != nil {
+				return nil, err
+			}
+			n = 0
+			for _, pk := range pks {
+				if base != nil && !base[pk] {
+					continue
+				}
+				n++
+				if !seen[pk] {
+					seen[pk] = true
+					counted++
+				}
+			}
+		} else {
+			counted += n
+		}
+		if n == 0 {
+			continue
+		}
+		ret = append(ret, p.countRow(v, n))
+	}
+	if total > counted {
+		ret = append([]document.Row{p.countRow(nil, total-counted)}, ret...)
+	}
+	return ret, nil
+}
+
+func (p *Plan) countRow(value interface{}, n int64) document.Row {
+	row := document.Row{p.GroupBy[0]: value}
+	for _, a := range p.Aggregates {
+		row[a.Name()] = n
+	}
+	return row
+}
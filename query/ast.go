@@ -0,0 +1,392 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/document"
+)
+
+// Statement is a parsed query, either a *Select or a *Match
+type Statement interface {
+	statement()
+	String() string
+}
+
+// Op is a comparison operator
+type Op int
+
+// Comparison operators
+const (
+	OpEq Op = iota
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+)
+
+var opNames = [...]string{"=", "!=", "<", "<=", ">", ">="}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return "?"
+}
+
+// Expr is a boolean expression over the fields of a row
+type Expr interface {
+	expr()
+	String() string
+}
+
+// Compare compares a field with a constant value
+type Compare struct {
+	Field string
+	Op    Op
+	Value interface{}
+}
+
+// In tests whether a field holds one of the values
+type In struct {
+	Field  string
+	Values []interface{}
+	Not    bool
+}
+
+// Between tests whether a field lies in [Low, High]
+type Between struct {
+	Field string
+	Low   interface{}
+	High  interface{}
+	Not   bool
+}
+
+// Prefix tests whether a string field starts with Value
+type Prefix struct {
+	Field string
+	Value string
+}
+
+// Has tests whether a tag field holds the tag Value, it is false
+// rather than unknown for rows without tags
+type Has struct {
+	Field string
+	Value string
+}
+
+// IsNull tests whether a field is missing or null
+type IsNull struct {
+	Field string
+	Not   bool
+}
+
+// And is the conjunction of two expressions
+type And struct {
+	Left  Expr
+	Right Expr
+}
+
+// Or is the disjunction of two expressions
+type Or struct {
+	Left  Expr
+	Right Expr
+}
+
+// Not negates an expression
+type Not struct {
+	Expr Expr
+}
+
+func (*Compare) expr() {}
+func (*In) expr()      {}
+func (*Between) expr() {}
+func (*Prefix) expr()  {}
+func (*Has) expr()     {}
+func (*IsNull) expr()  {}
+func (*And) expr()     {}
+func (*Or) expr()      {}
+func (*Not) expr()     {}
+
+func literal(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(x, "'", "''", -1) + "'"
+	case bool:
+		if x {
+			return "TRUE"
+		}
+		return "FALSE"
+	case time.Time:
+		return "'" + x.Format(time.RFC3339Nano) + "'"
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func not(neg bool) string {
+	if neg {
+		return "NOT "
+	}
+	return ""
+}
+
+func (e *Compare) String() string {
+	return fmt.Sprintf("%s %s %s", e.Field, e.Op, literal(e.Value))
+}
+
+func (e *In) String() string {
+	vs := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		vs[i] = literal(v)
+	}
+	return fmt.Sprintf("%s %sIN (%s)", e.Field, not(e.Not), strings.Join(vs, ", "))
+}
+
+func (e *Between) String() string {
+	return fmt.Sprintf("%s %sBETWEEN %s AND %s", e.Field, not(e.Not), literal(e.Low), literal(e.High))
+}
+
+func (e *Prefix) String() string {
+	return fmt.Sprintf("%s STARTS WITH %s", e.Field, literal(e.Value))
+}
+
+func (e *Has) String() string {
+	return fmt.Sprintf("%s HAS %s", e.Field, literal(e.Value))
+}
+
+func (e *IsNull) String() string {
+	return fmt.Sprintf("%s IS %sNULL", e.Field, not(e.Not))
+}
+
+func (e *And) String() string {
+	return fmt.Sprintf("(%s AND %s)", e.Left, e.Right)
+}
+
+func (e *Or) String() string {
+	return fmt.Sprintf("(%s OR %s)", e.Left, e.Right)
+}
+
+func (e *Not) String() string {
+	return fmt.Sprintf("NOT %s", e.Expr)
+}
+
+// Order is a single ORDER BY term
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// AggFunc is an aggregate function
+type AggFunc int
+
+// Aggregate functions
+const (
+	AggCount AggFunc = iota
+	AggSum
+	AggMin
+	AggMax
+	AggAvg
+)
+
+var aggNames = [...]string{"COUNT", "SUM", "MIN", "MAX", "AVG"}
+
+func (f AggFunc) String() string {
+	if int(f) < len(aggNames) {
+		return aggNames[f]
+	}
+	return "?"
+}
+
+// Aggregate is an aggregated column, COUNT with an empty Field
+// counts rows while every other aggregate skips null values
+type Aggregate struct {
+	Func  AggFunc
+	Field string
+}
+
+// Name returns the column name of the aggregate, as in SUM(port)
+func (a Aggregate) Name() string {
+	field := a.Field
+	if field == "" {
+		field = "*"
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, field)
+}
+
+// Truncation is a time field truncated to a unit, grouping by
+// it buckets the rows by minute, hour or day in UTC
+type Truncation struct {
+	Field string
+	Unit  document.TimeUnit
+}
+
+// Name returns the column name of the truncation, as in
+// TRUNC(seen, HOUR)
+func (t Truncation) Name() string {
+	return fmt.Sprintf("TRUNC(%s, %s)", t.Field, t.Unit)
+}
+
+// Select is a SELECT query on a single table
+type Select struct {
+	// Fields lists the projected columns, nil means every field,
+	// aggregates are listed by name
+	Fields  []string
+	Table   string
+	Where   Expr
+	GroupBy []string
+	// Aggregates lists the aggregates computed per group
+	Aggregates []Aggregate
+	// Truncations lists the truncated time fields, they are
+	// grouped and listed by name
+	Truncations []Truncation
+	OrderBy     []Order
+	// Limit is the maximum number of rows, negative means no limit
+	Limit  int
+	Offset int
+}
+
+func (*Select) statement() {}
+
+func (s *Select) String() string {
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	if s.Fields == nil {
+		sb.WriteString("*")
+	} else {
+		sb.WriteString(strings.Join(s.Fields, ", "))
+	}
+	sb.WriteString(" FROM ")
+	sb.WriteString(s.Table)
+	if s.Where != nil {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(s.Where.String())
+	}
+	if len(s.GroupBy) != 0 {
+		sb.WriteString(" GROUP BY ")
+		sb.WriteString(strings.Join(s.GroupBy, ", "))
+	}
+	writeOrder(&sb, s.OrderBy)
+	writeLimit(&sb, s.Limit, s.Offset)
+	return sb.String()
+}
+
+// AddAggregate adds a to the aggregates of s unless it is
+// already computed and returns its column name
+func (s *Select) AddAggregate(a Aggregate) string {
+	for _, b := range s.Aggregates {
+		if a == b {
+			return a.Name()
+		}
+	}
+	s.Aggregates = append(s.Aggregates, a)
+	return a.Name()
+}
+
+// AddTruncation adds t to the truncations of s unless it is
+// already there and returns its column name
+func (s *Select) AddTruncation(t Truncation) string {
+	for _, u := range s.Truncations {
+		if t == u {
+			return t.Name()
+		}
+	}
+	s.Truncations = append(s.Truncations, t)
+	return t.Name()
+}
+
+func writeOrder(sb *strings.Builder, orders []Order) {
+	for i, o := range orders {
+		if i == 0 {
+			sb.WriteString(" ORDER BY ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(o.Field)
+		if o.Desc {
+			sb.WriteString(" DESC")
+		}
+	}
+}
+
+func writeLimit(sb *strings.Builder, limit, offset int) {
+	if limit >= 0 {
+		fmt.Fprintf(sb, " LIMIT %d", limit)
+	}
+	if offset > 0 {
+		fmt.Fprintf(sb, " OFFSET %d", offset)
+	}
+}
+
+// Node is a node pattern of a MATCH query, a variable bound
+// to the rows of a table
+type Node struct {
+	Var   string
+	Table string
+}
+
+// Edge links two consecutive nodes of a MATCH query, a forward
+// edge (a)-[f]->(b) holds when a.f is the primary key of b, a
+// backward edge (a)<-[f]-(b) when b.f is the primary key of a
+type Edge struct {
+	Field    string
+	Backward bool
+}
+
+// Match is a MATCH query following references between tables,
+// field names in Where and Return are qualified by variables
+// as in a.name, a bare variable returns the whole row
+type Match struct {
+	Nodes []Node
+	// Edges[i] links Nodes[i] and Nodes[i+1]
+	Edges  []Edge
+	Where  Expr
+	Return []string
+	Limit  int
+}
+
+func (*Match) statement() {}
+
+func (m *Match) String() string {
+	var sb strings.Builder
+	sb.WriteString("MATCH ")
+	for i, n := range m.Nodes {
+		if i > 0 {
+			e := m.Edges[i-1]
+			if e.Backward {
+				fmt.Fprintf(&sb, "<-[%s]-", e.Field)
+			} else {
+				fmt.Fprintf(&sb, "-[%s]->", e.Field)
+			}
+		}
+		fmt.Fprintf(&sb, "(%s:%s)", n.Var, n.Table)
+	}
+	if m.Where != nil {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(m.Where.String())
+	}
+	sb.WriteString(" RETURN ")
+	sb.WriteString(strings.Join(m.Return, ", "))
+	writeLimit(&sb, m.Limit, 0)
+	return sb.String()
+}
+
+// Explain describes the plan of a query, with Analyze the query
+// is also executed and measured
+type Explain struct {
+	Statement Statement
+	Analyze   bool
+}
+
+func (*Explain) statement() {}
+
+func (e *Explain) String() string {
+	if e.Analyze {
+		return "EXPLAIN ANALYZE " + e.Statement.String()
+	}
+	return "EXPLAIN " + e.Statement.String()
+}
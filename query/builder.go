@@ -0,0 +1,298 @@
+package query
+
+import (
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Cond returns the comparison of a field with a value
+func Cond(field string, op Op, value interface{}) Expr {
+	return &Compare{Field: field, Op: op, Value: value}
+}
+
+// OneOf returns the condition that a field holds one of values
+func OneOf(field string, values ...interface{}) Expr {
+	return &In{Field: field, Values: values}
+}
+
+// HasPrefix returns the condition that a string field starts
+// with prefix
+func HasPrefix(field string, prefix string) Expr {
+	return &Prefix{Field: field, Value: prefix}
+}
+
+// HasTag returns the condition that a tag field holds tag
+func HasTag(field string, tag string) Expr {
+	return &Has{Field: field, Value: tag}
+}
+
+// InRange returns the condition that a field lies in
+// [low, high), a nil bound is not checked
+func InRange(field string, low, high interface{}) Expr {
+	var terms []Expr
+	if low != nil {
+		terms = append(terms, Cond(field, OpGe, low))
+	}
+	if high != nil {
+		terms = append(terms, Cond(field, OpLt, high))
+	}
+	if len(terms) == 0 {
+		return &IsNull{Field: field, Not: true}
+	}
+	return conjunction(terms)
+}
+
+// All returns the conjunction of exprs
+func All(exprs ...Expr) Expr {
+	return conjunction(exprs)
+}
+
+// Any returns the disjunction of exprs
+func Any(exprs ...Expr) Expr {
+	var ret Expr
+	for _, e := range exprs {
+		if ret == nil {
+			ret = e
+		} else {
+			ret = &Or{Left: ret, Right: e}
+		}
+	}
+	return ret
+}
+
+// Negate returns the negation of e
+func Negate(e Expr) Expr {
+	return &Not{Expr: e}
+}
+
+// Builder builds a select query on a table, conditions
+// added by its methods are joined with AND, errors are reported
+// when the query is planned
+type Builder struct {
+	doc     *document.Document
+	chunked Chunked
+	sel     Select
+	err     error
+}
+
+// NewBuilder creates a builder querying doc, a nil doc makes
+// the builder fail with common.ErrWrongStorageType
+func NewBuilder(table string, doc *document.Document) *Builder {
+	b := &Builder{
+		doc: doc,
+		sel: Select{Table: table, Limit: -1},
+	}
+	if doc == nil {
+		b.err = common.ErrWrongStorageType
+	}
+	return b
+}
+
+// NewChunkedBuilder creates a builder querying a chunked table
+func NewChunkedBuilder(table string, chunked Chunked) *Builder {
+	return &Builder{
+		chunked: chunked,
+		sel:     Select{Table: table, Limit: -1},
+	}
+}
+
+func (b *Builder) and(e Expr) *Builder {
+	if e == nil {
+		return b
+	}
+	if b.sel.Where == nil {
+		b.sel.Where = e
+	} else {
+		b.sel.Where = &And{Left: b.sel.Where, Right: e}
+	}
+	return b
+}
+
+// Where adds the comparison of a field with a value
+func (b *Builder) Where(field string, op Op, value interface{}) *Builder {
+	return b.and(Cond(field, op, value))
+}
+
+// In adds the condition that a field holds one of values
+func (b *Builder) In(field string, values ...interface{}) *Builder {
+	return b.and(OneOf(field, values...))
+}
+
+// Prefix adds the condition that a string field starts with
+// prefix
+func (b *Builder) Prefix(field string, prefix string) *Builder {
+	return b.and(HasPrefix(field, prefix))
+}
+
+// Tagged adds the condition that a tag field holds every tag
+func (b *Builder) Tagged(field string, tags ...string) *Builder {
+	for _, tag := range tags {
+		b.and(HasTag(field, tag))
+	}
+	return b
+}
+
+// Range adds the condition that a field lies in [low, high),
+// a nil bound is not checked
+func (b *Builder) Range(field string, low, high interface{}) *Builder {
+	return b.and(InRange(field, low, high))
+}
+
+// And adds every expression of exprs
+func (b *Builder) And(exprs ...Expr) *Builder {
+	return b.and(All(exprs...))
+}
+
+// Or adds the condition that one of exprs holds
+func (b *Builder) Or(exprs ...Expr) *Builder {
+	return b.and(Any(exprs...))
+}
+
+// OrderBy sorts the rows by field in ascending order, later
+// calls break ties of earlier ones
+func (b *Builder) OrderBy(field string) *Builder {
+	b.sel.OrderBy = append(b.sel.OrderBy, Order{Field: field})
+	return b
+}
+
+// OrderByDesc sorts the rows by field in descending order
+func (b *Builder) OrderByDesc(field string) *Builder {
+	b.sel.OrderBy = append(b.sel.OrderBy, Order{Field: field, Desc: true})
+	return b
+}
+
+// Limit sets the maximum number of rows
+func (b *Builder) Limit(n int) *Builder {
+	b.sel.Limit = n
+	return b
+}
+
+// Offset sets the number of rows skipped
+func (b *Builder) Offset(n int) *Builder {
+	b.sel.Offset = n
+	return b
+}
+
+// Project restricts the returned fields, every field is
+// returned by default
+func (b *Builder) Project(fields ...string) *Builder {
+	b.sel.Fields = append(b.sel.Fields, fields...)
+	return b
+}
+
+// GroupBy groups the rows by fields, the query then returns
+// one row per group holding the fields and the aggregates
+func (b *Builder) GroupBy(fields ...string) *Builder {
+	b.sel.GroupBy = append(b.sel.GroupBy, fields...)
+	return b
+}
+
+// GroupByTime groups the rows by the minute, hour or day of the
+// time field, the group is returned in the column named by
+// Truncation{field, unit}.Name()
+func (b *Builder) GroupByTime(field string, unit document.TimeUnit) *Builder {
+	name := b.sel.AddTruncation(Truncation{Field: field, Unit: unit})
+	b.sel.GroupBy = append(b.sel.GroupBy, name)
+	return b
+}
+
+// Aggregate adds an aggregate of field and returns the builder,
+// the aggregate is returned in the column named by a.Name()
+func (b *Builder) Aggregate(fn AggFunc, field string) *Builder {
+	b.sel.AddAggregate(Aggregate{Func: fn, Field: field})
+	return b
+}
+
+// Count counts the rows of every group
+func (b *Builder) Count() *Builder {
+	return b.Aggregate(AggCount, "")
+}
+
+// CountOf counts the rows of every group where field is not null
+func (b *Builder) CountOf(field string) *Builder {
+	return b.Aggregate(AggCount, field)
+}
+
+// Sum sums field over every group
+func (b *Builder) Sum(field string) *Builder {
+	return b.Aggregate(AggSum, field)
+}
+
+// Min returns the smallest value of field in every group
+func (b *Builder) Min(field string) *Builder {
+	return b.Aggregate(AggMin, field)
+}
+
+// Max returns the largest value of field in every group
+func (b *Builder) Max(field string) *Builder {
+	return b.Aggregate(AggMax, field)
+}
+
+// Avg averages field over every group
+func (b *Builder) Avg(field string) *Builder {
+	return b.Aggregate(AggAvg, field)
+}
+
+// Select returns the query built so far
+func (b *Builder) Select() *Select {
+	s := b.sel
+	return &s
+}
+
+// Plan validates the query against the schema and compiles it
+func (b *Builder) Plan() (*Plan, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.chunked != nil {
+		return planChunked(b.chunked, b.Select())
+	}
+	return planSelect(b.doc, b.Select())
+}
+
+// Execute runs the query
+func (b *Builder) Execute() (*Result, error) {
+	p, err := b.Plan()
+	if err != nil {
+		return nil, err
+	}
+	return p.Execute()
+}
+
+// Rows runs the query and returns the projected rows
+func (b *Builder) Rows() ([]document.Row, error) {
+	p, err := b.Plan()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.Rows()
+	if err != nil || b.sel.Fields == nil {
+		return rows, err
+	}
+	for i, row := range rows {
+		projected := make(document.Row, len(p.Columns))
+		for _, c := range p.Columns {
+			if v, ok := row[c]; ok {
+				projected[c] = v
+			} else if v, ok := row.Lookup(c); ok {
+				projected[c] = v
+			}
+		}
+		rows[i] = projected
+	}
+	return rows, nil
+}
+
+// First runs the query and returns its first row, it returns
+// storage.ErrNoSuchKey if there is none
+func (b *Builder) First() (document.Row, error) {
+	rows, err := b.Limit(1).Rows()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, storage.ErrNoSuchKey
+	}
+	return rows[0], nil
+}
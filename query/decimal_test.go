@@ -0,0 +1,60 @@
+package query_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+)
+
+func TestDecimalQueries(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("invoices", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "ref", Type: common.TypeDecimal, Precision: 6, Scale: 2},
+			{Name: "amount", Type: common.TypeDecimal, Precision: 12, Scale: 2},
+		},
+		Unique: []string{"ref"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a thousand cents add up exactly, which floats do not
+	var rows []document.Row
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, document.Row{"ref": fmt.Sprintf("%d.5", i), "amount": 0.1})
+	}
+	rows[0]["amount"] = "1234567890.01"
+	insert(t, db, "invoices", rows...)
+
+	rs, err := query.Run(db, "SELECT SUM(amount), AVG(amount), MIN(amount), MAX(amount) FROM invoices WHERE ref >= 1.5 AND ref < 501")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(rs.Rows[0]))
+	for i, v := range rs.Rows[0] {
+		got[i] = fmt.Sprint(v)
+	}
+	if want := []string{"50.00", "0.10000000", "0.10", "0.10"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	rs, err = query.Run(db, "SELECT SUM(amount) FROM invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rs.Rows[0][0]); got != "1234567989.91" {
+		t.Fatalf("unexpected total %s", got)
+	}
+	if got := names(t, db, "SELECT ref FROM invoices WHERE ref BETWEEN 997 AND 998.50 ORDER BY ref DESC"); !reflect.DeepEqual(got, []string{"998.50", "997.50"}) {
+		t.Fatalf("unexpected range %v", got)
+	}
+	if got := names(t, db, "SELECT id FROM invoices WHERE ref = 7.50"); !reflect.DeepEqual(got, []string{"8"}) {
+		t.Fatalf("unexpected lookup %v", got)
+	}
+}
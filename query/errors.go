@@ -0,0 +1,18 @@
+package query
+
+import "fmt"
+
+// ErrSyntax as is
+var ErrSyntax = fmt.Errorf("Syntax error in query")
+
+// ErrUnknownVariable as is
+var ErrUnknownVariable = fmt.Errorf("Unknown variable in match query")
+
+// ErrNotComparable as is
+var ErrNotComparable = fmt.Errorf("Values are not comparable")
+
+// ErrInvalidAggregate as is
+var ErrInvalidAggregate = fmt.Errorf("Invalid aggregate query")
+
+// ErrInvalidView as is
+var ErrInvalidView = fmt.Errorf("Invalid materialized view")
@@ -0,0 +1,475 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+)
+
+// compareValues orders two non nil values of the same kind,
+// integers, floats and decimals compare with each other and
+// times compare as instants whatever their offsets
+func compareValues(a, b interface{}) (int, error) {
+	if x, ok := a.(decimal.Decimal); ok {
+		if y, ok := toDecimal(b); ok {
+			return x.Cmp(y), nil
+		}
+	} else if y, ok := b.(decimal.Decimal); ok {
+		if x, ok := toDecimal(a); ok {
+			return x.Cmp(y), nil
+		}
+	}
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return compareInt(x, y), nil
+		case float64:
+			return compareFloat(float64(x), y), nil
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return compareFloat(x, float64(y)), nil
+		case float64:
+			return compareFloat(x, y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, nil
+			case x.After(y):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, nil
+			case y:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %T and %T", ErrNotComparable, a, b)
+}
+
+// toDecimal converts numbers into decimals, floats convert
+// to the shortest decimal reading back as the same float
+func toDecimal(v interface{}) (decimal.Decimal, bool) {
+	switch x := v.(type) {
+	case decimal.Decimal:
+		return x, true
+	case int64:
+		return decimal.NewFromInt(x), true
+	case float64:
+		d, err := decimal.NewFromFloat(x)
+		return d, err == nil
+	}
+	return decimal.Decimal{}, false
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// sortCompare orders values for ORDER BY, null sorts first and
+// values that are not comparable are considered equal
+func sortCompare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	c, err := compareValues(a, b)
+	if err != nil {
+		return 0
+	}
+	return c
+}
+
+func equalValues(a, b interface{}) bool {
+	c, err := compareValues(a, b)
+	return err == nil && c == 0
+}
+
+// getter returns the value of a field, nil when it is missing
+type getter func(field string) interface{}
+
+func rowGetter(row document.Row) getter {
+	return func(field string) interface{} {
+		return fieldValue(row, field)
+	}
+}
+
+// fieldValue returns the value of a field of row, or the value at
+// a dotted path into an object field, nil when it is missing
+func fieldValue(row document.Row, field string) interface{} {
+	if v, ok := row[field]; ok {
+		return v
+	}
+	v, _ := row.Lookup(field)
+	return v
+}
+
+// truth is the three valued logic of filters, comparisons
+// involving null are unknown
+type truth int8
+
+const (
+	truthFalse truth = iota
+	truthUnknown
+	truthTrue
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+// eval reports whether a bound expression holds, unknown is
+// treated as false
+func eval(e Expr, get getter) bool {
+	return evalTruth(e, get) == truthTrue
+}
+
+func evalTruth(e Expr, get getter) truth {
+	switch x := e.(type) {
+	case *Compare:
+		v := get(x.Field)
+		if v == nil || x.Value == nil {
+			return truthUnknown
+		}
+		c, err := compareValues(v, x.Value)
+		if err != nil {
+			return truthUnknown
+		}
+		switch x.Op {
+		case OpEq:
+			return truthOf(c == 0)
+		case OpNe:
+			return truthOf(c != 0)
+		case OpLt:
+			return truthOf(c < 0)
+		case OpLe:
+			return truthOf(c <= 0)
+		case OpGt:
+			return truthOf(c > 0)
+		case OpGe:
+			return truthOf(c >= 0)
+		}
+		return truthUnknown
+	case *In:
+		v := get(x.Field)
+		if v == nil {
+			return truthUnknown
+		}
+		ret := truthFalse
+		for _, item := range x.Values {
+			if item == nil {
+				ret = truthUnknown
+			} else if equalValues(v, item) {
+				ret = truthTrue
+				break
+			}
+		}
+		if x.Not {
+			return not3(ret)
+		}
+		return ret
+	case *Between:
+		v := get(x.Field)
+		if v == nil || x.Low == nil || x.High == nil {
+			return truthUnknown
+		}
+		lo, err := compareValues(v, x.Low)
+		if err != nil {
+			return truthUnknown
+		}
+		hi, err := compareValues(v, x.High)
+		if err != nil {
+			return truthUnknown
+		}
+		return truthOf((lo >= 0 && hi <= 0) != x.Not)
+	case *Prefix:
+		v, ok := get(x.Field).(string)
+		if !ok {
+			return truthUnknown
+		}
+		return truthOf(strings.HasPrefix(v, x.Value))
+	case *Has:
+		tags, _ := get(x.Field).([]string)
+		i := sort.SearchStrings(tags, x.Value)
+		return truthOf(i < len(tags) && tags[i] == x.Value)
+	case *IsNull:
+		return truthOf((get(x.Field) == nil) != x.Not)
+	case *And:
+		l := evalTruth(x.Left, get)
+		if l == truthFalse {
+			return l
+		}
+		r := evalTruth(x.Right, get)
+		if r < l {
+			return r
+		}
+		return l
+	case *Or:
+		l := evalTruth(x.Left, get)
+		if l == truthTrue {
+			return l
+		}
+		r := evalTruth(x.Right, get)
+		if r > l {
+			return r
+		}
+		return l
+	case *Not:
+		return not3(evalTruth(x.Expr, get))
+	}
+	return truthUnknown
+}
+
+func not3(t truth) truth {
+	return truthTrue - t
+}
+
+// typeResolver returns the type of a field
+type typeResolver func(field string) (byte, error)
+
+func schemaResolver(sc schema) typeResolver {
+	return func(field string) (byte, error) {
+		typ, ok := fieldType(sc, field)
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", document.ErrUnknownField, field)
+		}
+		return typ, nil
+	}
+}
+
+// fieldType returns the type of a field, a dotted path into an
+// object field holds values of any type and resolves to
+// common.TypeObject
+func fieldType(sc schema, field string) (byte, bool) {
+	if typ, ok := sc.FieldType(field); ok {
+		return typ, true
+	}
+	parts := document.SplitPath(field)
+	if len(parts) < 2 {
+		return 0, false
+	}
+	if typ, ok := sc.FieldType(parts[0]); !ok || typ != common.TypeObject {
+		return 0, false
+	}
+	for _, p := range parts[1:] {
+		if p == "" {
+			return 0, false
+		}
+	}
+	return common.TypeObject, true
+}
+
+// scalar rejects comparisons on tag fields, whose values are sets
+func scalar(typ byte, field string) error {
+	if typ == common.TypeTag {
+		return fmt.Errorf("%w: tag field %s can only be tested with HAS", document.ErrWrongFieldType, field)
+	}
+	return nil
+}
+
+func bindValue(typ byte, field string, v interface{}) (interface{}, error) {
+	if err := scalar(typ, field); err != nil {
+		return nil, err
+	}
+	nv, err := document.NormalizeValue(typ, v)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", field, err)
+	}
+	return nv, nil
+}
+
+// bind checks the fields of e against the schema and converts
+// every constant into the type of the field it is compared with
+func bind(e Expr, resolve typeResolver) (Expr, error) {
+	switch x := e.(type) {
+	case nil:
+		return nil, nil
+	case *Compare:
+		typ, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		v, err := bindValue(typ, x.Field, x.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &Compare{Field: x.Field, Op: x.Op, Value: v}, nil
+	case *In:
+		typ, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		ret := &In{Field: x.Field, Not: x.Not, Values: make([]interface{}, len(x.Values))}
+		for i, item := range x.Values {
+			ret.Values[i], err = bindValue(typ, x.Field, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	case *Between:
+		typ, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		ret := &Between{Field: x.Field, Not: x.Not}
+		ret.Low, err = bindValue(typ, x.Field, x.Low)
+		if err != nil {
+			return nil, err
+		}
+		ret.High, err = bindValue(typ, x.Field, x.High)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case *Prefix:
+		typ, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		if typ != common.TypeString && typ != common.TypeEnum && typ != common.TypeObject {
+			return nil, fmt.Errorf("%w: prefix on %s field %s", document.ErrWrongFieldType, common.TypeName(typ), x.Field)
+		}
+		return x, nil
+	case *Has:
+		typ, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		if typ != common.TypeTag {
+			return nil, fmt.Errorf("%w: HAS on %s field %s", document.ErrWrongFieldType, common.TypeName(typ), x.Field)
+		}
+		return x, document.CheckTag(x.Value)
+	case *IsNull:
+		_, err := resolve(x.Field)
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	case *And:
+		l, err := bind(x.Left, resolve)
+		if err != nil {
+			return nil, err
+		}
+		r, err := bind(x.Right, resolve)
+		if err != nil {
+			return nil, err
+		}
+		return &And{Left: l, Right: r}, nil
+	case *Or:
+		l, err := bind(x.Left, resolve)
+		if err != nil {
+			return nil, err
+		}
+		r, err := bind(x.Right, resolve)
+		if err != nil {
+			return nil, err
+		}
+		return &Or{Left: l, Right: r}, nil
+	case *Not:
+		inner, err := bind(x.Expr, resolve)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: inner}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported expression %T", ErrSyntax, e)
+}
+
+// conjuncts flattens the top level conjunctions of e
+func conjuncts(e Expr) []Expr {
+	if e == nil {
+		return nil
+	}
+	if and, ok := e.(*And); ok {
+		return append(conjuncts(and.Left), conjuncts(and.Right)...)
+	}
+	return []Expr{e}
+}
+
+// conjunction joins exprs back with AND, nil when empty
+func conjunction(exprs []Expr) Expr {
+	var ret Expr
+	for _, e := range exprs {
+		if ret == nil {
+			ret = e
+		} else {
+			ret = &And{Left: ret, Right: e}
+		}
+	}
+	return ret
+}
+
+// fields lists every field referenced by e
+func fields(e Expr) []string {
+	switch x := e.(type) {
+	case *Compare:
+		return []string{x.Field}
+	case *In:
+		return []string{x.Field}
+	case *Between:
+		return []string{x.Field}
+	case *Prefix:
+		return []string{x.Field}
+	case *Has:
+		return []string{x.Field}
+	case *IsNull:
+		return []string{x.Field}
+	case *And:
+		return append(fields(x.Left), fields(x.Right)...)
+	case *Or:
+		return append(fields(x.Left), fields(x.Right)...)
+	case *Not:
+		return fields(x.Expr)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Result is the result of a query, every row holds one value
+// per column
+type Result struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Run parses and executes a query
+func Run(c Catalog, src string) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return Execute(c, stmt)
+}
+
+// Execute executes a parsed query
+func Execute(c Catalog, stmt Statement) (*Result, error) {
+	switch s := stmt.(type) {
+	case *Select:
+		p, err := PlanSelect(c, s)
+		if err != nil {
+			return nil, err
+		}
+		return p.Execute()
+	case *Match:
+		m, err := planMatch(c, s)
+		if err != nil {
+			return nil, err
+		}
+		return m.execute()
+	case *Explain:
+		return explain(c, s)
+	}
+	return nil, fmt.Errorf("%w: unsupported statement %T", ErrSyntax, stmt)
+}
+
+// each calls fn on every row yielded by the access path, in
+// primary key order, until fn returns false
+func (a *Access) each(doc *document.Document, fn func(document.Row) (bool, error)) error {
+	switch a.Kind {
+	case AccessFullScan, AccessPKRange:
+		return doc.Range(a.Start, a.Stop, func(_ string, row document.Row) (bool, error) {
+			return fn(row)
+		})
+	case AccessPKLookup:
+		return eachKey(doc, a.Keys, fn)
+	case AccessUniqueLookup:
+		var keys []string
+		for _, v := range a.Values {
+			pk, err := doc.LookupUnique(a.Field, v)
+			if err == storage.ErrNoSuchKey {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, pk)
+		}
+		return eachKey(doc, sortUnique(keys), fn)
+	case AccessPosting:
+		var keys []string
+		for i, t := range a.Postings {
+			var union []string
+			for _, v := range t.Values {
+				pks, err := doc.Posting(t.Field, v)
+				if err != nil {
+					return err
+				}
+				union = append(union, pks...)
+			}
+			union = sortUnique(union)
+			if i == 0 {
+				keys = union
+			} else {
+				keys = intersect(keys, union)
+			}
+		}
+		return eachKey(doc, keys, fn)
+	}
+	return fmt.Errorf("unknown access path %d", a.Kind)
+}
+
+// each calls fn on every row read by the plan until fn
+// returns false
+func (p *Plan) each(fn func(document.Row) (bool, error)) error {
+	if p.chunked == nil {
+		return p.Access.each(p.doc, fn)
+	}
+	return p.chunked.Chunks(func(rows []document.Row) (bool, error) {
+		for _, row := range rows {
+			more, err := fn(row)
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+func eachKey(doc *document.Document, keys []string, fn func(document.Row) (bool, error)) error {
+	for _, k := range keys {
+		row, err := doc.Get(k)
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		more, err := fn(row)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rows returns the rows matching the plan, sorted and limited but
+// not projected
+func (p *Plan) Rows() ([]document.Row, error) {
+	return p.rows(new(Execution))
+}
+
+func (p *Plan) rows(exec *Execution) ([]document.Row, error) {
+	var rows []document.Row
+	var err error
+	if p.Aggregating() {
+		rows, err = p.aggregate(exec)
+	} else {
+		rows, err = p.scan(exec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !p.Ordered {
+		sortRows(rows, p.OrderBy)
+	}
+	if p.Offset >= len(rows) {
+		return nil, nil
+	}
+	rows = rows[p.Offset:]
+	if p.Limit >= 0 && p.Limit < len(rows) {
+		rows = rows[:p.Limit]
+	}
+	exec.RowsReturned = len(rows)
+	return rows, nil
+}
+
+// scan reads the rows matching the filter, stopping early when
+// the rows are read in order and a limit is given
+func (p *Plan) scan(exec *Execution) ([]document.Row, error) {
+	want := -1
+	if p.Ordered && p.Limit >= 0 {
+		want = p.Offset + p.Limit
+	}
+	var rows []document.Row
+	if want == 0 {
+		return nil, nil
+	}
+	err := p.each(func(row document.Row) (bool, error) {
+		exec.RowsRead++
+		if p.Filter != nil && !eval(p.Filter, rowGetter(row)) {
+			return true, nil
+		}
+		rows = append(rows, row)
+		return want < 0 || len(rows) < want, nil
+	})
+	return rows, err
+}
+
+// Execute executes the plan
+func (p *Plan) Execute() (*Result, error) {
+	rows, err := p.Rows()
+	if err != nil {
+		return nil, err
+	}
+	ret := &Result{Columns: p.Columns, Rows: make([][]interface{}, len(rows))}
+	for i, row := range rows {
+		out := make([]interface{}, len(p.Columns))
+		for j, c := range p.Columns {
+			out[j] = fieldValue(row, c)
+		}
+		ret.Rows[i] = out
+	}
+	return ret, nil
+}
+
+func sortRows(rows []document.Row, orders []Order) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, o := range orders {
+			c := sortCompare(fieldValue(rows[i], o.Field), fieldValue(rows[j], o.Field))
+			if c == 0 {
+				continue
+			}
+			if o.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
@@ -0,0 +1,225 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Execution measures a query run by EXPLAIN ANALYZE
+type Execution struct {
+	RowsRead     int
+	RowsReturned int
+	Elapsed      time.Duration
+}
+
+func (e *Execution) String() string {
+	return fmt.Sprintf("%d rows read, %d rows returned in %s", e.RowsRead, e.RowsReturned, e.Elapsed)
+}
+
+func literals(values []interface{}) string {
+	ret := make([]string, len(values))
+	for i, v := range values {
+		ret[i] = literal(v)
+	}
+	return strings.Join(ret, ", ")
+}
+
+// key formats the primary key pk, binary keys are decoded
+func (a Access) key(pk string) string {
+	if a.keyText != nil && pk != "" {
+		pk = a.keyText(pk)
+	}
+	return literal(pk)
+}
+
+func (a Access) String() string {
+	switch a.Kind {
+	case AccessPKLookup:
+		keys := make([]string, len(a.Keys))
+		for i, k := range a.Keys {
+			keys[i] = a.key(k)
+		}
+		return fmt.Sprintf("%s (%s)", a.Kind, strings.Join(keys, ", "))
+	case AccessPKRange:
+		stop := "+inf"
+		if a.Stop != "" {
+			stop = a.key(a.Stop)
+		}
+		return fmt.Sprintf("%s [%s, %s)", a.Kind, a.key(a.Start), stop)
+	case AccessUniqueLookup:
+		return fmt.Sprintf("%s %s IN (%s)", a.Kind, a.Field, literals(a.Values))
+	case AccessPosting:
+		terms := make([]string, len(a.Postings))
+		for i, t := range a.Postings {
+			terms[i] = fmt.Sprintf("%s IN (%s)", t.Field, literals(t.Values))
+		}
+		return fmt.Sprintf("%s %s", a.Kind, strings.Join(terms, " AND "))
+	}
+	return a.Kind.String()
+}
+
+func (c Candidate) String() string {
+	if c.Cost < 0 {
+		return c.Access.String()
+	}
+	return fmt.Sprintf("%s: %.0f rows, cost %.1f", c.Access, c.Rows, c.Cost)
+}
+
+// Explain describes the plan, one step per line
+func (p *Plan) Explain() string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("table: %s", p.Table)
+	add("access: %s", p.Access)
+	if p.Statistics == nil {
+		add("estimate: no statistics, run analyze")
+	} else {
+		add("estimate: %.0f of %d rows, cost %.1f", p.Estimate, p.Statistics.Rows, p.Cost)
+	}
+	if p.Filter != nil {
+		add("filter: %s", p.Filter)
+	}
+	if p.Aggregating() {
+		names := make([]string, len(p.Aggregates))
+		for i, a := range p.Aggregates {
+			names[i] = a.Name()
+		}
+		agg := strings.Join(names, ", ")
+		if len(p.GroupBy) != 0 {
+			agg = strings.TrimPrefix(agg+" GROUP BY "+strings.Join(p.GroupBy, ", "), " ")
+		}
+		if p.PostingGroups {
+			add("aggregate: %s, from posting lists", agg)
+		} else {
+			add("aggregate: %s, hash", agg)
+		}
+	}
+	if len(p.OrderBy) != 0 {
+		var sb strings.Builder
+		writeOrder(&sb, p.OrderBy)
+		if p.Ordered {
+			add("order: %s, from the access path", strings.TrimPrefix(sb.String(), " ORDER BY "))
+		} else {
+			add("sort: %s", strings.TrimPrefix(sb.String(), " ORDER BY "))
+		}
+	}
+	if p.Limit >= 0 {
+		add("limit: %d", p.Limit)
+	}
+	if p.Offset > 0 {
+		add("offset: %d", p.Offset)
+	}
+	add("columns: %s", strings.Join(p.Columns, ", "))
+	if len(p.Candidates) > 1 {
+		add("candidates:")
+		for _, c := range p.Candidates {
+			add("  %s", c)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Analyze executes the plan and measures it
+func (p *Plan) Analyze() (*Execution, error) {
+	exec := new(Execution)
+	start := time.Now()
+	_, err := p.rows(exec)
+	exec.Elapsed = time.Since(start)
+	return exec, err
+}
+
+func (mp *matchPlan) explain() string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("start: (%s:%s)", mp.m.Nodes[0].Var, mp.m.Nodes[0].Table)
+	for _, line := range strings.Split(mp.start.Explain(), "\n")[1:] {
+		if strings.HasPrefix(line, "columns:") {
+			continue
+		}
+		add("  %s", line)
+	}
+	for i, e := range mp.m.Edges {
+		from, to := mp.m.Nodes[i], mp.m.Nodes[i+1]
+		doc := mp.docs[i+1]
+		var how string
+		switch {
+		case !e.Backward:
+			add("edge: (%s)-[%s]->(%s:%s)", from.Var, e.Field, to.Var, to.Table)
+			how = AccessPKLookup.String()
+		case doc.IsUnique(e.Field):
+			add("edge: (%s)<-[%s]-(%s:%s)", from.Var, e.Field, to.Var, to.Table)
+			how = fmt.Sprintf("%s on %s", AccessUniqueLookup, e.Field)
+		case doc.IsEnum(e.Field), doc.IsReference(e.Field):
+			add("edge: (%s)<-[%s]-(%s:%s)", from.Var, e.Field, to.Var, to.Table)
+			how = fmt.Sprintf("%s on %s", AccessPosting, e.Field)
+		default:
+			add("edge: (%s)<-[%s]-(%s:%s)", from.Var, e.Field, to.Var, to.Table)
+			how = AccessFullScan.String() + " per row"
+		}
+		add("  access: %s", how)
+		if mp.local[i+1] != nil {
+			add("  filter: %s", mp.local[i+1])
+		}
+	}
+	if mp.residual != nil {
+		add("filter: %s", mp.residual)
+	}
+	if mp.m.Limit >= 0 {
+		add("limit: %d", mp.m.Limit)
+	}
+	add("return: %s", strings.Join(mp.columns, ", "))
+	return strings.Join(lines, "\n")
+}
+
+func explain(c Catalog, e *Explain) (*Result, error) {
+	var text string
+	var run func() (string, error)
+	switch s := e.Statement.(type) {
+	case *Select:
+		p, err := PlanSelect(c, s)
+		if err != nil {
+			return nil, err
+		}
+		text = p.Explain()
+		run = func() (string, error) {
+			exec, err := p.Analyze()
+			if err != nil {
+				return "", err
+			}
+			return exec.String(), nil
+		}
+	case *Match:
+		mp, err := planMatch(c, s)
+		if err != nil {
+			return nil, err
+		}
+		text = mp.explain()
+		run = func() (string, error) {
+			start := time.Now()
+			rs, err := mp.execute()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d rows returned in %s", len(rs.Rows), time.Since(start)), nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: cannot explain %T", ErrSyntax, e.Statement)
+	}
+	if e.Analyze {
+		actual, err := run()
+		if err != nil {
+			return nil, err
+		}
+		text += "\nactual: " + actual
+	}
+	ret := &Result{Columns: []string{"plan"}}
+	for _, line := range strings.Split(text, "\n") {
+		ret.Rows = append(ret.Rows, []interface{}{line})
+	}
+	return ret, nil
+}
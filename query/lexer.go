@@ -0,0 +1,127 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenKeyword
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true, "AND": true,
+	"OR": true, "NOT": true, "IN": true, "BETWEEN": true, "IS": true,
+	"NULL": true, "TRUE": true, "FALSE": true, "MATCH": true, "RETURN": true,
+	"STARTS": true, "WITH": true, "EXPLAIN": true, "ANALYZE": true,
+	"GROUP": true, "HAS": true,
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func syntaxError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w at position %d: %s", ErrSyntax, pos, fmt.Sprintf(format, args...))
+}
+
+// lex splits src into tokens, keywords are upper cased while
+// identifiers keep their case
+func lex(src string) ([]token, error) {
+	var ret []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(rs) && (rs[j] == '_' || unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			word := string(rs[i:j])
+			if up := strings.ToUpper(word); keywords[up] {
+				ret = append(ret, token{tokenKeyword, up, i})
+			} else {
+				ret = append(ret, token{tokenIdent, word, i})
+			}
+			i = j
+		case c == '`':
+			j := i + 1
+			for j < len(rs) && rs[j] != '`' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, syntaxError(i, "unterminated identifier")
+			}
+			ret = append(ret, token{tokenIdent, string(rs[i+1 : j]), i})
+			i = j + 1
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+					sb.WriteRune(rs[j])
+					continue
+				}
+				if rs[j] == c {
+					if j+1 < len(rs) && rs[j+1] == c {
+						sb.WriteRune(c)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, syntaxError(i, "unterminated string")
+			}
+			ret = append(ret, token{tokenString, sb.String(), i})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E' ||
+				((rs[j] == '-' || rs[j] == '+') && (rs[j-1] == 'e' || rs[j-1] == 'E'))) {
+				j++
+			}
+			ret = append(ret, token{tokenNumber, string(rs[i:j]), i})
+			i = j
+		default:
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				if two == "<=" || two == ">=" || two == "!=" || two == "<>" {
+					ret = append(ret, token{tokenSymbol, two, i})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[],*=<>-:.;", c) {
+				return nil, syntaxError(i, "unexpected character %q", c)
+			}
+			ret = append(ret, token{tokenSymbol, string(c), i})
+			i++
+		}
+	}
+	return append(ret, token{tokenEOF, "", len(rs)}), nil
+}
@@ -0,0 +1,277 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/storage"
+)
+
+type matchPlan struct {
+	m     *Match
+	docs  []*document.Document
+	vars  map[string]int
+	start *Plan
+	// local[i] filters the rows bound to Nodes[i]
+	local []Expr
+	// residual is checked on complete bindings
+	residual Expr
+	columns  []string
+	returns  []ref
+}
+
+// ref is a returned column, an empty field returns the whole row
+type ref struct {
+	node  int
+	field string
+}
+
+// splitField splits a qualified field a.name into its variable
+// and field name
+func splitField(f string) (string, string) {
+	i := strings.IndexByte(f, '.')
+	if i < 0 {
+		return f, ""
+	}
+	return f[:i], f[i+1:]
+}
+
+func (mp *matchPlan) resolveRef(f string) (ref, error) {
+	v, name := splitField(f)
+	i, ok := mp.vars[v]
+	if !ok {
+		return ref{}, fmt.Errorf("%w: %s", ErrUnknownVariable, v)
+	}
+	if name != "" {
+		if _, ok := fieldType(mp.docs[i], name); !ok {
+			return ref{}, fmt.Errorf("%w: %s", document.ErrUnknownField, f)
+		}
+	}
+	return ref{node: i, field: name}, nil
+}
+
+// unqualify renames the fields of e from a.name to name
+func unqualify(e Expr) Expr {
+	field := func(f string) string {
+		_, name := splitField(f)
+		return name
+	}
+	switch x := e.(type) {
+	case *Compare:
+		return &Compare{Field: field(x.Field), Op: x.Op, Value: x.Value}
+	case *In:
+		return &In{Field: field(x.Field), Values: x.Values, Not: x.Not}
+	case *Between:
+		return &Between{Field: field(x.Field), Low: x.Low, High: x.High, Not: x.Not}
+	case *Prefix:
+		return &Prefix{Field: field(x.Field), Value: x.Value}
+	case *Has:
+		return &Has{Field: field(x.Field), Value: x.Value}
+	case *IsNull:
+		return &IsNull{Field: field(x.Field), Not: x.Not}
+	case *And:
+		return &And{Left: unqualify(x.Left), Right: unqualify(x.Right)}
+	case *Or:
+		return &Or{Left: unqualify(x.Left), Right: unqualify(x.Right)}
+	case *Not:
+		return &Not{Expr: unqualify(x.Expr)}
+	}
+	return e
+}
+
+func planMatch(c Catalog, m *Match) (*matchPlan, error) {
+	mp := &matchPlan{
+		m:     m,
+		docs:  make([]*document.Document, len(m.Nodes)),
+		vars:  make(map[string]int, len(m.Nodes)),
+		local: make([]Expr, len(m.Nodes)),
+	}
+	for i, n := range m.Nodes {
+		if _, ok := mp.vars[n.Var]; ok {
+			return nil, fmt.Errorf("%w: variable %s bound twice", ErrSyntax, n.Var)
+		}
+		doc, err := c.Document(n.Table)
+		if err != nil {
+			return nil, err
+		}
+		mp.vars[n.Var] = i
+		mp.docs[i] = doc
+	}
+	for i, e := range m.Edges {
+		owner := mp.docs[i]
+		if e.Backward {
+			owner = mp.docs[i+1]
+		}
+		if _, ok := owner.FieldType(e.Field); !ok {
+			return nil, fmt.Errorf("%w: %s", document.ErrUnknownField, e.Field)
+		}
+	}
+	locals := make([][]Expr, len(m.Nodes))
+	var residual []Expr
+	for _, t := range conjuncts(m.Where) {
+		node := -1
+		for _, f := range fields(t) {
+			r, err := mp.resolveRef(f)
+			if err != nil {
+				return nil, err
+			}
+			if r.field == "" {
+				return nil, fmt.Errorf("%w: %s is not a field", ErrSyntax, f)
+			}
+			if node == -1 || node == r.node {
+				node = r.node
+			} else {
+				node = -2
+			}
+		}
+		if node >= 0 {
+			locals[node] = append(locals[node], unqualify(t))
+		} else {
+			residual = append(residual, t)
+		}
+	}
+	var err error
+	mp.residual, err = bind(conjunction(residual), func(f string) (byte, error) {
+		r, err := mp.resolveRef(f)
+		if err != nil {
+			return 0, err
+		}
+		typ, _ := fieldType(mp.docs[r.node], r.field)
+		return typ, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.Nodes {
+		mp.local[i], err = bind(conjunction(locals[i]), schemaResolver(mp.docs[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	mp.start, err = planSelect(mp.docs[0], &Select{
+		Table: m.Nodes[0].Table,
+		Where: conjunction(locals[0]),
+		Limit: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range m.Return {
+		r, err := mp.resolveRef(f)
+		if err != nil {
+			return nil, err
+		}
+		mp.returns = append(mp.returns, r)
+		mp.columns = append(mp.columns, f)
+	}
+	return mp, nil
+}
+
+func (mp *matchPlan) accept(node int, row document.Row) bool {
+	return mp.local[node] == nil || eval(mp.local[node], rowGetter(row))
+}
+
+// neighbours calls fn on every row bound to Nodes[i+1] given
+// the row bound to Nodes[i]
+func (mp *matchPlan) neighbours(i int, row document.Row, fn func(document.Row) (bool, error)) error {
+	e := mp.m.Edges[i]
+	doc := mp.docs[i+1]
+	if !e.Backward {
+		v := row[e.Field]
+		if v == nil {
+			return nil
+		}
+		typ, _ := doc.FieldType(primaryKeyName(doc))
+		key, err := document.NormalizeValue(typ, v)
+		if err != nil {
+			return nil
+		}
+		next, err := doc.Get(document.FormatKey(key))
+		if err == storage.ErrNoSuchKey {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fn(next)
+		return err
+	}
+	pk := row[primaryKeyName(mp.docs[i])]
+	if pk == nil {
+		return nil
+	}
+	typ, _ := doc.FieldType(e.Field)
+	v, err := document.NormalizeValue(typ, pk)
+	if err != nil {
+		return nil
+	}
+	access := Access{Kind: AccessFullScan}
+	switch {
+	case doc.IsUnique(e.Field):
+		access = Access{Kind: AccessUniqueLookup, Field: e.Field, Values: []interface{}{v}}
+	case doc.IsEnum(e.Field), doc.IsReference(e.Field):
+		access = Access{Kind: AccessPosting, Postings: []PostingTerm{{Field: e.Field, Values: []interface{}{v}}}}
+	}
+	return access.each(doc, func(next document.Row) (bool, error) {
+		if next[e.Field] == nil || !equalValues(next[e.Field], v) {
+			return true, nil
+		}
+		return fn(next)
+	})
+}
+
+func (mp *matchPlan) execute() (*Result, error) {
+	ret := &Result{Columns: mp.columns}
+	binding := make([]document.Row, len(mp.m.Nodes))
+	get := func(f string) interface{} {
+		v, name := splitField(f)
+		return fieldValue(binding[mp.vars[v]], name)
+	}
+	full := func() bool {
+		return mp.m.Limit >= 0 && len(ret.Rows) >= mp.m.Limit
+	}
+	var extend func(i int) (bool, error)
+	extend = func(i int) (bool, error) {
+		if i == len(binding)-1 {
+			if mp.residual != nil && !eval(mp.residual, get) {
+				return true, nil
+			}
+			out := make([]interface{}, len(mp.returns))
+			for j, r := range mp.returns {
+				if r.field == "" {
+					out[j] = binding[r.node]
+				} else {
+					out[j] = fieldValue(binding[r.node], r.field)
+				}
+			}
+			ret.Rows = append(ret.Rows, out)
+			return !full(), nil
+		}
+		more := true
+		err := mp.neighbours(i, binding[i], func(next document.Row) (bool, error) {
+			if !mp.accept(i+1, next) {
+				return true, nil
+			}
+			binding[i+1] = next
+			var err error
+			more, err = extend(i + 1)
+			return more, err
+		})
+		return more, err
+	}
+	if mp.m.Limit == 0 {
+		return ret, nil
+	}
+	err := mp.start.Access.each(mp.docs[0], func(row document.Row) (bool, error) {
+		if !mp.accept(0, row) {
+			return true, nil
+		}
+		binding[0] = row
+		return extend(0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
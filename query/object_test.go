@@ -0,0 +1,76 @@
+package query_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+)
+
+func TestObjectQueries(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		Fields:      []metaparser.Field{{Name: "meta", Type: common.TypeObject}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := []string{"eu", "us", "ap"}
+	var rows []document.Row
+	for i := 0; i < 12; i++ {
+		rows = append(rows, document.Row{
+			"name": fmt.Sprintf("h%02d", i),
+			"meta": map[string]interface{}{
+				"labels": map[string]interface{}{"zone": zones[i%3]},
+				"cpu":    i % 4,
+				"disks":  []interface{}{fmt.Sprintf("sd%c", 'a'+i%2)},
+				"spot":   i%2 == 0,
+			},
+		})
+	}
+	insert(t, db, "hosts", rows...)
+
+	eu := []string{"h03", "h06"}
+	src := "SELECT name, meta.labels.zone FROM hosts WHERE meta.labels.zone = 'eu' AND meta.cpu >= 2"
+	if got := names(t, db, src); !reflect.DeepEqual(got, eu) {
+		t.Fatalf("got %v, want %v", got, eu)
+	}
+	rs, err := query.Run(db, "SELECT meta.disks.0, meta.cpu FROM hosts ORDER BY meta.cpu DESC, name LIMIT 1")
+	if err != nil || !reflect.DeepEqual(rs.Rows, [][]interface{}{{"sdb", int64(3)}}) {
+		t.Fatalf("got %v, %v", rs, err)
+	}
+	if got := names(t, db, "SELECT COUNT(*) FROM hosts WHERE meta.spot = true AND meta.labels.zone STARTS WITH 'a'"); got[0] != "2" {
+		t.Fatalf("unexpected count %v", got)
+	}
+
+	// an indexed path answers equalities from its posting list
+	if err := tbl.Document.IndexPath("meta.labels.zone"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := query.PlanSelect(db, &query.Select{
+		Table: "hosts",
+		Where: &query.Compare{Field: "meta.labels.zone", Op: query.OpEq, Value: "ap"},
+		Limit: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Access.Kind != query.AccessPosting {
+		t.Fatalf("got %v, want a posting list", p.Access.Kind)
+	}
+	if got := names(t, db, src); !reflect.DeepEqual(got, eu) {
+		t.Fatalf("got %v, want %v", got, eu)
+	}
+	if err := tbl.AlterSchema(metaparser.Change{Op: metaparser.ChangeRenameField, Field: "meta", Name: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name FROM hosts WHERE info.labels.zone = 'us' AND info.cpu = 1"); !reflect.DeepEqual(got, []string{"h01"}) {
+		t.Fatalf("unexpected rows %v", got)
+	}
+}
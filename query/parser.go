@@ -0,0 +1,581 @@
+package query
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/xtlsoft/kical/document"
+)
+
+// Parse parses a query written in the Kical query language
+func Parse(src string) (Statement, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	var explain *Explain
+	if p.acceptKeyword("EXPLAIN") {
+		explain = &Explain{Analyze: p.acceptKeyword("ANALYZE")}
+	}
+	var stmt Statement
+	switch {
+	case p.isKeyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.isKeyword("MATCH"):
+		stmt, err = p.parseMatch()
+	default:
+		return nil, p.unexpected("SELECT or MATCH")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if explain != nil {
+		explain.Statement = stmt
+		stmt = explain
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected("end of query")
+	}
+	return stmt, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	return syntaxError(t.pos, "expected %s, found %s", want, t)
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokenKeyword && t.text == kw
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.unexpected(kw)
+	}
+	return nil
+}
+
+func (p *parser) isSymbol(sym string) bool {
+	t := p.peek()
+	return t.kind == tokenSymbol && t.text == sym
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if p.isSymbol(sym) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return p.unexpected(strconv.Quote(sym))
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return "", p.unexpected("identifier")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// field parses a field name optionally qualified by a variable
+func (p *parser) field() (string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	for p.acceptSymbol(".") {
+		t := p.peek()
+		if t.kind == tokenNumber && strings.Trim(t.text, "0123456789.") == "" {
+			// the lexer reads the array indexes 0.1 as one number
+			p.pos++
+			name += "." + t.text
+			continue
+		}
+		f, err := p.ident()
+		if err != nil {
+			return "", err
+		}
+		name += "." + f
+	}
+	return name, nil
+}
+
+var aggFuncs = map[string]AggFunc{
+	"COUNT": AggCount, "SUM": AggSum, "MIN": AggMin, "MAX": AggMax, "AVG": AggAvg,
+}
+
+// call reports whether the next tokens start a function call
+func (p *parser) call() bool {
+	if p.peek().kind != tokenIdent {
+		return false
+	}
+	next := p.tokens[p.pos+1]
+	return next.kind == tokenSymbol && next.text == "("
+}
+
+// truncation parses TRUNC(field, unit), truncations are added
+// to s and named by their column name
+func (p *parser) truncation(s *Select) (string, error) {
+	p.pos += 2
+	f, err := p.field()
+	if err != nil {
+		return "", err
+	}
+	err = p.expectSymbol(",")
+	if err != nil {
+		return "", err
+	}
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return "", p.unexpected("time unit")
+	}
+	unit, ok := document.ParseTimeUnit(t.text)
+	if !ok {
+		return "", syntaxError(t.pos, "unknown time unit %s", t.text)
+	}
+	p.pos++
+	err = p.expectSymbol(")")
+	if err != nil {
+		return "", err
+	}
+	return s.AddTruncation(Truncation{Field: f, Unit: unit}), nil
+}
+
+// group parses a GROUP BY term, a field or a truncation
+func (p *parser) group(s *Select) (string, error) {
+	if p.call() && strings.EqualFold(p.peek().text, "TRUNC") {
+		return p.truncation(s)
+	}
+	return p.field()
+}
+
+// column parses a field, an aggregate call or a truncation,
+// aggregates are added to s and named by their column name
+func (p *parser) column(s *Select) (string, error) {
+	if !p.call() {
+		return p.field()
+	}
+	t := p.peek()
+	if strings.EqualFold(t.text, "TRUNC") {
+		return p.truncation(s)
+	}
+	fn, ok := aggFuncs[strings.ToUpper(t.text)]
+	if !ok {
+		return "", syntaxError(t.pos, "unknown function %s", t.text)
+	}
+	p.pos += 2
+	a := Aggregate{Func: fn}
+	if !p.acceptSymbol("*") {
+		f, err := p.field()
+		if err != nil {
+			return "", err
+		}
+		a.Field = f
+	} else if fn != AggCount {
+		return "", syntaxError(t.pos, "%s(*) is not supported", fn)
+	}
+	err := p.expectSymbol(")")
+	if err != nil {
+		return "", err
+	}
+	return s.AddAggregate(a), nil
+}
+
+func (p *parser) integer() (int, error) {
+	t := p.peek()
+	if t.kind != tokenNumber {
+		return 0, p.unexpected("integer")
+	}
+	n, err := strconv.Atoi(t.text)
+	if err != nil || n < 0 {
+		return 0, syntaxError(t.pos, "invalid count %s", t.text)
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *parser) parseSelect() (*Select, error) {
+	p.next()
+	s := &Select{Limit: -1}
+	if !p.acceptSymbol("*") {
+		for {
+			f, err := p.column(s)
+			if err != nil {
+				return nil, err
+			}
+			s.Fields = append(s.Fields, f)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	err := p.expectKeyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+	s.Table, err = p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("WHERE") {
+		s.Where, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("GROUP") {
+		err = p.expectKeyword("BY")
+		if err != nil {
+			return nil, err
+		}
+		for {
+			f, err := p.group(s)
+			if err != nil {
+				return nil, err
+			}
+			s.GroupBy = append(s.GroupBy, f)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("ORDER") {
+		err = p.expectKeyword("BY")
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var o Order
+			o.Field, err = p.column(s)
+			if err != nil {
+				return nil, err
+			}
+			if p.acceptKeyword("DESC") {
+				o.Desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			s.OrderBy = append(s.OrderBy, o)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		s.Limit, err = p.integer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("OFFSET") {
+		s.Offset, err = p.integer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) parseNode() (Node, error) {
+	var n Node
+	err := p.expectSymbol("(")
+	if err != nil {
+		return n, err
+	}
+	n.Var, err = p.ident()
+	if err != nil {
+		return n, err
+	}
+	err = p.expectSymbol(":")
+	if err != nil {
+		return n, err
+	}
+	n.Table, err = p.ident()
+	if err != nil {
+		return n, err
+	}
+	return n, p.expectSymbol(")")
+}
+
+func (p *parser) parseEdge() (Edge, error) {
+	var e Edge
+	var err error
+	if p.acceptSymbol("<") {
+		e.Backward = true
+	}
+	for _, sym := range []string{"-", "["} {
+		if err = p.expectSymbol(sym); err != nil {
+			return e, err
+		}
+	}
+	e.Field, err = p.ident()
+	if err != nil {
+		return e, err
+	}
+	closing := []string{"]", "-", ">"}
+	if e.Backward {
+		closing = closing[:2]
+	}
+	for _, sym := range closing {
+		if err = p.expectSymbol(sym); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+func (p *parser) parseMatch() (*Match, error) {
+	p.next()
+	m := &Match{Limit: -1}
+	n, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+	m.Nodes = append(m.Nodes, n)
+	for p.isSymbol("-") || p.isSymbol("<") {
+		e, err := p.parseEdge()
+		if err != nil {
+			return nil, err
+		}
+		n, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		m.Edges = append(m.Edges, e)
+		m.Nodes = append(m.Nodes, n)
+	}
+	if p.acceptKeyword("WHERE") {
+		m.Where, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = p.expectKeyword("RETURN")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		m.Return = append(m.Return, f)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		m.Limit, err = p.integer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: e}, nil
+	}
+	if p.acceptSymbol("(") {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+	}
+	return p.parsePredicate()
+}
+
+var compareOps = map[string]Op{
+	"=": OpEq, "!=": OpNe, "<>": OpNe, "<": OpLt, "<=": OpLe, ">": OpGt, ">=": OpGe,
+}
+
+func (p *parser) parsePredicate() (Expr, error) {
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokenSymbol {
+		if op, ok := compareOps[t.text]; ok {
+			p.pos++
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			return &Compare{Field: field, Op: op, Value: v}, nil
+		}
+	}
+	if p.acceptKeyword("STARTS") {
+		err = p.expectKeyword("WITH")
+		if err != nil {
+			return nil, err
+		}
+		t := p.peek()
+		if t.kind != tokenString {
+			return nil, p.unexpected("string")
+		}
+		p.pos++
+		return &Prefix{Field: field, Value: t.text}, nil
+	}
+	if p.acceptKeyword("HAS") {
+		t := p.peek()
+		if t.kind != tokenString {
+			return nil, p.unexpected("string")
+		}
+		p.pos++
+		return &Has{Field: field, Value: t.text}, nil
+	}
+	if p.acceptKeyword("IS") {
+		neg := p.acceptKeyword("NOT")
+		return &IsNull{Field: field, Not: neg}, p.expectKeyword("NULL")
+	}
+	neg := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("IN"):
+		err = p.expectSymbol("(")
+		if err != nil {
+			return nil, err
+		}
+		e := &In{Field: field, Not: neg}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			e.Values = append(e.Values, v)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		return e, p.expectSymbol(")")
+	case p.acceptKeyword("BETWEEN"):
+		e := &Between{Field: field, Not: neg}
+		e.Low, err = p.value()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectKeyword("AND")
+		if err != nil {
+			return nil, err
+		}
+		e.High, err = p.value()
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, p.unexpected("comparison")
+}
+
+func (p *parser) value() (interface{}, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenString:
+		p.pos++
+		return t.text, nil
+	case t.kind == tokenNumber:
+		p.pos++
+		return parseNumber(t, false)
+	case t.kind == tokenSymbol && t.text == "-":
+		p.pos++
+		n := p.peek()
+		if n.kind != tokenNumber {
+			return nil, p.unexpected("number")
+		}
+		p.pos++
+		return parseNumber(n, true)
+	case t.kind == tokenKeyword && (t.text == "TRUE" || t.text == "FALSE"):
+		p.pos++
+		return t.text == "TRUE", nil
+	case t.kind == tokenKeyword && t.text == "NULL":
+		p.pos++
+		return nil, nil
+	}
+	return nil, p.unexpected("value")
+}
+
+func parseNumber(t token, neg bool) (interface{}, error) {
+	text := t.text
+	if neg {
+		text = "-" + text
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if _, err := strconv.ParseFloat(text, 64); err != nil {
+		return nil, syntaxError(t.pos, "invalid number %s", t.text)
+	}
+	// the text is kept so that decimal fields bind it exactly
+	return json.Number(text), nil
+}
@@ -0,0 +1,541 @@
+package query
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// Catalog resolves table names into document tables
+type Catalog interface {
+	Document(name string) (*document.Document, error)
+}
+
+// Chunked is a table read chunk by chunk, analytical tables
+// are chunked
+type Chunked interface {
+	Metadata() *metaparser.Metadata
+	FieldType(name string) (byte, bool)
+	Chunks(fn func(rows []document.Row) (bool, error)) error
+}
+
+// ChunkCatalog is a catalog also resolving chunked tables, they
+// are looked up when Document fails with common.ErrWrongStorageType
+type ChunkCatalog interface {
+	Catalog
+	Chunked(name string) (Chunked, error)
+}
+
+// schema is implemented by every table a plan can read
+type schema interface {
+	Metadata() *metaparser.Metadata
+	FieldType(name string) (byte, bool)
+}
+
+// CatalogFunc adapts a function into a Catalog
+type CatalogFunc func(name string) (*document.Document, error)
+
+// Document implements Catalog
+func (f CatalogFunc) Document(name string) (*document.Document, error) {
+	return f(name)
+}
+
+// AccessKind is the way a plan reads the rows of a table
+type AccessKind int
+
+// Access paths, every path yields rows in primary key order
+const (
+	AccessFullScan AccessKind = iota
+	AccessPKLookup
+	AccessPKRange
+	AccessUniqueLookup
+	AccessPosting
+	AccessChunkScan
+)
+
+var accessNames = [...]string{"full scan", "primary key lookup", "primary key range", "unique index lookup", "posting list", "chunk scan"}
+
+func (k AccessKind) String() string {
+	if int(k) < len(accessNames) {
+		return accessNames[k]
+	}
+	return "unknown"
+}
+
+// PostingTerm selects the rows whose enum field holds one of
+// the values, or whose tag field holds one of the tags
+type PostingTerm struct {
+	Field  string
+	Values []interface{}
+}
+
+// Access describes how the rows of a table are read
+type Access struct {
+	Kind AccessKind
+	// Keys lists the primary keys of a primary key lookup
+	Keys []string
+	// Start and Stop bound a primary key range, Stop is exclusive
+	// and an empty Stop means no upper bound
+	Start string
+	Stop  string
+	// Field and Values describe a unique index lookup
+	Field  string
+	Values []interface{}
+	// Postings are intersected by a posting list access
+	Postings []PostingTerm
+
+	// keyText formats binary primary keys for EXPLAIN
+	keyText func(pk string) string
+}
+
+// Plan is the executable plan of a select query
+type Plan struct {
+	Table  string
+	Access Access
+	// Filter is the bound WHERE clause, every row read is
+	// checked against it
+	Filter  Expr
+	Columns []string
+	OrderBy []Order
+	Limit   int
+	Offset  int
+	// Ordered reports whether the access path already yields rows
+	// in the requested order, so reading can stop at the limit
+	Ordered bool
+	// Estimate and Cost estimate the rows read and the cost of
+	// the access path, they are negative without statistics
+	Estimate float64
+	Cost     float64
+	// Candidates lists every access path considered
+	Candidates []Candidate
+	// Statistics are the statistics of the table, nil if the
+	// table has never been analyzed
+	Statistics *document.Statistics
+	// GroupBy and Aggregates are set when the query aggregates
+	// rows, the plan then yields one row per group
+	GroupBy    []string
+	Aggregates []Aggregate
+	// Truncations lists the grouped time truncations, which are
+	// named in GroupBy
+	Truncations []Truncation
+	// PostingGroups reports whether groups are counted from enum
+	// posting lists without reading rows
+	PostingGroups bool
+
+	doc     *document.Document
+	chunked Chunked
+}
+
+// PlanSelect validates s against the schema of its table and
+// chooses an access path from its WHERE clause
+func PlanSelect(c Catalog, s *Select) (*Plan, error) {
+	doc, err := c.Document(s.Table)
+	if errors.Is(err, common.ErrWrongStorageType) {
+		if cc, ok := c.(ChunkCatalog); ok {
+			chunked, err := cc.Chunked(s.Table)
+			if err != nil {
+				return nil, err
+			}
+			return planChunked(chunked, s)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return planSelect(doc, s)
+}
+
+// newPlan binds the clauses of s shared by every access path
+func newPlan(sc schema, s *Select) (*Plan, error) {
+	resolve := schemaResolver(sc)
+	filter, err := bind(s.Where, resolve)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Table:   s.Table,
+		Filter:  filter,
+		Columns: s.Fields,
+		OrderBy: s.OrderBy,
+		Limit:   s.Limit,
+		Offset:  s.Offset,
+	}
+	if len(s.GroupBy) != 0 || len(s.Aggregates) != 0 {
+		return p, p.bindAggregates(s, resolve)
+	}
+	if p.Columns == nil {
+		p.Columns = defaultColumns(sc)
+	}
+	for _, f := range p.Columns {
+		if _, err := resolve(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range p.OrderBy {
+		if _, err := resolve(o.Field); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func planSelect(doc *document.Document, s *Select) (*Plan, error) {
+	p, err := newPlan(doc, s)
+	if err != nil {
+		return nil, err
+	}
+	p.doc = doc
+	st, err := doc.Statistics()
+	if err != nil && err != storage.ErrNoSuchKey {
+		return nil, err
+	}
+	p.Statistics = st
+	best, all := chooseAccess(doc, st, conjuncts(p.Filter))
+	p.Access = best.Access
+	p.Estimate = best.Rows
+	p.Cost = best.Cost
+	p.Candidates = all
+	pk := primaryKeyName(doc)
+	p.Ordered = len(p.OrderBy) == 0 ||
+		(len(p.OrderBy) == 1 && p.OrderBy[0].Field == pk && !p.OrderBy[0].Desc && orderedPK(doc))
+	if p.Aggregating() {
+		p.Ordered = len(p.OrderBy) == 0
+		p.PostingGroups = p.postingGroupable()
+	}
+	return p, nil
+}
+
+// planChunked plans a query on a chunked table, which is always
+// read whole
+func planChunked(chunked Chunked, s *Select) (*Plan, error) {
+	p, err := newPlan(chunked, s)
+	if err != nil {
+		return nil, err
+	}
+	p.chunked = chunked
+	p.Access = Access{Kind: AccessChunkScan}
+	p.Estimate = -1
+	p.Cost = -1
+	p.Ordered = len(p.OrderBy) == 0
+	return p, nil
+}
+
+func primaryKeyName(sc schema) string {
+	if pk := sc.Metadata().PrimaryKey; pk != nil {
+		return pk.Name
+	}
+	return ""
+}
+
+// orderedPK reports whether primary keys sort like their values,
+// which holds for every type keyenc encodes
+func orderedPK(sc schema) bool {
+	typ, _ := sc.FieldType(primaryKeyName(sc))
+	switch typ {
+	case common.TypeString, common.TypeInteger, common.TypeFloat, common.TypeDecimal, common.TypeTime:
+		return true
+	}
+	return false
+}
+
+func defaultColumns(sc schema) []string {
+	meta := sc.Metadata()
+	var ret []string
+	pk := primaryKeyName(sc)
+	if pk != "" {
+		ret = append(ret, pk)
+	}
+	for _, f := range meta.Fields {
+		if f.Name != pk {
+			ret = append(ret, f.Name)
+		}
+	}
+	return ret
+}
+
+// equalities returns the values a conjunct requires field to
+// equal one of, ok is false if it does not restrict field so
+func equalities(e Expr) (field string, values []interface{}, ok bool) {
+	switch x := e.(type) {
+	case *Compare:
+		if x.Op == OpEq && x.Value != nil {
+			return x.Field, []interface{}{x.Value}, true
+		}
+	case *Has:
+		return x.Field, []interface{}{x.Value}, true
+	case *In:
+		if !x.Not {
+			for _, v := range x.Values {
+				if v != nil {
+					values = append(values, v)
+				}
+			}
+			return x.Field, values, true
+		}
+	}
+	return "", nil, false
+}
+
+// Costs of the elementary operations of an access path
+const (
+	costScanRow  = 1.0
+	costFetchRow = 2.0
+	costIndexKey = 0.5
+)
+
+// Candidate is an access path considered by the planner
+type Candidate struct {
+	Access Access
+	// Rows is the estimated number of rows read, negative when
+	// the table has no statistics
+	Rows float64
+	Cost float64
+}
+
+// candidates lists the access paths usable for a conjunctive
+// filter, from the most to the least selective by construction:
+// primary key lookups, unique indexes, posting lists,
+// primary key ranges and the full scan
+func candidates(doc *document.Document, terms []Expr) []Access {
+	pk := primaryKeyName(doc)
+	var keys []string
+	hasKeys := false
+	var ret []Access
+	var postings []PostingTerm
+	for _, t := range terms {
+		field, values, ok := equalities(t)
+		if !ok {
+			continue
+		}
+		switch {
+		case field == pk && pk != "":
+			set := make([]string, 0, len(values))
+			for _, v := range values {
+				set = append(set, document.FormatKey(v))
+			}
+			if hasKeys {
+				keys = intersect(keys, sortUnique(set))
+			} else {
+				keys = sortUnique(set)
+				hasKeys = true
+			}
+		case doc.IsUnique(field):
+			ret = append(ret, Access{Kind: AccessUniqueLookup, Field: field, Values: values})
+		case doc.HasPosting(field):
+			postings = append(postings, PostingTerm{Field: field, Values: values})
+		}
+	}
+	if hasKeys {
+		ret = append([]Access{{Kind: AccessPKLookup, Keys: keys}}, ret...)
+	}
+	if len(postings) != 0 {
+		ret = append(ret, Access{Kind: AccessPosting, Postings: postings})
+	}
+	if orderedPK(doc) {
+		if a, ok := pkRange(pk, terms); ok {
+			ret = append(ret, a)
+		}
+	}
+	ret = append(ret, Access{Kind: AccessFullScan})
+	for i := range ret {
+		ret[i].keyText = doc.KeyText
+	}
+	return ret
+}
+
+// estimate computes the number of rows read and the cost of an
+// access path, posting terms that cost more to read than they
+// save are dropped from the access
+func estimate(doc *document.Document, st *document.Statistics, a Access) Candidate {
+	n := float64(st.Rows)
+	c := Candidate{Access: a}
+	switch a.Kind {
+	case AccessFullScan:
+		c.Rows = n
+		c.Cost = n * costScanRow
+	case AccessPKRange:
+		c.Rows = n * st.RangeFraction(a.Start, a.Stop)
+		c.Cost = c.Rows * costScanRow
+	case AccessPKLookup:
+		c.Rows = math.Min(float64(len(a.Keys)), n)
+		c.Cost = float64(len(a.Keys)) * costFetchRow
+	case AccessUniqueLookup:
+		k := float64(len(a.Values))
+		c.Rows = math.Min(k, n)
+		c.Cost = k*costFetchRow + c.Rows*costFetchRow
+	case AccessPosting:
+		sizes := make([]float64, len(a.Postings))
+		for i, t := range a.Postings {
+			for _, v := range t.Values {
+				iv, err := doc.IndexValue(t.Field, v)
+				if err == nil {
+					sizes[i] += float64(st.EnumCount(t.Field, iv))
+				}
+			}
+		}
+		order := make([]int, len(sizes))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return sizes[order[i]] < sizes[order[j]]
+		})
+		var kept []PostingTerm
+		read := 0.0
+		rows := n
+		for i, idx := range order {
+			size := sizes[idx]
+			next := size
+			if i > 0 && n > 0 {
+				next = rows * size / n
+			}
+			if i > 0 && size*costIndexKey >= (rows-next)*costFetchRow {
+				continue
+			}
+			kept = append(kept, a.Postings[idx])
+			read += size * costIndexKey
+			rows = next
+		}
+		c.Access.Postings = kept
+		c.Rows = rows
+		c.Cost = read + rows*costFetchRow
+	}
+	return c
+}
+
+// chooseAccess picks the access path of a conjunctive filter,
+// the cheapest one when statistics are available and otherwise
+// the first candidate
+func chooseAccess(doc *document.Document, st *document.Statistics, terms []Expr) (Candidate, []Candidate) {
+	all := candidates(doc, terms)
+	if st == nil {
+		ret := make([]Candidate, len(all))
+		for i, a := range all {
+			ret[i] = Candidate{Access: a, Rows: -1, Cost: -1}
+		}
+		return ret[0], ret
+	}
+	ret := make([]Candidate, len(all))
+	best := 0
+	for i, a := range all {
+		ret[i] = estimate(doc, st, a)
+		if ret[i].Cost < ret[best].Cost {
+			best = i
+		}
+	}
+	return ret[best], ret
+}
+
+// pkRange narrows the scanned key range from the comparisons
+// on a primary key sorting like its values
+func pkRange(pk string, terms []Expr) (Access, bool) {
+	a := Access{Kind: AccessPKRange}
+	found := false
+	lower := func(v interface{}, inclusive bool) {
+		if v == nil {
+			return
+		}
+		s := document.FormatKey(v)
+		if !inclusive {
+			s += "\x00"
+		}
+		if s > a.Start {
+			a.Start = s
+		}
+		found = true
+	}
+	upper := func(v interface{}, inclusive bool) {
+		if v == nil {
+			return
+		}
+		s := document.FormatKey(v)
+		if inclusive {
+			s += "\x00"
+		}
+		if a.Stop == "" || s < a.Stop {
+			a.Stop = s
+		}
+		found = true
+	}
+	for _, t := range terms {
+		switch x := t.(type) {
+		case *Compare:
+			if x.Field != pk {
+				continue
+			}
+			switch x.Op {
+			case OpGt:
+				lower(x.Value, false)
+			case OpGe:
+				lower(x.Value, true)
+			case OpLt:
+				upper(x.Value, false)
+			case OpLe:
+				upper(x.Value, true)
+			}
+		case *Between:
+			if x.Field == pk && !x.Not {
+				lower(x.Low, true)
+				upper(x.High, true)
+			}
+		case *Prefix:
+			if x.Field == pk {
+				lower(x.Value, true)
+				if end := prefixEnd(x.Value); end != "" {
+					upper(end, false)
+				}
+			}
+		}
+	}
+	if found && a.Stop != "" && a.Stop <= a.Start {
+		return Access{Kind: AccessPKLookup, Keys: []string{}}, true
+	}
+	return a, found
+}
+
+// prefixEnd returns the smallest string greater than every
+// string starting with prefix, empty if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func sortUnique(s []string) []string {
+	sort.Strings(s)
+	ret := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// intersect intersects two sorted string sets
+func intersect(a, b []string) []string {
+	ret := make([]string, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	return ret
+}
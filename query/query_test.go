@@ -0,0 +1,817 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func newDatabase(t *testing.T) *kical.Database {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string]*metaparser.Metadata{
+		"regions": {
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "code"},
+			Fields:      []metaparser.Field{{Name: "name", Type: common.TypeString}},
+		},
+		"services": {
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+			Fields: []metaparser.Field{
+				{Name: "name", Type: common.TypeString},
+				{Name: "region", Type: common.TypeString},
+				{Name: "tier", Type: common.TypeEnum},
+				{Name: "port", Type: common.TypeInteger},
+			},
+			Unique: []string{"name"},
+		},
+	}
+	for name, meta := range tables {
+		if _, err := db.CreateTable(name, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(t, db, "regions",
+		document.Row{"code": "eu", "name": "Europe"},
+		document.Row{"code": "us", "name": "Americas"},
+		document.Row{"code": "ap", "name": "Asia"},
+	)
+	tiers := []string{"gold", "silver", "bronze"}
+	regions := []string{"eu", "us", "ap", "eu"}
+	var rows []document.Row
+	for i := 0; i < 40; i++ {
+		row := document.Row{
+			"name":   fmt.Sprintf("svc%02d", i),
+			"region": regions[i%len(regions)],
+			"tier":   tiers[i%len(tiers)],
+		}
+		if i%5 != 0 {
+			row["port"] = 8000 + i
+		}
+		rows = append(rows, row)
+	}
+	insert(t, db, "services", rows...)
+	return db
+}
+
+func insert(t *testing.T, db *kical.Database, table string, rows ...document.Row) {
+	d, err := db.Document(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.NewSession()
+	for _, row := range rows {
+		if _, err := s.Insert(row); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := map[string]string{
+		"select * from t": "SELECT * FROM t",
+		"SELECT a, b FROM t WHERE a = 'x' AND b > -2;":                                                   "SELECT a, b FROM t WHERE (a = 'x' AND b > -2)",
+		"SELECT a FROM t WHERE NOT (a IN (1, 2.5) OR b IS NOT NULL) ORDER BY a DESC, b LIMIT 3 OFFSET 1": "SELECT a FROM t WHERE NOT (a IN (1, 2.5) OR b IS NOT NULL) ORDER BY a DESC, b LIMIT 3 OFFSET 1",
+		"SELECT a FROM `my table` WHERE a BETWEEN 'it''s' AND 'z'":                                       "SELECT a FROM my table WHERE a BETWEEN 'it''s' AND 'z'",
+		"MATCH (a:x)-[f]->(b:y)<-[g]-(c:z) WHERE a.k<-1 RETURN a, c.v LIMIT 2":                           "MATCH (a:x)-[f]->(b:y)<-[g]-(c:z) WHERE a.k < -1 RETURN a, c.v LIMIT 2",
+		"SELECT a FROM t WHERE NOT tags has 'x' AND tags HAS 'y'":                                        "SELECT a FROM t WHERE (NOT tags HAS 'x' AND tags HAS 'y')",
+		"select t, count(*), sum(p) from t where p > 1 group by t order by COUNT(*) desc":                "SELECT t, COUNT(*), SUM(p) FROM t WHERE p > 1 GROUP BY t ORDER BY COUNT(*) DESC",
+		"select trunc(at, hour), count(*) from t group by trunc(at, Hour), h":                            "SELECT TRUNC(at, HOUR), COUNT(*) FROM t GROUP BY TRUNC(at, HOUR), h",
+		"SELECT m.disks.0.1 FROM t WHERE m.labels.zone = 'eu'":                                           "SELECT m.disks.0.1 FROM t WHERE m.labels.zone = 'eu'",
+	}
+	for src, want := range cases {
+		stmt, err := query.Parse(src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if got := stmt.String(); got != want {
+			t.Fatalf("%s: got %s, want %s", src, got, want)
+		}
+	}
+	for _, src := range []string{
+		"", "SELECT", "SELECT * FROM", "SELECT * FROM t WHERE", "SELECT * FROM t WHERE a",
+		"SELECT * FROM t LIMIT x", "SELECT * FROM t extra", "SELECT * FROM t WHERE a = 'x",
+		"MATCH (a:x)-[f]-(b:y) RETURN a", "MATCH (a:x) RETURN", "SELECT * FROM t WHERE a = #",
+		"SELECT COUNT( FROM t", "SELECT * FROM t GROUP a", "SELECT * FROM t WHERE a HAS 1",
+		"SELECT TRUNC(a, WEEK) FROM t", "SELECT * FROM t GROUP BY TRUNC(a)", "SELECT a. FROM t",
+		"SELECT a.1e5 FROM t",
+	} {
+		_, err := query.Parse(src)
+		if !errors.Is(err, query.ErrSyntax) {
+			t.Fatalf("%q: got %v, want a syntax error", src, err)
+		}
+	}
+}
+
+// names runs src and returns the first column of every row
+func names(t *testing.T, db *kical.Database, src string) []string {
+	rs, err := query.Run(db, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	ret := []string{}
+	for _, row := range rs.Rows {
+		ret = append(ret, fmt.Sprint(row[0]))
+	}
+	return ret
+}
+
+// brute filters the services table in Go
+func brute(t *testing.T, db *kical.Database, keep func(i int, row document.Row) bool) []string {
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _, err := d.Scan("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := []string{}
+	for _, row := range rows {
+		i := int(row["id"].(int64)) - 1
+		if keep(i, row) {
+			ret = append(ret, row["name"].(string))
+		}
+	}
+	return ret
+}
+
+func TestSelect(t *testing.T) {
+	db := newDatabase(t)
+	cases := []struct {
+		src  string
+		keep func(i int, row document.Row) bool
+	}{
+		{"SELECT name FROM services", func(i int, row document.Row) bool { return true }},
+		{"SELECT name FROM services WHERE tier = 'gold'", func(i int, row document.Row) bool { return i%3 == 0 }},
+		{"SELECT name FROM services WHERE tier IN ('gold', 'bronze') AND region = 'eu'", func(i int, row document.Row) bool {
+			return i%3 != 1 && (i%4 == 0 || i%4 == 3)
+		}},
+		{"SELECT name FROM services WHERE port >= 8030 OR port IS NULL", func(i int, row document.Row) bool {
+			return i%5 == 0 || i >= 30
+		}},
+		{"SELECT name FROM services WHERE NOT port BETWEEN 8002 AND 8035", func(i int, row document.Row) bool {
+			return i%5 != 0 && (i < 2 || i > 35)
+		}},
+		{"SELECT name FROM services WHERE id IN (3, '4', 100) OR id = 7", func(i int, row document.Row) bool {
+			return i == 2 || i == 3 || i == 6
+		}},
+		{"SELECT name FROM services WHERE region != 'eu' AND tier = 'silver' AND port < 8020", func(i int, row document.Row) bool {
+			return (i%4 == 1 || i%4 == 2) && i%3 == 1 && i%5 != 0 && i < 20
+		}},
+	}
+	for _, c := range cases {
+		got := names(t, db, c.src)
+		want := brute(t, db, c.keep)
+		if len(got) != len(want) || len(want) == 0 {
+			t.Fatalf("%s: got %v, want %v", c.src, got, want)
+		}
+		gotSet := map[string]bool{}
+		for _, n := range got {
+			gotSet[n] = true
+		}
+		for _, n := range want {
+			if !gotSet[n] {
+				t.Fatalf("%s: got %v, want %v", c.src, got, want)
+			}
+		}
+	}
+
+	got := names(t, db, "SELECT name, port FROM services WHERE tier = 'gold' ORDER BY port DESC LIMIT 3 OFFSET 1")
+	if want := []string{"svc36", "svc33", "svc27"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	got = names(t, db, "SELECT code FROM regions WHERE code > 'ap' ORDER BY code")
+	if want := []string{"eu", "us"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	rs, err := query.Run(db, "SELECT * FROM regions WHERE code = 'us'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]interface{}{{"us", "Americas"}}; !reflect.DeepEqual(rs.Rows, want) ||
+		!reflect.DeepEqual(rs.Columns, []string{"code", "name"}) {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+
+	for src, want := range map[string]error{
+		"SELECT nope FROM services":                 document.ErrUnknownField,
+		"SELECT * FROM services WHERE nope = 1":     document.ErrUnknownField,
+		"SELECT * FROM services WHERE port = 'abc'": document.ErrWrongFieldType,
+		"SELECT * FROM services ORDER BY nope":      document.ErrUnknownField,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, want) {
+			t.Fatalf("%s: got %v, want %v", src, err, want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	db := newDatabase(t)
+	cases := map[string]query.AccessKind{
+		"SELECT * FROM services":                                         query.AccessFullScan,
+		"SELECT * FROM services WHERE id = 3 AND name = 'svc02'":         query.AccessPKLookup,
+		"SELECT * FROM services WHERE name IN ('svc01', 'svc02')":        query.AccessUniqueLookup,
+		"SELECT * FROM services WHERE tier = 'gold' AND port > 1":        query.AccessPosting,
+		"SELECT * FROM services WHERE id > 3":                            query.AccessPKRange,
+		"SELECT * FROM services WHERE tier = 'gold' OR name = 'svc01'":   query.AccessFullScan,
+		"SELECT * FROM regions WHERE code BETWEEN 'a' AND 'f'":           query.AccessPKRange,
+		"SELECT * FROM regions WHERE code >= 'f' AND code < 'a'":         query.AccessPKLookup,
+		"SELECT * FROM services WHERE tier = 'gold' AND tier = 'silver'": query.AccessPosting,
+	}
+	for src, want := range cases {
+		stmt, err := query.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := query.PlanSelect(db, stmt.(*query.Select))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Access.Kind != want {
+			t.Fatalf("%s: got %s, want %s", src, p.Access.Kind, want)
+		}
+	}
+	if got := names(t, db, "SELECT name FROM services WHERE tier = 'gold' AND tier = 'silver'"); len(got) != 0 {
+		t.Fatalf("unexpected rows %v", got)
+	}
+	if got := names(t, db, "SELECT code FROM regions WHERE code >= 'f' AND code < 'a'"); len(got) != 0 {
+		t.Fatalf("unexpected rows %v", got)
+	}
+}
+
+func TestIndexMaintenance(t *testing.T) {
+	db := newDatabase(t)
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.NewSession()
+	_, err = s.Insert(document.Row{"name": "svc01", "tier": "gold"})
+	s.Close()
+	if !errors.Is(err, document.ErrUniqueViolation) {
+		t.Fatalf("got %v, want a unique violation", err)
+	}
+
+	s = d.NewSession()
+	err = s.Set(document.FormatKey(int64(2)), document.Row{"name": "renamed", "region": "eu", "tier": "gold"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete(document.FormatKey(int64(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if pk, err := d.LookupUnique("name", "renamed"); err != nil || pk != document.FormatKey(int64(2)) {
+		t.Fatalf("got %q, %v", pk, err)
+	}
+	if _, err := d.LookupUnique("name", "svc01"); err != storage.ErrNoSuchKey {
+		t.Fatalf("stale unique entry: %v", err)
+	}
+	gold, err := d.Posting("tier", "gold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silver, err := d.Posting("tier", "silver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range silver {
+		if pk == document.FormatKey(int64(2)) {
+			t.Fatal("stale posting entry")
+		}
+	}
+	if gold[0] != document.FormatKey(int64(2)) || len(gold) != 14 {
+		t.Fatalf("unexpected gold postings %v", gold)
+	}
+
+	s = d.NewSession()
+	_, err = s.Insert(document.Row{"name": "svc01", "tier": "gold"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlteredSchema(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tbl.AlterSchema(
+		metaparser.Change{Op: metaparser.ChangeRenameField, Field: "region", Name: "zone"},
+		metaparser.Change{Op: metaparser.ChangeRetypeField, Field: "zone", Type: common.TypeEnum},
+		metaparser.Change{Op: metaparser.ChangeDropField, Field: "tier"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the retyped field is planned from its posting lists
+	src := "SELECT name FROM services WHERE zone = 'ap'"
+	if text := explainLines(t, db, "EXPLAIN "+src); !strings.Contains(text, "access: posting list") {
+		t.Fatalf("want a posting list access in\n%s", text)
+	}
+	if got := names(t, db, src); len(got) != 10 || got[0] != "svc02" || got[1] != "svc06" {
+		t.Fatalf("unexpected rows %v", got)
+	}
+	for src, target := range map[string]error{
+		"SELECT region FROM services":                 document.ErrUnknownField,
+		"SELECT id FROM services WHERE tier = 'gold'": document.ErrUnknownField,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", src, err, target)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	db := newDatabase(t)
+	rs, err := query.Run(db, "MATCH (s:services)-[region]->(r:regions) WHERE s.tier = 'gold' AND r.name != 'Europe' AND s.port > 8010 RETURN s.name, r.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{{"svc18", "Asia"}, {"svc21", "Americas"}, {"svc33", "Americas"}}
+	if len(rs.Rows) != len(want) {
+		t.Fatalf("got %v, want %v", rs.Rows, want)
+	}
+	got := map[string]interface{}{}
+	for _, row := range rs.Rows {
+		got[row[0].(string)] = row[1]
+	}
+	for _, row := range want {
+		if got[row[0].(string)] != row[1] {
+			t.Fatalf("got %v, want %v", rs.Rows, want)
+		}
+	}
+
+	rs, err = query.Run(db, "MATCH (r:regions)<-[region]-(s:services) WHERE r.code = 'ap' AND (s.tier = 'gold' OR r.name = 'nowhere') RETURN r.code, s LIMIT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != 2 {
+		t.Fatalf("unexpected rows %v", rs.Rows)
+	}
+	for _, row := range rs.Rows {
+		s := row[1].(document.Row)
+		if row[0] != "ap" || s["region"] != "ap" || s["tier"] != "gold" {
+			t.Fatalf("unexpected row %v", row)
+		}
+	}
+
+	// a backward edge over a reference reads its posting list
+	_, err = db.CreateTable("apps", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields:      []metaparser.Field{{Name: "region", Type: common.TypeString}},
+		References:  []metaparser.Reference{{Field: "region", Table: "regions"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "apps", document.Row{"region": "eu"}, document.Row{"region": "us"}, document.Row{"region": "eu"})
+	src := "MATCH (r:regions)<-[region]-(a:apps) WHERE r.code = 'eu' RETURN a.id"
+	if text := explainLines(t, db, "EXPLAIN "+src); !strings.Contains(text, "access: posting list on region") {
+		t.Fatalf("want a posting list access in\n%s", text)
+	}
+	if got := names(t, db, src); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Fatalf("unexpected apps %v", got)
+	}
+
+	for src, want := range map[string]error{
+		"MATCH (a:services) WHERE b.name = 'x' RETURN a":         query.ErrUnknownVariable,
+		"MATCH (a:services)-[nope]->(b:regions) RETURN a":        document.ErrUnknownField,
+		"MATCH (a:services) RETURN a.nope":                       document.ErrUnknownField,
+		"MATCH (a:services)-[region]->(a:regions) RETURN a.name": query.ErrSyntax,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, want) {
+			t.Fatalf("%s: got %v, want %v", src, err, want)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := tbl.Query().
+		Where("tier", query.OpEq, "gold").
+		Range("port", 8010, 8030).
+		Or(query.HasPrefix("region", "e"), query.Cond("region", query.OpEq, "ap")).
+		OrderByDesc("port").
+		Project("name", "port").
+		Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []document.Row{
+		{"name": "svc27", "port": int64(8027)},
+		{"name": "svc24", "port": int64(8024)},
+		{"name": "svc18", "port": int64(8018)},
+		{"name": "svc12", "port": int64(8012)},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+
+	p, err := tbl.Query().In("name", "svc03", "svc04").Where("port", query.OpNe, 0).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Access.Kind != query.AccessUniqueLookup {
+		t.Fatalf("unexpected access %s", p.Access.Kind)
+	}
+	row, err := tbl.Query().Prefix("name", "svc3").OrderBy("name").Offset(2).First()
+	if err != nil || row["name"] != "svc32" {
+		t.Fatalf("got %v, %v", row, err)
+	}
+	_, err = tbl.Query().Prefix("name", "zzz").First()
+	if err != storage.ErrNoSuchKey {
+		t.Fatalf("got %v, want storage.ErrNoSuchKey", err)
+	}
+
+	regions, err := db.Table("regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = regions.Query().Prefix("code", "e").Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Access.Kind != query.AccessPKRange || p.Access.Start != "e" || p.Access.Stop != "f" {
+		t.Fatalf("unexpected access %+v", p.Access)
+	}
+	rows, err = regions.Query().Prefix("code", "e").Rows()
+	if err != nil || len(rows) != 1 || rows[0]["name"] != "Europe" {
+		t.Fatalf("got %v, %v", rows, err)
+	}
+
+	for _, q := range []*query.Builder{
+		tbl.Query().Where("nope", query.OpEq, 1),
+		tbl.Query().Where("port", query.OpEq, "x"),
+		tbl.Query().Prefix("port", "8"),
+		tbl.Query().Project("nope"),
+		tbl.Query().OrderBy("nope"),
+	} {
+		if _, err := q.Rows(); !errors.Is(err, document.ErrUnknownField) && !errors.Is(err, document.ErrWrongFieldType) {
+			t.Fatalf("%s: got %v, want a schema error", q.Select(), err)
+		}
+	}
+
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer drv.Close()
+	kvdb, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvt, err := kvdb.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvt.Query().Rows(); err != common.ErrWrongStorageType {
+		t.Fatalf("got %v, want common.ErrWrongStorageType", err)
+	}
+}
+
+func explainLines(t *testing.T, db *kical.Database, src string) string {
+	rs, err := query.Run(db, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	var ret string
+	for _, row := range rs.Rows {
+		ret += row[0].(string) + "\n"
+	}
+	return ret
+}
+
+func TestStatistics(t *testing.T) {
+	db := newDatabase(t)
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []document.Row
+	for i := 0; i < 60; i++ {
+		rows = append(rows, document.Row{"name": fmt.Sprintf("bulk%02d", i), "tier": "bulk"})
+	}
+	insert(t, db, "services", rows...)
+	s := d.NewSession()
+	if err = s.Delete(document.FormatKey(int64(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(document.FormatKey(int64(1000))); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set(document.FormatKey(int64(2)), document.Row{"name": "svc01", "tier": "bulk"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := d.Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"gold": 13, "silver": 12, "bronze": 13, "bulk": 61}
+	if st.Rows != 99 || !reflect.DeepEqual(st.Enums["tier"], want) || len(st.Bounds) != document.HistogramBuckets {
+		t.Fatalf("unexpected statistics %+v", st)
+	}
+	// the inserts rebuilt the histogram without an analyze
+	text := explainLines(t, db, "EXPLAIN SELECT * FROM services WHERE id >= 90")
+	if !strings.Contains(text, "estimate: 12 of 99 rows") {
+		t.Fatalf("want the histogram estimate in\n%s", text)
+	}
+	analyzed, err := d.Analyze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analyzed.Rows != st.Rows || !reflect.DeepEqual(analyzed.Enums, st.Enums) || len(analyzed.Bounds) != document.HistogramBuckets {
+		t.Fatalf("unexpected analyzed statistics %+v", analyzed)
+	}
+
+	cases := map[string]query.AccessKind{
+		"SELECT * FROM services WHERE tier = 'bronze'":                    query.AccessPosting,
+		"SELECT * FROM services WHERE tier = 'bulk'":                      query.AccessFullScan,
+		"SELECT * FROM services WHERE tier = 'bulk' AND name = 'bulk07'":  query.AccessUniqueLookup,
+		"SELECT * FROM services WHERE tier IN ('gold', 'silver', 'bulk')": query.AccessFullScan,
+	}
+	for src, kind := range cases {
+		text := explainLines(t, db, "EXPLAIN "+src)
+		if !strings.Contains(text, "access: "+kind.String()) {
+			t.Fatalf("%s: want %s in\n%s", src, kind, text)
+		}
+	}
+	text = explainLines(t, db, "EXPLAIN ANALYZE SELECT name FROM services WHERE tier = 'bronze' AND port > 8010 ORDER BY port LIMIT 2")
+	for _, line := range []string{"estimate: 13 of 99 rows", "sort: port", "limit: 2", "actual: 13 rows read, 2 rows returned"} {
+		if !strings.Contains(text, line) {
+			t.Fatalf("want %q in\n%s", line, text)
+		}
+	}
+	text = explainLines(t, db, "EXPLAIN MATCH (s:services)-[region]->(r:regions) WHERE s.name = 'svc03' RETURN r.name")
+	for _, line := range []string{"start: (s:services)", "access: unique index lookup name IN ('svc03')", "edge: (s)-[region]->(r:regions)"} {
+		if !strings.Contains(text, line) {
+			t.Fatalf("want %q in\n%s", line, text)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	db := newDatabase(t)
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _, err := d.Scan("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type agg struct {
+		count, ports, sum int64
+		min, max          int64
+	}
+	want := map[string]*agg{}
+	for _, row := range rows {
+		tier := row["tier"].(string)
+		a := want[tier]
+		if a == nil {
+			a = &agg{min: 1 << 62}
+			want[tier] = a
+		}
+		a.count++
+		if port, ok := row["port"].(int64); ok {
+			a.ports++
+			a.sum += port
+			if port < a.min {
+				a.min = port
+			}
+			if port > a.max {
+				a.max = port
+			}
+		}
+	}
+	rs, err := query.Run(db, "SELECT tier, COUNT(*), COUNT(port), SUM(port), MIN(port), MAX(port), AVG(port) FROM services GROUP BY tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != len(want) || rs.Columns[6] != "AVG(port)" {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+	for i, tier := range []string{"bronze", "gold", "silver"} {
+		a := want[tier]
+		got := rs.Rows[i]
+		expected := []interface{}{tier, a.count, a.ports, a.sum, a.min, a.max, float64(a.sum) / float64(a.ports)}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("group %s: got %v, want %v", tier, got, expected)
+		}
+	}
+
+	// counts from posting lists match the hash aggregation
+	insert(t, db, "services", document.Row{"name": "untiered"})
+	for _, src := range []string{
+		"SELECT tier, COUNT(*) FROM services GROUP BY tier",
+		"SELECT tier, COUNT(*) FROM services WHERE tier IN ('gold', 'silver') GROUP BY tier",
+	} {
+		text := explainLines(t, db, "EXPLAIN "+src)
+		if !strings.Contains(text, "from posting lists") {
+			t.Fatalf("%s: want posting lists in\n%s", src, text)
+		}
+	}
+	counts := names(t, db, "SELECT COUNT(*), tier FROM services GROUP BY tier")
+	if !reflect.DeepEqual(counts, []string{"1", "13", "14", "13"}) {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	counts = names(t, db, "SELECT COUNT(*) FROM services WHERE tier IN ('gold', 'silver') GROUP BY tier")
+	if !reflect.DeepEqual(counts, []string{"14", "13"}) {
+		t.Fatalf("unexpected filtered counts %v", counts)
+	}
+	text := explainLines(t, db, "EXPLAIN SELECT COUNT(port) FROM services GROUP BY tier")
+	if !strings.Contains(text, "aggregate: COUNT(port) GROUP BY tier, hash") {
+		t.Fatalf("want hash aggregation in\n%s", text)
+	}
+
+	if got := names(t, db, "SELECT region FROM services GROUP BY region ORDER BY COUNT(*) DESC, region LIMIT 2"); !reflect.DeepEqual(got, []string{"eu", "ap"}) {
+		t.Fatalf("unexpected regions %v", got)
+	}
+	rs, err = query.Run(db, "SELECT COUNT(*), SUM(port), MAX(name) FROM services WHERE port > 9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs.Rows, [][]interface{}{{int64(0), nil, nil}}) {
+		t.Fatalf("unexpected empty aggregate %v", rs.Rows)
+	}
+	for src, target := range map[string]error{
+		"SELECT SUM(name) FROM services":                      document.ErrWrongFieldType,
+		"SELECT name, COUNT(*) FROM services GROUP BY tier":   query.ErrInvalidAggregate,
+		"SELECT tier FROM services GROUP BY tier ORDER BY id": query.ErrInvalidAggregate,
+		"SELECT COUNT(*) FROM services GROUP BY color":        document.ErrUnknownField,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", src, err, target)
+		}
+	}
+
+	tbl, err := db.Table("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := tbl.Query().Where("port", query.OpLt, 8020).GroupBy("region").Count().Sum("port").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || groups[0]["region"] != "ap" || groups[0]["COUNT(*)"] != int64(4) || groups[0]["SUM(port)"] != int64(8002+8006+8014+8018) {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
+
+func TestSumOverflow(t *testing.T) {
+	db := newDatabase(t)
+	insert(t, db, "services",
+		document.Row{"name": "big1", "port": int64(math.MaxInt64)},
+		document.Row{"name": "big2", "port": int64(math.MaxInt64 - 1)},
+		document.Row{"name": "neg", "port": int64(-5)},
+	)
+	// the sum goes on as a decimal once it leaves the int64 range
+	rs, err := query.Run(db, "SELECT SUM(port), AVG(port) FROM services WHERE name IN ('big1', 'big2', 'neg')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{fmt.Sprint(rs.Rows[0][0]), fmt.Sprint(rs.Rows[0][1])}
+	if want := []string{"18446744073709551608", "6148914691236517202.666667"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	rs, err = query.Run(db, "SELECT SUM(port) FROM services WHERE name IN ('big1', 'neg')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Rows[0][0] != int64(math.MaxInt64-5) {
+		t.Fatalf("got %#v", rs.Rows[0][0])
+	}
+}
+
+func TestAnalyticalAggregate(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("metrics", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeAnalytical,
+		K:           2,
+		Fields: []metaparser.Field{
+			{Name: "host", Type: common.TypeString},
+			{Name: "load", Type: common.TypeFloat},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := db.Table("metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := tbl.GetAnalytical()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []string{"a", "b", "c"}
+	sums := map[string]float64{}
+	counts := map[string]int64{}
+	var rows []document.Row
+	for i := 0; i < 50; i++ {
+		host := hosts[i%len(hosts)]
+		load := float64(i) * 0.25
+		rows = append(rows, document.Row{"host": host, "load": load})
+		sums[host] += load
+		counts[host]++
+	}
+	if _, err = a.Append(rows...); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := query.Run(db, "SELECT host, COUNT(*), SUM(load), AVG(load), MAX(id) FROM metrics WHERE id > 0 GROUP BY host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != len(hosts) {
+		t.Fatalf("unexpected result %+v", rs)
+	}
+	maxIDs := []int64{49, 50, 48}
+	for i, host := range hosts {
+		want := []interface{}{host, counts[host], sums[host], sums[host] / float64(counts[host]), maxIDs[i]}
+		if !reflect.DeepEqual(rs.Rows[i], want) {
+			t.Fatalf("host %s: got %v, want %v", host, rs.Rows[i], want)
+		}
+	}
+	text := explainLines(t, db, "EXPLAIN SELECT COUNT(*) FROM metrics")
+	if !strings.Contains(text, "access: chunk scan") || !strings.Contains(text, "aggregate: COUNT(*), hash") {
+		t.Fatalf("unexpected plan\n%s", text)
+	}
+}
+
+func TestNumericKeys(t *testing.T) {
+	db := newDatabase(t)
+	src := "SELECT id FROM services WHERE id > 8 AND id <= 11 ORDER BY id"
+	stmt, err := query.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := query.PlanSelect(db, stmt.(*query.Select))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Access.Kind != query.AccessPKRange {
+		t.Fatalf("got %s, want primary key range", p.Access.Kind)
+	}
+	if got := names(t, db, src); strings.Join(got, ",") != "9,10,11" {
+		t.Fatalf("unexpected ids %v", got)
+	}
+	if got := names(t, db, "SELECT id FROM services ORDER BY id LIMIT 3 OFFSET 8"); strings.Join(got, ",") != "9,10,11" {
+		t.Fatalf("unexpected ids %v", got)
+	}
+
+	// a posting value holding a zero byte does not run into the
+	// posting list of its prefix
+	insert(t, db, "services",
+		document.Row{"name": "nul01", "tier": "x"},
+		document.Row{"name": "nul02", "tier": "x\x00y"},
+	)
+	if got := names(t, db, "SELECT name FROM services WHERE tier = 'x'"); len(got) != 1 || got[0] != "nul01" {
+		t.Fatalf("unexpected rows %v", got)
+	}
+	d, err := db.Document("services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := d.EnumValues("tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["x"] != 1 || values["x\x00y"] != 1 {
+		t.Fatalf("unexpected values %q", values)
+	}
+}
@@ -0,0 +1,122 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+)
+
+func TestTagQueries(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "host"},
+		Fields: []metaparser.Field{
+			{Name: "tags", Type: common.TypeTag},
+			{Name: "tier", Type: common.TypeEnum},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := []string{"canary", "gpu-free", "edge", "arm"}
+	var rows []document.Row
+	for i := 0; i < 30; i++ {
+		var tags []interface{}
+		for j, tag := range all {
+			if i%(j+2) == 0 {
+				tags = append(tags, tag)
+			}
+		}
+		row := document.Row{"host": fmt.Sprintf("h%02d", i), "tier": []string{"gold", "silver"}[i%2]}
+		if len(tags) != 0 {
+			row["tags"] = tags
+		}
+		rows = append(rows, row)
+	}
+	insert(t, db, "hosts", rows...)
+
+	hosts := func(keep func(i int) bool) []string {
+		ret := []string{}
+		for i := 0; i < 30; i++ {
+			if keep(i) {
+				ret = append(ret, fmt.Sprintf("h%02d", i))
+			}
+		}
+		return ret
+	}
+	cases := map[string][]string{
+		"SELECT host FROM hosts WHERE tags HAS 'canary' AND tags HAS 'gpu-free'":  hosts(func(i int) bool { return i%6 == 0 }),
+		"SELECT host FROM hosts WHERE tags HAS 'arm' AND tier = 'silver'":         hosts(func(i int) bool { return i%10 == 5 }),
+		"SELECT host FROM hosts WHERE tags HAS 'edge' OR tags HAS 'arm'":          hosts(func(i int) bool { return i%4 == 0 || i%5 == 0 }),
+		"SELECT host FROM hosts WHERE NOT tags HAS 'canary' AND tags IS NOT NULL": hosts(func(i int) bool { return i%2 != 0 && (i%3 == 0 || i%5 == 0) }),
+		"SELECT host FROM hosts WHERE tags IS NULL":                               hosts(func(i int) bool { return i%2 != 0 && i%3 != 0 && i%5 != 0 }),
+	}
+	for src, want := range cases {
+		if got := names(t, db, src); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", src, got, want)
+		}
+	}
+	text := explainLines(t, db, "EXPLAIN SELECT host FROM hosts WHERE tags HAS 'canary' AND tags HAS 'gpu-free'")
+	if !strings.Contains(text, "access: posting list") {
+		t.Fatalf("want a posting list access in\n%s", text)
+	}
+	got, err := tbl.Query().Tagged("tags", "canary", "gpu-free").Project("host").Rows()
+	if err != nil || len(got) != 5 || got[1]["host"] != "h06" {
+		t.Fatalf("tagged: %v %v", got, err)
+	}
+	for src, target := range map[string]error{
+		"SELECT host FROM hosts WHERE tags = 'canary'": document.ErrWrongFieldType,
+		"SELECT host FROM hosts WHERE tier HAS 'gold'": document.ErrWrongFieldType,
+		"SELECT host FROM hosts WHERE tags HAS ''":     document.ErrInvalidTag,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", src, err, target)
+		}
+	}
+
+	// groups of tags from posting lists match the hash aggregation
+	counts := map[string]int64{}
+	var untagged int64
+	for i := 0; i < 30; i++ {
+		tagged := false
+		for j, tag := range all {
+			if i%(j+2) == 0 && i%2 == 1 {
+				counts[tag]++
+				tagged = true
+			}
+		}
+		if !tagged && i%2 == 1 {
+			untagged++
+		}
+	}
+	for src, how := range map[string]string{
+		"SELECT tags, COUNT(*) FROM hosts WHERE tier = 'silver' GROUP BY tags":              "from posting lists",
+		"SELECT tags, COUNT(*), COUNT(tier) FROM hosts WHERE tier = 'silver' GROUP BY tags": "hash",
+	} {
+		if text := explainLines(t, db, "EXPLAIN "+src); !strings.Contains(text, how) {
+			t.Fatalf("%s: want %s in\n%s", src, how, text)
+		}
+		rs, err := query.Run(db, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]interface{}{{nil, untagged}, {"arm", counts["arm"]}, {"gpu-free", counts["gpu-free"]}}
+		if len(counts) != 2 {
+			t.Fatalf("unexpected reference counts %v", counts)
+		}
+		for i, r := range rs.Rows {
+			rs.Rows[i] = r[:2]
+		}
+		if !reflect.DeepEqual(rs.Rows, want) {
+			t.Fatalf("%s: got %v, want %v", src, rs.Rows, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+)
+
+func TestTimeQueries(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("heartbeats", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "at"},
+		Fields: []metaparser.Field{
+			{Name: "at", Type: common.TypeTime},
+			{Name: "host", Type: common.TypeString},
+			{Name: "seen", Type: common.TypeTime},
+		},
+		Unique: []string{"seen"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two days of beats every 30 minutes, written with offsets
+	// on both sides of UTC so that local and UTC orders differ
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	zones := []*time.Location{time.FixedZone("", 8*3600), time.FixedZone("", -5*3600), time.UTC}
+	var rows []document.Row
+	for i := 0; i < 96; i++ {
+		at := start.Add(time.Duration(i) * 30 * time.Minute).In(zones[i%len(zones)])
+		row := document.Row{"at": at, "host": fmt.Sprintf("h%d", i%4)}
+		if i%2 == 0 {
+			row["seen"] = at.Add(-time.Minute).Format(time.RFC3339)
+		}
+		rows = append(rows, row)
+	}
+	insert(t, db, "heartbeats", rows...)
+	d, err := db.Document("heartbeats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := "SELECT at FROM heartbeats WHERE at >= '2024-03-01T10:00:00+08:00' AND at < '2024-03-01 06:00:00' ORDER BY at"
+	if text := explainLines(t, db, "EXPLAIN "+src); !strings.Contains(text, "access: primary key range ['2024-03-01T02:00:00Z', '2024-03-01T06:00:00Z')") {
+		t.Fatalf("want a primary key range in\n%s", text)
+	}
+	rs, err := query.Run(db, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != 8 {
+		t.Fatalf("got %d rows, want 8", len(rs.Rows))
+	}
+	for i, r := range rs.Rows {
+		want := start.Add(2*time.Hour + time.Duration(i)*30*time.Minute)
+		if !r[0].(time.Time).Equal(want) {
+			t.Fatalf("row %d: got %v, want %v", i, r[0], want)
+		}
+	}
+	// last seen filters on a field with a unique index
+	if got := names(t, db, "SELECT host FROM heartbeats WHERE seen > '2024-03-02T21:00:00Z'"); !reflect.DeepEqual(got, []string{"h0", "h2"}) {
+		t.Fatalf("unexpected hosts %v", got)
+	}
+	if got := names(t, db, "SELECT host FROM heartbeats WHERE seen = '2024-03-01T07:59:00+08:00'"); !reflect.DeepEqual(got, []string{"h0"}) {
+		t.Fatalf("unexpected host %v", got)
+	}
+
+	// hours and days are UTC buckets whatever the offsets
+	rs, err = query.Run(db, "SELECT TRUNC(at, DAY), COUNT(*), MIN(at) FROM heartbeats GROUP BY TRUNC(at, DAY)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != 2 || rs.Rows[1][1] != int64(48) || !rs.Rows[1][0].(time.Time).Equal(start.AddDate(0, 0, 1)) ||
+		!rs.Rows[0][2].(time.Time).Equal(start) {
+		t.Fatalf("unexpected days %v", rs.Rows)
+	}
+	rs, err = query.NewBuilder("heartbeats", d).Where("at", query.OpGe, "2024-03-02T22:00:00Z").GroupByTime("at", document.Hour).Count().Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rows) != 2 || rs.Rows[0][1] != int64(2) || rs.Rows[1][1] != int64(2) {
+		t.Fatalf("unexpected hours %v", rs.Rows)
+	}
+
+	for src, target := range map[string]error{
+		"SELECT TRUNC(host, DAY), COUNT(*) FROM heartbeats GROUP BY TRUNC(host, DAY)": document.ErrWrongFieldType,
+		"SELECT TRUNC(at, DAY), COUNT(*) FROM heartbeats GROUP BY host":               query.ErrInvalidAggregate,
+		"SELECT at FROM heartbeats WHERE at > 'yesterday'":                            document.ErrWrongFieldType,
+		"SELECT at FROM heartbeats WHERE at > '2500-01-01'":                           document.ErrWrongFieldType,
+	} {
+		if _, err := query.Run(db, src); !errors.Is(err, target) {
+			t.Fatalf("%s: got %v, want %v", src, err, target)
+		}
+	}
+}
@@ -0,0 +1,642 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// ViewKey is the primary key field of the rows of an aggregate
+// view, it holds the values of the group as a JSON array
+const ViewKey = "_group"
+
+// viewStatePrefix starts the names of the fields of an aggregate
+// view holding the counts and sums its columns are derived from,
+// as in _COUNT(*)
+const viewStatePrefix = "_"
+
+// View maintains a materialized view, the rows of a select query
+// on a row document table stored in a row document table of
+// their own. The rows of a projection view are keyed by the
+// primary key of their source row, an aggregate view holds a row
+// per group keyed by ViewKey
+type View struct {
+	c    Catalog
+	sel  *Select
+	plan *Plan
+	// state lists the aggregates kept in the rows of an aggregate
+	// view to apply changes to them: the number of rows of the
+	// group and the count and sum of every summed or averaged field
+	state []Aggregate
+	// statePlan plans the query with the state aggregates added
+	statePlan *Plan
+}
+
+// NewView plans the view query s, which must read a row document
+// table and may neither order nor limit its rows, the columns of
+// a projection must be fields and those of an aggregate must
+// include every grouped field
+func NewView(c Catalog, s *Select) (*View, error) {
+	if len(s.OrderBy) != 0 || s.Limit >= 0 || s.Offset != 0 {
+		return nil, fmt.Errorf("%w: a view cannot be ordered or limited", ErrInvalidView)
+	}
+	p, err := PlanSelect(c, s)
+	if err != nil {
+		return nil, err
+	}
+	if p.doc == nil {
+		return nil, fmt.Errorf("%w: %s is not a document table", ErrInvalidView, s.Table)
+	}
+	pk := p.doc.Metadata().PrimaryKey
+	if pk == nil {
+		return nil, fmt.Errorf("%w: %s has no primary key", ErrInvalidView, s.Table)
+	}
+	v := &View{c: c, sel: s, plan: p}
+	if !p.Aggregating() {
+		for _, col := range p.Columns {
+			if _, ok := p.doc.FieldType(col); !ok {
+				return nil, fmt.Errorf("%w: %s is not a field", ErrInvalidView, col)
+			}
+		}
+		return v, nil
+	}
+	for _, f := range p.GroupBy {
+		if f == ViewKey {
+			return nil, fmt.Errorf("%w: %s is reserved", ErrInvalidView, ViewKey)
+		}
+		if !contains(p.Columns, f) {
+			return nil, fmt.Errorf("%w: grouped field %s is not selected", ErrInvalidView, f)
+		}
+	}
+	v.state = stateAggregates(p.Aggregates)
+	ss := *s
+	ss.Aggregates = append([]Aggregate(nil), s.Aggregates...)
+	for _, a := range v.state {
+		if !containsAggregate(ss.Aggregates, a) {
+			ss.Aggregates = append(ss.Aggregates, a)
+		}
+	}
+	v.statePlan, err = PlanSelect(c, &ss)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// stateAggregates lists the aggregates the columns of an aggregate
+// view are derived from, but for minimums and maximums
+func stateAggregates(aggs []Aggregate) []Aggregate {
+	ret := []Aggregate{{Func: AggCount}}
+	for _, a := range aggs {
+		if a.Func != AggSum && a.Func != AggAvg {
+			continue
+		}
+		for _, sa := range []Aggregate{{Func: AggCount, Field: a.Field}, {Func: AggSum, Field: a.Field}} {
+			if !containsAggregate(ret, sa) {
+				ret = append(ret, sa)
+			}
+		}
+	}
+	return ret
+}
+
+func containsAggregate(s []Aggregate, x Aggregate) bool {
+	for _, y := range s {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// stateField returns the name of the field holding the state
+// aggregate a
+func stateField(a Aggregate) string {
+	return viewStatePrefix + a.Name()
+}
+
+func contains(s []string, x string) bool {
+	for _, y := range s {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata returns the schema of the table holding the view
+// name, without its definition, fields take the type of the
+// values they hold without the constraints of their source
+func (v *View) Metadata(name string) *metaparser.Metadata {
+	p := v.plan
+	src := p.doc.Metadata()
+	m := &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		TableName:   name,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom},
+	}
+	field := func(name, source string) metaparser.Field {
+		f, ok := src.Field(source)
+		if !ok {
+			f.Type, _ = fieldType(p.doc, source)
+		}
+		return metaparser.Field{Name: name, Type: f.Type, Precision: f.Precision, Scale: f.Scale}
+	}
+	if !p.Aggregating() {
+		m.PrimaryKey.Name = src.PrimaryKey.Name
+		for _, col := range p.Columns {
+			m.Fields = append(m.Fields, field(col, col))
+		}
+		if !contains(p.Columns, src.PrimaryKey.Name) {
+			m.Fields = append(m.Fields, field(src.PrimaryKey.Name, src.PrimaryKey.Name))
+		}
+		return m
+	}
+	m.PrimaryKey.Name = ViewKey
+	m.Fields = []metaparser.Field{{Name: ViewKey, Type: common.TypeString}}
+	for _, col := range p.Columns {
+		m.Fields = append(m.Fields, v.column(col, field))
+	}
+	for _, a := range v.state {
+		f := metaparser.Field{Name: stateField(a), Type: common.TypeInteger}
+		if a.Func == AggSum {
+			f.Type = field(f.Name, a.Field).Type
+		}
+		m.Fields = append(m.Fields, f)
+	}
+	return m
+}
+
+// column returns the field holding the aggregate view column col
+func (v *View) column(col string, field func(name, source string) metaparser.Field) metaparser.Field {
+	p := v.plan
+	for _, t := range p.Truncations {
+		if t.Name() == col {
+			return metaparser.Field{Name: col, Type: common.TypeTime}
+		}
+	}
+	for _, a := range p.Aggregates {
+		if a.Name() != col {
+			continue
+		}
+		f := field(col, a.Field)
+		f.Precision, f.Scale = 0, 0
+		switch a.Func {
+		case AggCount:
+			f.Type = common.TypeInteger
+		case AggAvg:
+			if f.Type != common.TypeDecimal {
+				f.Type = common.TypeFloat
+			}
+		}
+		return f
+	}
+	f := field(col, col)
+	if f.Type == common.TypeTag {
+		f.Type = common.TypeString
+	}
+	return f
+}
+
+// Rebuild writes every row of the view into the session s of its
+// table and deletes the rows no longer in it
+func (v *View) Rebuild(s *document.Session) error {
+	p := v.plan
+	rows := make(map[string]document.Row)
+	if p.Aggregating() {
+		groups, err := v.statePlan.aggregate(new(Execution))
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			key, row := v.groupRow(g)
+			rows[document.FormatKey(key)] = row
+		}
+	} else {
+		matched, err := p.scan(new(Execution))
+		if err != nil {
+			return err
+		}
+		for _, row := range matched {
+			pk, err := p.doc.PrimaryKeyOf(row)
+			if err != nil {
+				return err
+			}
+			rows[pk] = v.project(row)
+		}
+	}
+	cursor := ""
+	for {
+		old, next, err := s.Scan(cursor, 500)
+		if err != nil {
+			return err
+		}
+		for _, row := range old {
+			pk := v.key(row)
+			if _, ok := rows[pk]; ok {
+				continue
+			}
+			err = s.Delete(pk)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for pk, row := range rows {
+		err := s.Set(pk, row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply updates the rows of the view touched by changes of its
+// source in the session s of its table, the changes must be
+// applied once each in the order they are committed. A projection
+// rewrites the row of every changed key from the committed source
+// row, an aggregate applies the old and new rows to the groups
+// they belong to
+func (v *View) Apply(s *document.Session, changes []document.RowChange) error {
+	if v.plan.Aggregating() {
+		return v.applyGroups(s, changes)
+	}
+	p := v.plan
+	seen := make(map[string]bool, len(changes))
+	for _, c := range changes {
+		if seen[c.Key] {
+			continue
+		}
+		seen[c.Key] = true
+		row, err := p.doc.Get(c.Key)
+		if err == nil && v.match(row) {
+			err = s.Set(c.Key, v.project(row))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != storage.ErrNoSuchKey {
+			return err
+		}
+		err = v.remove(s, c.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupChange lists the rows leaving and joining a group
+type groupChange struct {
+	keys    []interface{}
+	removed []document.Row
+	added   []document.Row
+}
+
+func (v *View) applyGroups(s *document.Session, changes []document.RowChange) error {
+	p := v.plan
+	groups := make(map[string]*groupChange)
+	var order []string
+	collect := func(row document.Row, removed bool) {
+		if row == nil || !v.match(row) {
+			return
+		}
+		for _, keys := range p.groupKeys(row) {
+			key := viewKey(keys)
+			gc, ok := groups[key]
+			if !ok {
+				gc = &groupChange{keys: keys}
+				groups[key] = gc
+				order = append(order, key)
+			}
+			if removed {
+				gc.removed = append(gc.removed, row)
+			} else {
+				gc.added = append(gc.added, row)
+			}
+		}
+	}
+	for _, c := range changes {
+		collect(c.Old, true)
+		collect(c.New, false)
+	}
+	for _, key := range order {
+		err := v.applyGroup(s, key, groups[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyGroup updates the row of the group key: the counts and sums
+// are moved by the values of the rows removed and added, and so
+// are the minimums and maximums unless a removed row held one, in
+// which case they are recomputed from the rows of the group. The
+// row is deleted once the group is empty, unless the view has a
+// single group
+func (v *View) applyGroup(s *document.Session, key string, gc *groupChange) error {
+	p := v.plan
+	pk := document.FormatKey(key)
+	row, err := s.Get(pk)
+	if err == storage.ErrNoSuchKey {
+		row = document.Row{ViewKey: key}
+		for i, f := range p.GroupBy {
+			if gc.keys[i] != nil {
+				row[f] = gc.keys[i]
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	state := make(map[Aggregate]interface{}, len(v.state))
+	for _, a := range v.state {
+		state[a] = row[stateField(a)]
+	}
+	var stale []Aggregate
+	for _, r := range gc.removed {
+		foldState(state, r, -1)
+		for _, a := range p.Aggregates {
+			if a.Func != AggMin && a.Func != AggMax {
+				continue
+			}
+			x, best := fieldValue(r, a.Field), row[a.Name()]
+			if x != nil && best != nil && sortCompare(x, best) == 0 && !containsAggregate(stale, a) {
+				stale = append(stale, a)
+			}
+		}
+	}
+	for _, r := range gc.added {
+		foldState(state, r, 1)
+		for _, a := range p.Aggregates {
+			if a.Func != AggMin && a.Func != AggMax || containsAggregate(stale, a) {
+				continue
+			}
+			x, best := fieldValue(r, a.Field), row[a.Name()]
+			if x == nil {
+				continue
+			}
+			if best == nil {
+				row[a.Name()] = x
+			} else if c := sortCompare(x, best); a.Func == AggMin && c < 0 || a.Func == AggMax && c > 0 {
+				row[a.Name()] = x
+			}
+		}
+	}
+	rows, _ := state[Aggregate{Func: AggCount}].(int64)
+	if rows == 0 && len(p.GroupBy) != 0 {
+		return v.remove(s, pk)
+	}
+	for _, a := range v.state {
+		setValue(row, stateField(a), state[a])
+	}
+	for _, a := range p.Aggregates {
+		count, _ := state[Aggregate{Func: AggCount, Field: a.Field}].(int64)
+		sum := state[Aggregate{Func: AggSum, Field: a.Field}]
+		switch a.Func {
+		case AggCount:
+			setValue(row, a.Name(), count)
+		case AggSum:
+			setValue(row, a.Name(), sum)
+		case AggAvg:
+			if count == 0 {
+				sum = nil
+			}
+			setValue(row, a.Name(), average(sum, count))
+		}
+	}
+	if len(stale) != 0 {
+		g, err := v.recompute(key, gc.keys, stale)
+		if err != nil {
+			return err
+		}
+		for _, a := range stale {
+			setValue(row, a.Name(), g[a.Name()])
+		}
+	}
+	return s.Set(pk, row)
+}
+
+// foldState adds the row r to the state aggregates when sign is 1
+// and removes it when sign is -1, a sum is dropped along with the
+// last value it adds up
+func foldState(state map[Aggregate]interface{}, r document.Row, sign int64) {
+	for a, x := range state {
+		if a.Func != AggCount {
+			continue
+		}
+		n, _ := x.(int64)
+		if a.Field == "" {
+			state[a] = n + sign
+			continue
+		}
+		value := fieldValue(r, a.Field)
+		if value == nil {
+			continue
+		}
+		state[a] = n + sign
+		sa := Aggregate{Func: AggSum, Field: a.Field}
+		if _, ok := state[sa]; !ok {
+			continue
+		}
+		if n+sign == 0 {
+			state[sa] = nil
+		} else {
+			state[sa] = addValue(state[sa], value, sign)
+		}
+	}
+}
+
+// addValue adds sign times the number x to sum, a nil sum is zero
+func addValue(sum, x interface{}, sign int64) interface{} {
+	switch x := x.(type) {
+	case int64:
+		switch y := sum.(type) {
+		case nil:
+			return sign * x
+		case int64:
+			return y + sign*x
+		case float64:
+			return y + float64(sign*x)
+		case decimal.Decimal:
+			return y.Add(decimal.NewFromInt(sign * x))
+		}
+	case float64:
+		f := float64(sign) * x
+		switch y := sum.(type) {
+		case nil:
+			return f
+		case int64:
+			return float64(y) + f
+		case float64:
+			return y + f
+		case decimal.Decimal:
+			return y.Float64() + f
+		}
+	case decimal.Decimal:
+		if sign < 0 {
+			x = x.Neg()
+		}
+		switch y := sum.(type) {
+		case nil:
+			return x
+		case int64:
+			return decimal.NewFromInt(y).Add(x)
+		case float64:
+			return y + x.Float64()
+		case decimal.Decimal:
+			return y.Add(x)
+		}
+	}
+	return sum
+}
+
+// setValue sets the field name of row, deleting it when x is nil
+func setValue(row document.Row, name string, x interface{}) {
+	if x == nil {
+		delete(row, name)
+	} else {
+		row[name] = x
+	}
+}
+
+// recompute aggregates the rows of the group keys with aggs, its
+// rows are selected by adding the group values to the filter, nil
+// is returned when the group is empty
+func (v *View) recompute(key string, keys []interface{}, aggs []Aggregate) (document.Row, error) {
+	p := v.plan
+	s := *v.sel
+	s.Fields = nil
+	s.Aggregates = aggs
+	terms := []Expr{s.Where}
+	for i, f := range p.GroupBy {
+		typ, ok := fieldType(p.doc, f)
+		if !ok || typ == common.TypeObject {
+			continue
+		}
+		switch x := keys[i].(type) {
+		case nil:
+			terms = append(terms, &IsNull{Field: f})
+		case string:
+			if typ == common.TypeTag {
+				terms = append(terms, &Has{Field: f, Value: x})
+			} else {
+				terms = append(terms, &Compare{Field: f, Op: OpEq, Value: x})
+			}
+		default:
+			terms = append(terms, &Compare{Field: f, Op: OpEq, Value: x})
+		}
+	}
+	s.Where = conjunction(terms)
+	gp, err := PlanSelect(v.c, &s)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := gp.aggregate(new(Execution))
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if v.groupKey(g) == key {
+			return g, nil
+		}
+	}
+	return nil, nil
+}
+
+// key returns the primary key of a row of the view
+func (v *View) key(row document.Row) string {
+	if v.plan.Aggregating() {
+		return document.FormatKey(row[ViewKey])
+	}
+	return document.FormatKey(row[v.plan.doc.Metadata().PrimaryKey.Name])
+}
+
+func (v *View) match(row document.Row) bool {
+	return v.plan.Filter == nil || eval(v.plan.Filter, rowGetter(row))
+}
+
+// remove deletes the row pk of the view if it exists
+func (v *View) remove(s *document.Session, pk string) error {
+	_, err := s.Get(pk)
+	if err == storage.ErrNoSuchKey {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(pk)
+}
+
+// project returns the row of a projection view holding the
+// selected fields of the source row
+func (v *View) project(row document.Row) document.Row {
+	pk := v.plan.doc.Metadata().PrimaryKey.Name
+	ret := document.Row{pk: row[pk]}
+	for _, col := range v.plan.Columns {
+		if x, ok := row[col]; ok && x != nil {
+			ret[col] = x
+		}
+	}
+	return ret
+}
+
+// groupKey returns the key of the row of an aggregate view
+// holding the group g
+func (v *View) groupKey(g document.Row) string {
+	keys := make([]interface{}, len(v.plan.GroupBy))
+	for i, f := range v.plan.GroupBy {
+		keys[i] = g[f]
+	}
+	return viewKey(keys)
+}
+
+// groupRow returns the key and the row of an aggregate view
+// holding the group g, along with its state aggregates
+func (v *View) groupRow(g document.Row) (string, document.Row) {
+	key := v.groupKey(g)
+	ret := document.Row{ViewKey: key}
+	for _, col := range v.plan.Columns {
+		if x := g[col]; x != nil {
+			ret[col] = x
+		}
+	}
+	for _, a := range v.state {
+		if x := g[a.Name()]; x != nil {
+			ret[stateField(a)] = x
+		}
+	}
+	return key, ret
+}
+
+// viewKey encodes the values of a group into the text of its key,
+// a JSON array holding decimals as strings and times in UTC
+func viewKey(keys []interface{}) string {
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		switch x := k.(type) {
+		case decimal.Decimal:
+			values[i] = x.Reduce().String()
+		case time.Time:
+			values[i] = x.UTC().Format(time.RFC3339Nano)
+		default:
+			values[i] = k
+		}
+	}
+	rs, err := json.Marshal(values)
+	if err != nil {
+		return groupKey(keys)
+	}
+	return string(rs)
+}
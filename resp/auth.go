@@ -0,0 +1,98 @@
+package resp
+
+import (
+	"errors"
+
+	"github.com/xtlsoft/kical/security"
+)
+
+// Front is the front-end name of the server in the audit trail
+const Front = "resp"
+
+// auth authenticates the connection, as `AUTH <token>` or as
+// `AUTH <user> <token>` which also checks the user of the token
+func (cn *conn) auth(args []string) {
+	store := cn.server.conf.Security
+	if store == nil {
+		cn.w.err("ERR AUTH called without any security configured")
+		return
+	}
+	p, err := store.Authenticate(args[len(args)-1])
+	if err == nil && len(args) == 3 && p.User != args[1] {
+		err = security.ErrUnauthenticated
+	}
+	if err != nil {
+		cn.authorize("AUTH", "", "", security.Read)
+		cn.w.err("WRONGPASS invalid username-token pair")
+		return
+	}
+	cn.principal = p
+	cn.w.simple("OK")
+}
+
+// authorize checks that the user of the connection is granted
+// perm on the key of table, an empty key standing for the whole
+// table
+func (cn *conn) authorize(name, table, key string, perm security.Permission) error {
+	return cn.server.conf.Security.Authorize(cn.principal, &security.Operation{
+		Front:      Front,
+		Name:       name,
+		Table:      table,
+		Key:        key,
+		Permission: perm,
+	})
+}
+
+// authorizeKeys authorizes cmd on the keys of args in the selected
+// table
+func (cn *conn) authorizeKeys(cmd *command, args []string) error {
+	perm := security.Read
+	if cmd.write {
+		perm = security.Write
+	}
+	spec := cmd.keys
+	switch {
+	case spec.first < 0:
+		return nil
+	case spec.first == 0:
+		return cn.authorize(args[0], cn.name, "", perm)
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		err := cn.authorize(args[0], cn.name, args[i], perm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter authorizes reading table, it returns nil when every key
+// may be read, otherwise a filter of the keys that may be read
+func (cn *conn) filter(name, table string) (func(key string) bool, error) {
+	store := cn.server.conf.Security
+	if store == nil {
+		return nil, nil
+	}
+	return store.Filter(cn.principal, &security.Operation{
+		Front:      Front,
+		Name:       name,
+		Table:      table,
+		Permission: security.Read,
+	})
+}
+
+// authFail reports a denial the way redis does
+func (cn *conn) authFail(err error) {
+	switch {
+	case errors.Is(err, security.ErrUnauthenticated):
+		cn.w.err("NOAUTH Authentication required.")
+	case errors.Is(err, security.ErrDenied):
+		cn.w.err("NOPERM this user has no permissions to access one of the keys or the table of this command")
+	default:
+		cn.fail(err)
+	}
+}
@@ -0,0 +1,123 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxBulkLength is the largest bulk string accepted from clients
+const MaxBulkLength = 512 << 20
+
+// MaxArgs is the largest number of arguments of a command
+const MaxArgs = 1 << 20
+
+// MaxLineLength is the longest line, an inline command or the
+// header of an array or a bulk string, accepted from clients
+const MaxLineLength = 64 << 10
+
+// ErrProtocol is returned when a client sends malformed data
+var ErrProtocol = fmt.Errorf("Protocol error")
+
+// readCommand reads a command sent either as a RESP array of
+// bulk strings or as an inline command
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > MaxArgs {
+		return nil, ErrProtocol
+	}
+	// the arguments are allocated as they are received, not as
+	// announced
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, ErrProtocol
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 || l > MaxBulkLength {
+			return nil, ErrProtocol
+		}
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, r, int64(l)+2)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		b := buf.Bytes()
+		if b[l] != '\r' || b[l+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		args = append(args, string(b[:l]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most MaxLineLength bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxLineLength {
+			return "", ErrProtocol
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+	}
+}
+
+// writer buffers RESP replies
+type writer struct {
+	w *bufio.Writer
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *writer) err(s string) {
+	w.w.WriteString("-" + strings.Replace(s, "\r\n", " ", -1) + "\r\n")
+}
+
+func (w *writer) int(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *writer) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,848 @@
+// Package resp provides a Redis protocol (RESP) front-end for
+// the kv tables of a kical database, so that redis-cli and redis
+// client libraries can query them
+package resp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/kv"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// ErrServerClosed is returned by Serve after Close is called
+var ErrServerClosed = fmt.Errorf("RESP server closed")
+
+// DefaultScanCount is the page size of SCAN without COUNT
+const DefaultScanCount = 10
+
+// Configure is the configuration of a RESP server
+type Configure struct {
+	// DefaultTable is the table selected when a connection opens,
+	// an empty value requires clients to SELECT a table first
+	DefaultTable string
+
+	// PurgeInterval is how often expired keys are purged from
+	// disk, zero disables purging. Expired keys are invisible to
+	// reads regardless.
+	PurgeInterval time.Duration
+
+	// Security makes clients AUTH with a token before any other
+	// command and only run the commands their user is granted,
+	// reads need the read permission on their keys and writes the
+	// write permission. SCAN and KEYS only return the keys the
+	// user can read.
+	Security *security.Store
+}
+
+// Server serves the RESP protocol upon a database
+type Server struct {
+	db   *kical.Database
+	conf *Configure
+
+	// writeLock serializes writing commands so that read-modify-write
+	// commands such as INCR are atomic among RESP clients
+	writeLock sync.Mutex
+
+	lock      sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	done      chan struct{}
+}
+
+// NewServer creates a new RESP server, conf may be nil
+func NewServer(db *kical.Database, conf *Configure) *Server {
+	if conf == nil {
+		conf = &Configure{}
+	}
+	s := &Server{
+		db:        db,
+		conf:      conf,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+		done:      make(chan struct{}),
+	}
+	if conf.PurgeInterval > 0 {
+		go s.purgeLoop()
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr and serves it
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.lock.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = true
+		s.lock.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+// Close stops every listener and connection of the server
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var ret error
+	for l := range s.listeners {
+		err := l.Close()
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return ret
+}
+
+func (s *Server) purgeLoop() {
+	ticker := time.NewTicker(s.conf.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.purge()
+		}
+	}
+}
+
+func (s *Server) purge() {
+	names, err := s.db.Tables()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		tbl, err := s.db.Table(name)
+		if err != nil || !tbl.IsKV() {
+			continue
+		}
+		s.writeLock.Lock()
+		tbl.KV.PurgeExpired()
+		s.writeLock.Unlock()
+	}
+}
+
+type conn struct {
+	server    *Server
+	w         *writer
+	table     *kv.KV
+	name      string
+	cursors   map[uint64]string
+	next      uint64
+	principal *security.Principal
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+	}()
+	cn := &conn{
+		server:  s,
+		w:       &writer{w: bufio.NewWriter(c)},
+		cursors: make(map[uint64]string),
+	}
+	if s.conf.DefaultTable != "" {
+		// the commands on it are authorized once authenticated
+		err := cn.selectTable(s.conf.DefaultTable, false)
+		if err != nil {
+			cn.w.err("ERR " + err.Error())
+			cn.w.flush()
+			return
+		}
+	}
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err == ErrProtocol {
+				cn.w.err("ERR Protocol error")
+				cn.w.flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := cn.dispatch(args)
+		if r.Buffered() == 0 || quit {
+			if cn.w.flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// selectTable selects the kv table name, or the one of index name,
+// with check the user needs to be granted some keys of the table
+// before it is looked up, so that the missing tables are only told
+// to the users who may see them
+func (cn *conn) selectTable(name string, check bool) error {
+	var tbl *kical.Table
+	if idx, err := strconv.Atoi(name); err == nil {
+		found, err := cn.server.hasTable(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			tbl, err = cn.server.tableByIndex(idx)
+			if err != nil {
+				return err
+			}
+			name = tbl.GetName()
+		}
+	}
+	if check {
+		_, err := cn.filter("SELECT", name)
+		if err != nil {
+			return err
+		}
+	}
+	if tbl == nil {
+		var err error
+		tbl, err = cn.server.db.Table(name)
+		if err == storage.ErrNoSuchKey {
+			return fmt.Errorf("no such table '%s'", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return fmt.Errorf("table '%s' is not a kv table", tbl.GetName())
+	}
+	cn.table = t
+	cn.name = tbl.GetName()
+	cn.cursors = make(map[uint64]string)
+	return nil
+}
+
+// hasTable reports whether the table name exists
+func (s *Server) hasTable(name string) (bool, error) {
+	names, err := s.db.Tables()
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tableByIndex returns the idx-th kv table in name order, so that
+// clients which can only SELECT numbers can still pick a table
+func (s *Server) tableByIndex(idx int) (*kical.Table, error) {
+	names, err := s.db.Tables()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tbl, err := s.db.Table(name)
+		if err != nil {
+			return nil, err
+		}
+		if !tbl.IsKV() {
+			continue
+		}
+		if idx == 0 {
+			return tbl, nil
+		}
+		idx--
+	}
+	return nil, fmt.Errorf("DB index is out of range")
+}
+
+// keySpec locates the keys among the arguments of a command, as
+// the first, last and step of the COMMAND reply of redis. A zero
+// spec stands for a command on the whole table, a negative first
+// key for a command filtering the keys it returns itself.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var (
+	oneKey   = keySpec{1, 1, 1}
+	allKeys  = keySpec{1, -1, 1}
+	pairKeys = keySpec{1, -1, 2}
+	filtered = keySpec{-1, 0, 0}
+)
+
+type command struct {
+	minArgs int
+	maxArgs int
+	write   bool
+	table   bool
+	keys    keySpec
+	fn      func(cn *conn, args []string)
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"AUTH":    {2, 3, false, false, keySpec{}, (*conn).auth},
+		"PING":    {1, 2, false, false, keySpec{}, (*conn).ping},
+		"ECHO":    {2, 2, false, false, keySpec{}, (*conn).echo},
+		"SELECT":  {2, 2, false, false, keySpec{}, (*conn).selectCmd},
+		"COMMAND": {1, -1, false, false, keySpec{}, (*conn).command},
+		"GET":     {2, 2, false, true, oneKey, (*conn).get},
+		"MGET":    {2, -1, false, true, allKeys, (*conn).mget},
+		"EXISTS":  {2, -1, false, true, allKeys, (*conn).exists},
+		"TTL":     {2, 2, false, true, oneKey, (*conn).ttl},
+		"PTTL":    {2, 2, false, true, oneKey, (*conn).ttl},
+		"SCAN":    {2, -1, false, true, filtered, (*conn).scan},
+		"KEYS":    {2, 2, false, true, filtered, (*conn).keys},
+		"DBSIZE":  {1, 1, false, true, keySpec{}, (*conn).dbsize},
+		"SET":     {3, -1, true, true, oneKey, (*conn).set},
+		"MSET":    {3, -1, true, true, pairKeys, (*conn).mset},
+		"DEL":     {2, -1, true, true, allKeys, (*conn).del},
+		"INCR":    {2, 2, true, true, oneKey, (*conn).incr},
+		"DECR":    {2, 2, true, true, oneKey, (*conn).incr},
+		"INCRBY":  {3, 3, true, true, oneKey, (*conn).incr},
+		"DECRBY":  {3, 3, true, true, oneKey, (*conn).incr},
+		"EXPIRE":  {3, 3, true, true, oneKey, (*conn).expire},
+		"PEXPIRE": {3, 3, true, true, oneKey, (*conn).expire},
+		"PERSIST": {2, 2, true, true, oneKey, (*conn).persist},
+	}
+}
+
+func (cn *conn) dispatch(args []string) (quit bool) {
+	name := strings.ToUpper(args[0])
+	args[0] = name
+	if name == "QUIT" {
+		cn.w.simple("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		cn.w.err(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		cn.w.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	if cn.server.conf.Security != nil && name != "AUTH" && cn.principal == nil {
+		cn.authFail(cn.authorize(name, "", "", security.Read))
+		return false
+	}
+	if cmd.table && cn.table == nil {
+		cn.w.err("ERR no table selected, use SELECT <table>")
+		return false
+	}
+	if cmd.table && cn.server.conf.Security != nil {
+		err := cn.authorizeKeys(cmd, args)
+		if err != nil {
+			cn.authFail(err)
+			return false
+		}
+	}
+	if cmd.write {
+		cn.server.writeLock.Lock()
+		defer cn.server.writeLock.Unlock()
+	}
+	cmd.fn(cn, args)
+	return false
+}
+
+// FormatValue formats a stored value as a redis string
+func FormatValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case int:
+		return strconv.Itoa(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	}
+	rs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(rs)
+}
+
+func (cn *conn) fail(err error) {
+	cn.w.err("ERR " + err.Error())
+}
+
+func (cn *conn) ping(args []string) {
+	if len(args) == 2 {
+		cn.w.bulk(args[1])
+		return
+	}
+	cn.w.simple("PONG")
+}
+
+func (cn *conn) echo(args []string) {
+	cn.w.bulk(args[1])
+}
+
+func (cn *conn) selectCmd(args []string) {
+	err := cn.selectTable(args[1], true)
+	if err != nil {
+		cn.authFail(err)
+		return
+	}
+	cn.w.simple("OK")
+}
+
+func (cn *conn) command(args []string) {
+	cn.w.array(0)
+}
+
+func (cn *conn) get(args []string) {
+	v, err := cn.table.Get(args[1])
+	if err == storage.ErrNoSuchKey {
+		cn.w.null()
+		return
+	}
+	if err != nil {
+		cn.fail(err)
+		return
+	}
+	cn.w.bulk(FormatValue(v))
+}
+
+func (cn *conn) mget(args []string) {
+	values := make([]interface{}, 0, len(args)-1)
+	for _, key := range args[1:] {
+		v, err := cn.table.Get(key)
+		if err != nil && err != storage.ErrNoSuchKey {
+			cn.fail(err)
+			return
+		}
+		values = append(values, v)
+	}
+	cn.w.array(len(values))
+	for _, v := range values {
+		if v == nil {
+			cn.w.null()
+		} else {
+			cn.w.bulk(FormatValue(v))
+		}
+	}
+}
+
+func (cn *conn) exists(args []string) {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := cn.table.Get(key)
+		if err == nil {
+			n++
+		} else if err != storage.ErrNoSuchKey {
+			cn.fail(err)
+			return
+		}
+	}
+	cn.w.int(n)
+}
+
+func (cn *conn) ttl(args []string) {
+	d, ok, err := cn.table.TTL(args[1])
+	switch {
+	case err == storage.ErrNoSuchKey:
+		cn.w.int(-2)
+	case err != nil:
+		cn.fail(err)
+	case !ok:
+		cn.w.int(-1)
+	case args[0] == "PTTL":
+		cn.w.int(int64((d + time.Millisecond - 1) / time.Millisecond))
+	default:
+		cn.w.int(int64((d + time.Second - 1) / time.Second))
+	}
+}
+
+func (cn *conn) scan(args []string) {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		cn.w.err("ERR invalid cursor")
+		return
+	}
+	pattern := "*"
+	count := DefaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			cn.w.err("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				cn.w.err("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			cn.w.err("ERR syntax error")
+			return
+		}
+	}
+	allowed, err := cn.filter("SCAN", cn.name)
+	if err != nil {
+		cn.authFail(err)
+		return
+	}
+	cursor := ""
+	if id != 0 {
+		var ok bool
+		cursor, ok = cn.cursors[id]
+		if !ok {
+			cn.w.err("ERR invalid cursor")
+			return
+		}
+		delete(cn.cursors, id)
+	}
+	entries, next, err := cn.table.Scan(cursor, count)
+	if err != nil {
+		cn.fail(err)
+		return
+	}
+	var keys []string
+	for _, e := range entries {
+		if matchGlob(pattern, e.Key) && (allowed == nil || allowed(e.Key)) {
+			keys = append(keys, e.Key)
+		}
+	}
+	var nextID uint64
+	if next != "" {
+		cn.next++
+		nextID = cn.next
+		cn.cursors[nextID] = next
+	}
+	cn.w.array(2)
+	cn.w.bulk(strconv.FormatUint(nextID, 10))
+	cn.w.array(len(keys))
+	for _, k := range keys {
+		cn.w.bulk(k)
+	}
+}
+
+func (cn *conn) keys(args []string) {
+	allowed, err := cn.filter("KEYS", cn.name)
+	if err != nil {
+		cn.authFail(err)
+		return
+	}
+	var keys []string
+	cursor := ""
+	for {
+		entries, next, err := cn.table.Scan(cursor, kvPageSize)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+		for _, e := range entries {
+			if matchGlob(args[1], e.Key) && (allowed == nil || allowed(e.Key)) {
+				keys = append(keys, e.Key)
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	cn.w.array(len(keys))
+	for _, k := range keys {
+		cn.w.bulk(k)
+	}
+}
+
+const kvPageSize = 1024
+
+func (cn *conn) dbsize(args []string) {
+	var n int64
+	cursor := ""
+	for {
+		entries, next, err := cn.table.Scan(cursor, kvPageSize)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+		n += int64(len(entries))
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	cn.w.int(n)
+}
+
+// commit commits sess or reports the error to the client
+func (cn *conn) commit(sess *kv.Session, err error) bool {
+	if err != nil {
+		sess.Close()
+		cn.fail(err)
+		return false
+	}
+	err = sess.Commit()
+	if err != nil {
+		cn.fail(err)
+		return false
+	}
+	return true
+}
+
+func (cn *conn) set(args []string) {
+	var expire time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				cn.w.err("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				cn.w.err("ERR invalid expire time in 'set' command")
+				return
+			}
+			if strings.ToUpper(args[i]) == "EX" {
+				expire = time.Duration(n) * time.Second
+			} else {
+				expire = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			cn.w.err("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		cn.w.err("ERR syntax error")
+		return
+	}
+	sess := cn.table.NewSession()
+	if nx || xx {
+		_, err := sess.Get(args[1])
+		if err != nil && err != storage.ErrNoSuchKey {
+			cn.commit(sess, err)
+			return
+		}
+		if (nx && err == nil) || (xx && err != nil) {
+			sess.Close()
+			cn.w.null()
+			return
+		}
+	}
+	err := sess.Set(args[1], args[2])
+	if err == nil && expire > 0 {
+		err = sess.Expire(args[1], time.Now().Add(expire))
+	}
+	if cn.commit(sess, err) {
+		cn.w.simple("OK")
+	}
+}
+
+func (cn *conn) mset(args []string) {
+	if len(args)%2 != 1 {
+		cn.w.err("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	sess := cn.table.NewSession()
+	var err error
+	for i := 1; i < len(args) && err == nil; i += 2 {
+		err = sess.Set(args[i], args[i+1])
+	}
+	if cn.commit(sess, err) {
+		cn.w.simple("OK")
+	}
+}
+
+func (cn *conn) del(args []string) {
+	sess := cn.table.NewSession()
+	var n int64
+	for _, key := range args[1:] {
+		_, err := sess.Get(key)
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err == nil {
+			err = sess.Delete(key)
+		}
+		if err != nil {
+			cn.commit(sess, err)
+			return
+		}
+		n++
+	}
+	if cn.commit(sess, nil) {
+		cn.w.int(n)
+	}
+}
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+func toInteger(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case int64:
+		return x, nil
+	case int:
+		return int64(x), nil
+	case string:
+		n, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+		return n, nil
+	}
+	return 0, errNotInteger
+}
+
+func (cn *conn) incr(args []string) {
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			cn.fail(errNotInteger)
+			return
+		}
+	}
+	if args[0] == "DECR" || args[0] == "DECRBY" {
+		delta = -delta
+	}
+	sess := cn.table.NewSession()
+	var n int64
+	v, err := sess.Get(args[1])
+	if err == nil {
+		n, err = toInteger(v)
+	} else if err == storage.ErrNoSuchKey {
+		err = nil
+	}
+	if err != nil {
+		cn.commit(sess, err)
+		return
+	}
+	if (delta > 0 && n > (1<<63-1)-delta) || (delta < 0 && n < (-1<<63)-delta) {
+		cn.commit(sess, errors.New("increment or decrement would overflow"))
+		return
+	}
+	n += delta
+	d, hasTTL, err := sess.TTL(args[1])
+	if err == storage.ErrNoSuchKey {
+		err = nil
+	}
+	if err == nil {
+		err = sess.Set(args[1], n)
+	}
+	if err == nil && hasTTL {
+		err = sess.Expire(args[1], time.Now().Add(d))
+	}
+	if cn.commit(sess, err) {
+		cn.w.int(n)
+	}
+}
+
+func (cn *conn) expire(args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		cn.fail(errNotInteger)
+		return
+	}
+	d := time.Duration(n) * time.Second
+	if args[0] == "PEXPIRE" {
+		d = time.Duration(n) * time.Millisecond
+	}
+	sess := cn.table.NewSession()
+	err = sess.Expire(args[1], time.Now().Add(d))
+	if err == storage.ErrNoSuchKey {
+		sess.Close()
+		cn.w.int(0)
+		return
+	}
+	if cn.commit(sess, err) {
+		cn.w.int(1)
+	}
+}
+
+func (cn *conn) persist(args []string) {
+	sess := cn.table.NewSession()
+	_, ok, err := sess.TTL(args[1])
+	if err == storage.ErrNoSuchKey || (err == nil && !ok) {
+		sess.Close()
+		cn.w.int(0)
+		return
+	}
+	if err == nil {
+		err = sess.Persist(args[1])
+	}
+	if cn.commit(sess, err) {
+		cn.w.int(1)
+	}
+}
@@ -0,0 +1,308 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/resp"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func (c *client) do(args ...string) interface{} {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := c.c.Write([]byte(b.String()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+// read decodes a reply, errors are returned as error values
+func (c *client) read() interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		ret := make([]interface{}, n)
+		for i := range ret {
+			ret[i] = c.read()
+		}
+		return ret
+	}
+	c.t.Fatalf("bad reply %q", line)
+	return nil
+}
+
+func newClient(t *testing.T) *client {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alpha", "registry"} {
+		_, err = db.CreateTable(name, &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := resp.NewServer(db, nil)
+	go srv.Serve(l)
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		srv.Close()
+		drv.Close()
+	})
+	return &client{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+func expect(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if err, ok := got.(error); ok {
+		if want != "error" {
+			t.Fatalf("unexpected error %v, want %v", err, want)
+		}
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c := newClient(t)
+	expect(t, c.do("PING"), "PONG")
+	expect(t, c.do("GET", "a"), "error")
+	expect(t, c.do("SELECT", "nope"), "error")
+	expect(t, c.do("SELECT", "registry"), "OK")
+	expect(t, c.do("SET", "a", "1"), "OK")
+	expect(t, c.do("SET", "a", "2", "NX"), nil)
+	expect(t, c.do("SET", "b", "2", "XX"), nil)
+	expect(t, c.do("INCR", "a"), int64(2))
+	expect(t, c.do("INCRBY", "a", "10"), int64(12))
+	expect(t, c.do("GET", "a"), "12")
+	expect(t, c.do("MSET", "b", "x", "c", "y"), "OK")
+	expect(t, c.do("INCR", "b"), "error")
+	expect(t, c.do("MGET", "a", "b", "zz"), []interface{}{"12", "x", nil})
+	expect(t, c.do("EXISTS", "a", "b", "zz"), int64(2))
+	expect(t, c.do("TTL", "a"), int64(-1))
+	expect(t, c.do("EXPIRE", "a", "100"), int64(1))
+	expect(t, c.do("TTL", "a"), int64(100))
+	expect(t, c.do("INCR", "a"), int64(13))
+	expect(t, c.do("TTL", "a"), int64(100))
+	expect(t, c.do("EXPIRE", "zz", "100"), int64(0))
+	expect(t, c.do("PEXPIRE", "c", "-1"), int64(1))
+	expect(t, c.do("GET", "c"), nil)
+	expect(t, c.do("TTL", "c"), int64(-2))
+	expect(t, c.do("DEL", "b", "c", "zz"), int64(1))
+	expect(t, c.do("DBSIZE"), int64(1))
+
+	// the table is also reachable by its index among kv tables
+	expect(t, c.do("SELECT", "0"), "OK")
+	expect(t, c.do("DBSIZE"), int64(0))
+	expect(t, c.do("SELECT", "1"), "OK")
+	expect(t, c.do("GET", "a"), "13")
+	expect(t, c.do("NOPE"), "error")
+}
+
+func TestScan(t *testing.T) {
+	c := newClient(t)
+	expect(t, c.do("SELECT", "registry"), "OK")
+	want := map[string]bool{}
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("svc:%02d", i)
+		expect(t, c.do("SET", k, "v"), "OK")
+		expect(t, c.do("SET", fmt.Sprintf("host:%02d", i), "v"), "OK")
+		want[k] = true
+	}
+	got := map[string]bool{}
+	cursor := "0"
+	for {
+		r := c.do("SCAN", cursor, "MATCH", "svc:*", "COUNT", "7").([]interface{})
+		for _, k := range r[1].([]interface{}) {
+			got[k.(string)] = true
+		}
+		cursor = r[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	expect(t, got, want)
+	expect(t, len(c.do("KEYS", "host:1?").([]interface{})), 10)
+}
+
+func TestSecurity(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"registry", "secrets"} {
+		_, err = db.CreateTable(name, &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetRole(&security.Role{Name: "tenant", Grants: []security.Grant{
+		{Table: "registry", Prefix: "acme:", Permission: security.Write},
+		{Table: "registry", Prefix: "shared:", Permission: security.Read},
+	}})
+	store.SetUser(&security.User{Name: "alice", Roles: []string{"tenant"}})
+	token, _ := store.IssueToken("alice", 0)
+	tbl, _ := db.Table("registry")
+	sess := tbl.KV.NewSession()
+	sess.Set("shared:motd", "hello")
+	sess.Set("globex:db", "10.0.0.1")
+	if err = sess.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := resp.NewServer(db, &resp.Configure{DefaultTable: "registry", Security: store})
+	defer srv.Close()
+	go srv.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t: t, c: conn, r: bufio.NewReader(conn)}
+
+	if err, ok := c.do("GET", "shared:motd").(error); !ok || !strings.HasPrefix(err.Error(), "NOAUTH") {
+		t.Fatalf("expected NOAUTH, got %v", err)
+	}
+	expect(t, c.do("AUTH", "forged"), "error")
+	expect(t, c.do("AUTH", "bob", token), "error")
+	expect(t, c.do("AUTH", "alice", token), "OK")
+	expect(t, c.do("GET", "shared:motd"), "hello")
+	expect(t, c.do("SET", "acme:db", "10.0.0.2"), "OK")
+	if err, ok := c.do("SET", "shared:motd", "bye").(error); !ok || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Fatalf("expected NOPERM, got %v", err)
+	}
+	expect(t, c.do("MGET", "acme:db", "globex:db"), "error")
+	expect(t, c.do("MSET", "acme:a", "1", "globex:a", "1"), "error")
+	expect(t, c.do("GET", "acme:a"), nil)
+	expect(t, c.do("DBSIZE"), "error")
+	expect(t, c.do("KEYS", "*"), []interface{}{"acme:db", "shared:motd"})
+	expect(t, c.do("SELECT", "secrets"), "error")
+	// the tables are looked up once authorized, without creating them
+	if err, ok := c.do("SELECT", "missing").(error); !ok || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Fatalf("expected NOPERM, got %v", err)
+	}
+	if tables, _ := db.Tables(); len(tables) != 2 {
+		t.Fatalf("got tables %v", tables)
+	}
+	expect(t, c.do("GET", "acme:db"), "10.0.0.2")
+
+	entries, err := store.Audit(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unauthenticated denials are counted together
+	var anonymous int64
+	var denied []security.AuditEntry
+	for _, e := range entries {
+		if e.User == "" {
+			anonymous += e.Count
+		} else {
+			denied = append(denied, e)
+		}
+	}
+	if anonymous != 3 || len(denied) != 6 {
+		t.Fatalf("got %d audit entries: %+v", len(entries), entries)
+	}
+	if e := denied[1]; e.User != "alice" || e.Front != resp.Front || e.Operation != "MGET" || e.Key != "globex:db" {
+		t.Fatalf("bad entry %+v", e)
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	c := newClient(t)
+	addr := c.c.RemoteAddr().String()
+	for _, header := range []string{
+		"*-1\r\n",
+		"*-9223372036854775808\r\n",
+		fmt.Sprintf("*%d\r\n", resp.MaxArgs+1),
+		"*1\r\n$-1\r\n",
+		fmt.Sprintf("*1\r\n$%d\r\n", resp.MaxBulkLength+1),
+		"*" + strings.Repeat("1", resp.MaxLineLength) + "\r\n",
+		strings.Repeat("x", 2*resp.MaxLineLength),
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := &client{t: t, c: conn, r: bufio.NewReader(conn)}
+		if _, err = conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		got := bad.read()
+		conn.Close()
+		if err, ok := got.(error); !ok || err.Error() != "ERR Protocol error" {
+			t.Fatalf("%.20q: got %v", header, got)
+		}
+	}
+	// the server is still up
+	expect(t, c.do("PING"), "PONG")
+}
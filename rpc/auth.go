@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/xtlsoft/kical/security"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Front is the front-end name of the server in the audit trail
+const Front = "rpc"
+
+// authorizationKey is the metadata key carrying the token, as
+// `Bearer <token>`
+const authorizationKey = "authorization"
+
+// SetSecurity makes the server authenticate the calls with the
+// token of their authorization metadata and only serve the
+// operations the user is granted by s. Reads need the read
+// permission on their keys and writes the write permission, scans
+// and watches only return the keys the user can read.
+func (s *Server) SetSecurity(store *security.Store) {
+	s.security = store
+}
+
+// tokenOf returns the token of the call of ctx
+func tokenOf(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md.Get(authorizationKey) {
+		if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	return ""
+}
+
+func (s *Server) operation(ctx context.Context, name, table, key string, perm security.Permission) (*security.Principal, *security.Operation) {
+	p, _ := s.security.Authenticate(tokenOf(ctx))
+	return p, &security.Operation{
+		Front:      Front,
+		Name:       name,
+		Table:      table,
+		Key:        key,
+		Permission: perm,
+	}
+}
+
+// authorize checks that the user of the call is granted perm on
+// the key of table, an empty key standing for the whole table
+func (s *Server) authorize(ctx context.Context, name, table, key string, perm security.Permission) error {
+	if s.security == nil {
+		return nil
+	}
+	return toStatus(s.security.Authorize(s.operation(ctx, name, table, key, perm)))
+}
+
+// filter authorizes reading the keys of table starting with
+// prefix, it returns nil when every key may be read
+func (s *Server) filter(ctx context.Context, name, table, prefix string) (func(key string) bool, error) {
+	if s.security == nil {
+		return nil, nil
+	}
+	allowed, err := s.security.Filter(s.operation(ctx, name, table, prefix, security.Read))
+	return allowed, toStatus(err)
+}
+
+// tokenCredentials sends a token with every call
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// WithToken returns the dial option authenticating the calls of a
+// client with token. The token is sent as is, use it over TLS
+// outside of trusted networks.
+func WithToken(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(tokenCredentials(token))
+}
@@ -0,0 +1,189 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"google.golang.org/grpc"
+)
+
+// Client wraps KicalClient with helpers working on Go values,
+// a missing key is reported as storage.ErrNoSuchKey
+type Client struct {
+	KicalClient
+}
+
+// NewClient creates a new client upon cc
+func NewClient(cc *grpc.ClientConn) *Client {
+	return &Client{KicalClient: NewKicalClient(cc)}
+}
+
+func decodeValue(rs []byte) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal(rs, &v)
+	return v, err
+}
+
+func decodeRow(rs []byte) (document.Row, error) {
+	var row document.Row
+	err := json.Unmarshal(rs, &row)
+	return row, err
+}
+
+// GetValue gets an entry from a kv table
+func (c *Client) GetValue(ctx context.Context, table, key string) (interface{}, error) {
+	resp, err := c.Get(ctx, &GetRequest{Table: table, Key: key})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return decodeValue(resp.Kv.Value)
+}
+
+// SetValue sets an entry of a kv table
+func (c *Client) SetValue(ctx context.Context, table, key string, value interface{}) error {
+	rs, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.Set(ctx, &SetRequest{Table: table, Kv: &KeyValue{Key: key, Value: rs}})
+	return fromStatus(err)
+}
+
+// DeleteValue deletes an entry of a kv table
+func (c *Client) DeleteValue(ctx context.Context, table, key string) error {
+	_, err := c.Delete(ctx, &DeleteRequest{Table: table, Key: key})
+	return fromStatus(err)
+}
+
+// ScanValues streams the entries selected by req to fn
+func (c *Client) ScanValues(ctx context.Context, req *ScanRequest, fn func(key string, value interface{}) error) error {
+	stream, err := c.Scan(ctx, req)
+	if err != nil {
+		return fromStatus(err)
+	}
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		v, err := decodeValue(kv.Value)
+		if err != nil {
+			return err
+		}
+		err = fn(kv.Key, v)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetRow gets a document by its primary key
+func (c *Client) GetRow(ctx context.Context, table, pk string) (document.Row, error) {
+	doc, err := c.GetDocument(ctx, &GetDocumentRequest{Table: table, Key: pk})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return decodeRow(doc.Body)
+}
+
+// InsertRow inserts a document and returns its primary key
+func (c *Client) InsertRow(ctx context.Context, table string, row document.Row) (string, error) {
+	rs, err := json.Marshal(row)
+	if err != nil {
+		return "", err
+	}
+	doc, err := c.InsertDocument(ctx, &InsertDocumentRequest{Table: table, Body: rs})
+	if err != nil {
+		return "", fromStatus(err)
+	}
+	return doc.Key, nil
+}
+
+// SetRow replaces the document with primary key pk
+func (c *Client) SetRow(ctx context.Context, table, pk string, row document.Row) error {
+	rs, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = c.SetDocument(ctx, &SetDocumentRequest{Table: table, Document: &Document{Key: pk, Body: rs}})
+	return fromStatus(err)
+}
+
+// DeleteRow deletes the document with primary key pk
+func (c *Client) DeleteRow(ctx context.Context, table, pk string) error {
+	_, err := c.DeleteDocument(ctx, &DeleteDocumentRequest{Table: table, Key: pk})
+	return fromStatus(err)
+}
+
+// ScanRows streams the documents selected by req to fn
+func (c *Client) ScanRows(ctx context.Context, req *ScanRequest, fn func(row document.Row) error) error {
+	stream, err := c.ScanDocuments(ctx, req)
+	if err != nil {
+		return fromStatus(err)
+	}
+	for {
+		doc, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		row, err := decodeRow(doc.Body)
+		if err != nil {
+			return err
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Watcher receives the changes streamed by a Watch call
+type Watcher struct {
+	stream Kical_WatchClient
+}
+
+// WatchTable starts watching the keys with the given prefix, it
+// returns once the server has registered the watcher
+func (c *Client) WatchTable(ctx context.Context, table, prefix string) (*Watcher, error) {
+	stream, err := c.Watch(ctx, &WatchRequest{Table: table, Prefix: prefix})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	_, err = stream.Recv()
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return &Watcher{stream: stream}, nil
+}
+
+// Recv blocks until the next committed session touching the
+// watched keys and returns its events
+func (w *Watcher) Recv() ([]common.Event, error) {
+	resp, err := w.stream.Recv()
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	events := make([]common.Event, 0, len(resp.Events))
+	for _, e := range resp.Events {
+		ev := common.Event{Type: common.EventPut, Key: e.Kv.Key}
+		if e.Type == Event_DELETE {
+			ev.Type = common.EventDelete
+		} else {
+			ev.Value, err = decodeValue(e.Kv.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
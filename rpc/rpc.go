@@ -0,0 +1,58 @@
+// Package rpc provides the gRPC service of kical together with
+// a Go client, the messages are generated from kical.proto
+package rpc
+
+//go:generate protoc --gogofast_out=plugins=grpc,paths=source_relative:. kical.proto
+
+import (
+	"errors"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ScanPageSize is the number of entries read from the table at
+// once while streaming a scan
+const ScanPageSize = 256
+
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, security.ErrUnauthenticated):
+		code = codes.Unauthenticated
+	case errors.Is(err, security.ErrDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, storage.ErrNoSuchKey):
+		code = codes.NotFound
+	case errors.Is(err, common.ErrTableExists),
+		errors.Is(err, document.ErrDuplicateKey):
+		code = codes.AlreadyExists
+	case errors.Is(err, common.ErrWrongStorageType):
+		code = codes.FailedPrecondition
+	case errors.Is(err, document.ErrUnknownField),
+		errors.Is(err, document.ErrWrongFieldType),
+		errors.Is(err, document.ErrMissingPrimaryKey),
+		errors.Is(err, metaparser.ErrMalformedMetadata),
+		errors.Is(err, storage.ErrInvalidBucketName):
+		code = codes.InvalidArgument
+	}
+	return status.Error(code, err.Error())
+}
+
+func fromStatus(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return storage.ErrNoSuchKey
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/rpc"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newClient(t *testing.T) (*kical.Database, *rpc.Client) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { drv.Close() })
+	return db, dial(t, rpc.NewServer(db))
+}
+
+// dial serves s and returns a client of it, opts are added to the
+// dial options
+func dial(t *testing.T, s *rpc.Server, opts ...grpc.DialOption) *rpc.Client {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	rpc.RegisterKicalServer(srv, s)
+	go srv.Serve(lis)
+	opts = append(opts, grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	conn, err := grpc.Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+	return rpc.NewClient(conn)
+}
+
+func TestKV(t *testing.T) {
+	db, c := newClient(t)
+	ctx := context.Background()
+	_, err := db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.WatchTable(ctx, "reg", "svc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"host/a", "svc/a", "svc/b", "svc/c"} {
+		err = c.SetValue(ctx, "reg", k, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.DeleteValue(ctx, "reg", "svc/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.GetValue(ctx, "reg", "svc/a")
+	if err != nil || v != "svc/a" {
+		t.Fatalf("unexpected get %v %v", v, err)
+	}
+	_, err = c.GetValue(ctx, "reg", "svc/c")
+	if err != storage.ErrNoSuchKey {
+		t.Fatalf("expected missing key, got %v", err)
+	}
+
+	var keys []string
+	err = c.ScanValues(ctx, &rpc.ScanRequest{Table: "reg", Prefix: "svc/"}, func(key string, value interface{}) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || len(keys) != 2 || keys[0] != "svc/a" || keys[1] != "svc/b" {
+		t.Fatalf("unexpected scan %v %v", keys, err)
+	}
+
+	want := []common.Event{
+		{Type: common.EventPut, Key: "svc/a", Value: "svc/a"},
+		{Type: common.EventPut, Key: "svc/b", Value: "svc/b"},
+		{Type: common.EventPut, Key: "svc/c", Value: "svc/c"},
+		{Type: common.EventDelete, Key: "svc/c"},
+	}
+	for _, e := range want {
+		events, err := w.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0] != e {
+			t.Fatalf("unexpected events %v, want %v", events, e)
+		}
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	db, c := newClient(t)
+	ctx := context.Background()
+	_, err := db.CreateTable("services", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		Fields:      []metaparser.Field{{Name: "name", Type: common.TypeString}},
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := c.InsertRow(ctx, "services", document.Row{"name": "api"})
+	if err != nil || pk != "1" {
+		t.Fatalf("unexpected insert %v %v", pk, err)
+	}
+	_, err = c.InsertRow(ctx, "services", document.Row{"name": "api", "port": 80})
+	if err == nil {
+		t.Fatal("expected an error on unknown field")
+	}
+	resp, err := c.Txn(ctx, &rpc.TxnRequest{Table: "services", Ops: []*rpc.TxnOp{
+		{Type: rpc.TxnOp_INSERT, Value: []byte(`{"name":"db"}`)},
+		{Type: rpc.TxnOp_SET, Key: "1", Value: []byte(`{"name":"gateway"}`)},
+	}})
+	if err != nil || len(resp.Keys) != 1 || resp.Keys[0] != "2" {
+		t.Fatalf("unexpected txn %v %v", resp, err)
+	}
+	row, err := c.GetRow(ctx, "services", "1")
+	if err != nil || row["name"] != "gateway" {
+		t.Fatalf("unexpected row %v %v", row, err)
+	}
+	var names []string
+	err = c.ScanRows(ctx, &rpc.ScanRequest{Table: "services"}, func(row document.Row) error {
+		names = append(names, row["name"].(string))
+		return nil
+	})
+	if err != nil || len(names) != 2 || names[1] != "db" {
+		t.Fatalf("unexpected scan %v %v", names, err)
+	}
+	err = c.DeleteRow(ctx, "services", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetRow(ctx, "services", "2")
+	if err != storage.ErrNoSuchKey {
+		t.Fatalf("expected missing key, got %v", err)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	_, err = db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err == nil {
+		_, err = db.CreateTable("hosts", &metaparser.Metadata{
+			StorageType: metaparser.MetaStorageTypeRowDocument,
+			Fields:      []metaparser.Field{{Name: "name", Type: common.TypeString}},
+			PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetRole(&security.Role{Name: "tenant", Grants: []security.Grant{
+		{Table: "reg", Prefix: "acme/", Permission: security.Write},
+		{Table: "hosts", Prefix: "acme-", Permission: security.Write},
+	}})
+	store.SetUser(&security.User{Name: "alice", Roles: []string{"tenant"}})
+	token, _ := store.IssueToken("alice", 0)
+	s := rpc.NewServer(db)
+	s.SetSecurity(store)
+	anonymous := dial(t, s)
+	c := dial(t, s, rpc.WithToken(token))
+
+	tbl, _ := db.Table("reg")
+	sess := tbl.KV.NewSession()
+	sess.Set("globex/db", "10.0.0.1")
+	if err = sess.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = anonymous.GetValue(ctx, "reg", "acme/db"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	w, err := c.WatchTable(ctx, "reg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetValue(ctx, "reg", "acme/db", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetValue(ctx, "reg", "globex/db", "10.0.0.3"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	if _, err = c.GetValue(ctx, "reg", "globex/db"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	var keys []string
+	err = c.ScanValues(ctx, &rpc.ScanRequest{Table: "reg"}, func(key string, value interface{}) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || len(keys) != 1 || keys[0] != "acme/db" {
+		t.Fatalf("unexpected scan %v %v", keys, err)
+	}
+	// only the changes to the keys of alice are watched
+	sess = tbl.KV.NewSession()
+	sess.Set("globex/db", "10.0.0.4")
+	sess.Set("acme/web", "10.0.0.5")
+	if err = sess.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"acme/db", "acme/web"} {
+		events, err := w.Recv()
+		if err != nil || len(events) != 1 || events[0].Key != key {
+			t.Fatalf("unexpected events %v %v, want %s", events, err, key)
+		}
+	}
+
+	if _, err = c.InsertRow(ctx, "hosts", document.Row{"name": "acme-web"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.InsertRow(ctx, "hosts", document.Row{"name": "globex-web"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	if err = c.DeleteRow(ctx, "hosts", "globex-web"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	// the tables are looked up once authorized, without creating them
+	if _, err = c.GetValue(ctx, "missing", "acme/db"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	if tables, _ := db.Tables(); len(tables) != 2 {
+		t.Fatalf("got tables %v", tables)
+	}
+	entries, err := store.Audit(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d audit entries: %+v", len(entries), entries)
+	}
+	if e := entries[3]; e.User != "alice" || e.Front != rpc.Front || e.Operation != "Txn" || e.Table != "hosts" || e.Key != "globex-web" {
+		t.Fatalf("bad entry %+v", e)
+	}
+}
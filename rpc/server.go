@@ -0,0 +1,519 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements KicalServer upon a database
+type Server struct {
+	db       *kical.Database
+	security *security.Store
+}
+
+// NewServer creates a new server serving db, register it with
+// RegisterKicalServer
+func NewServer(db *kical.Database) *Server {
+	return &Server{db: db}
+}
+
+// table returns the table name for the call, the user must be
+// granted some keys of the table before it is looked up so that the
+// missing tables are only told to the users who may see them
+func (s *Server) table(ctx context.Context, call, name string) (*kical.Table, error) {
+	_, err := s.filter(ctx, call, name, "")
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := s.db.Table(name)
+	if err == storage.ErrNoSuchKey {
+		return nil, status.Errorf(codes.NotFound, "no such table %q", name)
+	}
+	return tbl, toStatus(err)
+}
+
+func unmarshalValue(rs []byte) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(rs)))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad json value: %v", err)
+	}
+	return document.PlainValue(v), nil
+}
+
+func unmarshalRow(rs []byte) (document.Row, error) {
+	v, err := unmarshalValue(rs)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "document must be a json object")
+	}
+	return document.Row(m), nil
+}
+
+func marshalValue(v interface{}) ([]byte, error) {
+	rs, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot encode value: %v", err)
+	}
+	return rs, nil
+}
+
+// Get implements KicalServer
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	tbl, err := s.table(ctx, "Get", req.Table)
+	if err != nil {
+		return nil, err
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	err = s.authorize(ctx, "Get", req.Table, req.Key, security.Read)
+	if err != nil {
+		return nil, err
+	}
+	v, err := t.Get(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	rs, err := marshalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &GetResponse{Kv: &KeyValue{Key: req.Key, Value: rs}}, nil
+}
+
+// Set implements KicalServer
+func (s *Server) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	if req.Kv == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing kv")
+	}
+	tbl, err := s.table(ctx, "Set", req.Table)
+	if err != nil {
+		return nil, err
+	}
+	if !tbl.IsKV() {
+		return nil, toStatus(common.ErrWrongStorageType)
+	}
+	_, err = s.Txn(ctx, &TxnRequest{
+		Table: req.Table,
+		Ops:   []*TxnOp{{Type: TxnOp_SET, Key: req.Kv.Key, Value: req.Kv.Value}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SetResponse{}, nil
+}
+
+// Delete implements KicalServer
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	tbl, err := s.table(ctx, "Delete", req.Table)
+	if err != nil {
+		return nil, err
+	}
+	if !tbl.IsKV() {
+		return nil, toStatus(common.ErrWrongStorageType)
+	}
+	_, err = s.Txn(ctx, &TxnRequest{
+		Table: req.Table,
+		Ops:   []*TxnOp{{Type: TxnOp_DELETE, Key: req.Key}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteResponse{}, nil
+}
+
+// scanRange walks the keys selected by req page by page
+func scanRange(req *ScanRequest, page func(cursor string, limit int) ([]string, string, error), fn func(i int) error) error {
+	cursor := req.Start
+	if req.Prefix > cursor {
+		cursor = req.Prefix
+	}
+	var sent int64
+	for {
+		keys, next, err := page(cursor, ScanPageSize)
+		if err != nil {
+			return toStatus(err)
+		}
+		for i, k := range keys {
+			if (req.End != "" && k >= req.End) ||
+				(req.Prefix != "" && !strings.HasPrefix(k, req.Prefix)) ||
+				(req.Limit > 0 && sent == req.Limit) {
+				return nil
+			}
+			err = fn(i)
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Scan implements KicalServer
+func (s *Server) Scan(req *ScanRequest, stream Kical_ScanServer) error {
+	tbl, err := s.table(stream.Context(), "Scan", req.Table)
+	if err != nil {
+		return err
+	}
+	t, err := tbl.GetKV()
+	if err != nil {
+		return toStatus(err)
+	}
+	allowed, err := s.filter(stream.Context(), "Scan", req.Table, req.Prefix)
+	if err != nil {
+		return err
+	}
+	var entries []kvEntry
+	return scanRange(req, func(cursor string, limit int) ([]string, string, error) {
+		es, next, err := t.Scan(cursor, limit)
+		entries = entries[:0]
+		keys := make([]string, 0, len(es))
+		for _, e := range es {
+			if allowed != nil && !allowed(e.Key) {
+				continue
+			}
+			entries = append(entries, kvEntry{e.Key, e.Value})
+			keys = append(keys, e.Key)
+		}
+		return keys, next, err
+	}, func(i int) error {
+		rs, err := marshalValue(entries[i].value)
+		if err != nil {
+			return err
+		}
+		return stream.Send(&KeyValue{Key: entries[i].key, Value: rs})
+	})
+}
+
+type kvEntry struct {
+	key   string
+	value interface{}
+}
+
+func (s *Server) document(ctx context.Context, call, name string) (*document.Document, error) {
+	tbl, err := s.table(ctx, call, name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := tbl.GetDocument()
+	return d, toStatus(err)
+}
+
+func (s *Server) marshalDocument(d *document.Document, row document.Row) (*Document, error) {
+	pk, err := d.PrimaryKeyOf(row)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	rs, err := marshalValue(row)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{Key: d.KeyText(pk), Body: rs}, nil
+}
+
+// GetDocument implements KicalServer
+func (s *Server) GetDocument(ctx context.Context, req *GetDocumentRequest) (*Document, error) {
+	d, err := s.document(ctx, "GetDocument", req.Table)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := d.ParseKey(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	err = s.authorize(ctx, "GetDocument", req.Table, d.KeyText(pk), security.Read)
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.Get(pk)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return s.marshalDocument(d, row)
+}
+
+// InsertDocument implements KicalServer
+func (s *Server) InsertDocument(ctx context.Context, req *InsertDocumentRequest) (*Document, error) {
+	resp, err := s.Txn(ctx, &TxnRequest{
+		Table: req.Table,
+		Ops:   []*TxnOp{{Type: TxnOp_INSERT, Value: req.Body}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetDocument(ctx, &GetDocumentRequest{Table: req.Table, Key: resp.Keys[0]})
+}
+
+// SetDocument implements KicalServer
+func (s *Server) SetDocument(ctx context.Context, req *SetDocumentRequest) (*SetDocumentResponse, error) {
+	if req.Document == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing document")
+	}
+	if _, err := s.document(ctx, "SetDocument", req.Table); err != nil {
+		return nil, err
+	}
+	_, err := s.Txn(ctx, &TxnRequest{
+		Table: req.Table,
+		Ops:   []*TxnOp{{Type: TxnOp_SET, Key: req.Document.Key, Value: req.Document.Body}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SetDocumentResponse{}, nil
+}
+
+// DeleteDocument implements KicalServer
+func (s *Server) DeleteDocument(ctx context.Context, req *DeleteDocumentRequest) (*DeleteDocumentResponse, error) {
+	if _, err := s.document(ctx, "DeleteDocument", req.Table); err != nil {
+		return nil, err
+	}
+	_, err := s.Txn(ctx, &TxnRequest{
+		Table: req.Table,
+		Ops:   []*TxnOp{{Type: TxnOp_DELETE, Key: req.Key}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteDocumentResponse{}, nil
+}
+
+// ScanDocuments implements KicalServer
+func (s *Server) ScanDocuments(req *ScanRequest, stream Kical_ScanDocumentsServer) error {
+	d, err := s.document(stream.Context(), "ScanDocuments", req.Table)
+	if err != nil {
+		return err
+	}
+	allowed, err := s.filter(stream.Context(), "ScanDocuments", req.Table, req.Prefix)
+	if err != nil {
+		return err
+	}
+	req, err = documentRange(d, req)
+	if err != nil {
+		return toStatus(err)
+	}
+	var rows []document.Row
+	return scanRange(req, func(cursor string, limit int) ([]string, string, error) {
+		var next string
+		rows, next, err = d.Scan(cursor, limit)
+		keys := make([]string, 0, len(rows))
+		kept := rows[:0]
+		for _, row := range rows {
+			pk, err := d.PrimaryKeyOf(row)
+			if err != nil {
+				return nil, "", err
+			}
+			if allowed != nil && !allowed(d.KeyText(pk)) {
+				continue
+			}
+			kept = append(kept, row)
+			keys = append(keys, pk)
+		}
+		rows = kept
+		return keys, next, err
+	}, func(i int) error {
+		doc, err := s.marshalDocument(d, rows[i])
+		if err != nil {
+			return err
+		}
+		return stream.Send(doc)
+	})
+}
+
+// documentRange converts the bounds of req, written as text,
+// into primary key strings
+func documentRange(d *document.Document, req *ScanRequest) (*ScanRequest, error) {
+	ret := *req
+	var err error
+	if ret.Start != "" {
+		if ret.Start, err = d.ParseKey(ret.Start); err != nil {
+			return nil, err
+		}
+	}
+	if ret.End != "" {
+		if ret.End, err = d.ParseKey(ret.End); err != nil {
+			return nil, err
+		}
+	}
+	return &ret, nil
+}
+
+// Txn implements KicalServer
+func (s *Server) Txn(ctx context.Context, req *TxnRequest) (*TxnResponse, error) {
+	tbl, err := s.table(ctx, "Txn", req.Table)
+	if err != nil {
+		return nil, err
+	}
+	authorize := func(key string) error {
+		return s.authorize(ctx, "Txn", req.Table, key, security.Write)
+	}
+	switch {
+	case tbl.IsKV():
+		return txnKV(tbl, req.Ops, authorize)
+	case tbl.IsRowDocument():
+		return txnDocument(tbl, req.Ops, authorize)
+	}
+	return nil, toStatus(common.ErrWrongStorageType)
+}
+
+// txnKV applies ops in a session of tbl, authorize checks the key
+// of every op before it is applied
+func txnKV(tbl *kical.Table, ops []*TxnOp, authorize func(key string) error) (*TxnResponse, error) {
+	sess := tbl.KV.NewSession()
+	for i, op := range ops {
+		err := authorize(op.Key)
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+		switch op.Type {
+		case TxnOp_SET:
+			var v interface{}
+			v, err = unmarshalValue(op.Value)
+			if err == nil {
+				err = sess.Set(op.Key, v)
+			}
+		case TxnOp_DELETE:
+			err = sess.Delete(op.Key)
+		default:
+			err = status.Errorf(codes.InvalidArgument, "op %d: %s is not supported on kv tables", i, op.Type)
+		}
+		if err != nil {
+			sess.Close()
+			return nil, toStatus(err)
+		}
+	}
+	return &TxnResponse{}, toStatus(sess.Commit())
+}
+
+// txnDocument applies ops in a session of tbl, authorize checks
+// the key of every op before it is applied
+func txnDocument(tbl *kical.Table, ops []*TxnOp, authorize func(key string) error) (*TxnResponse, error) {
+	d := tbl.Document
+	sess := d.NewSession()
+	resp := &TxnResponse{}
+	for _, op := range ops {
+		var err error
+		var row document.Row
+		var pk string
+		switch op.Type {
+		case TxnOp_INSERT:
+			row, err = unmarshalRow(op.Value)
+			if err == nil {
+				err = authorize(rowKey(d, row))
+			}
+			if err == nil {
+				pk, err = sess.Insert(row)
+				resp.Keys = append(resp.Keys, d.KeyText(pk))
+			}
+		case TxnOp_SET:
+			row, err = unmarshalRow(op.Value)
+			if err == nil {
+				pk, err = d.ParseKey(op.Key)
+			}
+			if err == nil {
+				err = authorize(d.KeyText(pk))
+			}
+			if err == nil {
+				err = sess.Set(pk, row)
+			}
+		case TxnOp_DELETE:
+			pk, err = d.ParseKey(op.Key)
+			if err == nil {
+				err = authorize(d.KeyText(pk))
+			}
+			if err == nil {
+				err = sess.Delete(pk)
+			}
+		}
+		if err != nil {
+			sess.Close()
+			return nil, toStatus(err)
+		}
+	}
+	err := sess.Commit()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return resp, nil
+}
+
+// Watch implements KicalServer
+func (s *Server) Watch(req *WatchRequest, stream Kical_WatchServer) error {
+	if _, err := s.table(stream.Context(), "Watch", req.Table); err != nil {
+		return err
+	}
+	allowed, err := s.filter(stream.Context(), "Watch", req.Table, req.Prefix)
+	if err != nil {
+		return err
+	}
+	w := s.db.Watch(req.Table, req.Prefix)
+	defer w.Close()
+	err = stream.Send(&WatchResponse{})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case events, ok := <-w.C:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind")
+			}
+			resp := &WatchResponse{}
+			for _, e := range events {
+				if allowed != nil && !allowed(e.Key) {
+					continue
+				}
+				ev := &Event{Kv: &KeyValue{Key: e.Key}}
+				if e.Type == common.EventDelete {
+					ev.Type = Event_DELETE
+				} else {
+					rs, err := marshalValue(e.Value)
+					if err != nil {
+						return err
+					}
+					ev.Kv.Value = rs
+				}
+				resp.Events = append(resp.Events, ev)
+			}
+			if len(resp.Events) == 0 {
+				continue
+			}
+			err := stream.Send(resp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rowKey returns the primary key row is stored under in text form,
+// empty when it is generated on insert or invalid
+func rowKey(d *document.Document, row document.Row) string {
+	pk, err := d.PrimaryKeyOf(row)
+	if err != nil {
+		return ""
+	}
+	return d.KeyText(pk)
+}
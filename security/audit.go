@@ -0,0 +1,160 @@
+package security
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/xtlsoft/kical/storage"
+)
+
+// AuditEntry records a denied operation
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// User is empty for unauthenticated operations
+	User       string     `json:"user,omitempty"`
+	Front      string     `json:"front"`
+	Operation  string     `json:"operation"`
+	Table      string     `json:"table,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	Permission Permission `json:"permission"`
+	Reason     string     `json:"reason"`
+	// Count is the number of unauthenticated denials of the front
+	// the entry stands for, zero for a single denial
+	Count int64 `json:"count,omitempty"`
+}
+
+// AnonymousAuditWindow is the period unauthenticated denials are
+// recorded over: the denials of a front in a window are counted
+// in a single entry holding the first of them, so that requests
+// without credentials cannot grow the audit trail without bound
+const AnonymousAuditWindow = time.Minute
+
+// anonymousDenials is the entry of the unauthenticated denials of
+// a front in the current window
+type anonymousDenials struct {
+	window time.Time
+	key    []byte
+	entry  *AuditEntry
+}
+
+// auditKey returns the key of an entry of the audit trail, by
+// time then sequence so that entries of the same instant are kept
+func auditKey(t time.Time, seq uint32) []byte {
+	ret := make([]byte, 13)
+	ret[0] = prefixAudit
+	binary.BigEndian.PutUint64(ret[1:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(ret[9:], seq)
+	return ret
+}
+
+// deny records the denial of op and returns err. A denial which
+// cannot be recorded is still a denial, the failure is added to
+// the error.
+func (s *Store) deny(p *Principal, op *Operation, err error) error {
+	e := &AuditEntry{
+		Time:       time.Now().UTC(),
+		Front:      op.Front,
+		Operation:  op.Name,
+		Table:      op.Table,
+		Key:        op.Key,
+		Permission: op.Permission,
+		Reason:     err.Error(),
+	}
+	var aerr error
+	if p == nil {
+		aerr = s.auditAnonymous(e)
+	} else {
+		e.User = p.User
+		s.auditLock.Lock()
+		s.auditSeq++
+		key := auditKey(e.Time, s.auditSeq)
+		s.auditLock.Unlock()
+		aerr = s.audit(key, e)
+	}
+	if aerr != nil {
+		return fmt.Errorf("%w (audit failed: %v)", err, aerr)
+	}
+	return err
+}
+
+// auditAnonymous counts the unauthenticated denial e in the entry of
+// its front for the current window, the entry is written again
+// with every denial under the lock so that the last count wins
+func (s *Store) auditAnonymous(e *AuditEntry) error {
+	window := e.Time.Truncate(AnonymousAuditWindow)
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	a := s.anonymous[e.Front]
+	if a == nil || !a.window.Equal(window) {
+		if s.anonymous == nil {
+			s.anonymous = make(map[string]*anonymousDenials)
+		}
+		s.auditSeq++
+		a = &anonymousDenials{window: window, key: auditKey(e.Time, s.auditSeq), entry: e}
+		s.anonymous[e.Front] = a
+	}
+	a.entry.Count++
+	return s.audit(a.key, a.entry)
+}
+
+// audit writes the entry e of the audit trail at key
+func (s *Store) audit(key []byte, e *AuditEntry) error {
+	rs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	batch := s.bucket.NewBatch(storage.BatchWriteOnly)
+	err = batch.Set(key, rs, nil)
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
+
+// Audit returns at most limit entries of the audit trail recorded
+// from since on, oldest first, every one of them when limit is
+// not positive
+func (s *Store) Audit(since time.Time, limit int) ([]AuditEntry, error) {
+	var start []byte
+	if since.IsZero() {
+		start = []byte{prefixAudit}
+	} else {
+		start = auditKey(since, 0)
+	}
+	iter := s.bucket.NewIter(start, []byte{prefixAudit + 1})
+	defer iter.Close()
+	var ret []AuditEntry
+	for iter.First(); iter.Valid() && (limit <= 0 || len(ret) < limit); iter.Next() {
+		var e AuditEntry
+		err := json.Unmarshal(iter.Value(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("bad audit entry %x: %v", iter.Key(), err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// PurgeAudit deletes the entries of the audit trail recorded
+// before t
+func (s *Store) PurgeAudit(before time.Time) error {
+	// the unauthenticated denials counted in a purged entry start
+	// a new one
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	for front, a := range s.anonymous {
+		if a.entry.Time.Before(before) {
+			delete(s.anonymous, front)
+		}
+	}
+	batch := s.bucket.NewBatch(storage.BatchWriteOnly)
+	err := batch.DeleteRange([]byte{prefixAudit}, auditKey(before, 0))
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
@@ -0,0 +1,570 @@
+// Package security holds the users, roles and grants of a kical
+// database and authorizes the operations of its server front-ends.
+// Users authenticate with tokens, every denied operation is
+// recorded in an audit trail. The records are stored in the
+// SystemBucket, which no front-end serves.
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtlsoft/kical/storage"
+)
+
+// ErrUnauthenticated is returned for operations without a valid
+// token
+var ErrUnauthenticated = fmt.Errorf("Authentication required")
+
+// ErrDenied is returned for operations the user is not granted
+var ErrDenied = fmt.Errorf("Permission denied")
+
+// ErrNoSuchUser as is
+var ErrNoSuchUser = fmt.Errorf("No such user")
+
+// ErrNoSuchRole as is
+var ErrNoSuchRole = fmt.Errorf("No such role")
+
+// ErrInvalidGrant is returned for grants without a table or with
+// an unknown permission
+var ErrInvalidGrant = fmt.Errorf("Invalid grant")
+
+// ErrInvalidName is returned for empty user and role names
+var ErrInvalidName = fmt.Errorf("Invalid name")
+
+// SystemBucket is the bucket holding the records of the store
+const SystemBucket = "_security"
+
+// AllTables is the table of the grants applying to every table
+const AllTables = "*"
+
+// Key prefixes of the records in the SystemBucket
+const (
+	prefixUser  = 'u'
+	prefixRole  = 'r'
+	prefixToken = 't'
+	prefixAudit = 'a'
+)
+
+// Permission is a level of access to a table, each one includes
+// the ones below it
+type Permission int
+
+// Permissions
+const (
+	Read Permission = iota + 1
+	Write
+	Admin
+)
+
+var permissionNames = map[Permission]string{
+	Read:  "read",
+	Write: "write",
+	Admin: "admin",
+}
+
+// ParsePermission returns the permission named s
+func ParsePermission(s string) (Permission, bool) {
+	for p, name := range permissionNames {
+		if name == s {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+func (p Permission) String() string {
+	if name, ok := permissionNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p Permission) MarshalText() ([]byte, error) {
+	if _, ok := permissionNames[p]; !ok {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGrant, p)
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *Permission) UnmarshalText(text []byte) error {
+	v, ok := ParsePermission(string(text))
+	if !ok {
+		return fmt.Errorf("%w: unknown permission %q", ErrInvalidGrant, text)
+	}
+	*p = v
+	return nil
+}
+
+// Grant gives a permission on the keys of Table starting with
+// Prefix, AllTables for every table. The primary keys of document
+// tables are matched in their text form. Operations on a whole
+// table, such as queries and schema changes, need a grant without
+// prefix.
+type Grant struct {
+	Table      string     `json:"table"`
+	Prefix     string     `json:"prefix,omitempty"`
+	Permission Permission `json:"permission"`
+}
+
+func (g *Grant) check() error {
+	if g.Table == "" {
+		return fmt.Errorf("%w: missing table", ErrInvalidGrant)
+	}
+	if _, ok := permissionNames[g.Permission]; !ok {
+		return fmt.Errorf("%w: unknown permission %v", ErrInvalidGrant, g.Permission)
+	}
+	return nil
+}
+
+// matches reports whether g allows perm on the key of table
+func (g *Grant) matches(table, key string, perm Permission) bool {
+	return (g.Table == AllTables || g.Table == table) &&
+		strings.HasPrefix(key, g.Prefix) && g.Permission >= perm
+}
+
+// Role is a named set of grants
+type Role struct {
+	Name   string  `json:"name"`
+	Grants []Grant `json:"grants,omitempty"`
+}
+
+// User holds the roles a user is granted
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// token is the record of a token, stored by its hash
+type token struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (t *token) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// Principal is an authenticated user, it is checked again at
+// every operation so that revoking its token or its roles takes
+// effect on open connections
+type Principal struct {
+	User  string
+	token string
+}
+
+// Operation is an operation of a front-end to authorize, Key is
+// empty for the operations on a whole table
+type Operation struct {
+	// Front is the front-end serving the operation, such as http
+	Front string
+	// Name describes the operation, such as the command name
+	Name       string
+	Table      string
+	Key        string
+	Permission Permission
+}
+
+// Store holds the users, roles and tokens of a database, they
+// are kept in memory and written through to the SystemBucket
+type Store struct {
+	bucket storage.Storage
+
+	lock   sync.RWMutex
+	users  map[string]*User
+	roles  map[string]*Role
+	tokens map[string]*token
+
+	auditLock sync.Mutex
+	auditSeq  uint32
+	// anonymous maps the fronts to the entry of their current
+	// window of unauthenticated denials
+	anonymous map[string]*anonymousDenials
+}
+
+// NewStore opens the store of the database served by driver
+func NewStore(driver storage.Driver) (*Store, error) {
+	bucket, err := driver.Bucket(SystemBucket)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		bucket: bucket,
+		users:  make(map[string]*User),
+		roles:  make(map[string]*Role),
+		tokens: make(map[string]*token),
+	}
+	err = s.load(prefixUser, func(name string, rs []byte) error {
+		u := &User{}
+		s.users[name] = u
+		return json.Unmarshal(rs, u)
+	})
+	if err == nil {
+		err = s.load(prefixRole, func(name string, rs []byte) error {
+			r := &Role{}
+			s.roles[name] = r
+			return json.Unmarshal(rs, r)
+		})
+	}
+	if err == nil {
+		err = s.load(prefixToken, func(hash string, rs []byte) error {
+			t := &token{}
+			s.tokens[hash] = t
+			return json.Unmarshal(rs, t)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load(prefix byte, fn func(name string, rs []byte) error) error {
+	iter := s.bucket.NewIter([]byte{prefix}, []byte{prefix + 1})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		err := fn(string(iter.Key()[1:]), iter.Value())
+		if err != nil {
+			return fmt.Errorf("bad security record %q: %v", iter.Key(), err)
+		}
+	}
+	return nil
+}
+
+// write stores the records of puts and deletes the keys of dels
+func (s *Store) write(puts map[string]interface{}, dels ...string) error {
+	batch := s.bucket.NewBatch(storage.BatchWriteOnly)
+	for k, v := range puts {
+		rs, err := json.Marshal(v)
+		if err == nil {
+			err = batch.Set([]byte(k), rs, &storage.SetOptions{Synchronized: true})
+		}
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	for _, k := range dels {
+		err := batch.Delete([]byte(k))
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+func recordKey(prefix byte, name string) string {
+	return string(prefix) + name
+}
+
+// SetRole creates or replaces a role
+func (s *Store) SetRole(r *Role) error {
+	if r.Name == "" {
+		return ErrInvalidName
+	}
+	for i := range r.Grants {
+		if err := r.Grants[i].check(); err != nil {
+			return err
+		}
+	}
+	c := &Role{Name: r.Name, Grants: append([]Grant(nil), r.Grants...)}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.write(map[string]interface{}{recordKey(prefixRole, c.Name): c})
+	if err != nil {
+		return err
+	}
+	s.roles[c.Name] = c
+	return nil
+}
+
+// DeleteRole deletes a role, the users holding it lose its grants
+func (s *Store) DeleteRole(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.roles[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrNoSuchRole, name)
+	}
+	err := s.write(nil, recordKey(prefixRole, name))
+	if err != nil {
+		return err
+	}
+	delete(s.roles, name)
+	return nil
+}
+
+// Role returns a copy of the role name
+func (s *Store) Role(name string) (*Role, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r, ok := s.roles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchRole, name)
+	}
+	return &Role{Name: r.Name, Grants: append([]Grant(nil), r.Grants...)}, nil
+}
+
+// Roles returns the names of the roles in order
+func (s *Store) Roles() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make([]string, 0, len(s.roles))
+	for name := range s.roles {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// SetUser creates or replaces a user, its roles must exist
+func (s *Store) SetUser(u *User) error {
+	if u.Name == "" {
+		return ErrInvalidName
+	}
+	c := &User{Name: u.Name, Roles: append([]string(nil), u.Roles...)}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range c.Roles {
+		if _, ok := s.roles[r]; !ok {
+			return fmt.Errorf("%w: %q", ErrNoSuchRole, r)
+		}
+	}
+	err := s.write(map[string]interface{}{recordKey(prefixUser, c.Name): c})
+	if err != nil {
+		return err
+	}
+	s.users[c.Name] = c
+	return nil
+}
+
+// DeleteUser deletes a user and revokes its tokens
+func (s *Store) DeleteUser(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrNoSuchUser, name)
+	}
+	dels := []string{recordKey(prefixUser, name)}
+	for hash, t := range s.tokens {
+		if t.User == name {
+			dels = append(dels, recordKey(prefixToken, hash))
+		}
+	}
+	err := s.write(nil, dels...)
+	if err != nil {
+		return err
+	}
+	for _, k := range dels[1:] {
+		delete(s.tokens, k[1:])
+	}
+	delete(s.users, name)
+	return nil
+}
+
+// User returns a copy of the user name
+func (s *Store) User(name string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchUser, name)
+	}
+	return &User{Name: u.Name, Roles: append([]string(nil), u.Roles...)}, nil
+}
+
+// Users returns the names of the users in order
+func (s *Store) Users() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make([]string, 0, len(s.users))
+	for name := range s.users {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueToken returns a new token authenticating user, valid for
+// ttl or forever when ttl is zero. Only its hash is stored, the
+// token cannot be read back.
+func (s *Store) IssueToken(user string, ttl time.Duration) (string, error) {
+	rs := make([]byte, 32)
+	_, err := rand.Read(rs)
+	if err != nil {
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(rs)
+	t := &token{User: user}
+	if ttl > 0 {
+		t.Expires = time.Now().Add(ttl).UTC()
+	}
+	hash := hashToken(tok)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.users[user]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrNoSuchUser, user)
+	}
+	err = s.write(map[string]interface{}{recordKey(prefixToken, hash): t})
+	if err != nil {
+		return "", err
+	}
+	s.tokens[hash] = t
+	return tok, nil
+}
+
+// RevokeToken makes tok invalid
+func (s *Store) RevokeToken(tok string) error {
+	hash := hashToken(tok)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.tokens[hash]; !ok {
+		return ErrUnauthenticated
+	}
+	err := s.write(nil, recordKey(prefixToken, hash))
+	if err != nil {
+		return err
+	}
+	delete(s.tokens, hash)
+	return nil
+}
+
+// Authenticate returns the user tok authenticates
+func (s *Store) Authenticate(tok string) (*Principal, error) {
+	if tok == "" {
+		return nil, ErrUnauthenticated
+	}
+	hash := hashToken(tok)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t, ok := s.tokens[hash]
+	if !ok || t.expired(time.Now()) {
+		return nil, ErrUnauthenticated
+	}
+	if _, ok := s.users[t.User]; !ok {
+		return nil, ErrUnauthenticated
+	}
+	return &Principal{User: t.User, token: hash}, nil
+}
+
+// grants returns the grants of p, or ErrUnauthenticated when its
+// token or user is gone, s is read locked
+func (s *Store) grants(p *Principal) ([]Grant, error) {
+	if p == nil {
+		return nil, ErrUnauthenticated
+	}
+	t, ok := s.tokens[p.token]
+	if !ok || t.User != p.User || t.expired(time.Now()) {
+		return nil, ErrUnauthenticated
+	}
+	u, ok := s.users[p.User]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	var ret []Grant
+	for _, name := range u.Roles {
+		if r, ok := s.roles[name]; ok {
+			ret = append(ret, r.Grants...)
+		}
+	}
+	return ret, nil
+}
+
+// Allowed reports whether p may access the key of table with
+// perm, without recording anything
+func (s *Store) Allowed(p *Principal, table, key string, perm Permission) bool {
+	if table == SystemBucket {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	grants, err := s.grants(p)
+	if err != nil {
+		return false
+	}
+	for i := range grants {
+		if grants[i].matches(table, key, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible reports whether p may read any key of table, so that
+// listings only show the tables a user can use
+func (s *Store) Visible(p *Principal, table string) bool {
+	if table == SystemBucket {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	grants, err := s.grants(p)
+	if err != nil {
+		return false
+	}
+	for _, g := range grants {
+		if g.Table == AllTables || g.Table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns nil when p may run op, the denials are
+// recorded in the audit trail. A nil principal is unauthenticated.
+func (s *Store) Authorize(p *Principal, op *Operation) error {
+	err := s.check(p, op)
+	if err != nil {
+		return s.deny(p, op, err)
+	}
+	return nil
+}
+
+func (s *Store) check(p *Principal, op *Operation) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	grants, err := s.grants(p)
+	if err != nil {
+		return err
+	}
+	if op.Table != SystemBucket {
+		for i := range grants {
+			if grants[i].matches(op.Table, op.Key, op.Permission) {
+				return nil
+			}
+		}
+	}
+	return ErrDenied
+}
+
+// Filter authorizes op on the keys starting with op.Key, as a scan
+// or a watch does. It returns a nil filter when p may access them
+// all, otherwise a filter of the keys p may access as long as it
+// may access some keys of the table; if not op is denied.
+func (s *Store) Filter(p *Principal, op *Operation) (func(key string) bool, error) {
+	err := s.check(p, op)
+	if err == nil {
+		return nil, nil
+	}
+	if err == ErrDenied && s.Visible(p, op.Table) {
+		return func(key string) bool {
+			return s.Allowed(p, op.Table, key, op.Permission)
+		}, nil
+	}
+	return nil, s.deny(p, op, err)
+}
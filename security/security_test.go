@@ -0,0 +1,188 @@
+package security_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical/security"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func op(table, key string, perm security.Permission) *security.Operation {
+	return &security.Operation{Front: "test", Name: "op", Table: table, Key: key, Permission: perm}
+}
+
+func TestStore(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer drv.Close()
+	s, err := security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetUser(&security.User{Name: "alice", Roles: []string{"tenant"}}); !errors.Is(err, security.ErrNoSuchRole) {
+		t.Fatalf("expected ErrNoSuchRole, got %v", err)
+	}
+	if err = s.SetRole(&security.Role{Name: "bad", Grants: []security.Grant{{Table: "reg"}}}); !errors.Is(err, security.ErrInvalidGrant) {
+		t.Fatalf("expected ErrInvalidGrant, got %v", err)
+	}
+	for _, r := range []*security.Role{
+		{Name: "tenant", Grants: []security.Grant{
+			{Table: "reg", Prefix: "acme/", Permission: security.Write},
+			{Table: "docs", Permission: security.Read},
+		}},
+		{Name: "ops", Grants: []security.Grant{{Table: security.AllTables, Permission: security.Admin}}},
+	} {
+		if err = s.SetRole(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, u := range []*security.User{{Name: "alice", Roles: []string{"tenant"}}, {Name: "root", Roles: []string{"ops"}}} {
+		if err = s.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.IssueToken("bob", 0); !errors.Is(err, security.ErrNoSuchUser) {
+		t.Fatalf("expected ErrNoSuchUser, got %v", err)
+	}
+	aliceToken, err := s.IssueToken("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootToken, err := s.IssueToken("root", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records survive a reopen
+	s, err = security.NewStore(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Users(); len(got) != 2 || got[0] != "alice" {
+		t.Fatalf("users %v", got)
+	}
+	alice, err := s.Authenticate(aliceToken)
+	if err != nil || alice.User != "alice" {
+		t.Fatalf("got %v, %v", alice, err)
+	}
+	root, err := s.Authenticate(rootToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Authenticate("forged"); err != security.ErrUnauthenticated {
+		t.Fatalf("expected ErrUnauthenticated, got %v", err)
+	}
+
+	for _, c := range []struct {
+		p      *security.Principal
+		op     *security.Operation
+		denied error
+	}{
+		{alice, op("reg", "acme/svc", security.Write), nil},
+		{alice, op("reg", "acme/svc", security.Read), nil},
+		{alice, op("reg", "globex/svc", security.Read), security.ErrDenied},
+		{alice, op("reg", "", security.Read), security.ErrDenied},
+		{alice, op("reg", "acme/", security.Admin), security.ErrDenied},
+		{alice, op("docs", "", security.Read), nil},
+		{alice, op("docs", "1", security.Write), security.ErrDenied},
+		{root, op("anything", "", security.Admin), nil},
+		{root, op(security.SystemBucket, "u", security.Read), security.ErrDenied},
+		{nil, op("docs", "", security.Read), security.ErrUnauthenticated},
+	} {
+		if err := s.Authorize(c.p, c.op); !errors.Is(err, c.denied) || (c.denied == nil && err != nil) {
+			t.Fatalf("%+v: got %v, want %v", c.op, err, c.denied)
+		}
+	}
+
+	allowed, err := s.Filter(alice, op("reg", "", security.Read))
+	if err != nil || allowed == nil || !allowed("acme/a") || allowed("globex/a") {
+		t.Fatalf("bad filter: %v", err)
+	}
+	if allowed, err = s.Filter(alice, op("reg", "acme/", security.Read)); err != nil || allowed != nil {
+		t.Fatalf("expected no filter, got %v", err)
+	}
+	if _, err = s.Filter(alice, op("secret", "", security.Read)); !errors.Is(err, security.ErrDenied) {
+		t.Fatalf("expected ErrDenied, got %v", err)
+	}
+	if s.Visible(alice, "secret") || !s.Visible(alice, "reg") || s.Visible(root, security.SystemBucket) {
+		t.Fatal("bad visibility")
+	}
+
+	// every denial is in the audit trail
+	entries, err := s.Audit(time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("got %d audit entries: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.User != "alice" || e.Table != "reg" || e.Key != "globex/svc" || e.Permission != security.Read || e.Front != "test" {
+		t.Fatalf("bad entry %+v", e)
+	}
+	if e := entries[5]; e.User != "" || e.Reason != security.ErrUnauthenticated.Error() {
+		t.Fatalf("bad entry %+v", e)
+	}
+	if entries, _ = s.Audit(time.Time{}, 2); len(entries) != 2 {
+		t.Fatalf("limit ignored, got %d entries", len(entries))
+	}
+	if err = s.PurgeAudit(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = s.Audit(time.Time{}, 0); len(entries) != 0 {
+		t.Fatalf("got %d entries after purge", len(entries))
+	}
+
+	// unauthenticated denials share an entry per front and window
+	for i := 0; i < 100; i++ {
+		if err = s.Authorize(nil, op("docs", fmt.Sprint(i), security.Read)); !errors.Is(err, security.ErrUnauthenticated) {
+			t.Fatalf("expected ErrUnauthenticated, got %v", err)
+		}
+	}
+	if entries, err = s.Audit(time.Time{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	for _, e := range entries {
+		count += e.Count
+	}
+	// the denials may straddle two windows
+	if len(entries) > 2 || count != 100 || entries[0].Key != "0" {
+		t.Fatalf("got %d entries for %d denials: %+v", len(entries), count, entries)
+	}
+	if err = s.PurgeAudit(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// revoking applies to authenticated principals
+	if err = s.SetUser(&security.User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Authorize(alice, op("docs", "", security.Read)); !errors.Is(err, security.ErrDenied) {
+		t.Fatalf("expected ErrDenied, got %v", err)
+	}
+	if err = s.RevokeToken(rootToken); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Authorize(root, op("docs", "", security.Read)); !errors.Is(err, security.ErrUnauthenticated) {
+		t.Fatalf("expected ErrUnauthenticated, got %v", err)
+	}
+	if err = s.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Authenticate(aliceToken); err != security.ErrUnauthenticated {
+		t.Fatalf("expected the token of a deleted user to fail, got %v", err)
+	}
+	if err = s.SetUser(&security.User{Name: "temp"}); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := s.IssueToken("temp", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err = s.Authenticate(tok); err != security.ErrUnauthenticated {
+		t.Fatalf("expected an expired token, got %v", err)
+	}
+}
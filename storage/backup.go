@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrNotSupported is returned when a storage lacks an optional feature
+var ErrNotSupported = fmt.Errorf("Operation not supported by the storage")
+
+// backupScratchPrefix prefixes the directories next to a bucket
+// where the checkpoints of backups are staged before they are
+// copied out, after a dot and the name of the bucket
+const backupScratchPrefix = "kical-backup-"
+
+// backupSeq numbers the scratch directories of the buckets which
+// are not on the local file system
+var backupSeq uint64
+
+// Checkpointer is implemented by storages able to write consistent
+// on-disk copies of themselves while serving writes
+type Checkpointer interface {
+	// Checkpoint writes a consistent copy into dir, which must
+	// not exist yet
+	Checkpoint(dir string) error
+	// Backup updates the copy in dir to the current state, only
+	// copying the files which are not in dir already
+	Backup(dir string) (*BackupStats, error)
+}
+
+// BackupStats describes the work done by a backup
+type BackupStats struct {
+	FilesCopied int
+	FilesReused int
+	FilesPruned int
+	BytesCopied int64
+}
+
+// Add adds the counters of o to s
+func (s *BackupStats) Add(o *BackupStats) {
+	s.FilesCopied += o.FilesCopied
+	s.FilesReused += o.FilesReused
+	s.FilesPruned += o.FilesPruned
+	s.BytesCopied += o.BytesCopied
+}
+
+// Checkpoint writes a consistent copy of the bucket into dir, hard
+// links are used when the bucket lives on the local file system
+func (pds *PebbleDriverStorage) Checkpoint(dir string) error {
+	if pds.fs == vfs.Default {
+		return pds.checkpoint(dir)
+	}
+	_, err := os.Stat(dir)
+	if err == nil {
+		return &os.PathError{Op: "checkpoint", Path: dir, Err: os.ErrExist}
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	_, err = pds.Backup(dir)
+	return err
+}
+
+// Backup brings the copy of the bucket in dir up to date. A pebble
+// checkpoint is staged next to the bucket, where it only costs hard
+// links, then the new copy is written next to dir and swapped with
+// it, so that an interrupted backup leaves the previous copy whole.
+// Sstables are immutable so the ones already in dir are linked
+// into the new copy instead of copied, which makes repeated backups
+// into the same dir incremental.
+func (pds *PebbleDriverStorage) Backup(dir string) (*BackupStats, error) {
+	scratch, err := pds.scratchDir()
+	if err != nil {
+		return nil, err
+	}
+	defer pds.fs.RemoveAll(scratch)
+	checkpoint := pds.fs.PathJoin(scratch, "checkpoint")
+	err = pds.checkpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	names, err := pds.fs.List(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(dir)
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	stage, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".new-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stage)
+	stats := &BackupStats{}
+	keep := make(map[string]bool)
+	for _, name := range names {
+		keep[name] = true
+		src := pds.fs.PathJoin(checkpoint, name)
+		dst := filepath.Join(stage, name)
+		if strings.HasSuffix(name, ".sst") {
+			st, err := pds.fs.Stat(src)
+			if err != nil {
+				return nil, err
+			}
+			old := filepath.Join(dir, name)
+			if ot, err := os.Stat(old); err == nil && ot.Size() == st.Size() && os.Link(old, dst) == nil {
+				stats.FilesReused++
+				continue
+			}
+		}
+		n, err := copyFile(pds.fs, src, dst)
+		if err != nil {
+			return nil, err
+		}
+		stats.FilesCopied++
+		stats.BytesCopied += n
+	}
+	err = syncDir(stage)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && !keep[info.Name()] {
+			stats.FilesPruned++
+		}
+	}
+	return stats, swapDir(stage, dir)
+}
+
+// checkpoint syncs the WAL before taking a pebble checkpoint, which
+// only copies the part of the WAL already written out and would
+// miss the batches committed without a sync, a read-only bucket
+// has none
+func (pds *PebbleDriverStorage) checkpoint(dir string) error {
+	err := pds.db.LogData(nil, pebble.Sync)
+	if err != nil && err != pebble.ErrReadOnly {
+		return err
+	}
+	return pds.db.Checkpoint(dir)
+}
+
+// scratchDir creates a directory of its own next to the bucket, on
+// the same file system for the hard links but out of the way of
+// the copies of the bucket if it is left behind
+func (pds *PebbleDriverStorage) scratchDir() (string, error) {
+	prefix := scratchPrefix(pds.dirname)
+	if pds.fs == vfs.Default {
+		return ioutil.TempDir(filepath.Dir(pds.dirname), prefix)
+	}
+	dir := pds.fs.PathJoin(filepath.Dir(pds.dirname), fmt.Sprintf("%s%d", prefix, atomic.AddUint64(&backupSeq, 1)))
+	return dir, pds.fs.MkdirAll(dir, 0755)
+}
+
+func scratchPrefix(dirname string) string {
+	return "." + filepath.Base(dirname) + "." + backupScratchPrefix
+}
+
+// sweepScratch removes the scratch directories left by the backups
+// of the bucket in dirname which were killed, including the ones
+// staged inside the bucket by older versions. The bucket is locked
+// by pebble so no backup of it is running. It is best effort, a
+// directory which cannot be removed is left for the next time.
+func sweepScratch(dirname string) {
+	parent := filepath.Dir(dirname)
+	prefix := scratchPrefix(dirname)
+	infos, _ := ioutil.ReadDir(parent)
+	for _, info := range infos {
+		dir := filepath.Join(parent, info.Name())
+		if info.IsDir() && strings.HasPrefix(info.Name(), prefix) && !isPebbleDir(dir) {
+			os.RemoveAll(dir)
+		}
+	}
+	infos, _ = ioutil.ReadDir(dirname)
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), backupScratchPrefix) {
+			os.RemoveAll(filepath.Join(dirname, info.Name()))
+		}
+	}
+}
+
+// swapDir replaces dir with the complete copy in stage, dir is
+// only missing between two renames. The staged and replaced copies
+// are hidden next to dir, RestoreBackup skips them.
+func swapDir(stage, dir string) error {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.Rename(stage, dir)
+		if err == nil {
+			err = syncDir(filepath.Dir(dir))
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".old-")
+	if err != nil {
+		return err
+	}
+	err = os.Remove(old)
+	if err == nil {
+		err = os.Rename(dir, old)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(stage, dir)
+	if err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	err = syncDir(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// copyFile copies src of fs to the local file dst through a
+// temporary file so that dst is never seen half written
+func copyFile(fs vfs.FS, src, dst string) (int64, error) {
+	in, err := fs.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, os.Rename(tmp, dst)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RestoreBackup copies the backup or checkpoint in src to the base
+// directory dst, which must not exist, so that a PebbleDriver can
+// be opened upon it
+func RestoreBackup(src, dst string) error {
+	_, err := os.Stat(dst)
+	if err == nil {
+		return &os.PathError{Op: "restore", Path: dst, Err: os.ErrExist}
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	buckets, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if !bucket.IsDir() || strings.HasPrefix(bucket.Name(), ".") || !isPebbleDir(filepath.Join(src, bucket.Name())) {
+			continue
+		}
+		bdir := filepath.Join(dst, bucket.Name())
+		err = os.MkdirAll(bdir, 0755)
+		if err != nil {
+			return err
+		}
+		files, err := ioutil.ReadDir(filepath.Join(src, bucket.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			_, err = copyFile(vfs.Default, filepath.Join(src, bucket.Name(), f.Name()), filepath.Join(bdir, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		err = syncDir(bdir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -142,8 +146,22 @@ func NewPebbleDriver(conf *PebbleDriverConfigure) *PebbleDriver {
 	}
 }
 
-// Bucket returns a new bucket
+// Bucket returns the bucket name, creating it when missing
 func (pd *PebbleDriver) Bucket(name string) (Storage, error) {
+	return pd.open(name, true)
+}
+
+// OpenBucket returns the existing bucket name, ErrNoSuchBucket when
+// it is missing. In memory buckets only exist once created.
+func (pd *PebbleDriver) OpenBucket(name string) (Storage, error) {
+	return pd.open(name, false)
+}
+
+func (pd *PebbleDriver) open(name string, create bool) (Storage, error) {
+	err := CheckBucketName(name)
+	if err != nil {
+		return nil, err
+	}
 	pd.dbsLock.Lock()
 	defer pd.dbsLock.Unlock()
 	var pds *PebbleDriverStorage
@@ -152,11 +170,14 @@ func (pd *PebbleDriver) Bucket(name string) (Storage, error) {
 		return pds, nil
 	}
 	dirname := filepath.Join(pd.conf.BaseDirectory, name)
+	if !create && (pd.conf.UseMemory || !isPebbleDir(dirname)) {
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchBucket, name)
+	}
 	opts := &pebble.Options{
 		BytesPerSync:                pd.conf.BytesPerSync,
 		DisableWAL:                  pd.conf.DisableWAL,
 		ErrorIfExists:               pd.conf.ErrorIfExists,
-		ErrorIfNotExists:            pd.conf.ErrorIfNotExists,
+		ErrorIfNotExists:            pd.conf.ErrorIfNotExists || !create,
 		L0CompactionThreshold:       pd.conf.L0CompactionThreshold,
 		L0StopWritesThreshold:       pd.conf.L0StopWritesThreshold,
 		LBaseMaxBytes:               pd.conf.LBaseMaxBytes,
@@ -173,18 +194,73 @@ func (pd *PebbleDriver) Bucket(name string) (Storage, error) {
 	if pd.conf.UseMemory {
 		opts.FS = vfs.NewMem()
 	}
-	db, err := pebble.Open(dirname, opts)
+	pds, err = NewPebbleDriverStorage(dirname, opts)
 	if err != nil {
 		return nil, err
 	}
-	pds = &PebbleDriverStorage{db: db}
 	pd.dbs[name] = pds
 	return pds, nil
 }
 
+// isPebbleDir reports whether dir holds a pebble database, which
+// always has a CURRENT file
+func isPebbleDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "CURRENT"))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Buckets returns the names of all buckets known to the driver,
+// including the ones only present on disk. Only the directories
+// holding a pebble database are buckets, others are left alone.
+func (pd *PebbleDriver) Buckets() ([]string, error) {
+	pd.dbsLock.Lock()
+	defer pd.dbsLock.Unlock()
+	seen := make(map[string]bool)
+	for name := range pd.dbs {
+		seen[name] = true
+	}
+	if !pd.conf.UseMemory {
+		infos, err := ioutil.ReadDir(pd.conf.BaseDirectory)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() && CheckBucketName(info.Name()) == nil && isPebbleDir(filepath.Join(pd.conf.BaseDirectory, info.Name())) {
+				seen[info.Name()] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for name := range seen {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Close closes every opened bucket
+func (pd *PebbleDriver) Close() error {
+	pd.dbsLock.Lock()
+	defer pd.dbsLock.Unlock()
+	var ret error
+	for name, pds := range pd.dbs {
+		err := pds.db.Close()
+		if err != nil && ret == nil {
+			ret = err
+		}
+		delete(pd.dbs, name)
+	}
+	return ret
+}
+
 // PebbleDriverStorage is the driver for pebble storage engine
 type PebbleDriverStorage struct {
-	db *pebble.DB
+	db      *pebble.DB
+	dirname string
+	fs      vfs.FS
+	// lock is held for reading by writes and for writing by
+	// Exclusive
+	lock sync.RWMutex
 }
 
 // NewPebbleDriverStorage fatories a new PebbleDriverStorage instance
@@ -193,8 +269,17 @@ func NewPebbleDriverStorage(dirname string, opts *pebble.Options) (*PebbleDriver
 	if err != nil {
 		return nil, err
 	}
+	fs := opts.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+	if fs == vfs.Default && !opts.ReadOnly {
+		sweepScratch(dirname)
+	}
 	return &PebbleDriverStorage{
-		db: db,
+		db:      db,
+		dirname: dirname,
+		fs:      fs,
 	}, nil
 }
 
@@ -212,8 +297,9 @@ func (pds *PebbleDriverStorage) Get(key []byte) ([]byte, error) {
 		}
 		return nil, err
 	}
+	ret := append([]byte(nil), dat...)
 	closer.Close()
-	return dat, nil
+	return ret, nil
 }
 
 // Set puts an entry to the DB
@@ -221,6 +307,8 @@ func (pds *PebbleDriverStorage) Set(key []byte, value []byte, options *SetOption
 	if options == nil {
 		options = &SetOptions{}
 	}
+	pds.lock.RLock()
+	defer pds.lock.RUnlock()
 	return pds.db.Set(key, value, &pebble.WriteOptions{
 		Sync: options.Synchronized,
 	})
@@ -228,11 +316,15 @@ func (pds *PebbleDriverStorage) Set(key []byte, value []byte, options *SetOption
 
 // Delete deletes an entry in the DB
 func (pds *PebbleDriverStorage) Delete(key []byte) error {
+	pds.lock.RLock()
+	defer pds.lock.RUnlock()
 	return pds.db.Delete(key, nil)
 }
 
 // DeleteRange deletes a set of entries in the DB
 func (pds *PebbleDriverStorage) DeleteRange(start []byte, end []byte) error {
+	pds.lock.RLock()
+	defer pds.lock.RUnlock()
 	return pds.db.DeleteRange(start, end, nil)
 }
 
@@ -253,36 +345,60 @@ func (pds *PebbleDriverStorage) NewBatch(typ BatchType) Batch {
 	case BatchWriteOnly:
 		return &PebbleDriverBatch{
 			batch: pds.db.NewBatch(),
+			lock:  &pds.lock,
 		}
 	case BatchReadWrite:
 		return &PebbleDriverBatch{
 			batch: pds.db.NewIndexedBatch(),
+			lock:  &pds.lock,
 		}
 	default:
 		panic("Unknown argument when calling NewBatch()")
 	}
 }
 
+// Exclusive runs fn while the other writes of the storage wait
+func (pds *PebbleDriverStorage) Exclusive(fn func(batch Batch) error) error {
+	pds.lock.Lock()
+	defer pds.lock.Unlock()
+	batch := &PebbleDriverBatch{batch: pds.db.NewIndexedBatch()}
+	err := fn(batch)
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
+
 // PebbleDriverBatch as is
 type PebbleDriverBatch struct {
 	batch *pebble.Batch
+	sync  bool
+	// lock is the lock of the storage, nil for the batch of
+	// Exclusive which holds it already
+	lock *sync.RWMutex
 }
 
 // Get gets an entry from the DB
 func (pdb *PebbleDriverBatch) Get(key []byte) ([]byte, error) {
 	dat, closer, err := pdb.batch.Get(key)
-	defer closer.Close()
 	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, ErrNoSuchKey
+		}
 		return nil, err
 	}
-	return dat, nil
+	ret := append([]byte(nil), dat...)
+	closer.Close()
+	return ret, nil
 }
 
 // Set puts an entry to the DB
 func (pdb *PebbleDriverBatch) Set(key []byte, value []byte, options *SetOptions) error {
-	return pdb.batch.Set(key, value, &pebble.WriteOptions{
-		Sync: options.Synchronized,
-	})
+	if options != nil && options.Synchronized {
+		pdb.sync = true
+	}
+	return pdb.batch.Set(key, value, nil)
 }
 
 // Delete deletes an entry in the DB
@@ -306,9 +422,23 @@ func (pdb *PebbleDriverBatch) NewIter(start []byte, stop []byte) Iterator {
 	}
 }
 
-// Commit commits a batch
+// Commit commits a batch, the commit is synchronized if any
+// of the sets in the batch asked for it
 func (pdb *PebbleDriverBatch) Commit() error {
-	return pdb.Commit()
+	opts := pebble.NoSync
+	if pdb.sync {
+		opts = pebble.Sync
+	}
+	if pdb.lock != nil {
+		pdb.lock.RLock()
+		defer pdb.lock.RUnlock()
+	}
+	return pdb.batch.Commit(opts)
+}
+
+// Close releases the batch without committing it
+func (pdb *PebbleDriverBatch) Close() error {
+	return pdb.batch.Close()
 }
 
 // PebbleDriverIterator as is
@@ -360,3 +490,8 @@ func (pdi *PebbleDriverIterator) SeekGE(m []byte) bool {
 func (pdi *PebbleDriverIterator) SeekLT(m []byte) bool {
 	return pdi.it.SeekLT(m)
 }
+
+// Close releases the iterator
+func (pdi *PebbleDriverIterator) Close() error {
+	return pdi.it.Close()
+}
@@ -0,0 +1,981 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownKeyVersion is returned when a value was encrypted with
+// a key the provider does not have
+var ErrUnknownKeyVersion = fmt.Errorf("Unknown encryption key version")
+
+// ErrDecrypt is returned when a value cannot be authenticated, it
+// was altered or moved to another key
+var ErrDecrypt = fmt.Errorf("Value failed to decrypt")
+
+// KeyProvider supplies the keys of an EncryptedDriver, keys are
+// 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256. Keys
+// must not change once handed out under a version.
+type KeyProvider interface {
+	// Current returns the version new values are encrypted with
+	Current() (uint32, error)
+	// Key returns the key of a version
+	Key(version uint32) ([]byte, error)
+	// Versions returns the versions of every key still readable
+	Versions() ([]uint32, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory, the one
+// with the highest version is the current one, the zero value
+// holds no key
+type StaticKeys struct {
+	lock    sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewStaticKeys creates a provider whose first key, version 1, is
+// key
+func NewStaticKeys(key []byte) (*StaticKeys, error) {
+	k := &StaticKeys{keys: make(map[uint32][]byte)}
+	_, err := k.Add(key)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add adds a key and makes it the current one, it returns the
+// version of the key
+func (k *StaticKeys) Add(key []byte) (uint32, error) {
+	_, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[uint32][]byte)
+	}
+	k.current++
+	k.keys[k.current] = append([]byte(nil), key...)
+	return k.current, nil
+}
+
+// SetKey adds the key of an explicit version, which becomes the
+// current one when it is the highest, a version keeps its key once
+// set
+func (k *StaticKeys) SetKey(version uint32, key []byte) error {
+	if version == 0 {
+		return fmt.Errorf("Key version 0 is invalid")
+	}
+	_, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[uint32][]byte)
+	}
+	if old, ok := k.keys[version]; ok && !bytes.Equal(old, key) {
+		return fmt.Errorf("Key version %d is already set", version)
+	}
+	k.keys[version] = append([]byte(nil), key...)
+	if version > k.current {
+		k.current = version
+	}
+	return nil
+}
+
+// Remove forgets the key of a version, values still encrypted
+// with it become unreadable so it is only removed once a rotation
+// is done
+func (k *StaticKeys) Remove(version uint32) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if version == k.current {
+		return fmt.Errorf("Cannot remove the current key")
+	}
+	delete(k.keys, version)
+	return nil
+}
+
+// Current as is
+func (k *StaticKeys) Current() (uint32, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current, nil
+}
+
+// Key as is
+func (k *StaticKeys) Key(version uint32) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	return key, nil
+}
+
+// Versions returns the versions newest first
+func (k *StaticKeys) Versions() ([]uint32, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	ret := make([]uint32, 0, len(k.keys))
+	for v := range k.keys {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] > ret[j] })
+	return ret, nil
+}
+
+// DefaultRotationChunk is the number of entries a rotation
+// re-encrypts per batch
+const DefaultRotationChunk = 256
+
+// EncryptedDriverConfigure is the configure structure of an
+// encrypted driver
+type EncryptedDriverConfigure struct {
+	Keys KeyProvider
+	// Buckets lists the encrypted buckets, all of them when empty
+	Buckets []string
+	// KeyBuckets lists the buckets whose keys are encrypted too.
+	// Keys are encrypted deterministically so that lookups still
+	// work, but their order is lost: iterators over these buckets
+	// decrypt and sort the whole bucket, which only suits small
+	// tables read by key such as credentials.
+	KeyBuckets []string
+	// RotationChunk is the number of entries a rotation
+	// re-encrypts per batch, DefaultRotationChunk when not positive
+	RotationChunk int
+}
+
+// EncryptedDriver wraps a driver, encrypting the values of its
+// buckets with AES-GCM. Each value is stored as the version of its
+// key, a random nonce and the sealed value, authenticated along
+// with the bucket name and the entry key so that values cannot be
+// moved around.
+type EncryptedDriver struct {
+	drv     Driver
+	conf    *EncryptedDriverConfigure
+	all     bool
+	buckets map[string]bool
+	keyed   map[string]bool
+
+	lock    sync.Mutex
+	opened  map[string]*EncryptedStorage
+	ciphers map[uint32]*keyCiphers
+}
+
+// NewEncryptedDriver creates an encrypted driver over drv
+func NewEncryptedDriver(drv Driver, conf *EncryptedDriverConfigure) *EncryptedDriver {
+	d := &EncryptedDriver{
+		drv:     drv,
+		conf:    conf,
+		all:     len(conf.Buckets) == 0,
+		buckets: make(map[string]bool),
+		keyed:   make(map[string]bool),
+		opened:  make(map[string]*EncryptedStorage),
+		ciphers: make(map[uint32]*keyCiphers),
+	}
+	for _, name := range conf.Buckets {
+		d.buckets[name] = true
+	}
+	for _, name := range conf.KeyBuckets {
+		d.buckets[name] = true
+		d.keyed[name] = true
+	}
+	return d
+}
+
+// Bucket returns the bucket name, encrypted when configured so
+func (d *EncryptedDriver) Bucket(name string) (Storage, error) {
+	s, err := d.drv.Bucket(name)
+	return d.wrap(name, s, err)
+}
+
+// OpenBucket returns the existing bucket name, encrypted when
+// configured so
+func (d *EncryptedDriver) OpenBucket(name string) (Storage, error) {
+	s, err := d.drv.OpenBucket(name)
+	return d.wrap(name, s, err)
+}
+
+// wrap returns the bucket name opened as s, encrypted when
+// configured so
+func (d *EncryptedDriver) wrap(name string, s Storage, err error) (Storage, error) {
+	if err != nil || !d.all && !d.buckets[name] {
+		return s, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	es, ok := d.opened[name]
+	if !ok || es.s != s {
+		es = &EncryptedStorage{s: s, d: d, bucket: name, keyed: d.keyed[name]}
+		d.opened[name] = es
+	}
+	return es, nil
+}
+
+// Buckets as is
+func (d *EncryptedDriver) Buckets() ([]string, error) {
+	return d.drv.Buckets()
+}
+
+// Close closes the wrapped driver when it can be closed
+func (d *EncryptedDriver) Close() error {
+	if c, ok := d.drv.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// keyCiphers holds the ciphers derived from a key: one for values,
+// one for keys and the MAC key giving the nonces of keys
+type keyCiphers struct {
+	values cipher.AEAD
+	keys   cipher.AEAD
+	mac    []byte
+}
+
+// subkey derives a key of the size of key for the purpose label
+func subkey(key []byte, label string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	return h.Sum(nil)[:len(key)]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (d *EncryptedDriver) ciphersOf(version uint32) (*keyCiphers, error) {
+	d.lock.Lock()
+	kc, ok := d.ciphers[version]
+	d.lock.Unlock()
+	if ok {
+		return kc, nil
+	}
+	key, err := d.conf.Keys.Key(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, aes.KeySizeError(len(key))
+	}
+	kc = &keyCiphers{mac: subkey(key, "kical key nonce")}
+	kc.values, err = newGCM(subkey(key, "kical value"))
+	if err != nil {
+		return nil, err
+	}
+	kc.keys, err = newGCM(subkey(key, "kical key"))
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	d.ciphers[version] = kc
+	d.lock.Unlock()
+	return kc, nil
+}
+
+// EncryptedStorage is a bucket of an EncryptedDriver
+type EncryptedStorage struct {
+	s      Storage
+	d      *EncryptedDriver
+	bucket string
+	keyed  bool
+	// lock is held for reading by commits and for writing by
+	// rotations, so that a rotation never overwrites a newer value
+	lock sync.RWMutex
+}
+
+// encryptionOverhead is the size of the version and the nonce
+// before a sealed value and of the tag after it
+const encryptionOverhead = 4 + 12 + 16
+
+// additionalData binds a value to its bucket and key
+func (es *EncryptedStorage) additionalData(key []byte) []byte {
+	ret := make([]byte, 0, len(es.bucket)+1+len(key))
+	ret = append(ret, es.bucket...)
+	ret = append(ret, 0)
+	return append(ret, key...)
+}
+
+// seal encrypts the value of key with the key of version
+func (es *EncryptedStorage) seal(version uint32, key []byte, value []byte) ([]byte, error) {
+	kc, err := es.d.ciphersOf(version)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 16, encryptionOverhead+len(value))
+	binary.BigEndian.PutUint32(ret, version)
+	_, err = io.ReadFull(rand.Reader, ret[4:16])
+	if err != nil {
+		return nil, err
+	}
+	return kc.values.Seal(ret, ret[4:16], value, es.additionalData(key)), nil
+}
+
+// open decrypts the stored value of key
+func (es *EncryptedStorage) open(key []byte, raw []byte) ([]byte, error) {
+	if len(raw) < encryptionOverhead {
+		return nil, ErrDecrypt
+	}
+	kc, err := es.d.ciphersOf(binary.BigEndian.Uint32(raw))
+	if err != nil {
+		return nil, err
+	}
+	ret, err := kc.values.Open(nil, raw[4:16], raw[16:], es.additionalData(key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return ret, nil
+}
+
+// sealKey encrypts a key deterministically: the nonce is a MAC of
+// the key, so equal keys give equal ciphertexts
+func (es *EncryptedStorage) sealKey(version uint32, key []byte) ([]byte, error) {
+	kc, err := es.d.ciphersOf(version)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, kc.mac)
+	h.Write([]byte(es.bucket))
+	h.Write([]byte{0})
+	h.Write(key)
+	ret := make([]byte, 4, encryptionOverhead+len(key))
+	binary.BigEndian.PutUint32(ret, version)
+	ret = append(ret, h.Sum(nil)[:12]...)
+	return kc.keys.Seal(ret, ret[4:16], key, []byte(es.bucket)), nil
+}
+
+// openKey decrypts a stored key
+func (es *EncryptedStorage) openKey(raw []byte) ([]byte, error) {
+	if len(raw) < encryptionOverhead {
+		return nil, ErrDecrypt
+	}
+	kc, err := es.d.ciphersOf(binary.BigEndian.Uint32(raw))
+	if err != nil {
+		return nil, err
+	}
+	ret, err := kc.keys.Open(nil, raw[4:16], raw[16:], []byte(es.bucket))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return ret, nil
+}
+
+// storedKeys returns the stored forms of key under every readable
+// version, the current one first
+func (es *EncryptedStorage) storedKeys(key []byte) ([][]byte, error) {
+	current, err := es.d.conf.Keys.Current()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := es.d.conf.Keys.Versions()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, len(versions))
+	for _, v := range append([]uint32{current}, versions...) {
+		if v == current && len(ret) != 0 {
+			continue
+		}
+		k, err := es.sealKey(v, key)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// get reads the value of key through get
+func (es *EncryptedStorage) get(get func([]byte) ([]byte, error), key []byte) ([]byte, error) {
+	if !es.keyed {
+		raw, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		return es.open(key, raw)
+	}
+	keys, err := es.storedKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		raw, err := get(k)
+		if err == ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return es.open(key, raw)
+	}
+	return nil, ErrNoSuchKey
+}
+
+// newIter wraps it, an iterator over the stored entries, bounded
+// by start and stop when keys are encrypted
+func (es *EncryptedStorage) newIter(newIter func(start []byte, stop []byte) Iterator, start []byte, stop []byte) Iterator {
+	if !es.keyed {
+		return &encryptedIterator{it: newIter(start, stop), s: es}
+	}
+	it := newIter(nil, nil)
+	ret := &decryptedIterator{sliceIterator: sliceIterator{pos: -1}}
+	versions := make(map[string]uint32)
+	index := make(map[string]int)
+	for it.First(); it.Valid(); it.Next() {
+		key, err := es.openKey(it.Key())
+		if err != nil {
+			ret.err = err
+			break
+		}
+		if start != nil && bytes.Compare(key, start) < 0 || stop != nil && bytes.Compare(key, stop) >= 0 {
+			continue
+		}
+		value, err := es.open(key, it.Value())
+		if err != nil {
+			ret.err = err
+			break
+		}
+		version := binary.BigEndian.Uint32(it.Key())
+		if i, ok := index[string(key)]; ok {
+			if versions[string(key)] < version {
+				versions[string(key)] = version
+				ret.entries[i].Value = value
+			}
+			continue
+		}
+		index[string(key)] = len(ret.entries)
+		versions[string(key)] = version
+		ret.entries = append(ret.entries, Entry{Key: key, Value: value})
+	}
+	err := it.Close()
+	if ret.err == nil {
+		ret.err = err
+	}
+	if ret.err != nil {
+		ret.entries = nil
+	}
+	sortEntries(ret.entries)
+	return ret
+}
+
+// Get as is
+func (es *EncryptedStorage) Get(key []byte) ([]byte, error) {
+	return es.get(es.s.Get, key)
+}
+
+// NewIter as is
+func (es *EncryptedStorage) NewIter(start []byte, stop []byte) Iterator {
+	return es.newIter(es.s.NewIter, start, stop)
+}
+
+// NewBatch as is
+func (es *EncryptedStorage) NewBatch(typ BatchType) Batch {
+	return &encryptedBatch{s: es, b: es.s.NewBatch(typ)}
+}
+
+// Checkpoint copies the encrypted bucket when the wrapped storage
+// is a Checkpointer
+func (es *EncryptedStorage) Checkpoint(dir string) error {
+	cp, ok := es.s.(Checkpointer)
+	if !ok {
+		return ErrNotSupported
+	}
+	return cp.Checkpoint(dir)
+}
+
+// Backup backs up the encrypted bucket when the wrapped storage is
+// a Checkpointer
+func (es *EncryptedStorage) Backup(dir string) (*BackupStats, error) {
+	cp, ok := es.s.(Checkpointer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return cp.Backup(dir)
+}
+
+// Ingest encrypts entries and ingests them when the wrapped storage
+// is an Ingester and keys are kept in clear, it commits them as a
+// batch otherwise
+func (es *EncryptedStorage) Ingest(entries []Entry) error {
+	ing, ok := es.s.(Ingester)
+	if !ok || es.keyed {
+		return commitEntries(es, entries)
+	}
+	// a rotation can not start over the bucket before the entries
+	// sealed with the current key are ingested
+	es.lock.RLock()
+	defer es.lock.RUnlock()
+	version, err := es.d.conf.Keys.Current()
+	if err != nil {
+		return err
+	}
+	sealed := make([]Entry, len(entries))
+	for i, e := range entries {
+		sealed[i] = e
+		if !e.Delete {
+			sealed[i].Value, err = es.seal(version, e.Key, e.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return ing.Ingest(sealed)
+}
+
+// rotate re-encrypts with the current key the entries encrypted
+// with older ones, a chunk at a time
+func (es *EncryptedStorage) rotate(ctx context.Context, chunk int, stats *RotationStats) error {
+	current, err := es.d.conf.Keys.Current()
+	if err != nil {
+		return err
+	}
+	var from []byte
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		from, err = es.rotateChunk(current, from, chunk, stats)
+		if err != nil || from == nil {
+			return err
+		}
+	}
+}
+
+// rotateChunk rotates at most chunk entries from the stored key
+// from, it returns the stored key to continue from or nil once the
+// bucket is done
+func (es *EncryptedStorage) rotateChunk(current uint32, from []byte, chunk int, stats *RotationStats) ([]byte, error) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	it := es.s.NewIter(from, nil)
+	batch := es.s.NewBatch(BatchWriteOnly)
+	var next []byte
+	var err error
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if n == chunk {
+			next = append([]byte(nil), it.Key()...)
+			break
+		}
+		n++
+		atomic.AddInt64(&stats.Entries, 1)
+		err = es.rotateEntry(batch, current, it.Key(), it.Value(), stats)
+		if err != nil {
+			break
+		}
+	}
+	closeErr := it.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		batch.Close()
+		return nil, err
+	}
+	return next, batch.Commit()
+}
+
+func (es *EncryptedStorage) rotateEntry(batch Batch, current uint32, rawKey []byte, rawValue []byte, stats *RotationStats) error {
+	if len(rawValue) < encryptionOverhead {
+		return ErrDecrypt
+	}
+	if binary.BigEndian.Uint32(rawValue) == current && (!es.keyed || binary.BigEndian.Uint32(rawKey) == current) {
+		return nil
+	}
+	key := rawKey
+	var err error
+	if es.keyed {
+		key, err = es.openKey(rawKey)
+		if err != nil {
+			return err
+		}
+	}
+	value, err := es.open(key, rawValue)
+	if err != nil {
+		return err
+	}
+	value, err = es.seal(current, key, value)
+	if err != nil {
+		return err
+	}
+	newKey := rawKey
+	if es.keyed && binary.BigEndian.Uint32(rawKey) != current {
+		newKey, err = es.sealKey(current, key)
+		if err != nil {
+			return err
+		}
+		err = batch.Delete(rawKey)
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&stats.Rewritten, 1)
+	return batch.Set(newKey, value, nil)
+}
+
+// Exclusive runs fn while the commits and rotations of the bucket
+// wait
+func (es *EncryptedStorage) Exclusive(fn func(batch Batch) error) error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	batch := &encryptedBatch{s: es, b: es.s.NewBatch(BatchReadWrite), exclusive: true}
+	err := fn(batch)
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	return batch.Commit()
+}
+
+// encryptedBatch is a batch of an EncryptedStorage
+type encryptedBatch struct {
+	s *EncryptedStorage
+	b Batch
+	// exclusive is set for the batch of Exclusive, which holds
+	// the lock of the storage already
+	exclusive bool
+	// ops are the writes of the batch in clear, they are sealed
+	// again by Commit when the current key changed since
+	ops []batchOp
+}
+
+// batchOp is a write of an encryptedBatch
+type batchOp struct {
+	set bool
+	// version is the key version a set is sealed with
+	version uint32
+	key     []byte
+	// end is the end of a range deleted from key, nil when a
+	// single key is deleted
+	end     []byte
+	value   []byte
+	options *SetOptions
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// Get as is
+func (eb *encryptedBatch) Get(key []byte) ([]byte, error) {
+	return eb.s.get(eb.b.Get, key)
+}
+
+// Set encrypts value with the current key, when keys are encrypted
+// the forms of key under older versions are deleted
+func (eb *encryptedBatch) Set(key []byte, value []byte, options *SetOptions) error {
+	version, err := eb.s.d.conf.Keys.Current()
+	if err != nil {
+		return err
+	}
+	sealed, err := eb.s.seal(version, key, value)
+	if err != nil {
+		return err
+	}
+	eb.ops = append(eb.ops, batchOp{
+		set:     true,
+		version: version,
+		key:     cloneBytes(key),
+		value:   cloneBytes(value),
+		options: options,
+	})
+	if !eb.s.keyed {
+		return eb.b.Set(key, sealed, options)
+	}
+	keys, err := eb.s.storedKeys(key)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys[1:] {
+		err = eb.b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return eb.b.Set(keys[0], sealed, options)
+}
+
+// Delete as is
+func (eb *encryptedBatch) Delete(key []byte) error {
+	eb.ops = append(eb.ops, batchOp{key: cloneBytes(key)})
+	if !eb.s.keyed {
+		return eb.b.Delete(key)
+	}
+	keys, err := eb.s.storedKeys(key)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = eb.b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange deletes the keys in the range one by one when keys
+// are encrypted
+func (eb *encryptedBatch) DeleteRange(start []byte, end []byte) error {
+	if !eb.s.keyed {
+		eb.ops = append(eb.ops, batchOp{key: cloneBytes(start), end: cloneBytes(end)})
+		return eb.b.DeleteRange(start, end)
+	}
+	it := eb.NewIter(start, end)
+	var keys [][]byte
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	err := it.Close()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = eb.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewIter as is
+func (eb *encryptedBatch) NewIter(start []byte, stop []byte) Iterator {
+	return eb.s.newIter(eb.b.NewIter, start, stop)
+}
+
+// Commit commits the batch, the writes are sealed again with the
+// current key when it changed since they were, so that a rotation
+// started meanwhile leaves no entry under an older key
+func (eb *encryptedBatch) Commit() error {
+	if !eb.exclusive {
+		eb.s.lock.RLock()
+		defer eb.s.lock.RUnlock()
+	}
+	current, err := eb.s.d.conf.Keys.Current()
+	if err != nil {
+		eb.b.Close()
+		return err
+	}
+	stale := false
+	for _, op := range eb.ops {
+		if op.set && op.version != current {
+			stale = true
+			break
+		}
+	}
+	if !stale {
+		return eb.b.Commit()
+	}
+	eb.b.Close()
+	nb := &encryptedBatch{s: eb.s, b: eb.s.s.NewBatch(BatchReadWrite)}
+	for _, op := range eb.ops {
+		switch {
+		case op.set:
+			err = nb.Set(op.key, op.value, op.options)
+		case op.end != nil:
+			err = nb.DeleteRange(op.key, op.end)
+		default:
+			err = nb.Delete(op.key)
+		}
+		if err != nil {
+			nb.b.Close()
+			return err
+		}
+	}
+	return nb.b.Commit()
+}
+
+// Close as is
+func (eb *encryptedBatch) Close() error {
+	return eb.b.Close()
+}
+
+// encryptedIterator decrypts the values of an iterator, it becomes
+// invalid on the first value failing to decrypt and Close returns
+// the error
+type encryptedIterator struct {
+	it    Iterator
+	s     *EncryptedStorage
+	value []byte
+	err   error
+}
+
+func (ei *encryptedIterator) at(ok bool) bool {
+	ei.value = nil
+	if !ok || ei.err != nil {
+		return false
+	}
+	ei.value, ei.err = ei.s.open(ei.it.Key(), ei.it.Value())
+	return ei.err == nil
+}
+
+// First as is
+func (ei *encryptedIterator) First() bool {
+	return ei.at(ei.it.First())
+}
+
+// Last as is
+func (ei *encryptedIterator) Last() bool {
+	return ei.at(ei.it.Last())
+}
+
+// Next as is
+func (ei *encryptedIterator) Next() bool {
+	return ei.at(ei.it.Next())
+}
+
+// Prev as is
+func (ei *encryptedIterator) Prev() bool {
+	return ei.at(ei.it.Prev())
+}
+
+// SeekGE as is
+func (ei *encryptedIterator) SeekGE(m []byte) bool {
+	return ei.at(ei.it.SeekGE(m))
+}
+
+// SeekLT as is
+func (ei *encryptedIterator) SeekLT(m []byte) bool {
+	return ei.at(ei.it.SeekLT(m))
+}
+
+// Valid as is
+func (ei *encryptedIterator) Valid() bool {
+	return ei.err == nil && ei.it.Valid()
+}
+
+// Value as is
+func (ei *encryptedIterator) Value() []byte {
+	return ei.value
+}
+
+// Key as is
+func (ei *encryptedIterator) Key() []byte {
+	return ei.it.Key()
+}
+
+// Close as is
+func (ei *encryptedIterator) Close() error {
+	err := ei.it.Close()
+	if ei.err != nil {
+		return ei.err
+	}
+	return err
+}
+
+// decryptedIterator iterates over the decrypted entries of a
+// bucket with encrypted keys, Close returns the error which ended
+// the decryption
+type decryptedIterator struct {
+	sliceIterator
+	err error
+}
+
+// Close as is
+func (di *decryptedIterator) Close() error {
+	return di.err
+}
+
+// RotationStats describes the work done by a rotation
+type RotationStats struct {
+	Buckets int
+	// Entries is the number of entries examined
+	Entries int64
+	// Rewritten is the number of entries re-encrypted
+	Rewritten int64
+}
+
+// Rotation is a key rotation running in the background
+type Rotation struct {
+	done  chan struct{}
+	stats RotationStats
+	err   error
+}
+
+// Done is closed once the rotation ends
+func (r *Rotation) Done() <-chan struct{} {
+	return r.done
+}
+
+// Progress returns the number of entries examined and rewritten
+// so far
+func (r *Rotation) Progress() (entries int64, rewritten int64) {
+	return atomic.LoadInt64(&r.stats.Entries), atomic.LoadInt64(&r.stats.Rewritten)
+}
+
+// Wait waits for the rotation to end
+func (r *Rotation) Wait() (RotationStats, error) {
+	<-r.done
+	return r.stats, r.err
+}
+
+// StartRotation re-encrypts in the background every entry written
+// with an older key than the current one. Reads and writes go on
+// meanwhile, entries are readable whichever key they are under.
+func (d *EncryptedDriver) StartRotation(ctx context.Context) *Rotation {
+	r := &Rotation{done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		r.err = d.rotate(ctx, &r.stats)
+	}()
+	return r
+}
+
+// Rotate runs a rotation and waits for it
+func (d *EncryptedDriver) Rotate(ctx context.Context) (RotationStats, error) {
+	return d.StartRotation(ctx).Wait()
+}
+
+func (d *EncryptedDriver) rotate(ctx context.Context, stats *RotationStats) error {
+	chunk := d.conf.RotationChunk
+	if chunk <= 0 {
+		chunk = DefaultRotationChunk
+	}
+	names, err := d.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		s, err := d.Bucket(name)
+		if err != nil {
+			return err
+		}
+		es, ok := s.(*EncryptedStorage)
+		if !ok {
+			continue
+		}
+		err = es.rotate(ctx, chunk, stats)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		stats.Buckets++
+	}
+	return nil
+}
@@ -1,6 +1,25 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ErrNoSuchKey is the no such key error
 var ErrNoSuchKey = fmt.Errorf("Error no such key")
+
+// ErrNoSuchBucket is returned when opening a missing bucket
+var ErrNoSuchBucket = fmt.Errorf("No such bucket")
+
+// ErrInvalidBucketName is returned for names which cannot name a
+// bucket, bucket names are directory names of the driver
+var ErrInvalidBucketName = fmt.Errorf("Invalid bucket name")
+
+// CheckBucketName returns ErrInvalidBucketName unless name can be
+// the name of a bucket: a single, non empty path element
+func CheckBucketName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidBucketName, name)
+	}
+	return nil
+}
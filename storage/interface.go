@@ -12,7 +12,13 @@ const (
 
 // Driver defines a storage driver
 type Driver interface {
+	// Bucket opens the bucket name, creating it when missing
 	Bucket(name string) (Storage, error)
+	// OpenBucket opens the existing bucket name, ErrNoSuchBucket is
+	// returned when it is missing
+	OpenBucket(name string) (Storage, error)
+	// Buckets returns the names of the existing buckets
+	Buckets() ([]string, error)
 }
 
 // Storage is the driver storage class interface
@@ -25,6 +31,16 @@ type Storage interface {
 	NewBatch(typ BatchType) Batch
 }
 
+// Exclusive is implemented by storages able to keep every other
+// write out while a batch reads and rewrites entries, so that no
+// entry written meanwhile is overwritten with an older value
+type Exclusive interface {
+	// Exclusive runs fn with a read-write batch committed once fn
+	// returns nil, the other batches of the storage wait to commit
+	// until it is done
+	Exclusive(fn func(batch Batch) error) error
+}
+
 // Batch provides a method to execute a bunch of commands
 type Batch interface {
 	Get(key []byte) ([]byte, error)
@@ -33,6 +49,7 @@ type Batch interface {
 	DeleteRange(start []byte, end []byte) error
 	NewIter(start []byte, stop []byte) Iterator
 	Commit() error
+	Close() error
 }
 
 // SetOptions provide an interface for users
@@ -52,4 +69,5 @@ type Iterator interface {
 	Valid() bool
 	Value() []byte
 	Key() []byte
+	Close() error
 }
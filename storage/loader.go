@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/sstable"
+)
+
+// Entry is a write buffered by a Loader, Delete marks a deletion
+type Entry struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// Ingester is implemented by storages able to add sorted entries
+// as whole table files, bypassing the write-ahead log and the
+// memtable
+type Ingester interface {
+	// Ingest stores entries, sorted by strictly increasing key,
+	// over the current contents of the storage
+	Ingest(entries []Entry) error
+}
+
+// DefaultLoaderChunk is the number of bytes a Loader buffers
+// before storing them
+const DefaultLoaderChunk = 64 << 20
+
+// LoaderStats describes the work done by a Loader
+type LoaderStats struct {
+	// Entries is the number of entries stored
+	Entries int64
+	// Chunks is the number of chunks stored
+	Chunks int
+	// Ingested reports whether chunks were ingested as files
+	// rather than committed as batches
+	Ingested bool
+}
+
+// Loader is a Batch for bulk loads: writes are buffered and
+// reads see them, every chunk of buffered bytes is sorted and
+// ingested when the storage is an Ingester, committed as a batch
+// otherwise. Chunks are stored by Spill, which callers call
+// between the writes of two rows so that no row is split across
+// chunks. Chunks are visible as soon as they are stored, so a load
+// is not atomic, Close only discards the current chunk.
+type Loader struct {
+	s       Storage
+	chunk   int
+	pending map[string]Entry
+	size    int
+	stats   LoaderStats
+}
+
+// NewLoader creates a loader storing chunks of chunk bytes into s,
+// DefaultLoaderChunk when chunk is not positive
+func NewLoader(s Storage, chunk int) *Loader {
+	if chunk <= 0 {
+		chunk = DefaultLoaderChunk
+	}
+	_, ingest := s.(Ingester)
+	return &Loader{
+		s:       s,
+		chunk:   chunk,
+		pending: make(map[string]Entry),
+		stats:   LoaderStats{Ingested: ingest},
+	}
+}
+
+// Stats returns the work done so far
+func (l *Loader) Stats() LoaderStats {
+	return l.stats
+}
+
+// Get gets an entry, buffered or stored
+func (l *Loader) Get(key []byte) ([]byte, error) {
+	if e, ok := l.pending[string(key)]; ok {
+		if e.Delete {
+			return nil, ErrNoSuchKey
+		}
+		return append([]byte(nil), e.Value...), nil
+	}
+	return l.s.Get(key)
+}
+
+// Set buffers an entry
+func (l *Loader) Set(key []byte, value []byte, options *SetOptions) error {
+	return l.put(Entry{
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte(nil), value...),
+	})
+}
+
+// Delete buffers the deletion of an entry, nothing is written
+// for keys which are not stored
+func (l *Loader) Delete(key []byte) error {
+	if _, ok := l.pending[string(key)]; !ok {
+		_, err := l.s.Get(key)
+		if err == ErrNoSuchKey {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return l.put(Entry{Key: append([]byte(nil), key...), Delete: true})
+}
+
+// DeleteRange returns ErrNotSupported
+func (l *Loader) DeleteRange(start []byte, end []byte) error {
+	return ErrNotSupported
+}
+
+func (l *Loader) put(e Entry) error {
+	if old, ok := l.pending[string(e.Key)]; ok {
+		l.size -= len(old.Key) + len(old.Value)
+	}
+	l.pending[string(e.Key)] = e
+	l.size += len(e.Key) + len(e.Value)
+	return nil
+}
+
+// Spill stores the buffered entries once they fill a chunk
+func (l *Loader) Spill() error {
+	if l.size < l.chunk {
+		return nil
+	}
+	return l.flush()
+}
+
+// NewIter iterates over a snapshot of the stored entries in
+// [start, stop) merged with the buffered ones
+func (l *Loader) NewIter(start []byte, stop []byte) Iterator {
+	merged := make(map[string][]byte)
+	iter := l.s.NewIter(start, stop)
+	for iter.First(); iter.Valid(); iter.Next() {
+		merged[string(iter.Key())] = append([]byte(nil), iter.Value()...)
+	}
+	iter.Close()
+	for k, e := range l.pending {
+		if (start != nil && k < string(start)) || (stop != nil && k >= string(stop)) {
+			continue
+		}
+		if e.Delete {
+			delete(merged, k)
+		} else {
+			merged[k] = e.Value
+		}
+	}
+	ret := &sliceIterator{pos: -1}
+	for k, v := range merged {
+		ret.entries = append(ret.entries, Entry{Key: []byte(k), Value: v})
+	}
+	sortEntries(ret.entries)
+	return ret
+}
+
+// Commit stores the buffered entries
+func (l *Loader) Commit() error {
+	return l.flush()
+}
+
+// Close discards the buffered entries
+func (l *Loader) Close() error {
+	l.pending = make(map[string]Entry)
+	l.size = 0
+	return nil
+}
+
+func (l *Loader) flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	entries := make([]Entry, 0, len(l.pending))
+	for _, e := range l.pending {
+		entries = append(entries, e)
+	}
+	sortEntries(entries)
+	var err error
+	if in, ok := l.s.(Ingester); ok {
+		err = in.Ingest(entries)
+	} else {
+		err = commitEntries(l.s, entries)
+	}
+	if err != nil {
+		return err
+	}
+	l.stats.Entries += int64(len(entries))
+	l.stats.Chunks++
+	return l.Close()
+}
+
+func commitEntries(s Storage, entries []Entry) error {
+	batch := s.NewBatch(BatchWriteOnly)
+	for _, e := range entries {
+		var err error
+		if e.Delete {
+			err = batch.Delete(e.Key)
+		} else {
+			err = batch.Set(e.Key, e.Value, nil)
+		}
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+}
+
+// ingestSeq numbers the files written by Ingest
+var ingestSeq uint64
+
+// Ingest writes entries into an sstable inside the bucket and
+// ingests it, the file is removed afterwards
+func (pds *PebbleDriverStorage) Ingest(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	path := pds.fs.PathJoin(pds.dirname, fmt.Sprintf("kical-ingest-%d.sst", atomic.AddUint64(&ingestSeq, 1)))
+	f, err := pds.fs.Create(path)
+	if err != nil {
+		return err
+	}
+	defer pds.fs.Remove(path)
+	w := sstable.NewWriter(f, sstable.WriterOptions{})
+	for _, e := range entries {
+		if e.Delete {
+			err = w.Delete(e.Key)
+		} else {
+			err = w.Set(e.Key, e.Value)
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	pds.lock.RLock()
+	defer pds.lock.RUnlock()
+	return pds.db.Ingest([]string{path})
+}
+
+// sliceIterator iterates over sorted entries
+type sliceIterator struct {
+	entries []Entry
+	pos     int
+}
+
+func (it *sliceIterator) seek(i int) bool {
+	it.pos = i
+	return it.Valid()
+}
+
+// First as is
+func (it *sliceIterator) First() bool {
+	return it.seek(0)
+}
+
+// Last as is
+func (it *sliceIterator) Last() bool {
+	return it.seek(len(it.entries) - 1)
+}
+
+// Next as is
+func (it *sliceIterator) Next() bool {
+	return it.seek(it.pos + 1)
+}
+
+// Prev as is
+func (it *sliceIterator) Prev() bool {
+	return it.seek(it.pos - 1)
+}
+
+// SeekGE as is
+func (it *sliceIterator) SeekGE(m []byte) bool {
+	return it.seek(sort.Search(len(it.entries), func(i int) bool {
+		return bytes.Compare(it.entries[i].Key, m) >= 0
+	}))
+}
+
+// SeekLT as is
+func (it *sliceIterator) SeekLT(m []byte) bool {
+	return it.seek(sort.Search(len(it.entries), func(i int) bool {
+		return bytes.Compare(it.entries[i].Key, m) >= 0
+	}) - 1)
+}
+
+// Valid as is
+func (it *sliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+// Value as is
+func (it *sliceIterator) Value() []byte {
+	return it.entries[it.pos].Value
+}
+
+// Key as is
+func (it *sliceIterator) Key() []byte {
+	return it.entries[it.pos].Key
+}
+
+// Close as is
+func (it *sliceIterator) Close() error {
+	return nil
+}
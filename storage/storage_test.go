@@ -0,0 +1,302 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+)
+
+func rawContains(t *testing.T, s storage.Storage, needle string) bool {
+	it := s.NewIter(nil, nil)
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		if bytes.Contains(it.Key(), []byte(needle)) || bytes.Contains(it.Value(), []byte(needle)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryptedDriver(t *testing.T) {
+	mem := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer mem.Close()
+	keys, err := storage.NewStaticKeys(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := storage.NewEncryptedDriver(mem, &storage.EncryptedDriverConfigure{
+		Keys:          keys,
+		KeyBuckets:    []string{"secrets"},
+		RotationChunk: 7,
+	})
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"reg", "secrets"} {
+		_, err = db.CreateTable(name, &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl, err := db.Table(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := tbl.KV.NewSession()
+		for i := 0; i < 40; i++ {
+			s.Set(fmt.Sprintf("user%02d", i), fmt.Sprintf("password%02d", i))
+		}
+		if err = s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(name string) {
+		tbl, err := db.Table(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tbl.KV.Get("user17")
+		if err != nil || v != "password17" {
+			t.Fatalf("%s: got %v, %v", name, v, err)
+		}
+		entries, _, err := tbl.KV.Scan("user30", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 10 || entries[0].Key != "user30" || entries[9].Value != "password39" {
+			t.Fatalf("%s: bad scan %v", name, entries)
+		}
+	}
+	check("reg")
+	check("secrets")
+
+	reg, _ := mem.Bucket("reg")
+	secrets, _ := mem.Bucket("secrets")
+	if rawContains(t, reg, "password") || !rawContains(t, reg, "user") {
+		t.Fatal("values of reg are not encrypted or its keys are")
+	}
+	if rawContains(t, secrets, "password") || rawContains(t, secrets, "user") {
+		t.Fatal("keys or values of secrets are in clear")
+	}
+
+	// rotate while writing, then forget the old key
+	version, err := keys.Add(bytes.Repeat([]byte{9}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := drv.StartRotation(context.Background())
+	tbl, _ := db.Table("secrets")
+	s := tbl.KV.NewSession()
+	s.Set("user05", "changed")
+	s.Delete("user06")
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := r.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets < 2 || stats.Rewritten == 0 {
+		t.Fatalf("bad rotation stats %+v", stats)
+	}
+	if err = keys.Remove(version - 1); err != nil {
+		t.Fatal(err)
+	}
+	check("reg")
+	check("secrets")
+	if v, err := tbl.KV.Get("user05"); err != nil || v != "changed" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err := tbl.KV.Get("user06"); err == nil {
+		t.Fatal("expected user06 to stay deleted")
+	}
+	if stats, err = drv.Rotate(context.Background()); err != nil || stats.Rewritten != 0 {
+		t.Fatalf("second rotation rewrote entries: %+v, %v", stats, err)
+	}
+
+	// batches sealed before a rotation and committed after it are
+	// sealed again with the new key
+	var batches []storage.Batch
+	for _, name := range []string{"reg", "secrets"} {
+		es, _ := drv.Bucket(name)
+		b := es.NewBatch(storage.BatchReadWrite)
+		if err = b.Set([]byte("=late"), []byte("value"), nil); err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, b)
+	}
+	if version, err = keys.Add(bytes.Repeat([]byte{11}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = drv.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range batches {
+		if err = b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = keys.Remove(version - 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"reg", "secrets"} {
+		es, _ := drv.Bucket(name)
+		if v, err := es.Get([]byte("=late")); err != nil || string(v) != "value" {
+			t.Fatalf("%s: got %q, %v", name, v, err)
+		}
+	}
+
+	// a value moved to another key fails to decrypt
+	enc, _ := drv.Bucket("reg")
+	raw, err := reg.Get([]byte("=user01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := reg.NewBatch(storage.BatchWriteOnly)
+	batch.Set([]byte("=user02"), raw, nil)
+	if err = batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.Get([]byte("=user02")); !errors.Is(err, storage.ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+	it := enc.NewIter([]byte("=user"), []byte("=user03"))
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		n++
+	}
+	if err = it.Close(); n != 2 || !errors.Is(err, storage.ErrDecrypt) {
+		t.Fatalf("expected the iterator to stop at user02, got %d entries and %v", n, err)
+	}
+}
+
+func TestPebbleDriverBuckets(t *testing.T) {
+	base, err := ioutil.TempDir("", "kical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	if err = os.Mkdir(filepath.Join(base, "unrelated"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{BaseDirectory: base})
+	defer drv.Close()
+	for _, name := range []string{"", ".", "..", "../escaped", "a/b", `a\b`} {
+		if _, err = drv.Bucket(name); !errors.Is(err, storage.ErrInvalidBucketName) {
+			t.Fatalf("%q: expected ErrInvalidBucketName, got %v", name, err)
+		}
+	}
+	if _, err = drv.OpenBucket("missing"); !errors.Is(err, storage.ErrNoSuchBucket) {
+		t.Fatalf("expected ErrNoSuchBucket, got %v", err)
+	}
+	if _, err = drv.OpenBucket("unrelated"); !errors.Is(err, storage.ErrNoSuchBucket) {
+		t.Fatalf("expected ErrNoSuchBucket, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(base, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("opening a missing bucket created it: %v", err)
+	}
+	if _, err = drv.Bucket("reg"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := drv.Buckets()
+	if err != nil || len(names) != 1 || names[0] != "reg" {
+		t.Fatalf("got %v, %v", names, err)
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(base, "unrelated"))
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("the unrelated directory was written: %v", err)
+	}
+
+	// the buckets on disk are found by a new driver
+	drv.Close()
+	drv = storage.NewPebbleDriver(&storage.PebbleDriverConfigure{BaseDirectory: base})
+	if _, err = drv.OpenBucket("reg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	mem := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{UseMemory: true})
+	defer mem.Close()
+	keys, err := storage.NewStaticKeys(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := storage.NewEncryptedDriver(mem, &storage.EncryptedDriverConfigure{Keys: keys, Buckets: []string{"secrets"}})
+	for _, name := range []string{"plain", "secrets"} {
+		s, err := drv.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, ok := s.(storage.Exclusive)
+		if !ok {
+			t.Fatalf("%s: %T is not Exclusive", name, s)
+		}
+		started, release := make(chan struct{}), make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- ex.Exclusive(func(b storage.Batch) error {
+				close(started)
+				<-release
+				return b.Set([]byte("k"), []byte("old"), nil)
+			})
+		}()
+		<-started
+		committed := make(chan error)
+		go func() {
+			b := s.NewBatch(storage.BatchWriteOnly)
+			b.Set([]byte("k"), []byte("new"), nil)
+			committed <- b.Commit()
+		}()
+		select {
+		case err = <-committed:
+			t.Fatalf("%s: the commit did not wait: %v", name, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(release)
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+		if err = <-committed; err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get([]byte("k")); err != nil || string(v) != "new" {
+			t.Fatalf("%s: got %q, %v", name, v, err)
+		}
+	}
+}
+
+func TestStaticKeys(t *testing.T) {
+	keys := new(storage.StaticKeys)
+	for _, v := range []uint32{3, 1} {
+		if err := keys.SetKey(v, bytes.Repeat([]byte{byte(v)}, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keys.SetKey(3, bytes.Repeat([]byte{4}, 16)); err == nil {
+		t.Fatal("expected a version to keep its key")
+	}
+	if err := keys.SetKey(0, bytes.Repeat([]byte{4}, 16)); err == nil {
+		t.Fatal("expected version 0 to be rejected")
+	}
+	if v, err := keys.Current(); err != nil || v != 3 {
+		t.Fatalf("got current %d, %v", v, err)
+	}
+	if v, err := keys.Add(bytes.Repeat([]byte{5}, 16)); err != nil || v != 4 {
+		t.Fatalf("got version %d, %v", v, err)
+	}
+	if vs, _ := keys.Versions(); len(vs) != 3 || vs[0] != 4 || vs[2] != 1 {
+		t.Fatalf("got versions %v", vs)
+	}
+}
@@ -0,0 +1,1057 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+)
+
+// Parquet files start and end with parquetMagic, the end is
+// preceded by the thrift encoded file metadata and its length.
+// Files are written with a row group per ParquetRowGroup rows and
+// a snappy compressed data page per column and row group, every
+// column is optional but tags, which are a repeated string column
+// read as lists of strings. Integers are INT64, floats DOUBLE,
+// strings and enums UTF8, objects JSON, times INT64 timestamps
+// in microseconds and decimals of up to 18 digits INT64 decimals,
+// larger ones binary decimals and unconstrained ones strings.
+//
+// Files of other writers are read as long as their columns are
+// primitives or lists of primitives, encoded plain or with a
+// dictionary and compressed with snappy, gzip or zstd.
+// testdata/parquet.py writes such files for the tests and checks
+// the files written here against the format.
+const parquetMagic = "PAR1"
+
+// ParquetRowGroup is the number of rows of the row groups of the
+// Parquet files written
+const ParquetRowGroup = 65536
+
+// Physical types
+const (
+	pqBoolean   = 0
+	pqInt32     = 1
+	pqInt64     = 2
+	pqInt96     = 3
+	pqFloat     = 4
+	pqDouble    = 5
+	pqByteArray = 6
+	pqFixed     = 7
+)
+
+// Converted types
+const (
+	pqNone            = -1
+	pqUTF8            = 0
+	pqDecimal         = 5
+	pqDate            = 6
+	pqTimestampMillis = 9
+	pqTimestampMicros = 10
+	pqJSON            = 19
+)
+
+// Repetitions
+const (
+	pqRequired = 0
+	pqOptional = 1
+	pqRepeated = 2
+)
+
+// Encodings
+const (
+	pqPlain           = 0
+	pqPlainDictionary = 2
+	pqRLE             = 3
+	pqRLEDictionary   = 8
+)
+
+// Codecs
+const (
+	pqUncompressed = 0
+	pqSnappy       = 1
+	pqGzip         = 2
+	pqZstd         = 6
+)
+
+// Page types
+const (
+	pqDataPage       = 0
+	pqDictionaryPage = 2
+	pqDataPageV2     = 3
+)
+
+// Timestamp units
+const (
+	pqMillis = 1
+	pqMicros = 2
+	pqNanos  = 3
+)
+
+// pqColumn is a column as stored in a Parquet file
+type pqColumn struct {
+	col       *Column
+	name      string
+	physical  int64
+	typeLen   int
+	converted int64
+	unit      int
+	scale     int
+	precision int
+	maxDef    int
+	maxRep    int
+}
+
+// parquetColumn returns the Parquet column holding c
+func parquetColumn(c *Column) *pqColumn {
+	ret := &pqColumn{col: c, name: c.Name, converted: pqNone, maxDef: 1}
+	switch c.Type {
+	case common.TypeInteger:
+		ret.physical = pqInt64
+	case common.TypeFloat:
+		ret.physical = pqDouble
+	case common.TypeTime:
+		ret.physical, ret.converted, ret.unit = pqInt64, pqTimestampMicros, pqMicros
+	case common.TypeDecimal:
+		switch {
+		case c.Precision == 0:
+			ret.physical, ret.converted = pqByteArray, pqUTF8
+		case c.Precision <= 18:
+			ret.physical, ret.converted = pqInt64, pqDecimal
+		default:
+			ret.physical, ret.converted = pqByteArray, pqDecimal
+		}
+		ret.precision, ret.scale = c.Precision, c.Scale
+	case common.TypeObject:
+		ret.physical, ret.converted = pqByteArray, pqJSON
+	case common.TypeTag:
+		ret.physical, ret.converted, ret.maxRep = pqByteArray, pqUTF8, 1
+	default:
+		ret.physical, ret.converted = pqByteArray, pqUTF8
+	}
+	return ret
+}
+
+// schema returns the schema element of the column
+func (c *pqColumn) schema() tstruct {
+	repetition := int32(pqOptional)
+	if c.maxRep != 0 {
+		repetition = pqRepeated
+	}
+	ret := tstruct{
+		{1, int32(c.physical)},
+		{3, repetition},
+		{4, c.name},
+	}
+	if c.converted == pqNone {
+		return ret
+	}
+	ret = append(ret, tfield{6, int32(c.converted)})
+	var logical tstruct
+	switch c.converted {
+	case pqUTF8:
+		logical = tstruct{{1, tstruct{}}}
+	case pqJSON:
+		logical = tstruct{{12, tstruct{}}}
+	case pqTimestampMicros:
+		logical = tstruct{{8, tstruct{{1, true}, {2, tstruct{{2, tstruct{}}}}}}}
+	case pqDecimal:
+		ret = append(ret, tfield{7, int32(c.scale)}, tfield{8, int32(c.precision)})
+		logical = tstruct{{5, tstruct{{1, int32(c.scale)}, {2, int32(c.precision)}}}}
+	}
+	return append(ret, tfield{10, logical})
+}
+
+// appendPlain appends the plain encoding of the value v of the
+// column, a value of its field or a tag
+func (c *pqColumn) appendPlain(dst []byte, v interface{}) ([]byte, error) {
+	if c.converted == pqJSON {
+		text, err := jsonText(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendByteArray(dst, []byte(text)), nil
+	}
+	switch x := v.(type) {
+	case string:
+		return appendByteArray(dst, []byte(x)), nil
+	case int64:
+		return appendUint64(dst, uint64(x)), nil
+	case float64:
+		return appendUint64(dst, math.Float64bits(x)), nil
+	case time.Time:
+		return appendUint64(dst, uint64(x.Unix()*1e6+int64(x.Nanosecond()/1e3))), nil
+	case decimal.Decimal:
+		switch {
+		case c.physical == pqInt64:
+			return appendUint64(dst, uint64(x.Round(int32(c.scale)).Unscaled().Int64())), nil
+		case c.converted == pqDecimal:
+			return appendByteArray(dst, twosComplement(x.Round(int32(c.scale)).Unscaled())), nil
+		}
+		return appendByteArray(dst, []byte(x.String())), nil
+	}
+	return nil, fmt.Errorf("%w: %T", document.ErrWrongFieldType, v)
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendByteArray(dst []byte, v []byte) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(v)))
+	return append(append(dst, b[:]...), v...)
+}
+
+// twosComplement returns the big endian two's complement of x
+func twosComplement(x *big.Int) []byte {
+	if x.Sign() >= 0 {
+		b := x.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	n := (x.BitLen() + 8) / 8
+	v := new(big.Int).Lsh(big.NewInt(1), uint(8*n))
+	b := v.Add(v, x).Bytes()
+	for len(b) < n {
+		b = append([]byte{0xff}, b...)
+	}
+	return b
+}
+
+// fromTwosComplement decodes a big endian two's complement
+func fromTwosComplement(b []byte) *big.Int {
+	x := new(big.Int).SetBytes(b)
+	if len(b) != 0 && b[0]&0x80 != 0 {
+		x.Sub(x, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	return x
+}
+
+// appendLevels appends levels of at most 1 in the RLE encoding of
+// data pages, prefixed with its length
+func appendLevels(dst []byte, levels []int) []byte {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		dst = appendUvarint(dst, uint64(j-i)<<1)
+		dst = append(dst, byte(levels[i]))
+		i = j
+	}
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst
+}
+
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	cols    []*pqColumn
+	rows    []document.Row
+	groups  tlist
+	numRows int64
+}
+
+func newParquetWriter(w io.Writer, cols []Column) (*parquetWriter, error) {
+	ret := &parquetWriter{w: w}
+	for i := range cols {
+		ret.cols = append(ret.cols, parquetColumn(&cols[i]))
+	}
+	return ret, ret.write([]byte(parquetMagic))
+}
+
+func (w *parquetWriter) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+// Write buffers rows and writes a row group once there are
+// ParquetRowGroup of them
+func (w *parquetWriter) Write(rows []document.Row) error {
+	w.rows = append(w.rows, rows...)
+	if len(w.rows) < ParquetRowGroup {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *parquetWriter) flush() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	chunks := make(tlist, 0, len(w.cols))
+	total := int64(0)
+	for _, c := range w.cols {
+		chunk, size, err := w.column(c)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		total += size
+	}
+	w.groups = append(w.groups, tstruct{
+		{1, chunks},
+		{2, total},
+		{3, int64(len(w.rows))},
+	})
+	w.numRows += int64(len(w.rows))
+	w.rows = nil
+	return nil
+}
+
+// column writes the chunk of the column c of the buffered rows as
+// a single data page, it returns its column chunk and size
+func (w *parquetWriter) column(c *pqColumn) (tstruct, int64, error) {
+	var defs, reps []int
+	var values []byte
+	for _, row := range w.rows {
+		v, err := c.col.value(row[c.name])
+		if err != nil {
+			return nil, 0, err
+		}
+		if tags, ok := v.([]string); ok {
+			for i, tag := range tags {
+				rep := 0
+				if i != 0 {
+					rep = 1
+				}
+				reps = append(reps, rep)
+				defs = append(defs, 1)
+				values, _ = c.appendPlain(values, tag)
+			}
+			continue
+		}
+		if c.maxRep != 0 {
+			reps = append(reps, 0)
+		}
+		if v == nil {
+			defs = append(defs, 0)
+			continue
+		}
+		defs = append(defs, 1)
+		values, err = c.appendPlain(values, v)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	var page []byte
+	if c.maxRep != 0 {
+		page = appendLevels(page, reps)
+	}
+	page = appendLevels(page, defs)
+	page = append(page, values...)
+	compressed := snappy.Encode(nil, page)
+	header := appendThrift(nil, tstruct{
+		{1, int32(pqDataPage)},
+		{2, int32(len(page))},
+		{3, int32(len(compressed))},
+		{5, tstruct{
+			{1, int32(len(defs))},
+			{2, int32(pqPlain)},
+			{3, int32(pqRLE)},
+			{4, int32(pqRLE)},
+		}},
+	})
+	start := w.offset
+	err := w.write(header)
+	if err == nil {
+		err = w.write(compressed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(len(header) + len(page))
+	return tstruct{
+		{2, start},
+		{3, tstruct{
+			{1, int32(c.physical)},
+			{2, tlist{int32(pqPlain), int32(pqRLE)}},
+			{3, tlist{c.name}},
+			{4, int32(pqSnappy)},
+			{5, int64(len(defs))},
+			{6, size},
+			{7, int64(len(header) + len(compressed))},
+			{9, start},
+		}},
+	}, size, nil
+}
+
+// Close writes the last row group and the file metadata
+func (w *parquetWriter) Close() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+	schema := tlist{tstruct{{4, "schema"}, {5, int32(len(w.cols))}}}
+	for _, c := range w.cols {
+		schema = append(schema, c.schema())
+	}
+	meta := appendThrift(nil, tstruct{
+		{1, int32(1)},
+		{2, schema},
+		{3, w.numRows},
+		{4, w.groups},
+		{6, "kical"},
+	})
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(meta)))
+	meta = append(append(meta, length[:]...), parquetMagic...)
+	return w.write(meta)
+}
+
+type parquetReader struct {
+	r      io.ReaderAt
+	size   int64
+	leaves []*pqColumn
+	groups []interface{}
+	group  int
+	rows   []document.Row
+	errs   []error
+	pos    int
+	n      int64
+}
+
+func newParquetReader(r io.Reader, cols []Column) (*parquetReader, error) {
+	ret := new(parquetReader)
+	ra, ok := r.(io.ReaderAt)
+	seeker, seekable := r.(io.Seeker)
+	if ok && seekable {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		ret.r, ret.size = ra, size
+	} else {
+		rs, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		ret.r, ret.size = bytes.NewReader(rs), int64(len(rs))
+	}
+	if ret.size < int64(2*len(parquetMagic)+4) {
+		return nil, fmt.Errorf("%w: not a parquet file", ErrMalformed)
+	}
+	tail := make([]byte, 4+len(parquetMagic))
+	_, err := ret.r.ReadAt(tail, ret.size-int64(len(tail)))
+	if err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != parquetMagic {
+		return nil, fmt.Errorf("%w: not a parquet file", ErrMalformed)
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if length > ret.size-int64(len(tail)+len(parquetMagic)) {
+		return nil, fmt.Errorf("%w: bad metadata length", ErrMalformed)
+	}
+	footer := make([]byte, length)
+	_, err = ret.r.ReadAt(footer, ret.size-int64(len(tail))-length)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := (&thriftDecoder{buf: footer}).strct()
+	if err != nil {
+		return nil, err
+	}
+	err = ret.schema(meta.list(2), cols)
+	if err != nil {
+		return nil, err
+	}
+	ret.groups = meta.list(4)
+	return ret, nil
+}
+
+// schema maps the leaf columns of the schema elements of a file to
+// the columns cols, every top level field must be a primitive or a
+// list of primitives
+func (r *parquetReader) schema(elements []interface{}, cols []Column) error {
+	if len(elements) == 0 {
+		return fmt.Errorf("%w: empty schema", ErrMalformed)
+	}
+	index := columnIndex(cols)
+	pos := 1
+	// top is the name of the top level field holding the element,
+	// empty for top level elements
+	var walk func(top string, def, rep int) error
+	walk = func(top string, def, rep int) error {
+		if pos >= len(elements) {
+			return fmt.Errorf("%w: truncated schema", ErrMalformed)
+		}
+		el, _ := elements[pos].(tvalues)
+		pos++
+		switch el.int(3) {
+		case pqOptional:
+			def++
+		case pqRepeated:
+			def++
+			rep++
+		}
+		nested := top != ""
+		if !nested {
+			top = el.str(4)
+		}
+		if n := el.int(5); n > 0 {
+			for i := int64(0); i < n; i++ {
+				err := walk(top, def, rep)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		i, ok := index[top]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownColumn, top)
+		}
+		c := &pqColumn{
+			col:       &cols[i],
+			name:      top,
+			physical:  el.int(1),
+			typeLen:   int(el.int(2)),
+			converted: pqNone,
+			maxDef:    def,
+			maxRep:    rep,
+		}
+		if el.has(6) {
+			c.converted = el.int(6)
+			c.scale, c.precision = int(el.int(7)), int(el.int(8))
+		}
+		c.logical(el.strct(10))
+		if rep > 1 || (nested && rep != 1) {
+			return fmt.Errorf("%w: nested column %q", ErrUnsupported, top)
+		}
+		for _, l := range r.leaves {
+			if l.name == top {
+				return fmt.Errorf("%w: nested column %q", ErrUnsupported, top)
+			}
+		}
+		r.leaves = append(r.leaves, c)
+		return nil
+	}
+	root, _ := elements[0].(tvalues)
+	for i := int64(0); i < root.int(5); i++ {
+		err := walk("", 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logical reads the logical type of the column, which supersedes
+// its converted type
+func (c *pqColumn) logical(t tvalues) {
+	switch {
+	case t == nil:
+	case t.has(5):
+		d := t.strct(5)
+		c.converted, c.scale, c.precision = pqDecimal, int(d.int(1)), int(d.int(2))
+	case t.has(6):
+		c.converted = pqDate
+	case t.has(8):
+		unit := t.strct(8).strct(2)
+		c.converted = pqTimestampMicros
+		switch {
+		case unit.has(1):
+			c.unit = pqMillis
+		case unit.has(3):
+			c.unit = pqNanos
+		default:
+			c.unit = pqMicros
+		}
+	case t.has(12):
+		c.converted = pqJSON
+	}
+	if c.unit == 0 {
+		switch c.converted {
+		case pqTimestampMillis:
+			c.unit = pqMillis
+		case pqTimestampMicros:
+			c.unit = pqMicros
+		}
+	}
+}
+
+// Read returns the next row, the row groups are read one by one
+func (r *parquetReader) Read() (document.Row, error) {
+	for r.pos >= len(r.rows) {
+		if r.group >= len(r.groups) {
+			return nil, io.EOF
+		}
+		g, _ := r.groups[r.group].(tvalues)
+		r.group++
+		err := r.load(g)
+		if err != nil {
+			return nil, err
+		}
+	}
+	row, err := r.rows[r.pos], r.errs[r.pos]
+	r.rows[r.pos] = nil
+	r.pos++
+	r.n++
+	if err != nil {
+		return nil, &RowError{Row: r.n, Err: err}
+	}
+	return row, nil
+}
+
+// load decodes the rows of the row group g
+func (r *parquetReader) load(g tvalues) error {
+	chunks := g.list(1)
+	if len(chunks) != len(r.leaves) {
+		return fmt.Errorf("%w: %d column chunks for %d columns", ErrMalformed, len(chunks), len(r.leaves))
+	}
+	numRows := g.int(3)
+	if numRows < 0 || numRows > r.size {
+		return fmt.Errorf("%w: bad row count", ErrMalformed)
+	}
+	r.rows = make([]document.Row, numRows)
+	r.errs = make([]error, numRows)
+	r.pos = 0
+	for i := range r.rows {
+		r.rows[i] = make(document.Row)
+	}
+	for i, c := range r.leaves {
+		cc, _ := chunks[i].(tvalues)
+		err := r.column(c, cc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// column decodes the column chunk cc of the column c into the rows
+func (r *parquetReader) column(c *pqColumn, cc tvalues) error {
+	values, defs, reps, err := r.chunk(c, cc.strct(3), int64(len(r.rows)))
+	if err != nil {
+		return err
+	}
+	ri, vi := -1, 0
+	lists := make(map[int][]interface{})
+	for k := range defs {
+		if reps[k] == 0 {
+			ri++
+		}
+		if ri < 0 || ri >= len(r.rows) {
+			return fmt.Errorf("%w: more values than rows", ErrMalformed)
+		}
+		if defs[k] != c.maxDef {
+			continue
+		}
+		if vi >= len(values) {
+			return fmt.Errorf("%w: missing values", ErrMalformed)
+		}
+		v, err := c.convert(values[vi])
+		vi++
+		switch {
+		case err != nil:
+			if r.errs[ri] == nil {
+				r.errs[ri] = fmt.Errorf("%s: %w", c.name, err)
+			}
+		case c.maxRep != 0:
+			lists[ri] = append(lists[ri], v)
+		default:
+			r.set(c, ri, v)
+		}
+	}
+	for ri, list := range lists {
+		r.set(c, ri, list)
+	}
+	return nil
+}
+
+func (r *parquetReader) set(c *pqColumn, ri int, v interface{}) {
+	v, err := c.col.value(v)
+	if err != nil {
+		if r.errs[ri] == nil {
+			r.errs[ri] = err
+		}
+		return
+	}
+	if v != nil {
+		r.rows[ri][c.name] = v
+	}
+}
+
+// chunk reads the pages of a column chunk of metadata md and rows
+// rows, it returns the non null values and the levels of the column
+func (r *parquetReader) chunk(c *pqColumn, md tvalues, rows int64) ([]interface{}, []int, []int, error) {
+	if md == nil {
+		return nil, nil, nil, fmt.Errorf("%w: column chunk in another file", ErrUnsupported)
+	}
+	codec := md.int(4)
+	// a column which is not repeated has a value, maybe null, per row
+	numValues := md.int(5)
+	if numValues < 0 || (c.maxRep == 0 && numValues > rows) {
+		return nil, nil, nil, fmt.Errorf("%w: bad value count", ErrMalformed)
+	}
+	start := md.int(9)
+	if d := md.int(11); d > 0 && d < start {
+		start = d
+	}
+	size := md.int(7)
+	if start < 0 || size < 0 || start+size > r.size {
+		return nil, nil, nil, fmt.Errorf("%w: column chunk out of the file", ErrMalformed)
+	}
+	buf := make([]byte, size)
+	_, err := r.r.ReadAt(buf, start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var values, dict []interface{}
+	var defs, reps []int
+	for pos := 0; int64(len(defs)) < numValues && pos < len(buf); {
+		dec := &thriftDecoder{buf: buf, pos: pos}
+		h, err := dec.strct()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		pos = dec.pos
+		csize := int(h.int(3))
+		if csize < 0 || csize > len(buf)-pos {
+			return nil, nil, nil, fmt.Errorf("%w: page out of the column chunk", ErrMalformed)
+		}
+		body := buf[pos : pos+csize]
+		pos += csize
+		usize := int(h.int(2))
+		var page *pqPage
+		switch h.int(1) {
+		case pqDictionaryPage:
+			data, err := decompress(codec, body, usize)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			dict, err = c.plain(data, int(h.strct(7).int(1)))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		case pqDataPage:
+			data, err := decompress(codec, body, usize)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			page, err = c.pageV1(h.strct(5), data, int(numValues)-len(defs))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		case pqDataPageV2:
+			page, err = c.pageV2(h.strct(8), codec, body, usize, int(numValues)-len(defs))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		default:
+			continue
+		}
+		nonNull := 0
+		for _, d := range page.defs {
+			if d == c.maxDef {
+				nonNull++
+			}
+		}
+		vs, err := c.values(page.encoding, page.values, nonNull, dict)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		values = append(values, vs...)
+		defs = append(defs, page.defs...)
+		reps = append(reps, page.reps...)
+	}
+	return values, defs, reps, nil
+}
+
+// pqPage is a decoded data page, values are still encoded
+type pqPage struct {
+	defs     []int
+	reps     []int
+	encoding int64
+	values   []byte
+}
+
+// pageV1 decodes a data page of at most max values, the levels of
+// sparse columns are runs which may hold any number of values
+func (c *pqColumn) pageV1(h tvalues, data []byte, max int) (*pqPage, error) {
+	n := int(h.int(1))
+	if n < 0 || n > max {
+		return nil, fmt.Errorf("%w: bad value count", ErrMalformed)
+	}
+	page := &pqPage{encoding: h.int(2)}
+	var err error
+	page.reps, data, err = c.levelsV1(h.int(4), c.maxRep, data, n)
+	if err != nil {
+		return nil, err
+	}
+	page.defs, data, err = c.levelsV1(h.int(3), c.maxDef, data, n)
+	if err != nil {
+		return nil, err
+	}
+	page.values = data
+	return page, nil
+}
+
+// levelsV1 decodes n levels prefixed by their length, none are
+// stored when max is 0
+func (c *pqColumn) levelsV1(encoding int64, max int, data []byte, n int) ([]int, []byte, error) {
+	if max == 0 {
+		return make([]int, n), data, nil
+	}
+	if encoding != pqRLE {
+		return nil, nil, fmt.Errorf("%w: level encoding %d", ErrUnsupported, encoding)
+	}
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("%w: truncated levels", ErrMalformed)
+	}
+	l := int64(binary.LittleEndian.Uint32(data))
+	if l > int64(len(data)-4) {
+		return nil, nil, fmt.Errorf("%w: truncated levels", ErrMalformed)
+	}
+	levels, err := hybrid(data[4:4+l], bits.Len(uint(max)), n)
+	return levels, data[4+l:], err
+}
+
+func (c *pqColumn) pageV2(h tvalues, codec int64, body []byte, usize int, max int) (*pqPage, error) {
+	n := int(h.int(1))
+	rl, dl := h.int(6), h.int(5)
+	if n < 0 || n > max || rl < 0 || dl < 0 || rl+dl > int64(len(body)) {
+		return nil, fmt.Errorf("%w: bad data page", ErrMalformed)
+	}
+	page := &pqPage{encoding: h.int(4), defs: make([]int, n), reps: make([]int, n)}
+	var err error
+	if c.maxRep != 0 {
+		page.reps, err = hybrid(body[:rl], bits.Len(uint(c.maxRep)), n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.maxDef != 0 {
+		page.defs, err = hybrid(body[rl:rl+dl], bits.Len(uint(c.maxDef)), n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	page.values = body[rl+dl:]
+	if h.bool(7, true) {
+		page.values, err = decompress(codec, page.values, usize-int(rl+dl))
+	}
+	return page, err
+}
+
+// hybrid decodes n values of width bits in the RLE and bit packed
+// hybrid encoding
+func hybrid(data []byte, width int, n int) ([]int, error) {
+	ret := make([]int, 0, n)
+	bytesWidth := (width + 7) / 8
+	for len(ret) < n {
+		header, l := binary.Uvarint(data)
+		if l <= 0 {
+			return nil, fmt.Errorf("%w: truncated levels", ErrMalformed)
+		}
+		data = data[l:]
+		if header&1 == 0 {
+			run := header >> 1
+			if len(data) < bytesWidth || run > uint64(n-len(ret)) {
+				return nil, fmt.Errorf("%w: bad run", ErrMalformed)
+			}
+			v := 0
+			for i := 0; i < bytesWidth; i++ {
+				v |= int(data[i]) << (8 * i)
+			}
+			data = data[bytesWidth:]
+			for i := uint64(0); i < run; i++ {
+				ret = append(ret, v)
+			}
+			continue
+		}
+		groups := header >> 1
+		if groups*uint64(width) > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: bad bit packed run", ErrMalformed)
+		}
+		packed := data[:groups*uint64(width)]
+		data = data[len(packed):]
+		for i := 0; i < int(groups)*8 && len(ret) < n; i++ {
+			v := 0
+			for b := 0; b < width; b++ {
+				bit := i*width + b
+				v |= int(packed[bit/8]>>(bit%8)&1) << b
+			}
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
+
+// values decodes n values of a data page
+func (c *pqColumn) values(encoding int64, data []byte, n int, dict []interface{}) ([]interface{}, error) {
+	switch encoding {
+	case pqPlain:
+		return c.plain(data, n)
+	case pqPlainDictionary, pqRLEDictionary:
+		if n == 0 {
+			return nil, nil
+		}
+		if len(data) == 0 || dict == nil {
+			return nil, fmt.Errorf("%w: dictionary page missing", ErrMalformed)
+		}
+		indexes, err := hybrid(data[1:], int(data[0]), n)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]interface{}, n)
+		for i, x := range indexes {
+			if x >= len(dict) {
+				return nil, fmt.Errorf("%w: dictionary index out of range", ErrMalformed)
+			}
+			ret[i] = dict[x]
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("%w: value encoding %d", ErrUnsupported, encoding)
+}
+
+// plain decodes n plain encoded values
+func (c *pqColumn) plain(data []byte, n int) ([]interface{}, error) {
+	if n < 0 || n > len(data)*8 {
+		return nil, fmt.Errorf("%w: bad value count", ErrMalformed)
+	}
+	width := map[int64]int{pqInt32: 4, pqInt64: 8, pqInt96: 12, pqFloat: 4, pqDouble: 8, pqFixed: c.typeLen}[c.physical]
+	if c.physical == pqBoolean {
+		width = 0
+		if (n+7)/8 > len(data) {
+			return nil, fmt.Errorf("%w: truncated values", ErrMalformed)
+		}
+	} else if width*n > len(data) {
+		return nil, fmt.Errorf("%w: truncated values", ErrMalformed)
+	}
+	ret := make([]interface{}, n)
+	for i := range ret {
+		switch c.physical {
+		case pqBoolean:
+			ret[i] = data[i/8]>>(i%8)&1 == 1
+		case pqInt32:
+			ret[i] = int64(int32(binary.LittleEndian.Uint32(data[4*i:])))
+		case pqInt64:
+			ret[i] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+		case pqInt96:
+			b := data[12*i:]
+			nanos := int64(binary.LittleEndian.Uint64(b))
+			day := int64(binary.LittleEndian.Uint32(b[8:])) - 2440588
+			ret[i] = time.Unix(day*86400, nanos).UTC()
+		case pqFloat:
+			ret[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		case pqDouble:
+			ret[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+		case pqFixed:
+			ret[i] = data[width*i : width*(i+1)]
+		case pqByteArray:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("%w: truncated values", ErrMalformed)
+			}
+			l := int64(binary.LittleEndian.Uint32(data))
+			if l > int64(len(data)-4) {
+				return nil, fmt.Errorf("%w: truncated values", ErrMalformed)
+			}
+			ret[i] = data[4 : 4+l]
+			data = data[4+l:]
+		default:
+			return nil, fmt.Errorf("%w: physical type %d", ErrUnsupported, c.physical)
+		}
+	}
+	return ret, nil
+}
+
+// convert converts a plain value into the Go value of its type
+func (c *pqColumn) convert(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case []byte:
+		switch c.converted {
+		case pqDecimal:
+			return decimal.NewFromBigInt(fromTwosComplement(x), int32(c.scale)), nil
+		case pqJSON:
+			if c.col.Type == common.TypeObject {
+				v, err := parseJSON(string(x))
+				if err != nil {
+					return nil, fmt.Errorf("%w: %v", document.ErrWrongFieldType, err)
+				}
+				return v, nil
+			}
+		}
+		return string(x), nil
+	case int64:
+		switch {
+		case c.converted == pqDecimal:
+			return decimal.New(x, int32(c.scale)), nil
+		case c.converted == pqDate:
+			return time.Unix(x*86400, 0).UTC(), nil
+		case c.unit == pqMillis:
+			return time.Unix(x/1e3, x%1e3*1e6).UTC(), nil
+		case c.unit == pqMicros:
+			return time.Unix(x/1e6, x%1e6*1e3).UTC(), nil
+		case c.unit == pqNanos:
+			return time.Unix(0, x).UTC(), nil
+		}
+	}
+	return v, nil
+}
+
+var zstdDecoder struct {
+	once sync.Once
+	d    *zstd.Decoder
+	err  error
+}
+
+// decompress decompresses a page compressed with codec into size
+// bytes
+func decompress(codec int64, data []byte, size int) ([]byte, error) {
+	var ret []byte
+	var err error
+	switch codec {
+	case pqUncompressed:
+		return data, nil
+	case pqSnappy:
+		ret, err = snappy.Decode(nil, data)
+	case pqGzip:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			ret, err = ioutil.ReadAll(io.LimitReader(zr, int64(size)+1))
+		}
+	case pqZstd:
+		zstdDecoder.once.Do(func() {
+			zstdDecoder.d, zstdDecoder.err = zstd.NewReader(nil)
+		})
+		if zstdDecoder.err != nil {
+			return nil, zstdDecoder.err
+		}
+		ret, err = zstdDecoder.d.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("%w: compression codec %d", ErrUnsupported, codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if len(ret) != size {
+		return nil, fmt.Errorf("%w: page of %d bytes instead of %d", ErrMalformed, len(ret), size)
+	}
+	return ret, nil
+}
@@ -0,0 +1,644 @@
+#!/usr/bin/env python3
+"""Parquet fixtures of the transfer tests.
+
+    python3 parquet.py           writes the fixtures next to this file
+    python3 parquet.py FILE...   checks files against the format and
+                                 prints their rows as JSON lines
+
+The fixtures are laid out the way pyarrow writes files, which the
+writer of the transfer package does not do: dictionary encoded
+strings, three level lists, FLOAT, INT32 and DATE columns, fixed
+length decimals, millisecond timestamps, gzip compression, several
+row groups and version 2 data pages. They are encoded from the
+format specification (https://github.com/apache/parquet-format) with
+the standard library only, sharing no code with the Go package.
+
+Files are checked with pyarrow when it is installed, else with the
+reader below, which fails on any field the specification requires
+and is missing and on sizes and counts which do not add up.
+"""
+
+import datetime
+import gzip
+import json
+import os
+import struct
+import sys
+
+HERE = os.path.dirname(os.path.abspath(__file__))
+
+# physical types
+BOOLEAN, INT32, INT64, INT96, FLOAT, DOUBLE, BYTE_ARRAY, FIXED = range(8)
+# repetitions
+REQUIRED, OPTIONAL, REPEATED = range(3)
+# converted types
+UTF8, LIST, DECIMAL, DATE, TIMESTAMP_MILLIS = 0, 3, 5, 6, 9
+# encodings
+PLAIN, RLE, RLE_DICTIONARY = 0, 3, 8
+# codecs
+UNCOMPRESSED, SNAPPY, GZIP = 0, 1, 2
+# page types
+DATA_PAGE, DICTIONARY_PAGE, DATA_PAGE_V2 = 0, 2, 3
+
+# thrift compact protocol
+
+T_TRUE, T_FALSE, T_I32, T_I64, T_BINARY, T_LIST, T_STRUCT = 1, 2, 5, 6, 8, 9, 12
+
+
+def uvarint(v):
+    out = bytearray()
+    while v >= 0x80:
+        out.append(v & 0x7F | 0x80)
+        v >>= 7
+    out.append(v)
+    return bytes(out)
+
+
+def zigzag(v):
+    return uvarint((v << 1) ^ (v >> 63))
+
+
+class I32(int):
+    pass
+
+
+class I64(int):
+    pass
+
+
+def ttype(v):
+    if isinstance(v, bool):
+        return T_TRUE if v else T_FALSE
+    if isinstance(v, I32):
+        return T_I32
+    if isinstance(v, I64):
+        return T_I64
+    if isinstance(v, (str, bytes)):
+        return T_BINARY
+    if isinstance(v, list):
+        return T_LIST
+    return T_STRUCT
+
+
+def tvalue(v):
+    if isinstance(v, bool):
+        return bytes([T_TRUE if v else T_FALSE])
+    if isinstance(v, (I32, I64)):
+        return zigzag(v)
+    if isinstance(v, str):
+        v = v.encode()
+    if isinstance(v, bytes):
+        return uvarint(len(v)) + v
+    if isinstance(v, list):
+        t = ttype(v[0]) if v else T_STRUCT
+        head = bytes([len(v) << 4 | t]) if len(v) < 15 else bytes([0xF0 | t]) + uvarint(len(v))
+        return head + b"".join(tvalue(e) for e in v)
+    return tstruct(v)
+
+
+def tstruct(fields):
+    """encodes a dict of field ids to values"""
+    out, last = bytearray(), 0
+    for fid in sorted(fields):
+        v = fields[fid]
+        if v is None:
+            continue
+        t = ttype(v)
+        if 0 < fid - last <= 15:
+            out.append((fid - last) << 4 | t)
+        else:
+            out.append(t)
+            out += zigzag(fid)
+        last = fid
+        if t not in (T_TRUE, T_FALSE):
+            out += tvalue(v)
+    out.append(0)
+    return bytes(out)
+
+
+class Decoder:
+    def __init__(self, buf, pos=0):
+        self.buf, self.pos = buf, pos
+
+    def byte(self):
+        self.pos += 1
+        return self.buf[self.pos - 1]
+
+    def uvarint(self):
+        v = shift = 0
+        while True:
+            b = self.byte()
+            v |= (b & 0x7F) << shift
+            shift += 7
+            if b < 0x80:
+                return v
+
+    def varint(self):
+        v = self.uvarint()
+        return (v >> 1) ^ -(v & 1)
+
+    def value(self, t):
+        if t in (T_TRUE, T_FALSE):
+            return t == T_TRUE
+        if t == 3:
+            return struct.unpack("b", bytes([self.byte()]))[0]
+        if t in (4, T_I32, T_I64):
+            return self.varint()
+        if t == 7:
+            self.pos += 8
+            return struct.unpack_from("<d", self.buf, self.pos - 8)[0]
+        if t == T_BINARY:
+            n = self.uvarint()
+            self.pos += n
+            return bytes(self.buf[self.pos - n : self.pos])
+        if t in (T_LIST, 10):
+            h = self.byte()
+            n = h >> 4
+            if n == 15:
+                n = self.uvarint()
+            et = h & 0x0F
+            if et in (T_TRUE, T_FALSE):
+                return [self.byte() == T_TRUE for _ in range(n)]
+            return [self.value(et) for _ in range(n)]
+        if t == 11:
+            n = self.uvarint()
+            kt = self.byte() if n else 0
+            return {self.value(kt >> 4): self.value(kt & 0x0F) for _ in range(n)}
+        if t == T_STRUCT:
+            return self.struct()
+        raise ValueError("bad thrift type %d" % t)
+
+    def struct(self):
+        ret, fid = {}, 0
+        while True:
+            h = self.byte()
+            if h == 0:
+                return ret
+            fid = fid + (h >> 4) if h >> 4 else self.varint()
+            ret[fid] = self.value(h & 0x0F)
+
+
+# encodings
+
+
+def hybrid(values, width, runs):
+    """encodes values in the RLE and bit packed hybrid encoding, as
+    RLE runs when runs is true, else as a single bit packed run"""
+    out = bytearray()
+    if runs:
+        i = 0
+        while i < len(values):
+            j = i
+            while j < len(values) and values[j] == values[i]:
+                j += 1
+            out += uvarint((j - i) << 1)
+            out += values[i].to_bytes((width + 7) // 8, "little")
+            i = j
+        return bytes(out)
+    groups = (len(values) + 7) // 8
+    bits = 0
+    for i, v in enumerate(values):
+        bits |= v << (i * width)
+    return uvarint(groups << 1 | 1) + bits.to_bytes(groups * width, "little")
+
+
+def levels_v1(values, width, runs):
+    data = hybrid(values, width, runs)
+    return struct.pack("<I", len(data)) + data
+
+
+def plain(physical, values, type_length=0):
+    out = bytearray()
+    for v in values:
+        if physical == INT32:
+            out += struct.pack("<i", v)
+        elif physical == INT64:
+            out += struct.pack("<q", v)
+        elif physical == FLOAT:
+            out += struct.pack("<f", v)
+        elif physical == DOUBLE:
+            out += struct.pack("<d", v)
+        elif physical == BYTE_ARRAY:
+            out += struct.pack("<I", len(v)) + v
+        elif physical == FIXED:
+            out += v.to_bytes(type_length, "big", signed=True)
+    return bytes(out)
+
+
+# writing
+
+
+class Column:
+    """a leaf column: path is the list of schema names from the top
+    level field, values the Python values of its rows, None or a list
+    for the list columns"""
+
+    def __init__(self, path, physical, max_def, max_rep=0, type_length=0, dictionary=False, convert=None):
+        self.path, self.physical, self.max_def, self.max_rep = path, physical, max_def, max_rep
+        self.type_length, self.dictionary = type_length, dictionary
+        self.convert = convert or (lambda v: v)
+
+    def levels(self, rows):
+        """returns the definition and repetition levels and the non null
+        values of rows"""
+        defs, reps, values = [], [], []
+        for v in rows:
+            if self.max_rep == 0:
+                reps.append(0)
+                defs.append(self.max_def if v is not None else 0)
+                if v is not None:
+                    values.append(self.convert(v))
+                continue
+            # optional list, repeated group, optional element
+            if v is None or not v:
+                reps.append(0)
+                defs.append(0 if v is None else 1)
+                continue
+            for i, e in enumerate(v):
+                reps.append(1 if i else 0)
+                defs.append(3)
+                values.append(self.convert(e))
+        return defs, reps, values
+
+
+def write(path, schema, columns, groups, codec, page_version=1, runs=False):
+    """writes the rows of the row groups groups, lists of dicts of top
+    level names to values, as a parquet file"""
+    out = bytearray(b"PAR1")
+
+    def compress(data):
+        return gzip.compress(data, mtime=0) if codec == GZIP else data
+
+    row_groups = []
+    for rows in groups:
+        chunks, total = [], 0
+        for c in columns:
+            defs, reps, values = c.levels([r.get(c.path[0]) for r in rows])
+            start = len(out)
+            dictionary_offset = None
+            encoding = PLAIN
+            if c.dictionary:
+                entries = sorted(set(values))
+                data = plain(c.physical, entries)
+                body = compress(data)
+                dictionary_offset = len(out)
+                out += tstruct({1: I32(DICTIONARY_PAGE), 2: I32(len(data)), 3: I32(len(body)),
+                                7: {1: I32(len(entries)), 2: I32(PLAIN)}})
+                out += body
+                width = max(1, (len(entries) - 1).bit_length())
+                values_data = bytes([width]) + hybrid([entries.index(v) for v in values], width, runs)
+                encoding = RLE_DICTIONARY
+            else:
+                values_data = plain(c.physical, values, c.type_length)
+            data_offset = len(out)
+            if page_version == 1:
+                data = b""
+                if c.max_rep:
+                    data += levels_v1(reps, c.max_rep.bit_length(), runs)
+                data += levels_v1(defs, c.max_def.bit_length(), runs) + values_data
+                body = compress(data)
+                out += tstruct({1: I32(DATA_PAGE), 2: I32(len(data)), 3: I32(len(body)),
+                                5: {1: I32(len(defs)), 2: I32(encoding), 3: I32(RLE), 4: I32(RLE)}})
+            else:
+                rl = hybrid(reps, c.max_rep.bit_length(), runs) if c.max_rep else b""
+                dl = hybrid(defs, c.max_def.bit_length(), runs)
+                body = rl + dl + compress(values_data)
+                data_len = len(rl) + len(dl) + len(values_data)
+                out += tstruct({1: I32(DATA_PAGE_V2), 2: I32(data_len), 3: I32(len(body)),
+                                8: {1: I32(len(defs)), 2: I32(defs.count(0)), 3: I32(len(rows)),
+                                    4: I32(encoding), 5: I32(len(dl)), 6: I32(len(rl)),
+                                    7: codec != UNCOMPRESSED}})
+            out += body
+            size = len(out) - start
+            total += size
+            encodings = [I32(PLAIN), I32(RLE)] + ([I32(RLE_DICTIONARY)] if c.dictionary else [])
+            chunks.append({2: I64(start), 3: {
+                1: I32(c.physical), 2: encodings, 3: list(c.path), 4: I32(codec),
+                5: I64(len(defs)), 6: I64(size), 7: I64(size), 9: I64(data_offset),
+                11: I64(dictionary_offset) if dictionary_offset is not None else None,
+            }})
+        row_groups.append({1: chunks, 2: I64(total), 3: I64(len(rows))})
+    meta = tstruct({1: I32(2), 2: schema, 3: I64(sum(len(g) for g in groups)), 4: row_groups,
+                    6: "kical transfer/testdata/parquet.py"})
+    out += meta + struct.pack("<I", len(meta)) + b"PAR1"
+    with open(os.path.join(HERE, path), "wb") as f:
+        f.write(out)
+
+
+def element(name, physical=None, repetition=OPTIONAL, children=None, converted=None, logical=None, **kw):
+    ret = {4: name, 3: I32(repetition)}
+    if physical is not None:
+        ret[1] = I32(physical)
+    if children is not None:
+        ret[5] = I32(children)
+    if converted is not None:
+        ret[6] = I32(converted)
+    if logical is not None:
+        ret[10] = logical
+    for fid, key in ((2, "type_length"), (7, "scale"), (8, "precision")):
+        if key in kw:
+            ret[fid] = I32(kw[key])
+    return ret
+
+
+def days(y, m, d):
+    return (datetime.date(y, m, d) - datetime.date(1970, 1, 1)).days
+
+
+def millis(*args):
+    t = datetime.datetime(*args, tzinfo=datetime.timezone.utc)
+    return int(t.timestamp() * 1000)
+
+
+def fixtures():
+    schema = [
+        {4: "schema", 5: I32(7)},
+        element("name", BYTE_ARRAY, converted=UTF8, logical={1: {}}),
+        element("count", INT32),
+        element("load", FLOAT),
+        element("labels", repetition=OPTIONAL, children=1, converted=LIST, logical={3: {}}),
+        element("list", repetition=REPEATED, children=1),
+        element("element", BYTE_ARRAY, converted=UTF8, logical={1: {}}),
+        element("price", FIXED, converted=DECIMAL, logical={5: {1: I32(2), 2: I32(10)}},
+                type_length=5, scale=2, precision=10),
+        element("seen", INT64, converted=TIMESTAMP_MILLIS, logical={8: {1: True, 2: {1: {}}}}),
+        element("day", INT32, converted=DATE, logical={6: {}}),
+    ]
+    columns = [
+        Column(["name"], BYTE_ARRAY, 1, dictionary=True, convert=str.encode),
+        Column(["count"], INT32, 1),
+        Column(["load"], FLOAT, 1),
+        Column(["labels", "list", "element"], BYTE_ARRAY, 3, 1, dictionary=True, convert=str.encode),
+        Column(["price"], FIXED, 1, type_length=5),
+        Column(["seen"], INT64, 1),
+        Column(["day"], INT32, 1),
+    ]
+    rows = [
+        {"name": "web", "count": 3, "load": 0.5, "labels": ["prod", "eu"], "price": 1234,
+         "seen": millis(2021, 3, 4, 5, 6, 7, 89000), "day": days(2021, 3, 4)},
+        {"name": "db", "count": -7, "labels": [], "price": -5, "day": days(1969, 12, 31)},
+        {"name": "web", "load": 1.25, "seen": 0},
+        {"count": 2147483647, "load": -2.0, "labels": ["x"], "price": 9999999999,
+         "seen": millis(1969, 7, 20, 20, 17, 40), "day": days(2000, 2, 29)},
+        {"name": "cache", "count": 0, "load": 0.0, "labels": ["c", "a", "b"], "price": 0,
+         "day": days(1970, 1, 1)},
+    ]
+    write("pyarrow_layout.parquet", schema, columns, [rows[:3], rows[3:]], GZIP)
+
+    # a sparse column, its null runs take a few bytes for many rows
+    schema = [
+        {4: "schema", 5: I32(2)},
+        element("id", INT64, repetition=REQUIRED),
+        element("note", BYTE_ARRAY, converted=UTF8, logical={1: {}}),
+    ]
+    columns = [
+        Column(["id"], INT64, 0),
+        Column(["note"], BYTE_ARRAY, 1, convert=str.encode),
+    ]
+    rows = [{"id": i + 1, "note": "reboot" if i == 700 else None} for i in range(1000)]
+    write("sparse.parquet", schema, columns, [rows[:600], rows[600:]], UNCOMPRESSED, page_version=2, runs=True)
+
+
+# checking
+
+
+def snappy_decode(data):
+    d = Decoder(data)
+    size = d.uvarint()
+    out, pos = bytearray(), d.pos
+    while pos < len(data):
+        tag = data[pos]
+        pos += 1
+        kind = tag & 3
+        if kind == 0:
+            n = tag >> 2
+            if n >= 60:
+                k = n - 59
+                n = int.from_bytes(data[pos : pos + k], "little")
+                pos += k
+            n += 1
+            out += data[pos : pos + n]
+            pos += n
+            continue
+        if kind == 1:
+            n, offset = 4 + (tag >> 2 & 7), (tag >> 5) << 8 | data[pos]
+            pos += 1
+        elif kind == 2:
+            n, offset = (tag >> 2) + 1, int.from_bytes(data[pos : pos + 2], "little")
+            pos += 2
+        else:
+            n, offset = (tag >> 2) + 1, int.from_bytes(data[pos : pos + 4], "little")
+            pos += 4
+        if offset == 0 or offset > len(out):
+            raise ValueError("bad snappy offset")
+        for _ in range(n):
+            out.append(out[-offset])
+    if len(out) != size:
+        raise ValueError("bad snappy length")
+    return bytes(out)
+
+
+def decompress(codec, data, size):
+    if codec == UNCOMPRESSED:
+        out = data
+    elif codec == SNAPPY:
+        out = snappy_decode(data)
+    elif codec == GZIP:
+        out = gzip.decompress(data)
+    else:
+        raise ValueError("codec %d" % codec)
+    if len(out) != size:
+        raise ValueError("page of %d bytes instead of %d" % (len(out), size))
+    return out
+
+
+def unhybrid(data, width, n):
+    d, out = Decoder(data), []
+    while len(out) < n:
+        h = d.uvarint()
+        if h & 1 == 0:
+            k = (width + 7) // 8
+            v = int.from_bytes(data[d.pos : d.pos + k], "little")
+            d.pos += k
+            out += [v] * (h >> 1)
+            continue
+        k = (h >> 1) * width
+        bits = int.from_bytes(data[d.pos : d.pos + k], "little")
+        d.pos += k
+        out += [bits >> (i * width) & ((1 << width) - 1) for i in range((h >> 1) * 8)]
+    return out[:n]
+
+
+def unplain(physical, data, n, type_length):
+    out, pos = [], 0
+    for i in range(n):
+        if physical == BOOLEAN:
+            out.append(bool(data[i // 8] >> (i % 8) & 1))
+            continue
+        if physical == BYTE_ARRAY:
+            k = struct.unpack_from("<I", data, pos)[0]
+            out.append(bytes(data[pos + 4 : pos + 4 + k]))
+            pos += 4 + k
+            continue
+        fmt = {INT32: "<i", INT64: "<q", FLOAT: "<f", DOUBLE: "<d"}.get(physical)
+        if fmt:
+            out.append(struct.unpack_from(fmt, data, pos)[0])
+            pos += struct.calcsize(fmt)
+        elif physical == FIXED:
+            out.append(int.from_bytes(data[pos : pos + type_length], "big", signed=True))
+            pos += type_length
+        else:
+            raise ValueError("physical type %d" % physical)
+    if physical != BOOLEAN and pos != len(data):
+        raise ValueError("%d bytes left after the values" % (len(data) - pos))
+    return out
+
+
+def require(fields, ids, what):
+    for i in ids:
+        if i not in fields:
+            raise ValueError("%s lacks required field %d" % (what, i))
+
+
+def leaves(schema):
+    """returns the name, element, max definition and repetition
+    levels of the leaves of the schema"""
+    out, pos = [], 1
+
+    def walk(top, d, r):
+        nonlocal pos
+        el = schema[pos]
+        pos += 1
+        require(el, [4], "schema element")
+        rep = el.get(3, REQUIRED)
+        d += rep != REQUIRED
+        r += rep == REPEATED
+        top = top or el[4].decode()
+        if el.get(5):
+            for _ in range(el[5]):
+                walk(top, d, r)
+            return
+        require(el, [1], "leaf schema element")
+        out.append((top, el, d, r))
+
+    for _ in range(schema[0].get(5, 0)):
+        walk(None, 0, 0)
+    if pos != len(schema):
+        raise ValueError("schema elements left")
+    return out
+
+
+def check(path):
+    with open(path, "rb") as f:
+        buf = f.read()
+    if buf[:4] != b"PAR1" or buf[-4:] != b"PAR1":
+        raise ValueError("not a parquet file")
+    n = struct.unpack_from("<I", buf, len(buf) - 8)[0]
+    d = Decoder(buf, len(buf) - 8 - n)
+    meta = d.struct()
+    if d.pos != len(buf) - 8:
+        raise ValueError("bad metadata length")
+    require(meta, [1, 2, 3, 4], "file metadata")
+    cols = leaves(meta[2])
+    rows = []
+    for g in meta[4]:
+        require(g, [1, 2, 3], "row group")
+        group = [{} for _ in range(g[3])]
+        if len(g[1]) != len(cols):
+            raise ValueError("%d column chunks for %d columns" % (len(g[1]), len(cols)))
+        for (name, el, max_def, max_rep), cc in zip(cols, g[1]):
+            require(cc, [2, 3], "column chunk")
+            md = cc[3]
+            require(md, [1, 2, 3, 4, 5, 6, 7, 9], "column metadata")
+            start = min(md[9], md.get(11, md[9]))
+            end, pos = start + md[7], start
+            values, defs, reps, dictionary = [], [], [], None
+            while pos < end:
+                d = Decoder(buf, pos)
+                h = d.struct()
+                require(h, [1, 2, 3], "page header")
+                body = buf[d.pos : d.pos + h[3]]
+                pos = d.pos + h[3]
+                if h[1] == DICTIONARY_PAGE:
+                    require(h[7], [1, 2], "dictionary page header")
+                    data = decompress(md[4], body, h[2])
+                    dictionary = unplain(el[1], data, h[7][1], el.get(2, 0))
+                    continue
+                if h[1] == DATA_PAGE:
+                    require(h[5], [1, 2, 3, 4], "data page header")
+                    ph, data = h[5], decompress(md[4], body, h[2])
+                    count, encoding = ph[1], ph[2]
+                    page_reps, page_defs = [0] * count, [max_def] * count
+                    for lv, mx in (("r", max_rep), ("d", max_def)):
+                        if mx == 0:
+                            continue
+                        k = struct.unpack_from("<I", data)[0]
+                        decoded = unhybrid(data[4 : 4 + k], mx.bit_length(), count)
+                        data = data[4 + k :]
+                        if lv == "r":
+                            page_reps = decoded
+                        else:
+                            page_defs = decoded
+                elif h[1] == DATA_PAGE_V2:
+                    ph = h[8]
+                    require(ph, [1, 2, 3, 4, 5, 6], "data page v2 header")
+                    count, encoding, rl, dl = ph[1], ph[4], ph[6], ph[5]
+                    page_reps = unhybrid(body[:rl], max_rep.bit_length(), count) if max_rep else [0] * count
+                    page_defs = unhybrid(body[rl : rl + dl], max_def.bit_length(), count) if max_def else [max_def] * count
+                    data = body[rl + dl :]
+                    if ph.get(7, True):
+                        data = decompress(md[4], data, h[2] - rl - dl)
+                else:
+                    continue
+                present = sum(1 for x in page_defs if x == max_def)
+                if encoding == PLAIN:
+                    values += unplain(el[1], data, present, el.get(2, 0))
+                elif encoding in (2, RLE_DICTIONARY):
+                    values += [dictionary[i] for i in unhybrid(data[1:], data[0], present)]
+                else:
+                    raise ValueError("encoding %d" % encoding)
+                defs += page_defs
+                reps += page_reps
+            if pos != end:
+                raise ValueError("%s: pages overrun the column chunk" % name)
+            if len(defs) != md[5]:
+                raise ValueError("%s: %d values instead of %d" % (name, len(defs), md[5]))
+            ri, vi = -1, 0
+            for dl, rl in zip(defs, reps):
+                ri += rl == 0
+                if max_rep and dl > 0:
+                    group[ri].setdefault(name, [])
+                if dl != max_def:
+                    continue
+                v = values[vi]
+                vi += 1
+                if isinstance(v, bytes):
+                    v = int.from_bytes(v, "big", signed=True) if el.get(6) == DECIMAL else v.decode()
+                if max_rep:
+                    group[ri][name].append(v)
+                else:
+                    group[ri][name] = v
+            if ri + 1 != len(group):
+                raise ValueError("%s: %d rows instead of %d" % (name, ri + 1, len(group)))
+        rows += group
+    if len(rows) != meta[3]:
+        raise ValueError("%d rows instead of %d" % (len(rows), meta[3]))
+    return rows
+
+
+def main(paths):
+    try:
+        import pyarrow.parquet as pq
+    except ImportError:
+        pq = None
+    for path in paths:
+        rows = pq.read_table(path).to_pylist() if pq else check(path)
+        for row in rows:
+            print(json.dumps(row, default=str, sort_keys=True))
+
+
+if __name__ == "__main__":
+    if len(sys.argv) > 1:
+        main(sys.argv[1:])
+    else:
+        fixtures()
@@ -0,0 +1,286 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+)
+
+// jsonText encodes v as JSON without escaping HTML characters
+func jsonText(v interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// parseJSON decodes a single JSON value keeping numbers exact
+func parseJSON(text string) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("trailing data after JSON value")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// text formats a value of the column c as a CSV cell: numbers in
+// decimal, times in RFC 3339, tags and objects in JSON and null as
+// an empty cell
+func (c *Column) text(v interface{}) (string, error) {
+	v, err := c.value(v)
+	if err != nil || v == nil {
+		return "", err
+	}
+	switch x := v.(type) {
+	case string:
+		if c.Type != common.TypeObject {
+			return x, nil
+		}
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case float64:
+		if c.Type == common.TypeFloat {
+			return strconv.FormatFloat(x, 'g', -1, 64), nil
+		}
+	case decimal.Decimal:
+		return x.String(), nil
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	}
+	return jsonText(v)
+}
+
+// parse converts a CSV cell into a value of the column c, an empty
+// cell is null, tags are a JSON array or a single tag and objects
+// are JSON
+func (c *Column) parse(text string) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+	var v interface{} = text
+	switch {
+	case c.Type == common.TypeObject, c.Type == common.TypeTag && strings.HasPrefix(text, "["):
+		var err error
+		v, err = parseJSON(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", c.Name, document.ErrWrongFieldType, err)
+		}
+	}
+	return c.value(v)
+}
+
+type csvWriter struct {
+	w    *csv.Writer
+	cols []Column
+}
+
+func newCSVWriter(w io.Writer, cols []Column) (*csvWriter, error) {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.Name
+	}
+	err := cw.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &csvWriter{w: cw, cols: cols}, nil
+}
+
+func (w *csvWriter) Write(rows []document.Row) error {
+	record := make([]string, len(w.cols))
+	for _, row := range rows {
+		for i := range w.cols {
+			var err error
+			record[i], err = w.cols[i].text(row[w.cols[i].Name])
+			if err != nil {
+				return err
+			}
+		}
+		err := w.w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	cols   []Column
+	header []int
+	n      int64
+}
+
+// newCSVReader reads the header naming the columns of the file
+func newCSVReader(r io.Reader, cols []Column) (*csvReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	ret := &csvReader{r: cr, cols: cols}
+	header, err := cr.Read()
+	if err == io.EOF {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	index := columnIndex(cols)
+	seen := make(map[string]bool, len(header))
+	for _, name := range header {
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownColumn, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%w: column %q repeated", ErrMalformed, name)
+		}
+		seen[name] = true
+		ret.header = append(ret.header, i)
+	}
+	return ret, nil
+}
+
+func (r *csvReader) Read() (document.Row, error) {
+	if r.header == nil {
+		return nil, io.EOF
+	}
+	record, err := r.r.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	r.n++
+	if len(record) != len(r.header) {
+		return nil, &RowError{Row: r.n, Err: fmt.Errorf("%w: %d cells for %d columns", ErrMalformed, len(record), len(r.header))}
+	}
+	row := make(document.Row, len(record))
+	for i, text := range record {
+		c := &r.cols[r.header[i]]
+		v, err := c.parse(text)
+		if err != nil {
+			return nil, &RowError{Row: r.n, Err: err}
+		}
+		if v != nil {
+			row[c.Name] = v
+		}
+	}
+	return row, nil
+}
+
+type jsonLinesWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+	cols    []Column
+}
+
+func newJSONLinesWriter(w io.Writer, cols []Column) *jsonLinesWriter {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	encoder.SetEscapeHTML(false)
+	return &jsonLinesWriter{w: bw, encoder: encoder, cols: cols}
+}
+
+// Write writes a JSON object per row, decimals are strings so that
+// no digit is lost and times are in RFC 3339
+func (w *jsonLinesWriter) Write(rows []document.Row) error {
+	for _, row := range rows {
+		line := make(map[string]interface{}, len(w.cols))
+		for i := range w.cols {
+			v, err := w.cols[i].value(row[w.cols[i].Name])
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				line[w.cols[i].Name] = v
+			}
+		}
+		err := w.encoder.Encode(line)
+		if err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+func (w *jsonLinesWriter) Close() error {
+	return w.w.Flush()
+}
+
+type jsonLinesReader struct {
+	r     *bufio.Reader
+	cols  []Column
+	index map[string]int
+	n     int64
+}
+
+func newJSONLinesReader(r io.Reader, cols []Column) *jsonLinesReader {
+	return &jsonLinesReader{r: bufio.NewReader(r), cols: cols, index: columnIndex(cols)}
+}
+
+// Read reads the next line holding a JSON object, blank lines are
+// skipped
+func (r *jsonLinesReader) Read() (document.Row, error) {
+	var line []byte
+	for len(bytes.TrimSpace(line)) == 0 {
+		var err error
+		line, err = r.r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	r.n++
+	v, err := parseJSON(string(line))
+	if err != nil {
+		return nil, &RowError{Row: r.n, Err: fmt.Errorf("%w: %v", ErrMalformed, err)}
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &RowError{Row: r.n, Err: fmt.Errorf("%w: not a JSON object", ErrMalformed)}
+	}
+	row := make(document.Row, len(obj))
+	for name, x := range obj {
+		i, ok := r.index[name]
+		if !ok {
+			return nil, &RowError{Row: r.n, Err: fmt.Errorf("%w: %q", ErrUnknownColumn, name)}
+		}
+		x, err = r.cols[i].value(x)
+		if err != nil {
+			return nil, &RowError{Row: r.n, Err: err}
+		}
+		if x != nil {
+			row[name] = x
+		}
+	}
+	return row, nil
+}
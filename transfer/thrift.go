@@ -0,0 +1,319 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Parquet metadata is encoded with the thrift compact protocol:
+// struct fields are a header holding the delta from the previous
+// field id and the type, integers are zigzag varints, binaries
+// are prefixed with their uvarint length and structs end with a
+// stop byte
+
+// Compact protocol types
+const (
+	thriftStop   = 0
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// tstruct is a struct to encode, its fields by increasing id
+type tstruct []tfield
+
+// tfield is a field of a struct, v is an int32, int64, bool,
+// string, []byte, tstruct or tlist
+type tfield struct {
+	id int16
+	v  interface{}
+}
+
+// tlist is a list of values of the same type
+type tlist []interface{}
+
+func thriftType(v interface{}) byte {
+	switch x := v.(type) {
+	case int32:
+		return thriftI32
+	case int64:
+		return thriftI64
+	case bool:
+		if x {
+			return thriftTrue
+		}
+		return thriftFalse
+	case string, []byte:
+		return thriftBinary
+	case tlist:
+		return thriftList
+	}
+	return thriftStruct
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendVarint(dst []byte, v int64) []byte {
+	return appendUvarint(dst, uint64(v<<1^v>>63))
+}
+
+// appendThrift appends the encoding of the value v
+func appendThrift(dst []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case int32:
+		return appendVarint(dst, int64(x))
+	case int64:
+		return appendVarint(dst, x)
+	case bool:
+		if x {
+			return append(dst, thriftTrue)
+		}
+		return append(dst, thriftFalse)
+	case string:
+		dst = appendUvarint(dst, uint64(len(x)))
+		return append(dst, x...)
+	case []byte:
+		dst = appendUvarint(dst, uint64(len(x)))
+		return append(dst, x...)
+	case tlist:
+		typ := byte(thriftStruct)
+		if len(x) != 0 {
+			typ = thriftType(x[0])
+		}
+		if typ == thriftTrue || typ == thriftFalse {
+			typ = thriftTrue
+		}
+		if len(x) < 15 {
+			dst = append(dst, byte(len(x))<<4|typ)
+		} else {
+			dst = append(dst, 0xf0|typ)
+			dst = appendUvarint(dst, uint64(len(x)))
+		}
+		for _, e := range x {
+			dst = appendThrift(dst, e)
+		}
+		return dst
+	case tstruct:
+		last := int16(0)
+		for _, f := range x {
+			typ := thriftType(f.v)
+			if d := f.id - last; d > 0 && d <= 15 {
+				dst = append(dst, byte(d)<<4|typ)
+			} else {
+				dst = append(dst, typ)
+				dst = appendVarint(dst, int64(f.id))
+			}
+			last = f.id
+			if _, ok := f.v.(bool); !ok {
+				dst = appendThrift(dst, f.v)
+			}
+		}
+		return append(dst, thriftStop)
+	}
+	panic(fmt.Sprintf("transfer: cannot encode %T", v))
+}
+
+// tvalues is a decoded struct, its fields by id: integers are
+// int64, binaries []byte, structs tvalues and lists and sets
+// []interface{}, maps are skipped
+type tvalues map[int16]interface{}
+
+func (t tvalues) int(id int16) int64 {
+	x, _ := t[id].(int64)
+	return x
+}
+
+func (t tvalues) has(id int16) bool {
+	_, ok := t[id]
+	return ok
+}
+
+func (t tvalues) str(id int16) string {
+	x, _ := t[id].([]byte)
+	return string(x)
+}
+
+func (t tvalues) bool(id int16, def bool) bool {
+	x, ok := t[id].(bool)
+	if !ok {
+		return def
+	}
+	return x
+}
+
+func (t tvalues) strct(id int16) tvalues {
+	x, _ := t[id].(tvalues)
+	return x
+}
+
+func (t tvalues) list(id int16) []interface{} {
+	x, _ := t[id].([]interface{})
+	return x
+}
+
+// thriftDecoder decodes values of the compact protocol from buf
+type thriftDecoder struct {
+	buf   []byte
+	pos   int
+	depth int
+}
+
+var errThrift = fmt.Errorf("%w: bad thrift encoding", ErrMalformed)
+
+func (d *thriftDecoder) byte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errThrift
+	}
+	d.pos++
+	return d.buf[d.pos-1], nil
+}
+
+func (d *thriftDecoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, errThrift
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *thriftDecoder) varint() (int64, error) {
+	v, err := d.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (d *thriftDecoder) value(typ byte) (interface{}, error) {
+	switch typ {
+	case thriftTrue:
+		return true, nil
+	case thriftFalse:
+		return false, nil
+	case thriftByte:
+		b, err := d.byte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return d.varint()
+	case thriftDouble:
+		if d.pos+8 > len(d.buf) {
+			return nil, errThrift
+		}
+		d.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(d.buf[d.pos-8:])), nil
+	case thriftBinary:
+		n, err := d.uvarint()
+		if err != nil || n > uint64(len(d.buf)-d.pos) {
+			return nil, errThrift
+		}
+		d.pos += int(n)
+		return d.buf[d.pos-int(n) : d.pos], nil
+	case thriftList, thriftSet:
+		return d.list()
+	case thriftMap:
+		return nil, d.skipMap()
+	case thriftStruct:
+		return d.strct()
+	}
+	return nil, errThrift
+}
+
+func (d *thriftDecoder) list() ([]interface{}, error) {
+	h, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	n := uint64(h >> 4)
+	if n == 15 {
+		n, err = d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		return nil, errThrift
+	}
+	typ := h & 0x0f
+	ret := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var v interface{}
+		if typ == thriftTrue || typ == thriftFalse {
+			var b byte
+			b, err = d.byte()
+			v = b == thriftTrue
+		} else {
+			v, err = d.value(typ)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func (d *thriftDecoder) skipMap() error {
+	n, err := d.uvarint()
+	if err != nil || n == 0 {
+		return err
+	}
+	types, err := d.byte()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, err = d.value(types >> 4); err != nil {
+			return err
+		}
+		if _, err = d.value(types & 0x0f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *thriftDecoder) strct() (tvalues, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > 64 {
+		return nil, errThrift
+	}
+	ret := make(tvalues)
+	id := int16(0)
+	for {
+		h, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		if h == thriftStop {
+			return ret, nil
+		}
+		if delta := h >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v, err := d.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		ret[id], err = d.value(h & 0x0f)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
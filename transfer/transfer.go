@@ -0,0 +1,459 @@
+// Package transfer exports tables to and imports them from files
+// in the formats of analysts' tools: CSV, JSON lines and Parquet.
+// Every column maps to a field of the table and its values to the
+// declared type of the field, rows are written and read a chunk
+// at a time and rows failing to import are reported one by one.
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/analytical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/document"
+)
+
+// Format is a file format
+type Format string
+
+// Formats
+const (
+	CSV       Format = "csv"
+	JSONLines Format = "jsonl"
+	Parquet   Format = "parquet"
+)
+
+// Columns of kv tables
+const (
+	KeyColumn   = "key"
+	ValueColumn = "value"
+)
+
+// ExportChunk is the number of rows of row document and kv tables
+// read at once by Export
+const ExportChunk = 1024
+
+// ErrUnknownFormat as is
+var ErrUnknownFormat = fmt.Errorf("Unknown file format")
+
+// ErrUnknownColumn is returned when a file holds a column which is
+// not a field of the table
+var ErrUnknownColumn = fmt.Errorf("Unknown column")
+
+// ErrUnsupported is returned for files using features of their
+// format which are not supported
+var ErrUnsupported = fmt.Errorf("Unsupported file")
+
+// ErrMalformed is returned for corrupted files
+var ErrMalformed = fmt.Errorf("Malformed file")
+
+// ErrTooManyErrors is returned when an import rejects more rows
+// than ImportOptions.MaxErrors
+var ErrTooManyErrors = fmt.Errorf("Too many rejected rows")
+
+// ParseFormat returns the format named name
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case CSV, JSONLines, Parquet:
+		return f, nil
+	case "json", "ndjson":
+		return JSONLines, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// Column is a column of a file and the field it maps to
+type Column struct {
+	Name string
+	Type byte
+	// Precision and Scale of decimal fields, a zero Precision
+	// leaves them unconstrained
+	Precision int
+	Scale     int
+}
+
+// Columns returns the columns of the table tbl: the primary key
+// then the fields of a row document or analytical table in the
+// order of their declaration, the key and the value, an object,
+// of a kv table
+func Columns(tbl *kical.Table) ([]Column, error) {
+	if tbl.IsKV() {
+		return []Column{
+			{Name: KeyColumn, Type: common.TypeString},
+			{Name: ValueColumn, Type: common.TypeObject},
+		}, nil
+	}
+	var schema interface {
+		FieldType(name string) (byte, bool)
+	}
+	m := tbl.GetMetadata()
+	pk := ""
+	switch {
+	case tbl.IsRowDocument():
+		schema = tbl.Document
+		if m.PrimaryKey != nil {
+			pk = m.PrimaryKey.Name
+		}
+	case tbl.IsAnalytical():
+		schema = tbl.Analytical
+		pk = tbl.Analytical.PrimaryKey()
+	default:
+		return nil, common.ErrWrongStorageType
+	}
+	var ret []Column
+	if _, ok := m.Field(pk); pk != "" && !ok {
+		typ, _ := schema.FieldType(pk)
+		ret = append(ret, Column{Name: pk, Type: typ})
+	}
+	for _, f := range m.Fields {
+		ret = append(ret, Column{Name: f.Name, Type: f.Type, Precision: f.Precision, Scale: f.Scale})
+	}
+	return ret, nil
+}
+
+// Writer writes rows into a file
+type Writer interface {
+	// Write writes a chunk of rows
+	Write(rows []document.Row) error
+	// Close writes what is left and the end of the file, it does
+	// not close the underlying writer
+	Close() error
+}
+
+// NewWriter creates a writer of files of the format f holding the
+// columns cols, fields of rows which are not columns are left out
+func NewWriter(f Format, w io.Writer, cols []Column) (Writer, error) {
+	switch f {
+	case CSV:
+		return newCSVWriter(w, cols)
+	case JSONLines:
+		return newJSONLinesWriter(w, cols), nil
+	case Parquet:
+		return newParquetWriter(w, cols)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, string(f))
+}
+
+// RowError is a row rejected by a Reader or an import, Row counts
+// the rows of the file from 1
+type RowError struct {
+	Row int64
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads rows from a file
+type Reader interface {
+	// Read returns the next row, holding the values of the columns
+	// in the canonical Go types of their fields, or io.EOF. A row
+	// which cannot be read is skipped with a *RowError, any other
+	// error ends the file
+	Read() (document.Row, error)
+}
+
+// NewReader creates a reader of files of the format f, they may
+// hold any of the columns cols and no other. Parquet files are
+// read from their end, r is read into memory unless it is an
+// io.ReaderAt and an io.Seeker
+func NewReader(f Format, r io.Reader, cols []Column) (Reader, error) {
+	switch f {
+	case CSV:
+		return newCSVReader(r, cols)
+	case JSONLines:
+		return newJSONLinesReader(r, cols), nil
+	case Parquet:
+		return newParquetReader(r, cols)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, string(f))
+}
+
+func columnIndex(cols []Column) map[string]int {
+	ret := make(map[string]int, len(cols))
+	for i, c := range cols {
+		ret[c.Name] = i
+	}
+	return ret
+}
+
+// Export writes the rows of the table tbl into w in the format f,
+// it returns the number of rows written. Rows are read a chunk at
+// a time, rows written while the table is exported may be missed.
+func Export(tbl *kical.Table, w io.Writer, f Format) (int64, error) {
+	cols, err := Columns(tbl)
+	if err != nil {
+		return 0, err
+	}
+	fw, err := NewWriter(f, w, cols)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	write := func(rows []document.Row) error {
+		n += int64(len(rows))
+		return fw.Write(rows)
+	}
+	switch {
+	case tbl.IsKV():
+		err = exportKV(tbl, write)
+	case tbl.IsRowDocument():
+		err = exportDocument(tbl.Document, write)
+	default:
+		err = tbl.Analytical.Chunks(func(rows []document.Row) (bool, error) {
+			return true, write(rows)
+		})
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, fw.Close()
+}
+
+func exportKV(tbl *kical.Table, write func([]document.Row) error) error {
+	cursor := ""
+	for {
+		entries, next, err := tbl.KV.Scan(cursor, ExportChunk)
+		if err != nil {
+			return err
+		}
+		rows := make([]document.Row, len(entries))
+		for i, e := range entries {
+			rows[i] = document.Row{KeyColumn: e.Key, ValueColumn: e.Value}
+		}
+		err = write(rows)
+		if err != nil || next == "" {
+			return err
+		}
+		cursor = next
+	}
+}
+
+func exportDocument(d *document.Document, write func([]document.Row) error) error {
+	cursor := ""
+	for {
+		rows, next, err := d.Scan(cursor, ExportChunk)
+		if err != nil {
+			return err
+		}
+		err = write(rows)
+		if err != nil || next == "" {
+			return err
+		}
+		cursor = next
+	}
+}
+
+// ImportOptions are the options of Import
+type ImportOptions struct {
+	// Format of the file, CSV by default
+	Format Format
+	// Chunk is the number of bytes buffered by the bulk loader of
+	// row document and kv tables, storage.DefaultLoaderChunk when
+	// it is not positive
+	Chunk int
+	// MaxErrors is the number of rows which may be rejected before
+	// the import fails with ErrTooManyErrors, unlimited when it is
+	// negative
+	MaxErrors int
+}
+
+// Report describes an import
+type Report struct {
+	// Rows is the number of rows read
+	Rows int64
+	// Imported is the number of rows stored
+	Imported int64
+	// Errors lists the rejected rows
+	Errors []*RowError
+}
+
+// Import reads the rows of a file from r into the table tbl. Row
+// document and kv tables are written through a bulk loader, kv
+// rows are a key and a value column, rows of analytical tables are
+// appended a chunk at a time and get new ids. Rows failing to be
+// read or stored are skipped and listed in the report, the file is
+// imported unless more than opts.MaxErrors rows are rejected.
+// Chunks are stored as they fill up, so a failed import keeps the
+// rows stored until then, as counted by the report.
+func Import(tbl *kical.Table, r io.Reader, opts *ImportOptions) (*Report, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	f := opts.Format
+	if f == "" {
+		f = CSV
+	}
+	cols, err := Columns(tbl)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := NewReader(f, r, cols)
+	if err != nil {
+		return nil, err
+	}
+	im := &importer{opts: opts, report: new(Report)}
+	if tbl.IsAnalytical() {
+		err = im.analytical(fr, tbl.Analytical)
+	} else {
+		err = im.bulk(fr, tbl)
+	}
+	return im.report, err
+}
+
+type importer struct {
+	opts   *ImportOptions
+	report *Report
+}
+
+// reject records a rejected row, it fails once there are too many
+func (im *importer) reject(row int64, err error) error {
+	im.report.Errors = append(im.report.Errors, &RowError{Row: row, Err: err})
+	if im.opts.MaxErrors >= 0 && len(im.report.Errors) > im.opts.MaxErrors {
+		return fmt.Errorf("%w: %d", ErrTooManyErrors, len(im.report.Errors))
+	}
+	return nil
+}
+
+// each calls fn on every row read by fr, with its number
+func (im *importer) each(fr Reader, fn func(n int64, row document.Row) error) error {
+	for {
+		row, err := fr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		im.report.Rows++
+		var rerr *RowError
+		if errors.As(err, &rerr) {
+			err = im.reject(rerr.Row, rerr.Err)
+		} else if err == nil {
+			err = fn(im.report.Rows, row)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (im *importer) bulk(fr Reader, tbl *kical.Table) error {
+	b, err := tbl.BulkLoad(im.opts.Chunk)
+	if err != nil {
+		return err
+	}
+	// loaded counts the rows written into the loader, those of the
+	// chunks stored so far are imported
+	loaded, chunks := int64(0), 0
+	err = im.each(fr, func(n int64, row document.Row) error {
+		var err error
+		if tbl.IsKV() {
+			key, ok := row[KeyColumn].(string)
+			if !ok {
+				return im.reject(n, document.ErrMissingPrimaryKey)
+			}
+			err = b.Set(key, row[ValueColumn])
+		} else {
+			_, err = b.Insert(row)
+		}
+		if err != nil && rowFailure(err) {
+			return im.reject(n, err)
+		}
+		if err != nil {
+			return err
+		}
+		loaded++
+		if st := b.Stats(); st.Chunks != chunks {
+			chunks = st.Chunks
+			im.report.Imported = loaded
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return err
+	}
+	err = b.Commit()
+	if err != nil {
+		return err
+	}
+	im.report.Imported = loaded
+	return nil
+}
+
+// rowFailure reports whether err rejects a single row rather than
+// the import
+func rowFailure(err error) bool {
+	var verr *document.ValidationError
+	return errors.As(err, &verr) ||
+		errors.Is(err, document.ErrDuplicateKey) ||
+		errors.Is(err, document.ErrUniqueViolation) ||
+		errors.Is(err, document.ErrMissingPrimaryKey) ||
+		errors.Is(err, document.ErrWrongFieldType) ||
+		errors.Is(err, document.ErrUnknownField) ||
+		errors.Is(err, document.ErrInvalidTag) ||
+		errors.Is(err, document.ErrConstraintViolation) ||
+		errors.Is(err, document.ErrReferenceViolation)
+}
+
+func (im *importer) analytical(fr Reader, a *analytical.Analytical) error {
+	var rows []document.Row
+	var numbers []int64
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		_, err := a.Append(rows...)
+		if err == nil {
+			im.report.Imported += int64(len(rows))
+		} else if rowFailure(err) {
+			// find the failing rows by appending them one by one
+			for i, row := range rows {
+				_, err = a.Append(row)
+				if err == nil {
+					im.report.Imported++
+					continue
+				}
+				if !rowFailure(err) {
+					return err
+				}
+				err = im.reject(numbers[i], err)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			return err
+		}
+		rows, numbers = rows[:0], numbers[:0]
+		return nil
+	}
+	err := im.each(fr, func(n int64, row document.Row) error {
+		rows = append(rows, row)
+		numbers = append(numbers, n)
+		if len(rows) < a.ChunkSize() {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// value converts v into the canonical Go type of the column c
+func (c *Column) value(v interface{}) (interface{}, error) {
+	nv, err := document.NormalizeValue(c.Type, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Name, err)
+	}
+	return nv, nil
+}
@@ -0,0 +1,396 @@
+package transfer_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/storage"
+	"github.com/xtlsoft/kical/transfer"
+)
+
+func newDatabase(t *testing.T) *kical.Database {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	t.Cleanup(func() { drv.Close() })
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func assetsMeta(typ byte) *metaparser.Metadata {
+	return &metaparser.Metadata{
+		StorageType: typ,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "kind", Type: common.TypeEnum},
+			{Name: "labels", Type: common.TypeTag},
+			{Name: "count", Type: common.TypeInteger},
+			{Name: "load", Type: common.TypeFloat},
+			{Name: "price", Type: common.TypeDecimal, Precision: 10, Scale: 2},
+			{Name: "balance", Type: common.TypeDecimal, Precision: 30, Scale: 4},
+			{Name: "ratio", Type: common.TypeDecimal},
+			{Name: "seen", Type: common.TypeTime},
+			{Name: "spec", Type: common.TypeObject},
+		},
+	}
+}
+
+func assets(n int) []document.Row {
+	kinds := []string{"disk", "host", "switch"}
+	var rows []document.Row
+	for i := 0; i < n; i++ {
+		row := document.Row{
+			"name":    fmt.Sprintf("asset, \"%d\"", i),
+			"kind":    kinds[i%len(kinds)],
+			"count":   int64(i - 5),
+			"load":    float64(i) / 8,
+			"price":   decimal.New(int64(i*101-250), 2),
+			"balance": decimal.MustParse(fmt.Sprintf("-123456789012345678901.%04d", i)),
+			"ratio":   decimal.MustParse(fmt.Sprintf("0.%d00", i+1)),
+			"seen":    time.Date(1969+i%200, 12, 31, 23, 59, 59, 123456000, time.UTC),
+			"spec":    map[string]interface{}{"slots": int64(i), "vendor": "acme", "ok": i%2 == 0},
+		}
+		if i%3 != 0 {
+			row["labels"] = []string{"prod", fmt.Sprintf("rack%d", i%4)}
+		}
+		if i%4 == 0 {
+			delete(row, "load")
+			delete(row, "spec")
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func createAssets(t *testing.T, db *kical.Database, name string, typ byte) *kical.Table {
+	tbl, err := db.CreateTable(name, assetsMeta(typ))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tbl
+}
+
+func documentRows(t *testing.T, tbl *kical.Table) []document.Row {
+	rows, _, err := tbl.Document.Scan("", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func analyticalRows(t *testing.T, tbl *kical.Table) []document.Row {
+	var ret []document.Row
+	err := tbl.Analytical.Chunks(func(rows []document.Row) (bool, error) {
+		ret = append(ret, rows...)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// equalRows compares rows, decimals by value and times by instant
+func equalRows(t *testing.T, got, want []document.Row) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("row %d: got %v, want %v", i, got[i], want[i])
+		}
+		for k, w := range want[i] {
+			g := got[i][k]
+			switch x := w.(type) {
+			case decimal.Decimal:
+				if y, ok := g.(decimal.Decimal); !ok || !x.Equal(y) {
+					t.Fatalf("row %d %s: got %v, want %v", i, k, g, w)
+				}
+			case time.Time:
+				if y, ok := g.(time.Time); !ok || !x.Equal(y) {
+					t.Fatalf("row %d %s: got %v, want %v", i, k, g, w)
+				}
+			default:
+				if !reflect.DeepEqual(g, w) {
+					t.Fatalf("row %d %s: got %#v, want %#v", i, k, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	db := newDatabase(t)
+	src := createAssets(t, db, "assets", metaparser.MetaStorageTypeRowDocument)
+	s := src.Document.NewSession()
+	for _, row := range assets(50) {
+		if _, err := s.Insert(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := documentRows(t, src)
+	for _, f := range []transfer.Format{transfer.CSV, transfer.JSONLines, transfer.Parquet} {
+		buf := new(bytes.Buffer)
+		n, err := transfer.Export(src, buf, f)
+		if err != nil || n != 50 {
+			t.Fatalf("%s export: %d %v", f, n, err)
+		}
+		dst := createAssets(t, db, "assets_"+string(f), metaparser.MetaStorageTypeRowDocument)
+		report, err := transfer.Import(dst, bytes.NewReader(buf.Bytes()), &transfer.ImportOptions{Format: f, Chunk: 1024})
+		if err != nil || report.Rows != 50 || report.Imported != 50 || len(report.Errors) != 0 {
+			t.Fatalf("%s import: %+v %v", f, report, err)
+		}
+		equalRows(t, documentRows(t, dst), want)
+
+		// explicit ids move the auto increment counter
+		s := dst.Document.NewSession()
+		pk, err := s.Insert(document.Row{"name": "new"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if dst.Document.KeyText(pk) != "51" {
+			t.Fatalf("%s: next id %s", f, dst.Document.KeyText(pk))
+		}
+	}
+}
+
+func TestAnalyticalParquet(t *testing.T) {
+	db := newDatabase(t)
+	src := createAssets(t, db, "events", metaparser.MetaStorageTypeAnalytical)
+	if _, err := src.Analytical.Append(assets(600)...); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if n, err := transfer.Export(src, buf, transfer.Parquet); err != nil || n != 600 {
+		t.Fatalf("export: %d %v", n, err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("PAR1")) || !bytes.HasSuffix(buf.Bytes(), []byte("PAR1")) {
+		t.Fatal("not a parquet file")
+	}
+	dst := createAssets(t, db, "events_copy", metaparser.MetaStorageTypeAnalytical)
+	report, err := transfer.Import(dst, bytes.NewReader(buf.Bytes()), &transfer.ImportOptions{Format: transfer.Parquet})
+	if err != nil || report.Imported != 600 {
+		t.Fatalf("import: %+v %v", report, err)
+	}
+	equalRows(t, analyticalRows(t, dst), analyticalRows(t, src))
+}
+
+func TestKVTransfer(t *testing.T) {
+	db := newDatabase(t)
+	src, err := db.CreateTable("reg", &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := src.KV.NewSession()
+	s.Set("a", "x")
+	s.Set("b", int64(2))
+	s.Set("c", map[string]interface{}{"n": 1.5})
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []transfer.Format{transfer.CSV, transfer.JSONLines, transfer.Parquet} {
+		buf := new(bytes.Buffer)
+		if _, err := transfer.Export(src, buf, f); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := db.CreateTable("reg_"+string(f), &metaparser.Metadata{StorageType: metaparser.MetaStorageTypeKV})
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := transfer.Import(dst, buf, &transfer.ImportOptions{Format: f})
+		if err != nil || report.Imported != 3 {
+			t.Fatalf("%s import: %+v %v", f, report, err)
+		}
+		want, _, _ := src.KV.Scan("", 10)
+		got, _, _ := dst.KV.Scan("", 10)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", f, got, want)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	db := newDatabase(t)
+	tbl, err := db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "cores", Type: common.TypeInteger},
+			{Name: "seen", Type: common.TypeTime},
+		},
+		Unique: []string{"name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := "name,cores,seen\n" +
+		"a,4,2021-02-03\n" +
+		"b,four,\n" +
+		"c,8,yesterday\n" +
+		"a,2,\n" +
+		"d\n" +
+		"e,16,2021-02-03T04:05:06+08:00\n"
+	report, err := transfer.Import(tbl, strings.NewReader(file), &transfer.ImportOptions{MaxErrors: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 6 || report.Imported != 2 || len(report.Errors) != 4 {
+		t.Fatalf("report %+v", report)
+	}
+	var rejected []int64
+	for _, e := range report.Errors {
+		rejected = append(rejected, e.Row)
+	}
+	if !reflect.DeepEqual(rejected, []int64{2, 3, 4, 5}) {
+		t.Fatalf("rejected rows %v", rejected)
+	}
+	if !errors.Is(report.Errors[0], document.ErrWrongFieldType) || !errors.Is(report.Errors[2], document.ErrUniqueViolation) {
+		t.Fatalf("errors %v", report.Errors)
+	}
+
+	other, err := db.CreateTable("hosts2", tbl.GetMetadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = transfer.Import(other, strings.NewReader(file), &transfer.ImportOptions{MaxErrors: 1})
+	if !errors.Is(err, transfer.ErrTooManyErrors) || len(report.Errors) != 2 {
+		t.Fatalf("max errors: %+v %v", report, err)
+	}
+	if _, err := transfer.Import(other, strings.NewReader("name,os\nx,linux\n"), nil); !errors.Is(err, transfer.ErrUnknownColumn) {
+		t.Fatalf("unknown column: %v", err)
+	}
+
+	lines := `{"name": "j1", "cores": 2}` + "\n\n" + `{"name": "j2", "gpu": true}` + "\n" + `{"name": ` + "\n"
+	report, err = transfer.Import(other, strings.NewReader(lines), &transfer.ImportOptions{Format: transfer.JSONLines, MaxErrors: -1})
+	if err != nil || report.Imported != 1 || len(report.Errors) != 2 || !errors.Is(report.Errors[0], transfer.ErrUnknownColumn) || report.Errors[1].Row != 3 {
+		t.Fatalf("jsonl: %+v %v", report, err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	cols := []transfer.Column{
+		{Name: "n", Type: common.TypeInteger},
+		{Name: "tags", Type: common.TypeTag},
+	}
+	r, err := transfer.NewReader(transfer.CSV, strings.NewReader("tags,n\nsolo,1\n\"[\"\"b\"\",\"\"a\"\"]\",\n"), cols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []document.Row
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	want := []document.Row{{"n": int64(1), "tags": []string{"solo"}}, {"tags": []string{"a", "b"}}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+	if _, err := transfer.NewReader(transfer.Parquet, strings.NewReader("PAR1 not really PAR1"), cols); !errors.Is(err, transfer.ErrMalformed) {
+		t.Fatalf("bad parquet: %v", err)
+	}
+	if _, err := transfer.ParseFormat("xlsx"); !errors.Is(err, transfer.ErrUnknownFormat) {
+		t.Fatalf("format: %v", err)
+	}
+}
+
+// readFixture reads the rows of a Parquet file of testdata, written
+// by testdata/parquet.py
+func readFixture(t *testing.T, name string, cols []transfer.Column) []document.Row {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := transfer.NewReader(transfer.Parquet, f, cols)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var rows []document.Row
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestParquetFixtures(t *testing.T) {
+	rows := readFixture(t, "pyarrow_layout.parquet", []transfer.Column{
+		{Name: "name", Type: common.TypeString},
+		{Name: "count", Type: common.TypeInteger},
+		{Name: "load", Type: common.TypeFloat},
+		{Name: "labels", Type: common.TypeTag},
+		{Name: "price", Type: common.TypeDecimal, Precision: 10, Scale: 2},
+		{Name: "seen", Type: common.TypeTime},
+		{Name: "day", Type: common.TypeTime},
+	})
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	equalRows(t, rows, []document.Row{
+		{
+			"name": "web", "count": int64(3), "load": 0.5, "labels": []string{"eu", "prod"},
+			"price": decimal.New(1234, 2), "seen": time.Date(2021, 3, 4, 5, 6, 7, 89e6, time.UTC),
+			"day": day(2021, 3, 4),
+		},
+		{"name": "db", "count": int64(-7), "price": decimal.New(-5, 2), "day": day(1969, 12, 31)},
+		{"name": "web", "load": 1.25, "seen": time.Unix(0, 0)},
+		{
+			"count": int64(2147483647), "load": -2.0, "labels": []string{"x"},
+			"price": decimal.MustParse("99999999.99"), "seen": time.Date(1969, 7, 20, 20, 17, 40, 0, time.UTC),
+			"day": day(2000, 2, 29),
+		},
+		{
+			"name": "cache", "count": int64(0), "load": 0.0, "labels": []string{"a", "b", "c"},
+			"price": decimal.New(0, 2), "day": day(1970, 1, 1),
+		},
+	})
+
+	rows = readFixture(t, "sparse.parquet", []transfer.Column{
+		{Name: "id", Type: common.TypeInteger},
+		{Name: "note", Type: common.TypeString},
+	})
+	if len(rows) != 1000 {
+		t.Fatalf("got %d rows", len(rows))
+	}
+	for i, row := range rows {
+		if row["id"] != int64(i+1) || (row["note"] != nil) != (i == 700) {
+			t.Fatalf("row %d: got %v", i, row)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package kical
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// view is a materialized view known to the database, lock
+// serializes its maintenance
+type view struct {
+	name string
+	sel  *query.Select
+	lock sync.Mutex
+}
+
+// viewHub lists the materialized views of every source table, it
+// is read from the metadata of the tables on first use
+type viewHub struct {
+	lock   sync.Mutex
+	loaded bool
+	views  map[string][]*view
+}
+
+func newViewHub() *viewHub {
+	return &viewHub{
+		views: make(map[string][]*view),
+	}
+}
+
+// of returns the views of the table source
+func (h *viewHub) of(db *Database, source string) ([]*view, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.loaded {
+		err := h.load(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.views[source], nil
+}
+
+func (h *viewHub) load(db *Database) error {
+	tables, err := db.Tables()
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		s, err := db.driver.OpenBucket(name)
+		if err != nil {
+			return err
+		}
+		def, err := metaparser.NewParser(s).GetView()
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sel, err := parseView(def.Query)
+		if err != nil {
+			return fmt.Errorf("view %s: %w", name, err)
+		}
+		h.addLocked(&view{name: name, sel: sel})
+	}
+	h.loaded = true
+	return nil
+}
+
+// add registers v unless the views are still to be read, which
+// would find it
+func (h *viewHub) add(v *view) *view {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.loaded {
+		return v
+	}
+	return h.addLocked(v)
+}
+
+func (h *viewHub) addLocked(v *view) *view {
+	for _, u := range h.views[v.sel.Table] {
+		if u.name == v.name {
+			return u
+		}
+	}
+	h.views[v.sel.Table] = append(h.views[v.sel.Table], v)
+	return v
+}
+
+func parseView(src string) (*query.Select, error) {
+	stmt, err := query.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(*query.Select)
+	if !ok {
+		return nil, fmt.Errorf("%w: a view is a SELECT query", query.ErrInvalidView)
+	}
+	return sel, nil
+}
+
+// CreateView creates the materialized view name, a table holding
+// the rows of the select query src on a row document table. The
+// view is kept up to date by every commit to its source, right
+// after it: the rows of a projection by their source key, the
+// rows of an aggregate by applying the changed rows to their
+// groups. It is read like any other table and cannot be written. Since the view
+// is a separate store, a failure to maintain it is returned by
+// the commit to the source, which is stored anyway, RefreshView
+// then brings the view back in line
+func (db *Database) CreateView(name, src string) (*Table, error) {
+	sel, err := parseView(src)
+	if err != nil {
+		return nil, err
+	}
+	qv, err := query.NewView(db, sel)
+	if err != nil {
+		return nil, err
+	}
+	m := qv.Metadata(name)
+	m.View = &metaparser.View{Source: sel.Table, Query: strings.TrimSpace(src)}
+	tbl, err := db.CreateTable(name, m)
+	if err != nil {
+		return nil, err
+	}
+	v := db.views.add(&view{name: name, sel: sel})
+	return tbl, db.refresh(v)
+}
+
+// RefreshView rebuilds the materialized view name from its source
+func (db *Database) RefreshView(name string) error {
+	tbl, err := db.Table(name)
+	if err != nil {
+		return err
+	}
+	def := tbl.GetMetadata().View
+	if def == nil {
+		return fmt.Errorf("%w: %s is not a view", query.ErrInvalidView, name)
+	}
+	views, err := db.views.of(db, def.Source)
+	if err != nil {
+		return err
+	}
+	for _, v := range views {
+		if v.name == name {
+			return db.refresh(v)
+		}
+	}
+	return fmt.Errorf("%w: %s is not a view", query.ErrInvalidView, name)
+}
+
+// refresh rebuilds the view v, its source is held meanwhile so that
+// no change read by the rebuild is applied to the view again
+func (db *Database) refresh(v *view) error {
+	src, err := db.Document(v.sel.Table)
+	if err != nil {
+		return err
+	}
+	return src.Exclusive(func() error {
+		return db.maintain(v, func(qv *query.View, s *document.Session) error {
+			return qv.Rebuild(s)
+		})
+	})
+}
+
+// maintain runs fn on the view v planned against the current
+// schema of its source and commits the rows it writes
+func (db *Database) maintain(v *view, fn func(*query.View, *document.Session) error) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	d, err := db.Document(v.name)
+	if err != nil {
+		return err
+	}
+	qv, err := query.NewView(db, v.sel)
+	if err != nil {
+		return err
+	}
+	s := d.NewViewSession()
+	err = fn(qv, s)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	return s.Commit()
+}
+
+// observer returns the function applying the changes committed to
+// the table source to its views
+func (db *Database) observer(source string) document.Observer {
+	return func(changes []document.RowChange) error {
+		views, err := db.views.of(db, source)
+		if err != nil {
+			return err
+		}
+		for _, v := range views {
+			err = db.maintain(v, func(qv *query.View, s *document.Session) error {
+				return qv.Apply(s, changes)
+			})
+			if err != nil {
+				return fmt.Errorf("view %s: %w", v.name, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,251 @@
+package kical_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/xtlsoft/kical"
+	"github.com/xtlsoft/kical/common"
+	"github.com/xtlsoft/kical/decimal"
+	"github.com/xtlsoft/kical/document"
+	"github.com/xtlsoft/kical/metaparser"
+	"github.com/xtlsoft/kical/query"
+	"github.com/xtlsoft/kical/storage"
+)
+
+// viewRows returns the rows of src as sorted text
+func viewRows(t *testing.T, db *kical.Database, src string) []string {
+	res, err := query.Run(db, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	var ret []string
+	for _, row := range res.Rows {
+		for i, v := range row {
+			if d, ok := v.(decimal.Decimal); ok {
+				row[i] = d.Reduce()
+			}
+		}
+		ret = append(ret, fmt.Sprint(row))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestViews(t *testing.T) {
+	db := newServices(t)
+	views := map[string]string{
+		"per_region": "SELECT region, COUNT(*), SUM(port), MIN(port) FROM services GROUP BY region",
+		"per_tier":   "SELECT tier, COUNT(*) FROM services WHERE region = 'eu' GROUP BY tier",
+		"total":      "SELECT COUNT(*), AVG(port) FROM services",
+		"gold":       "SELECT name, port FROM services WHERE tier = 'gold'",
+	}
+	columns := map[string]string{
+		"per_region": "region, `COUNT(*)`, `SUM(port)`, `MIN(port)`",
+		"per_tier":   "tier, `COUNT(*)`",
+		"total":      "`COUNT(*)`, `AVG(port)`",
+		"gold":       "name, port",
+	}
+	for name, src := range views {
+		if _, err := db.CreateView(name, src); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	check := func(step string) {
+		t.Helper()
+		for name, src := range views {
+			got := viewRows(t, db, "SELECT "+columns[name]+" FROM "+name)
+			want := viewRows(t, db, src)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s, %s: got %v, want %v", step, name, got, want)
+			}
+		}
+	}
+	check("create")
+
+	services := mustDocument(t, db, "services")
+	insert(t, db, "services",
+		document.Row{"name": "new1", "region": "sa", "tier": "gold", "port": 7000},
+		document.Row{"name": "new2", "region": "eu", "tier": "bronze", "port": 1},
+	)
+	check("insert")
+
+	s := services.NewSession()
+	pk, err := services.ParseKey("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(pk, document.Row{"name": "moved", "region": "sa", "tier": "gold"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"13", "14", "1"} {
+		pk, _ := services.ParseKey(id)
+		if err := s.Delete(pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check("update")
+	if rows := viewRows(t, db, "SELECT `MIN(port)` FROM per_region WHERE region = 'eu'"); !reflect.DeepEqual(rows, []string{"[8004]"}) {
+		t.Fatalf("minimum after delete: %v", rows)
+	}
+
+	s = mustDocument(t, db, "gold").NewSession()
+	if err := s.Delete(pk); !errors.Is(err, document.ErrReadOnlyView) {
+		t.Fatalf("write to view: %v", err)
+	}
+	s.Close()
+	if err := db.RefreshView("total"); err != nil {
+		t.Fatal(err)
+	}
+	check("refresh")
+
+	for _, src := range []string{
+		"SELECT name FROM services ORDER BY name",
+		"SELECT COUNT(*) FROM services GROUP BY region",
+		"SELECT name FROM services LIMIT 3",
+		"MATCH (s:services) RETURN s.name",
+	} {
+		if _, err := db.CreateView("bad", src); !errors.Is(err, query.ErrInvalidView) {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+}
+
+func TestViewDeltas(t *testing.T) {
+	db := newDatabase(t)
+	_, err := db.CreateTable("orders", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyAutoIncrementID, Name: "id"},
+		Fields: []metaparser.Field{
+			{Name: "shop", Type: common.TypeString},
+			{Name: "price", Type: common.TypeDecimal, Precision: 10, Scale: 2},
+			{Name: "weight", Type: common.TypeFloat},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := "SELECT shop, COUNT(price), SUM(price), AVG(price), AVG(weight), MIN(weight), MAX(price) FROM orders GROUP BY shop"
+	if _, err = db.CreateView("per_shop", src); err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string) {
+		t.Helper()
+		got := viewRows(t, db, "SELECT shop, `COUNT(price)`, `SUM(price)`, `AVG(price)`, `AVG(weight)`, `MIN(weight)`, `MAX(price)` FROM per_shop")
+		want := viewRows(t, db, src)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", step, got, want)
+		}
+	}
+	orders := mustDocument(t, db, "orders")
+	var pks []string
+	for i := 0; i < 12; i++ {
+		row := document.Row{"shop": []string{"a", "b", "c"}[i%3], "weight": 0.25 * float64(i)}
+		if i%4 != 1 {
+			row["price"] = decimal.New(int64(150*i+99), 2)
+		}
+		s := orders.NewSession()
+		pk, err := s.Insert(row)
+		if err == nil {
+			err = s.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks = append(pks, pk)
+	}
+	check("insert")
+
+	s := orders.NewSession()
+	// the heaviest order of a, the most expensive of b and every
+	// order of c are removed, one of a moves to b
+	for _, i := range []int{9, 10, 2, 5, 8, 11} {
+		if err = s.Delete(pks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Set(pks[3], document.Row{"shop": "b", "weight": 9.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check("update")
+	if rows := viewRows(t, db, "SELECT shop FROM per_shop WHERE shop = 'c'"); len(rows) != 0 {
+		t.Fatalf("empty group kept: %v", rows)
+	}
+	if rows := viewRows(t, db, "SELECT `_COUNT(*)` FROM per_shop WHERE shop = 'b'"); !reflect.DeepEqual(rows, []string{"[4]"}) {
+		t.Fatalf("rows of b: %v", rows)
+	}
+
+	// a refresh racing with writers neither misses nor repeats a row
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 20 && err == nil; i++ {
+			s := orders.NewSession()
+			_, err = s.Insert(document.Row{"shop": "d", "price": decimal.New(int64(i), 0), "weight": 1.5})
+			if err == nil {
+				err = s.Commit()
+			}
+		}
+		done <- err
+	}()
+	for i := 0; i < 5; i++ {
+		if err = db.RefreshView("per_shop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	check("refresh")
+}
+
+func TestViewReopen(t *testing.T) {
+	drv := storage.NewPebbleDriver(&storage.PebbleDriverConfigure{
+		UseMemory: true,
+	})
+	defer drv.Close()
+	db, err := kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateTable("hosts", &metaparser.Metadata{
+		StorageType: metaparser.MetaStorageTypeRowDocument,
+		PrimaryKey:  &metaparser.PrimaryKey{Type: metaparser.MetaPrimaryKeyCustom, Name: "name"},
+		Fields: []metaparser.Field{
+			{Name: "name", Type: common.TypeString},
+			{Name: "tags", Type: common.TypeTag},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateView("per_tag", "SELECT tags, COUNT(*) FROM hosts GROUP BY tags"); err != nil {
+		t.Fatal(err)
+	}
+	db, err = kical.NewDatabase(drv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "hosts",
+		document.Row{"name": "a", "tags": []string{"eu", "web"}},
+		document.Row{"name": "b", "tags": []string{"eu"}},
+		document.Row{"name": "c"},
+	)
+	got := viewRows(t, db, "SELECT tags, `COUNT(*)` FROM per_tag")
+	want := []string{"[<nil> 1]", "[eu 2]", "[web 1]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if tbl, _ := db.Table("per_tag"); tbl.GetMetadata().View.Source != "hosts" {
+		t.Fatalf("view definition %+v", tbl.GetMetadata().View)
+	}
+}
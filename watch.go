@@ -0,0 +1,115 @@
+package kical
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/xtlsoft/kical/common"
+)
+
+// WatcherBufferSize is the number of pending event groups a
+// watcher may hold before it is closed as too slow
+const WatcherBufferSize = 256
+
+// Watcher receives the committed changes of a table
+type Watcher struct {
+	// C receives the events of every committed session that
+	// touches a watched key, it is closed when the watcher stops
+	C <-chan []common.Event
+
+	c        chan []common.Event
+	hub      *watchHub
+	table    string
+	prefix   string
+	overflow bool
+}
+
+// Overflowed reports whether the watcher was closed because its
+// consumer could not keep up
+func (w *Watcher) Overflowed() bool {
+	w.hub.lock.Lock()
+	defer w.hub.lock.Unlock()
+	return w.overflow
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() {
+	w.hub.remove(w)
+}
+
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[string]map[*Watcher]bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[string]map[*Watcher]bool),
+	}
+}
+
+func (h *watchHub) add(table, prefix string) *Watcher {
+	c := make(chan []common.Event, WatcherBufferSize)
+	w := &Watcher{
+		C:      c,
+		c:      c,
+		hub:    h,
+		table:  table,
+		prefix: prefix,
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.watchers[table] == nil {
+		h.watchers[table] = make(map[*Watcher]bool)
+	}
+	h.watchers[table][w] = true
+	return w
+}
+
+func (h *watchHub) remove(w *Watcher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removeLocked(w)
+}
+
+func (h *watchHub) removeLocked(w *Watcher) {
+	if !h.watchers[w.table][w] {
+		return
+	}
+	delete(h.watchers[w.table], w)
+	close(w.c)
+}
+
+func (h *watchHub) notifier(table string) common.Notifier {
+	return func(events []common.Event) {
+		h.publish(table, events)
+	}
+}
+
+func (h *watchHub) publish(table string, events []common.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for w := range h.watchers[table] {
+		var matched []common.Event
+		for _, e := range events {
+			if strings.HasPrefix(e.Key, w.prefix) {
+				matched = append(matched, e)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case w.c <- matched:
+		default:
+			w.overflow = true
+			h.removeLocked(w)
+		}
+	}
+}
+
+// Watch starts watching the keys with the given prefix in table,
+// the watcher must be closed by the caller
+func (db *Database) Watch(table, prefix string) *Watcher {
+	return db.watches.add(table, prefix)
+}